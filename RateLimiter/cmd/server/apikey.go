@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/goxprts/ratelimiter/internal/apikey"
+	"github.com/goxprts/ratelimiter/internal/config"
+	"github.com/goxprts/ratelimiter/internal/setup"
+)
+
+const apiKeyUsage = `usage: server apikey <command> [flags]
+
+commands:
+  create -owner <owner> -plan <plan> [-expires <duration>]
+  rotate -id <id> [-grace <duration>]
+  revoke -id <id>
+  list`
+
+// runAPIKeyCommand manages the key registry in the configured storage and
+// returns the exit code
+func runAPIKeyCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, apiKeyUsage)
+		return 2
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load configuration: %v\n", err)
+		return 1
+	}
+	store, err := setup.NewStorage(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to initialize %s storage: %v\n", cfg.Storage.Backend, err)
+		return 1
+	}
+	defer store.Close()
+	if cfg.Storage.Backend == "memory" {
+		fmt.Fprintln(os.Stderr, "warning: the memory storage is not shared, keys are lost when this command exits")
+	}
+
+	registry := apikey.NewRegistry(store)
+	ctx := context.Background()
+	flags := flag.NewFlagSet("apikey "+args[0], flag.ContinueOnError)
+
+	switch args[0] {
+	case "create":
+		owner := flags.String("owner", "", "owner of the key")
+		plan := flags.String("plan", "", "plan the key is limited by")
+		expires := flags.Duration("expires", 0, "lifetime of the key, e.g. 720h (0 never expires)")
+		if flags.Parse(args[1:]) != nil {
+			return 2
+		}
+		if *owner == "" || *plan == "" {
+			fmt.Fprintln(os.Stderr, "-owner and -plan are required")
+			return 2
+		}
+		if _, ok := cfg.Limiter.Apply(cfg.LimitsFile).Plans[*plan]; !ok {
+			fmt.Fprintf(os.Stderr, "warning: plan %q has no limits configured, requests with the key are limited by IP\n", *plan)
+		}
+		var expiresAt time.Time
+		if *expires > 0 {
+			expiresAt = time.Now().Add(*expires)
+		}
+		secret, k, err := registry.Create(ctx, *owner, *plan, expiresAt)
+		if err != nil {
+			return fail(err)
+		}
+		printSecret(secret, k)
+
+	case "rotate":
+		id := flags.String("id", "", "ID of the key to rotate")
+		grace := flags.Duration("grace", 0, "time the old key keeps working, e.g. 24h (0 revokes it)")
+		if flags.Parse(args[1:]) != nil {
+			return 2
+		}
+		secret, k, err := registry.Rotate(ctx, *id, *grace)
+		if err != nil {
+			return fail(err)
+		}
+		printSecret(secret, k)
+
+	case "revoke":
+		id := flags.String("id", "", "ID of the key to revoke")
+		if flags.Parse(args[1:]) != nil {
+			return 2
+		}
+		k, err := registry.Revoke(ctx, *id)
+		if err != nil {
+			return fail(err)
+		}
+		fmt.Printf("revoked %s (%s)\n", k.ID, k.Owner)
+
+	case "list":
+		keys, err := registry.List(ctx)
+		if err != nil {
+			return fail(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tOWNER\tPLAN\tCREATED\tEXPIRES\tSTATUS")
+		now := time.Now()
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", k.ID, k.Owner, k.Plan, formatTime(k.CreatedAt), formatTime(k.ExpiresAt), keyStatus(k, now))
+		}
+		w.Flush()
+
+	default:
+		fmt.Fprintln(os.Stderr, apiKeyUsage)
+		return 2
+	}
+	return 0
+}
+
+func printSecret(secret string, k apikey.Key) {
+	fmt.Printf("key:     %s\nid:      %s\nowner:   %s\nplan:    %s\nexpires: %s\n", secret, k.ID, k.Owner, k.Plan, formatTime(k.ExpiresAt))
+	fmt.Fprintln(os.Stderr, "store the key now, it cannot be shown again")
+}
+
+func keyStatus(k apikey.Key, now time.Time) string {
+	switch err := k.Check(now); {
+	case errors.Is(err, apikey.ErrRevoked):
+		return "revoked"
+	case errors.Is(err, apikey.ErrExpired):
+		return "expired"
+	case !k.RevokedAt.IsZero():
+		return "rotating"
+	default:
+		return "active"
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func fail(err error) int {
+	fmt.Fprintln(os.Stderr, err)
+	return 1
+}
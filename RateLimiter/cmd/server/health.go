@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/goxprts/ratelimiter/internal/config"
+	"github.com/goxprts/ratelimiter/internal/storage"
+)
+
+type healthResponse struct {
+	Status        string `json:"status"`
+	Storage       string `json:"storage"`
+	Circuit       string `json:"circuit,omitempty"`
+	FailurePolicy string `json:"failure_policy"`
+}
+
+// healthHandler reports the storage circuit state. While the circuit is not
+// closed the service is degraded, or unhealthy if requests are rejected.
+func healthHandler(cfg config.StorageConfig, breaker *storage.CircuitBreaker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := healthResponse{
+			Status:        "healthy",
+			Storage:       cfg.Backend,
+			FailurePolicy: cfg.FailurePolicy,
+		}
+		code := http.StatusOK
+
+		if breaker != nil {
+			state := breaker.State()
+			resp.Circuit = string(state)
+			if state != storage.BreakerClosed {
+				resp.Status = "degraded"
+				if cfg.FailurePolicy == "closed" {
+					resp.Status = "unhealthy"
+					code = http.StatusServiceUnavailable
+				}
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -1,56 +1,265 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/goxprts/ratelimiter/internal/admin"
 	"github.com/goxprts/ratelimiter/internal/config"
 	"github.com/goxprts/ratelimiter/internal/limiter"
+	"github.com/goxprts/ratelimiter/internal/metrics"
 	"github.com/goxprts/ratelimiter/internal/middleware"
+	"github.com/goxprts/ratelimiter/internal/proxy"
+	"github.com/goxprts/ratelimiter/internal/setup"
 	"github.com/goxprts/ratelimiter/internal/storage"
+	"github.com/goxprts/ratelimiter/internal/tracing"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
 )
 
+// shutdownTimeout is how long the requests in flight get to finish once the
+// server is asked to stop
+const shutdownTimeout = 15 * time.Second
+
 func main() {
+	// Manage API keys instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "apikey" {
+		os.Exit(runAPIKeyCommand(os.Args[2:]))
+	}
+
+	// Returning, rather than exiting, lets the deferred flushes run
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run serves until SIGINT or SIGTERM, or until a server fails
+func run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Load configuration
 	cfg, err := config.Load()
 	if err != nil {
-		log.Fatalf("Failed to load configuration: %v", err)
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	// Export spans before anything is traced
+	if cfg.Tracing.Enabled {
+		shutdown, err := tracing.Setup(context.Background(), tracing.Options{
+			ServiceName: cfg.Tracing.ServiceName,
+			Endpoint:    cfg.Tracing.Endpoint,
+			SampleRatio: cfg.Tracing.SampleRatio,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to initialize tracing: %w", err)
+		}
+		defer func() {
+			if err := shutdown(context.Background()); err != nil {
+				log.Printf("Failed to flush traces: %v", err)
+			}
+		}()
+		log.Printf("Tracing enabled: exporting %.0f%% of new traces to %s", cfg.Tracing.SampleRatio*100, cfg.Tracing.Endpoint)
+	}
+
+	// Initialize storage
+	store, err := setup.NewStorage(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialize %s storage: %w", cfg.Storage.Backend, err)
+	}
+
+	// Measure storage operations and limiter decisions
+	var limiterOpts []limiter.Option
+	var appMetrics *metrics.Metrics
+	if cfg.Server.MetricsEnabled {
+		appMetrics = metrics.New(store)
+		go appMetrics.RefreshBlocked(ctx, metrics.DefaultBlockedRefresh)
+		store = appMetrics.InstrumentStorage(store)
+		limiterOpts = append(limiterOpts, limiter.WithObserver(appMetrics))
+	}
+	if cfg.Tracing.Enabled {
+		store = tracing.NewStorage(store, cfg.Storage.Backend, otel.GetTracerProvider())
+	}
+
+	// Access lists and the admin API skip the breaker so its local fallback
+	// never replaces the shared state: while Redis is down the lists keep the
+	// last entries loaded and admin changes fail instead of staying local
+	sharedStore := store
+
+	// Stop calling Redis while it is failing
+	var breaker *storage.CircuitBreaker
+	if cfg.Storage.Backend == "redis" {
+		breaker = setup.NewCircuitBreaker(cfg.Storage, store)
+		store = breaker
+	}
+	defer store.Close()
+
+	// Build the limiter, its rules, access lists and key registry
+	stack, err := setup.NewStack(ctx, cfg, store, sharedStore, limiterOpts...)
+	if err != nil {
+		return fmt.Errorf("failed to build the rate limiter: %w", err)
+	}
+	limiterConfig, limits := stack.Config, stack.Limits
+	rateLimiter, rateLimiterMiddleware := stack.RateLimiter, stack.Middleware
+	accessList, ipExtractor, registry, tenants := stack.Access, stack.IPExtractor, stack.Keys, stack.Tenants
+	if limiterConfig.BatchFraction > 0 {
+		log.Printf("Local batching enabled: %.0f%% of the limit per reservation, %.0f%% overshoot",
+			limiterConfig.BatchFraction*100, limiterConfig.BatchOvershoot*100)
+	}
+	if cfg.Server.TenantHeader != "" {
+		log.Printf("Tenants read from the %s header of trusted proxies: %d configured", cfg.Server.TenantHeader, len(limits.Tenants))
+	}
+	if registry != nil {
+		log.Printf("API key registry enabled: unknown keys are rejected")
 	}
 
-	// Initialize Redis storage
-	redisStorage, err := storage.NewRedisStorage(
-		cfg.Redis.Address(),
-		cfg.Redis.Password,
-		cfg.Redis.DB,
-	)
+	// Create HTTP router, or forward to the upstreams in proxy mode
+	app, err := newApp(cfg.Proxy, ipExtractor)
 	if err != nil {
-		log.Fatalf("Failed to initialize Redis storage: %v", err)
+		return fmt.Errorf("invalid proxy configuration: %w", err)
+	}
+
+	// Cap the requests in flight once they pass the rate limiter
+	if cfg.Concurrency.Enabled() {
+		concurrency := middleware.NewConcurrencyMiddleware(store, ipExtractor, middleware.ConcurrencyOptions{
+			IPLimit:    cfg.Concurrency.IPLimit,
+			TokenLimit: cfg.Concurrency.TokenLimit,
+			KnownToken: func(token string) bool {
+				_, ok := rateLimiter.Limits().Tokens[token]
+				return ok
+			},
+			Keys:          registry,
+			LeaseTTL:      time.Duration(cfg.Concurrency.LeaseTTL) * time.Second,
+			FailurePolicy: setup.FailurePolicy(cfg.Storage),
+			Access:        accessList,
+			Tenants:       tenants,
+		})
+		app = concurrency.Middleware(app)
+		log.Printf("Concurrency limits: %d per IP, %d per token", cfg.Concurrency.IPLimit, cfg.Concurrency.TokenLimit)
+	}
+
+	// Wrap the router with rate limiter middleware
+	handler := http.NewServeMux()
+	limited := rateLimiterMiddleware.Middleware(app)
+	if cfg.Tracing.Enabled {
+		// Continue the trace of the caller, if any
+		limited = otelhttp.NewHandler(limited, "ratelimiter")
 	}
-	defer redisStorage.Close()
+	handler.Handle("/", limited)
 
-	// Convert token limits from config to limiter format
-	tokenLimits := make(map[string]limiter.TokenConfig)
-	for token, limit := range cfg.Limiter.TokenRateLimits {
-		tokenLimits[token] = limiter.TokenConfig{
-			RPS:       limit.RPS,
-			BlockTime: time.Duration(limit.BlockTime) * time.Second,
+	// Health checks must keep answering while the limiter is failing
+	handler.Handle("/health", healthHandler(cfg.Storage, breaker))
+
+	// Quota usage is not counted against the limits it reports, but under a
+	// limit of its own per IP so it can't be used to guess keys
+	usageOpts := []middleware.UsageOption{middleware.WithUsageTenants(tenants)}
+	if cfg.Server.UsageRateLimit > 0 {
+		usageOpts = append(usageOpts, middleware.WithUsageIPLimit(ipExtractor, limiter.TokenConfig{
+			RPS:       cfg.Server.UsageRateLimit,
+			BlockTime: time.Duration(cfg.Server.UsageBlockTime) * time.Second,
+		}))
+	}
+	handler.Handle("/usage", middleware.UsageHandler(rateLimiter, registry, usageOpts...))
+
+	// The admin API is not rate limited. It may listen apart from the public
+	// port so it can be kept on an internal network.
+	addr := fmt.Sprintf(":%s", cfg.Server.Port)
+	servers := []*http.Server{{Addr: addr, Handler: handler}}
+	if cfg.Server.AdminToken != "" {
+		adminHandler := admin.NewHandler(sharedStore, cfg.Server.AdminToken,
+			admin.WithAccessList(accessList),
+			admin.WithLimiter(rateLimiter),
+			admin.WithTenants(tenants),
+		)
+		if cfg.Server.AdminAddr != "" {
+			adminMux := http.NewServeMux()
+			adminMux.Handle("/admin/", adminHandler)
+			servers = append(servers, &http.Server{Addr: cfg.Server.AdminAddr, Handler: adminMux})
+			log.Printf("Admin API enabled on %s/admin/", cfg.Server.AdminAddr)
+		} else {
+			handler.Handle("/admin/", adminHandler)
+			log.Printf("Admin API enabled on /admin/")
 		}
 	}
 
-	// Initialize rate limiter
-	rateLimiter := limiter.NewRateLimiter(
-		redisStorage,
-		cfg.Limiter.IPRateLimit,
-		cfg.Limiter.IPBlockTime,
-		tokenLimits,
-	)
+	// Metrics are not rate limited either
+	if appMetrics != nil {
+		handler.Handle("/metrics", appMetrics.Handler())
+		log.Printf("Prometheus metrics enabled on /metrics")
+	}
+
+	// Reload limits when the config file changes
+	if cfg.Server.ConfigFile != "" {
+		go config.WatchFile(ctx, cfg.Server.ConfigFile, time.Duration(cfg.Server.ConfigReloadPeriod)*time.Second, func(file *config.FileConfig) {
+			stack.Reload(cfg.Limiter, file)
+		})
+	}
+
+	// Start server
+	log.Printf("Server starting on %s (storage: %s, namespace: %q, failure policy: %s)", addr, cfg.Storage.Backend, cfg.Storage.Namespace, cfg.Storage.FailurePolicy)
+	if cfg.Storage.Backend == "redis" {
+		log.Printf("Redis: %s mode, %d address(es), TLS: %t", cfg.Redis.Mode, len(cfg.Redis.Addresses()), cfg.Redis.TLS.Enabled)
+	}
+	log.Printf("IP Rate Limit: %d req/s, Block Time: %ds, Algorithm: %s", limiterConfig.IPRateLimit, limiterConfig.IPBlockTime, limits.IP.Algorithm)
+	log.Printf("Token Limits configured: %d tokens, %d plans, %d CIDR overrides", len(limits.Tokens), len(limits.Plans), len(limits.CIDRs))
+	log.Printf("Rules configured: %d (%s match)", len(limiterConfig.Rules), limiterConfig.RuleMatch)
+	log.Printf("Access lists: %d allowed, %d denied", len(stack.StaticAccess.Allow), len(stack.StaticAccess.Deny))
+
+	return serve(ctx, servers...)
+}
+
+// serve runs servers until ctx is done or one of them fails, then gives the
+// requests in flight shutdownTimeout to finish on every server
+func serve(ctx context.Context, servers ...*http.Server) error {
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				errs <- fmt.Errorf("server on %s failed: %w", server.Addr, err)
+			}
+		}(server)
+	}
 
-	// Initialize middleware
-	rateLimiterMiddleware := middleware.NewRateLimiterMiddleware(rateLimiter)
+	var err error
+	select {
+	case <-ctx.Done():
+		log.Printf("Shutting down, waiting up to %v for requests in flight", shutdownTimeout)
+	case err = <-errs:
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		if shutdownErr := server.Shutdown(shutdownCtx); shutdownErr != nil && err == nil {
+			err = fmt.Errorf("failed to shut down server on %s: %w", server.Addr, shutdownErr)
+		}
+	}
+	return err
+}
+
+func newApp(cfg config.ProxyConfig, ipExtractor *middleware.IPExtractor) (http.Handler, error) {
+	if len(cfg.Routes) > 0 {
+		routes := make([]proxy.Route, 0, len(cfg.Routes))
+		for _, r := range cfg.Routes {
+			routes = append(routes, proxy.Route{PathPrefix: r.PathPrefix, Upstream: r.Upstream})
+			log.Printf("Proxying %s to %s", r.PathPrefix, r.Upstream)
+		}
+		return proxy.New(routes, proxy.Options{
+			DialTimeout:     time.Duration(cfg.DialTimeout) * time.Second,
+			ResponseTimeout: time.Duration(cfg.ResponseTimeout) * time.Second,
+			StripPrefix:     cfg.StripPrefix,
+			PreserveHost:    cfg.PreserveHost,
+			TrustForwarded:  ipExtractor.TrustedPeer,
+		})
+	}
 
-	// Create HTTP router
 	mux := http.NewServeMux()
 
 	// Add a simple test endpoint
@@ -59,23 +268,5 @@ func main() {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(`{"message": "Request successful"}`))
 	})
-
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"status": "healthy"}`))
-	})
-
-	// Wrap the router with rate limiter middleware
-	handler := rateLimiterMiddleware.Middleware(mux)
-
-	// Start server
-	addr := fmt.Sprintf(":%s", cfg.Server.Port)
-	log.Printf("Server starting on %s", addr)
-	log.Printf("IP Rate Limit: %d req/s, Block Time: %ds", cfg.Limiter.IPRateLimit, cfg.Limiter.IPBlockTime)
-	log.Printf("Token Limits configured: %d tokens", len(cfg.Limiter.TokenRateLimits))
-
-	if err := http.ListenAndServe(addr, handler); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
-	}
+	return mux, nil
 }
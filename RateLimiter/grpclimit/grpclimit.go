@@ -0,0 +1,214 @@
+// Package grpclimit applies the rate limiter to gRPC servers. Calls go
+// through the same checks as HTTP requests: access lists, key registry,
+// tenants, rules and trusted proxies.
+package grpclimit
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goxprts/ratelimiter/internal/config"
+	"github.com/goxprts/ratelimiter/internal/middleware"
+	"github.com/goxprts/ratelimiter/internal/setup"
+	"github.com/goxprts/ratelimiter/internal/storage"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// DefaultAPIKeyMetadata is the metadata key holding the API key, the gRPC
+// counterpart of the API_KEY HTTP header
+const DefaultAPIKeyMetadata = "api_key"
+
+// Interceptor applies a RateLimiterMiddleware to gRPC calls
+type Interceptor struct {
+	checker        *middleware.RateLimiterMiddleware
+	apiKeyMetadata string
+	store          storage.Storage
+	now            func() time.Time
+}
+
+// Option configures optional interceptor behavior
+type Option func(*Interceptor)
+
+// WithAPIKeyMetadata reads the API key from another metadata key
+func WithAPIKeyMetadata(key string) Option {
+	return func(i *Interceptor) {
+		i.apiKeyMetadata = key
+	}
+}
+
+// New checks gRPC calls with m. Each call is checked as a POST to its full
+// method name, e.g. /grpc.health.v1.Health/Check, with the call metadata as
+// headers, so rules match on the service and method.
+func New(m *middleware.RateLimiterMiddleware, opts ...Option) *Interceptor {
+	i := &Interceptor{
+		checker:        m,
+		apiKeyMetadata: DefaultAPIKeyMetadata,
+		now:            time.Now,
+	}
+	for _, opt := range opts {
+		opt(i)
+	}
+	return i
+}
+
+// FromEnv builds the limiter from the same environment variables and limits
+// file as the server, for services in other modules. Access lists and API
+// keys are refreshed until ctx is done; Close releases the storage.
+func FromEnv(ctx context.Context, opts ...Option) (*Interceptor, error) {
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, err
+	}
+	store, err := setup.NewStorage(cfg)
+	if err != nil {
+		return nil, err
+	}
+	shared := store
+	if cfg.Storage.Backend == "redis" {
+		store = setup.NewCircuitBreaker(cfg.Storage, store)
+	}
+
+	stack, err := setup.NewStack(ctx, cfg, store, shared)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	i := New(stack.Middleware, opts...)
+	i.store = store
+	return i, nil
+}
+
+// Close closes the storage opened by FromEnv
+func (i *Interceptor) Close() error {
+	if i.store == nil {
+		return nil
+	}
+	return i.store.Close()
+}
+
+// Unary returns a unary server interceptor
+func (i *Interceptor) Unary() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		header, err := i.check(ctx, info.FullMethod)
+		if header != nil {
+			grpc.SetHeader(ctx, header)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// Stream returns a stream server interceptor. The limit is checked once,
+// when the stream is opened.
+func (i *Interceptor) Stream() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		header, err := i.check(ss.Context(), info.FullMethod)
+		if header != nil {
+			ss.SetHeader(header)
+		}
+		if err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+// check applies the limit to the call of method. It returns the rate limit
+// header metadata and, when the call must not proceed, a status error.
+func (i *Interceptor) check(ctx context.Context, method string) (metadata.MD, error) {
+	v := i.checker.Check(i.request(ctx, method))
+
+	var header metadata.MD
+	reset := time.Duration(0)
+	if v.Result != nil {
+		reset = time.Duration(math.Ceil(v.Result.ResetTime.Sub(i.now()).Seconds())) * time.Second
+		if reset < 0 {
+			reset = 0
+		}
+		header = metadata.Pairs(
+			"ratelimit-limit", strconv.Itoa(v.Result.Limit),
+			"ratelimit-remaining", strconv.Itoa(v.Result.Remaining),
+			"ratelimit-reset", strconv.Itoa(int(reset/time.Second)),
+		)
+	}
+
+	switch v.Status {
+	case 0:
+		return header, nil
+	case http.StatusTooManyRequests:
+		if reset < time.Second {
+			reset = time.Second
+		}
+		header.Set("retry-after", strconv.Itoa(int(reset/time.Second)))
+
+		st := status.New(codes.ResourceExhausted, v.Error)
+		if detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(reset)}); err == nil {
+			st = detailed
+		}
+		return header, st.Err()
+	default:
+		return header, status.Error(statusCode(v.Status), v.Error)
+	}
+}
+
+// statusCode maps the HTTP status of a rejected call to a gRPC code
+func statusCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case middleware.StatusClientClosedRequest:
+		return codes.Canceled
+	default:
+		return codes.Unknown
+	}
+}
+
+// request builds the HTTP request the call of method is checked as. The
+// peer address is the remote address, so forwarding metadata is only
+// honoured from trusted proxies.
+func (i *Interceptor) request(ctx context.Context, method string) *http.Request {
+	r := (&http.Request{
+		Method:     http.MethodPost,
+		URL:        &url.URL{Path: method},
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header:     make(http.Header),
+	}).WithContext(ctx)
+
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		r.RemoteAddr = p.Addr.String()
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, values := range md {
+		// Pseudo-headers like :authority are not request headers
+		if strings.HasPrefix(key, ":") {
+			continue
+		}
+		r.Header[http.CanonicalHeaderKey(key)] = values
+	}
+	r.Header.Del("API_KEY")
+	if values := md.Get(i.apiKeyMetadata); len(values) > 0 {
+		r.Header.Set("API_KEY", values[0])
+	}
+	return r
+}
@@ -0,0 +1,246 @@
+package grpclimit
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/goxprts/ratelimiter/internal/access"
+	"github.com/goxprts/ratelimiter/internal/apikey"
+	"github.com/goxprts/ratelimiter/internal/limiter"
+	"github.com/goxprts/ratelimiter/internal/middleware"
+	"github.com/goxprts/ratelimiter/internal/rules"
+	"github.com/goxprts/ratelimiter/internal/storage"
+	"github.com/goxprts/ratelimiter/internal/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func newTestStorage(t *testing.T) *storage.MemoryStorage {
+	store := storage.NewMemoryStorage(storage.MemoryOptions{})
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// newInterceptor checks calls with the middleware of rl built with opts
+func newInterceptor(rl *limiter.RateLimiter, opts ...middleware.Option) *Interceptor {
+	return New(middleware.NewRateLimiterMiddleware(rl, opts...))
+}
+
+// newTestClient serves the health service behind the interceptor and
+// returns a client connected to it
+func newTestClient(t *testing.T, i *Interceptor) healthpb.HealthClient {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(i.Unary()),
+		grpc.StreamInterceptor(i.Stream()),
+	)
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return healthpb.NewHealthClient(conn)
+}
+
+func TestInterceptor_Unary(t *testing.T) {
+	rl := limiter.NewRateLimiter(newTestStorage(t), 2, 60, map[string]limiter.TokenConfig{})
+	client := newTestClient(t, newInterceptor(rl))
+	ctx := context.Background()
+
+	var header metadata.MD
+	_, err := client.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.Header(&header))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2"}, header.Get("ratelimit-limit"))
+	assert.Equal(t, []string{"1"}, header.Get("ratelimit-remaining"))
+
+	client.Check(ctx, &healthpb.HealthCheckRequest{})
+	_, err = client.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.Header(&header))
+	require.Error(t, err)
+
+	st := status.Convert(err)
+	assert.Equal(t, codes.ResourceExhausted, st.Code())
+	assert.Equal(t, []string{"60"}, header.Get("retry-after"))
+	require.Len(t, st.Details(), 1)
+	retry, ok := st.Details()[0].(*errdetails.RetryInfo)
+	require.True(t, ok)
+	assert.Equal(t, 60*time.Second, retry.RetryDelay.AsDuration())
+}
+
+func TestInterceptor_APIKey(t *testing.T) {
+	rl := limiter.NewRateLimiter(newTestStorage(t), 1, 60, map[string]limiter.TokenConfig{
+		"abc123": {RPS: 3, BlockTime: time.Minute},
+	})
+	client := newTestClient(t, newInterceptor(rl))
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "api_key", "abc123")
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+		require.NoError(t, err, "request %d", i+1)
+	}
+	_, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestInterceptor_Stream(t *testing.T) {
+	rl := limiter.NewRateLimiter(newTestStorage(t), 1, 60, map[string]limiter.TokenConfig{})
+	client := newTestClient(t, newInterceptor(rl))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	stream, err = client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestInterceptor_FailurePolicy(t *testing.T) {
+	rl := limiter.NewRateLimiter(storagetest.Unavailable{}, 5, 60, map[string]limiter.TokenConfig{})
+	ctx := context.Background()
+
+	_, err := newTestClient(t, newInterceptor(rl)).Check(ctx, &healthpb.HealthCheckRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	_, err = newTestClient(t, newInterceptor(rl, middleware.WithFailurePolicy(middleware.FailOpen))).Check(ctx, &healthpb.HealthCheckRequest{})
+	assert.NoError(t, err)
+}
+
+func TestInterceptor_AccessList(t *testing.T) {
+	store := newTestStorage(t)
+	rl := limiter.NewRateLimiter(store, 1, 60, map[string]limiter.TokenConfig{})
+	allow, _ := access.ParseEntries([]string{"token:health"})
+	deny, _ := access.ParseEntries([]string{"token:banned"})
+	client := newTestClient(t, newInterceptor(rl, middleware.WithAccessList(access.New(store, access.Lists{Allow: allow, Deny: deny}))))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "api_key", "health")
+	for i := 0; i < 3; i++ {
+		_, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+		require.NoError(t, err, "request %d", i+1)
+	}
+
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "api_key", "banned")
+	_, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestInterceptor_Rules(t *testing.T) {
+	rl := limiter.NewRateLimiter(newTestStorage(t), 5, 60, map[string]limiter.TokenConfig{})
+	engine, err := rules.NewEngine([]rules.Rule{
+		{Name: "watch", PathPrefix: "/grpc.health.v1.Health/Watch", Limit: limiter.TokenConfig{RPS: 1, BlockTime: time.Minute}},
+	}, rules.FirstMatch)
+	require.NoError(t, err)
+	client := newTestClient(t, newInterceptor(rl, middleware.WithRules(engine)))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The rule limits the method it names, not the other ones
+	for i := 0; i < 2; i++ {
+		_, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+		require.NoError(t, err)
+	}
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	stream, err = client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestInterceptor_TrustedProxies(t *testing.T) {
+	rl := limiter.NewRateLimiter(newTestStorage(t), 1, 60, map[string]limiter.TokenConfig{})
+	ctx := func(client string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), "x-forwarded-for", client)
+	}
+
+	// Forwarding metadata from a trusted proxy names the client
+	extractor, err := middleware.NewIPExtractor([]string{"127.0.0.1"}, 64)
+	require.NoError(t, err)
+	client := newTestClient(t, newInterceptor(rl, middleware.WithIPExtractor(extractor)))
+	_, err = client.Check(ctx("203.0.113.1"), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	_, err = client.Check(ctx("203.0.113.2"), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+
+	// and is ignored from any other peer
+	client = newTestClient(t, newInterceptor(rl))
+	_, err = client.Check(ctx("203.0.113.3"), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	_, err = client.Check(ctx("203.0.113.4"), &healthpb.HealthCheckRequest{})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestInterceptor_KeyRegistry(t *testing.T) {
+	store := newTestStorage(t)
+	rl := limiter.NewRateLimiter(store, 1, 60, map[string]limiter.TokenConfig{})
+	limits := rl.Limits()
+	limits.Plans = map[string]limiter.TokenConfig{"pro": {RPS: 3, Plan: "pro"}}
+	rl.SetLimits(limits)
+
+	registry := apikey.NewRegistry(store)
+	secret, _, err := registry.Create(context.Background(), "alice", "pro", time.Time{})
+	require.NoError(t, err)
+	client := newTestClient(t, newInterceptor(rl, middleware.WithKeyRegistry(registry)))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "api_key", secret)
+	var header metadata.MD
+	_, err = client.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.Header(&header))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"3"}, header.Get("ratelimit-limit"))
+
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "api_key", "rlk_unknown")
+	_, err = client.Check(ctx, &healthpb.HealthCheckRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestInterceptor_Tenants(t *testing.T) {
+	rl := limiter.NewRateLimiter(storage.NewNamespacedStorage(newTestStorage(t), ""), 1, 60, map[string]limiter.TokenConfig{})
+	limits := rl.Limits()
+	limits.Tenants = map[string]limiter.TokenConfig{"acme": {RPS: 100}}
+	rl.SetLimits(limits)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-tenant-id", "acme")
+
+	// A trusted proxy picks the tenant of the call
+	extractor, err := middleware.NewIPExtractor([]string{"127.0.0.1"}, 64)
+	require.NoError(t, err)
+	client := newTestClient(t, newInterceptor(rl,
+		middleware.WithIPExtractor(extractor),
+		middleware.WithTenants(middleware.NewTenantResolver("X-Tenant-ID", extractor, rl)),
+	))
+	for i := 0; i < 3; i++ {
+		_, err = client.Check(ctx, &healthpb.HealthCheckRequest{})
+		require.NoError(t, err)
+	}
+
+	// Other peers are counted under the default limit
+	untrusted, err := middleware.NewIPExtractor(nil, 64)
+	require.NoError(t, err)
+	client = newTestClient(t, newInterceptor(rl,
+		middleware.WithIPExtractor(untrusted),
+		middleware.WithTenants(middleware.NewTenantResolver("X-Tenant-ID", untrusted, rl)),
+	))
+	_, err = client.Check(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	_, err = client.Check(ctx, &healthpb.HealthCheckRequest{})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
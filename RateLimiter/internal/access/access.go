@@ -0,0 +1,333 @@
+package access
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goxprts/ratelimiter/internal/apikey"
+	"github.com/goxprts/ratelimiter/internal/storage"
+)
+
+// Action is the outcome of checking a request against the lists
+type Action string
+
+const (
+	// None leaves the request to the rate limiter
+	None Action = ""
+	// Allow lets the request through without counting it
+	Allow Action = "allow"
+	// Deny rejects the request without counting it
+	Deny Action = "deny"
+)
+
+// keyPrefix namespaces the dynamic entries in the storage. versionKey is
+// bumped on every change so instances only rescan the entries when needed.
+const (
+	keyPrefix  = "access:"
+	versionKey = keyPrefix + "version"
+)
+
+// Entry is an IP, a CIDR range or a token
+type Entry struct {
+	// Prefix is set for IP and CIDR entries. A single IP is a full length prefix.
+	Prefix netip.Prefix
+	// TokenHash is the hex SHA-256 of the token, so tokens never reach the
+	// storage
+	TokenHash string
+}
+
+// ParseEntry parses "token:<token>", "token-sha256:<hex SHA-256 of the
+// token>", an IP or a CIDR
+func ParseEntry(s string) (Entry, error) {
+	s = strings.TrimSpace(s)
+	if token, ok := strings.CutPrefix(s, "token:"); ok {
+		if token == "" {
+			return Entry{}, fmt.Errorf("empty token in %q", s)
+		}
+		return Entry{TokenHash: apikey.Hash(token)}, nil
+	}
+	if hash, ok := strings.CutPrefix(s, "token-sha256:"); ok {
+		hash = strings.ToLower(hash)
+		if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != sha256.Size {
+			return Entry{}, fmt.Errorf("invalid token hash in %q", s)
+		}
+		return Entry{TokenHash: hash}, nil
+	}
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return Entry{}, fmt.Errorf("invalid CIDR %q", s)
+		}
+		return Entry{Prefix: prefix.Masked()}, nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return Entry{}, fmt.Errorf("invalid IP %q", s)
+	}
+	addr = addr.Unmap()
+	return Entry{Prefix: netip.PrefixFrom(addr, addr.BitLen())}, nil
+}
+
+// String returns the entry in the format accepted by ParseEntry. Tokens are
+// shown by their hash.
+func (e Entry) String() string {
+	if e.TokenHash != "" {
+		return "token-sha256:" + e.TokenHash
+	}
+	if e.Prefix.IsSingleIP() {
+		return e.Prefix.Addr().String()
+	}
+	return e.Prefix.String()
+}
+
+// ParseEntries parses a list of entries, stopping at the first invalid one
+func ParseEntries(values []string) ([]Entry, error) {
+	entries := make([]Entry, 0, len(values))
+	for _, value := range values {
+		entry, err := ParseEntry(value)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Lists holds the entries of both lists
+type Lists struct {
+	Allow []Entry
+	Deny  []Entry
+}
+
+// DynamicEntry is an entry added at runtime and shared through the storage
+type DynamicEntry struct {
+	Action Action
+	Entry  Entry
+	// TTL is the time left before the entry expires, zero if it never does
+	TTL time.Duration
+}
+
+// set is a list indexed for lookups
+type set struct {
+	prefixes []netip.Prefix
+	tokens   map[string]bool
+}
+
+func newSet(entries []Entry) set {
+	s := set{tokens: make(map[string]bool)}
+	for _, e := range entries {
+		if e.TokenHash != "" {
+			s.tokens[e.TokenHash] = true
+		} else {
+			s.prefixes = append(s.prefixes, e.Prefix)
+		}
+	}
+	return s
+}
+
+func (s set) contains(addr netip.Addr, tokenHash string) bool {
+	if tokenHash != "" && s.tokens[tokenHash] {
+		return true
+	}
+	if !addr.IsValid() {
+		return false
+	}
+	for _, prefix := range s.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+type compiled struct {
+	allow set
+	deny  set
+}
+
+func compile(l Lists) *compiled {
+	return &compiled{allow: newSet(l.Allow), deny: newSet(l.Deny)}
+}
+
+// List checks requests against static lists from the configuration and
+// dynamic lists kept in the storage. Dynamic entries are cached locally and
+// picked up by other instances on their next refresh.
+type List struct {
+	storage storage.Storage
+	static  atomic.Pointer[compiled]
+	dynamic atomic.Pointer[compiled]
+
+	mu      sync.Mutex
+	version int64
+	// expiresAt is when the first dynamic entry with a TTL expires
+	expiresAt time.Time
+}
+
+func New(store storage.Storage, static Lists) *List {
+	l := &List{storage: store}
+	l.SetStatic(static)
+	l.dynamic.Store(compile(Lists{}))
+	return l
+}
+
+// SetStatic replaces the lists loaded from the configuration
+func (l *List) SetStatic(static Lists) {
+	l.static.Store(compile(static))
+}
+
+// Check returns Deny if ip or token is in a deny list, Allow if either is in
+// an allow list and None otherwise. Deny entries win over allow entries, so
+// a single IP can be banned inside an allowed network. ip must be the client
+// address itself, not the aggregated IPv6 prefix it is limited under.
+func (l *List) Check(ip, token string) Action {
+	addr, _ := netip.ParseAddr(ip)
+	addr = addr.Unmap()
+	tokenHash := ""
+	if token != "" {
+		tokenHash = apikey.Hash(token)
+	}
+
+	static, dynamic := l.static.Load(), l.dynamic.Load()
+	if static.deny.contains(addr, tokenHash) || dynamic.deny.contains(addr, tokenHash) {
+		return Deny
+	}
+	if static.allow.contains(addr, tokenHash) || dynamic.allow.contains(addr, tokenHash) {
+		return Allow
+	}
+	return None
+}
+
+// Add stores a dynamic entry for all instances. A zero ttl never expires.
+func (l *List) Add(ctx context.Context, action Action, entry Entry, ttl time.Duration) error {
+	if action != Allow && action != Deny {
+		return fmt.Errorf("unknown list %q", action)
+	}
+	if err := l.storage.Set(ctx, entryKey(action, entry), 1, ttl); err != nil {
+		return fmt.Errorf("failed to add %s to %s list: %w", entry, action, err)
+	}
+	return l.changed(ctx)
+}
+
+// Remove deletes a dynamic entry
+func (l *List) Remove(ctx context.Context, action Action, entry Entry) error {
+	if err := l.storage.Reset(ctx, entryKey(action, entry)); err != nil {
+		return fmt.Errorf("failed to remove %s from %s list: %w", entry, action, err)
+	}
+	return l.changed(ctx)
+}
+
+// changed tells the other instances to rescan the entries
+func (l *List) changed(ctx context.Context) error {
+	if _, err := l.storage.Increment(ctx, versionKey); err != nil {
+		return fmt.Errorf("failed to update access lists version: %w", err)
+	}
+	return l.Refresh(ctx)
+}
+
+// Dynamic returns the dynamic entries currently in the storage
+func (l *List) Dynamic(ctx context.Context) ([]DynamicEntry, error) {
+	stored, err := l.storage.Scan(ctx, keyPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list access entries: %w", err)
+	}
+
+	entries := make([]DynamicEntry, 0, len(stored))
+	for _, s := range stored {
+		action, value, ok := strings.Cut(strings.TrimPrefix(s.Key, keyPrefix), ":")
+		if !ok || (Action(action) != Allow && Action(action) != Deny) {
+			continue
+		}
+		entry, err := ParseEntry(value)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, DynamicEntry{Action: Action(action), Entry: entry, TTL: s.TTL})
+	}
+	return entries, nil
+}
+
+// Refresh reloads the dynamic lists from the storage
+func (l *List) Refresh(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Read the version first so changes made during the scan are not missed
+	version, err := l.storage.Get(ctx, versionKey)
+	if err != nil {
+		return fmt.Errorf("failed to get access lists version: %w", err)
+	}
+	entries, err := l.Dynamic(ctx)
+	if err != nil {
+		return err
+	}
+
+	var lists Lists
+	var expiresAt time.Time
+	now := time.Now()
+	for _, e := range entries {
+		if e.Action == Allow {
+			lists.Allow = append(lists.Allow, e.Entry)
+		} else {
+			lists.Deny = append(lists.Deny, e.Entry)
+		}
+		if e.TTL > 0 && (expiresAt.IsZero() || now.Add(e.TTL).Before(expiresAt)) {
+			expiresAt = now.Add(e.TTL)
+		}
+	}
+	l.dynamic.Store(compile(lists))
+	l.version, l.expiresAt = version, expiresAt
+	return nil
+}
+
+// poll reloads the dynamic lists if they changed or an entry expired since
+// the last refresh. Scanning the storage is far costlier than reading the
+// version.
+func (l *List) poll(ctx context.Context) error {
+	version, err := l.storage.Get(ctx, versionKey)
+	if err != nil {
+		return fmt.Errorf("failed to get access lists version: %w", err)
+	}
+
+	l.mu.Lock()
+	stale := version != l.version || (!l.expiresAt.IsZero() && !time.Now().Before(l.expiresAt))
+	l.mu.Unlock()
+
+	if !stale {
+		return nil
+	}
+	return l.Refresh(ctx)
+}
+
+// Run keeps the dynamic lists up to date, checking for changes every
+// interval until ctx is done. Failed refreshes keep the previous lists.
+func (l *List) Run(ctx context.Context, interval time.Duration) {
+	if err := l.Refresh(ctx); err != nil {
+		log.Printf("Failed to load access lists: %v", err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := l.poll(ctx); err != nil {
+			log.Printf("Failed to refresh access lists: %v", err)
+		}
+	}
+}
+
+func entryKey(action Action, entry Entry) string {
+	return keyPrefix + string(action) + ":" + entry.String()
+}
@@ -0,0 +1,125 @@
+package access
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/goxprts/ratelimiter/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestStorage(t *testing.T) *storage.MemoryStorage {
+	store := storage.NewMemoryStorage(storage.MemoryOptions{})
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func mustParse(t *testing.T, values ...string) []Entry {
+	entries, err := ParseEntries(values)
+	require.NoError(t, err)
+	return entries
+}
+
+func TestParseEntry(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"1.2.3.4", "1.2.3.4"},
+		{"::ffff:1.2.3.4", "1.2.3.4"},
+		{"10.1.2.3/8", "10.0.0.0/8"},
+		{"2001:db8::/32", "2001:db8::/32"},
+		{"token:abc123", "token-sha256:6ca13d52ca70c883e0f0bb101e425a89e8624de51db2d2392593af6a84118090"},
+		{"token-sha256:6CA13D52CA70C883E0F0BB101E425A89E8624DE51DB2D2392593AF6A84118090", "token-sha256:6ca13d52ca70c883e0f0bb101e425a89e8624de51db2d2392593af6a84118090"},
+	}
+	for _, tt := range tests {
+		entry, err := ParseEntry(tt.value)
+		require.NoError(t, err, tt.value)
+		assert.Equal(t, tt.want, entry.String())
+	}
+
+	for _, value := range []string{"", "token:", "token-sha256:abc", "1.2.3", "10.0.0.0/33"} {
+		_, err := ParseEntry(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestList_Check(t *testing.T) {
+	list := New(newTestStorage(t), Lists{
+		Allow: mustParse(t, "10.0.0.0/8", "token:internal", "2001:db8::/32"),
+		Deny:  mustParse(t, "10.6.6.6", "203.0.113.0/24", "token:banned"),
+	})
+
+	assert.Equal(t, Allow, list.Check("10.1.2.3", ""))
+	assert.Equal(t, Allow, list.Check("192.168.1.1", "internal"))
+	assert.Equal(t, Allow, list.Check("2001:db8:1::7", ""))
+	assert.Equal(t, Deny, list.Check("203.0.113.7", ""))
+	assert.Equal(t, Deny, list.Check("192.168.1.1", "banned"))
+	assert.Equal(t, None, list.Check("192.168.1.1", "other"))
+
+	// Deny wins over allow
+	assert.Equal(t, Deny, list.Check("10.6.6.6", ""))
+	assert.Equal(t, Deny, list.Check("203.0.113.7", "internal"))
+
+	list.SetStatic(Lists{})
+	assert.Equal(t, None, list.Check("10.6.6.6", ""))
+}
+
+func TestList_Dynamic(t *testing.T) {
+	store := newTestStorage(t)
+	ctx := context.Background()
+	list := New(store, Lists{})
+	other := New(store, Lists{})
+
+	entry, err := ParseEntry("198.51.100.0/24")
+	require.NoError(t, err)
+	require.NoError(t, list.Add(ctx, Deny, entry, time.Hour))
+	assert.Equal(t, Deny, list.Check("198.51.100.1", ""))
+
+	// Other instances see the entry once they poll for changes
+	assert.Equal(t, None, other.Check("198.51.100.1", ""))
+	require.NoError(t, other.poll(ctx))
+	assert.Equal(t, Deny, other.Check("198.51.100.1", ""))
+
+	entries, err := list.Dynamic(ctx)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, Deny, entries[0].Action)
+	assert.Equal(t, "198.51.100.0/24", entries[0].Entry.String())
+	assert.InDelta(t, time.Hour, entries[0].TTL, float64(time.Second))
+
+	require.NoError(t, list.Remove(ctx, Deny, entry))
+	assert.Equal(t, None, list.Check("198.51.100.1", ""))
+	require.NoError(t, other.poll(ctx))
+	assert.Equal(t, None, other.Check("198.51.100.1", ""))
+
+	assert.Error(t, list.Add(ctx, None, entry, 0))
+}
+
+func TestList_Dynamic_TokenHashed(t *testing.T) {
+	store := newTestStorage(t)
+	ctx := context.Background()
+	list := New(store, Lists{})
+
+	entry, err := ParseEntry("token:s3cret")
+	require.NoError(t, err)
+	require.NoError(t, list.Add(ctx, Deny, entry, 0))
+	assert.Equal(t, Deny, list.Check("", "s3cret"))
+	assert.Equal(t, None, list.Check("", "other"))
+
+	stored, err := store.Scan(ctx, keyPrefix+"deny:")
+	require.NoError(t, err)
+	require.Len(t, stored, 1)
+	assert.NotContains(t, stored[0].Key, "s3cret")
+
+	// Entries listed by hash can be removed by hash
+	entries, err := list.Dynamic(ctx)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	byHash, err := ParseEntry(entries[0].Entry.String())
+	require.NoError(t, err)
+	require.NoError(t, list.Remove(ctx, Deny, byHash))
+	assert.Equal(t, None, list.Check("", "s3cret"))
+}
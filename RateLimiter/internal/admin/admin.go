@@ -0,0 +1,361 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/goxprts/ratelimiter/internal/access"
+	"github.com/goxprts/ratelimiter/internal/apikey"
+	"github.com/goxprts/ratelimiter/internal/limiter"
+	"github.com/goxprts/ratelimiter/internal/middleware"
+	"github.com/goxprts/ratelimiter/internal/storage"
+)
+
+// Handler serves the admin API for inspecting and managing limiter state:
+//
+//	GET    /admin/blocks         list blocked keys
+//	POST   /admin/blocks         block a key: {"key": "ip:1.2.3.4", "ttl_seconds": 300}
+//	DELETE /admin/blocks?key=    unblock a key
+//	GET    /admin/keys?key=      inspect the counters and block of a key
+//	DELETE /admin/keys?key=      reset the counters of a key
+//	GET    /admin/access         list the dynamic allow and deny entries
+//	POST   /admin/access         add an entry: {"list": "deny", "entry": "10.0.0.0/8", "ttl_seconds": 0}
+//	DELETE /admin/access?list=&entry=  remove an entry
+//
+// Keys may also be given as ip= or token= instead of key=, and the blocks and
+// keys of a tenant are managed by adding tenant=. Every request must carry
+// the admin token as "Authorization: Bearer <token>". The access endpoints
+// are only served when the handler has an access list.
+type Handler struct {
+	storage storage.Storage
+	token   string
+	access  *access.List
+	limiter *limiter.RateLimiter
+	tenants *middleware.TenantResolver
+	mux     *http.ServeMux
+}
+
+// Option configures optional Handler behavior
+type Option func(*Handler)
+
+// WithAccessList serves the endpoints managing the dynamic access lists
+func WithAccessList(list *access.List) Option {
+	return func(h *Handler) {
+		h.access = list
+	}
+}
+
+// WithLimiter drops what the limiter of this instance holds locally about
+// the keys unblocked or reset, e.g. batches and blocks of local batching
+func WithLimiter(rl *limiter.RateLimiter) Option {
+	return func(h *Handler) {
+		h.limiter = rl
+	}
+}
+
+// WithTenants accepts the tenants known to tenants in the tenant parameter
+func WithTenants(tenants *middleware.TenantResolver) Option {
+	return func(h *Handler) {
+		h.tenants = tenants
+	}
+}
+
+func NewHandler(store storage.Storage, token string, opts ...Option) *Handler {
+	h := &Handler{
+		storage: store,
+		token:   token,
+		mux:     http.NewServeMux(),
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	h.mux.HandleFunc("/admin/blocks", h.handleBlocks)
+	h.mux.HandleFunc("/admin/keys", h.handleKeys)
+	if h.access != nil {
+		h.mux.HandleFunc("/admin/access", h.handleAccess)
+	}
+	return h
+}
+
+type entryResponse struct {
+	Key        string `json:"key"`
+	Value      int64  `json:"value,omitempty"`
+	TTLSeconds int64  `json:"ttl_seconds"`
+}
+
+type keyResponse struct {
+	Key             string          `json:"key"`
+	Blocked         bool            `json:"blocked"`
+	BlockTTLSeconds int64           `json:"block_ttl_seconds,omitempty"`
+	Counters        []entryResponse `json:"counters"`
+}
+
+type blockRequest struct {
+	Key        string `json:"key"`
+	TTLSeconds int64  `json:"ttl_seconds"`
+}
+
+type accessEntry struct {
+	List       access.Action `json:"list"`
+	Entry      string        `json:"entry"`
+	TTLSeconds int64         `json:"ttl_seconds"`
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		writeError(w, http.StatusUnauthorized, "invalid or missing admin token")
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return false
+	}
+	return h.token != "" && subtle.ConstantTimeCompare([]byte(auth[7:]), []byte(h.token)) == 1
+}
+
+// tenant returns r in the namespace of the tenant parameter, if any
+func (h *Handler) tenant(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	ctx, err := h.tenants.Namespace(r.Context(), r.URL.Query().Get("tenant"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	return r.WithContext(ctx), true
+}
+
+func (h *Handler) handleBlocks(w http.ResponseWriter, r *http.Request) {
+	r, ok := h.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		entries, err := h.storage.ListBlocked(r.Context())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"blocks": toResponses(entries)})
+
+	case http.MethodPost:
+		var req blockRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		if req.Key == "" || req.TTLSeconds <= 0 {
+			writeError(w, http.StatusBadRequest, "key and a positive ttl_seconds are required")
+			return
+		}
+		if err := h.storage.Block(r.Context(), req.Key, time.Duration(req.TTLSeconds)*time.Second); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, entryResponse{Key: req.Key, TTLSeconds: req.TTLSeconds})
+
+	case http.MethodDelete:
+		key, ok := keyParam(w, r)
+		if !ok {
+			return
+		}
+		if err := h.storage.Unblock(r.Context(), key); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		h.forget(r, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (h *Handler) handleKeys(w http.ResponseWriter, r *http.Request) {
+	r, ok := h.tenant(w, r)
+	if !ok {
+		return
+	}
+	key, ok := keyParam(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		counters, err := h.counters(r, key)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		blocks, err := h.storage.Scan(r.Context(), "block:"+storage.HashTag(key))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		resp := keyResponse{Key: key, Counters: toResponses(counters)}
+		for _, block := range blocks {
+			if block.Key == "block:"+storage.HashTag(key) {
+				resp.Blocked = true
+				resp.BlockTTLSeconds = seconds(block.TTL)
+			}
+		}
+		writeJSON(w, http.StatusOK, resp)
+
+	case http.MethodDelete:
+		counters, err := h.counters(r, key)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		for _, counter := range counters {
+			if err := h.storage.Reset(r.Context(), counter.Key); err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		h.forget(r, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// forget drops the local limiter state of key, if the handler has a limiter
+func (h *Handler) forget(r *http.Request, key string) {
+	if h.limiter != nil {
+		h.limiter.Forget(r.Context(), key)
+	}
+}
+
+func (h *Handler) handleAccess(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		entries, err := h.access.Dynamic(r.Context())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		resp := map[string][]accessEntry{"allow": {}, "deny": {}}
+		for _, e := range entries {
+			list := string(e.Action)
+			resp[list] = append(resp[list], accessEntry{List: e.Action, Entry: e.Entry.String(), TTLSeconds: seconds(e.TTL)})
+		}
+		writeJSON(w, http.StatusOK, resp)
+
+	case http.MethodPost:
+		var req accessEntry
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		entry, ok := accessParams(w, req.List, req.Entry)
+		if !ok {
+			return
+		}
+		if req.TTLSeconds < 0 {
+			writeError(w, http.StatusBadRequest, "ttl_seconds must not be negative")
+			return
+		}
+		if err := h.access.Add(r.Context(), req.List, entry, time.Duration(req.TTLSeconds)*time.Second); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, accessEntry{List: req.List, Entry: entry.String(), TTLSeconds: req.TTLSeconds})
+
+	case http.MethodDelete:
+		query := r.URL.Query()
+		list := access.Action(query.Get("list"))
+		entry, ok := accessParams(w, list, query.Get("entry"))
+		if !ok {
+			return
+		}
+		if err := h.access.Remove(r.Context(), list, entry); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// accessParams validates the list name and parses the entry
+func accessParams(w http.ResponseWriter, list access.Action, value string) (access.Entry, bool) {
+	if list != access.Allow && list != access.Deny {
+		writeError(w, http.StatusBadRequest, `list must be "allow" or "deny"`)
+		return access.Entry{}, false
+	}
+	entry, err := access.ParseEntry(value)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return access.Entry{}, false
+	}
+	return entry, true
+}
+
+// counters returns the state keys of key: the key itself and the keys the
+// algorithms derive from it, such as {ip:1.2.3.4}:log
+func (h *Handler) counters(r *http.Request, key string) ([]storage.Entry, error) {
+	entries, err := h.storage.Scan(r.Context(), "{"+key)
+	if err != nil {
+		return nil, err
+	}
+
+	counters := []storage.Entry{}
+	for _, entry := range entries {
+		name := storage.UntagKey(entry.Key)
+		if name == key || strings.HasPrefix(name, key+":") {
+			counters = append(counters, entry)
+		}
+	}
+	return counters, nil
+}
+
+// keyParam reads the limiter key from the key, ip or token query parameter
+func keyParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	query := r.URL.Query()
+	switch {
+	case query.Get("key") != "":
+		return query.Get("key"), true
+	case query.Get("ip") != "":
+		return "ip:" + query.Get("ip"), true
+	case query.Get("token") != "":
+		return "token:" + apikey.ID(query.Get("token")), true
+	}
+	writeError(w, http.StatusBadRequest, "one of key, ip or token is required")
+	return "", false
+}
+
+func toResponses(entries []storage.Entry) []entryResponse {
+	responses := make([]entryResponse, len(entries))
+	for i, entry := range entries {
+		responses[i] = entryResponse{Key: entry.Key, Value: entry.Value, TTLSeconds: seconds(entry.TTL)}
+	}
+	return responses
+}
+
+// seconds rounds a TTL up to whole seconds
+func seconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,220 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goxprts/ratelimiter/internal/access"
+	"github.com/goxprts/ratelimiter/internal/apikey"
+	"github.com/goxprts/ratelimiter/internal/limiter"
+	"github.com/goxprts/ratelimiter/internal/middleware"
+	"github.com/goxprts/ratelimiter/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestHandler(t *testing.T) (*Handler, *storage.MemoryStorage) {
+	store := storage.NewMemoryStorage(storage.MemoryOptions{})
+	t.Cleanup(func() { store.Close() })
+	return NewHandler(store, "secret"), store
+}
+
+func do(h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestHandler_Unauthorized(t *testing.T) {
+	h, _ := newTestHandler(t)
+
+	req := httptest.NewRequest("GET", "/admin/blocks", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	req.Header.Set("Authorization", "Bearer wrong")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// The token must come with the Bearer scheme
+	req.Header.Set("Authorization", "secret")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestHandler_BlockListUnblock(t *testing.T) {
+	h, store := newTestHandler(t)
+	ctx := context.Background()
+
+	w := do(h, "POST", "/admin/blocks", `{"key":"ip:1.2.3.4","ttl_seconds":120}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	blocked, err := store.IsBlocked(ctx, "ip:1.2.3.4")
+	require.NoError(t, err)
+	assert.True(t, blocked)
+
+	w = do(h, "GET", "/admin/blocks", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var list struct {
+		Blocks []entryResponse `json:"blocks"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.Equal(t, []entryResponse{{Key: "ip:1.2.3.4", TTLSeconds: 120}}, list.Blocks)
+
+	w = do(h, "DELETE", "/admin/blocks?ip=1.2.3.4", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	blocked, err = store.IsBlocked(ctx, "ip:1.2.3.4")
+	require.NoError(t, err)
+	assert.False(t, blocked)
+}
+
+func TestHandler_UnblockLocalBatch(t *testing.T) {
+	store := storage.NewMemoryStorage(storage.MemoryOptions{})
+	t.Cleanup(func() { store.Close() })
+	rl := limiter.NewRateLimiter(store, 1, 60, map[string]limiter.TokenConfig{},
+		limiter.WithLocalBatching(limiter.BatchOptions{BatchFraction: 1}),
+	)
+	h := NewHandler(store, "secret", WithLimiter(rl))
+	ctx := context.Background()
+
+	rl.Allow(ctx, "10.0.0.1", "")
+	result, err := rl.Allow(ctx, "10.0.0.1", "")
+	require.NoError(t, err)
+	require.False(t, result.Allowed)
+
+	// The block cached by local batching is dropped with the stored one
+	w := do(h, http.MethodDelete, "/admin/blocks?ip=10.0.0.1", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	result, err = rl.Allow(ctx, "10.0.0.1", "")
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+}
+
+func TestHandler_BlockValidation(t *testing.T) {
+	h, _ := newTestHandler(t)
+
+	assert.Equal(t, http.StatusBadRequest, do(h, "POST", "/admin/blocks", `{"key":"ip:1.2.3.4"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, do(h, "POST", "/admin/blocks", `not json`).Code)
+	assert.Equal(t, http.StatusBadRequest, do(h, "DELETE", "/admin/blocks", "").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, do(h, "PUT", "/admin/blocks", "").Code)
+}
+
+func TestHandler_InspectAndResetKey(t *testing.T) {
+	h, store := newTestHandler(t)
+	ctx := context.Background()
+
+	// Tokens are counted under their ID
+	key := "token:" + apikey.ID("abc")
+	require.NoError(t, store.Set(ctx, "{"+key+"}", 3, time.Minute))
+	require.NoError(t, store.Set(ctx, "{"+key+"}:tokens", 1500, time.Minute))
+	require.NoError(t, store.Set(ctx, "{"+key+"0}", 7, time.Minute))
+	require.NoError(t, store.Block(ctx, key, 30*time.Second))
+
+	w := do(h, "GET", "/admin/keys?token=abc", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var resp keyResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, key, resp.Key)
+	assert.True(t, resp.Blocked)
+	assert.Equal(t, int64(30), resp.BlockTTLSeconds)
+	assert.Equal(t, []entryResponse{
+		{Key: "{" + key + "}", Value: 3, TTLSeconds: 60},
+		{Key: "{" + key + "}:tokens", Value: 1500, TTLSeconds: 60},
+	}, resp.Counters)
+
+	w = do(h, "DELETE", "/admin/keys?key="+key, "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	entries, err := store.Scan(ctx, "{token:")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "{"+key+"0}", entries[0].Key)
+}
+
+func TestHandler_AccessList(t *testing.T) {
+	store := storage.NewMemoryStorage(storage.MemoryOptions{})
+	t.Cleanup(func() { store.Close() })
+	list := access.New(store, access.Lists{})
+	h := NewHandler(store, "secret", WithAccessList(list))
+
+	w := do(h, "POST", "/admin/access", `{"list":"deny","entry":"203.0.113.0/24","ttl_seconds":600}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, access.Deny, list.Check("203.0.113.9", ""))
+
+	w = do(h, "POST", "/admin/access", `{"list":"allow","entry":"token:health"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = do(h, "GET", "/admin/access", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp map[string][]accessEntry
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	// Tokens are listed by their hash
+	assert.Equal(t, []accessEntry{{List: access.Allow, Entry: "token-sha256:" + apikey.Hash("health")}}, resp["allow"])
+	assert.Equal(t, []accessEntry{{List: access.Deny, Entry: "203.0.113.0/24", TTLSeconds: 600}}, resp["deny"])
+
+	w = do(h, "DELETE", "/admin/access?list=deny&entry=203.0.113.0/24", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, access.None, list.Check("203.0.113.9", ""))
+
+	assert.Equal(t, http.StatusBadRequest, do(h, "POST", "/admin/access", `{"list":"maybe","entry":"1.2.3.4"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, do(h, "POST", "/admin/access", `{"list":"deny","entry":"1.2.3"}`).Code)
+
+	// Without an access list the endpoints are not served
+	h, _ = newTestHandler(t)
+	assert.Equal(t, http.StatusNotFound, do(h, "GET", "/admin/access", "").Code)
+}
+
+func TestHandler_Tenants(t *testing.T) {
+	memory := storage.NewMemoryStorage(storage.MemoryOptions{})
+	t.Cleanup(func() { memory.Close() })
+	store := storage.NewNamespacedStorage(memory, "")
+	rl := limiter.NewRateLimiter(store, 5, 300, map[string]limiter.TokenConfig{})
+	limits := rl.Limits()
+	limits.Tenants = map[string]limiter.TokenConfig{"acme": {RPS: 5}}
+	rl.SetLimits(limits)
+	extractor, err := middleware.NewIPExtractor(nil, 64)
+	require.NoError(t, err)
+	h := NewHandler(store, "secret", WithTenants(middleware.NewTenantResolver("X-Tenant-ID", extractor, rl)))
+
+	ctx := storage.WithNamespace(context.Background(), "acme")
+	require.NoError(t, store.Block(ctx, "ip:1.2.3.4", time.Minute))
+
+	// Blocks of a tenant are left out of the default listing, and managed
+	// by naming the tenant
+	var resp map[string][]entryResponse
+	w := do(h, "GET", "/admin/blocks", "")
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Empty(t, resp["blocks"])
+	w = do(h, "GET", "/admin/blocks?tenant=acme", "")
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp["blocks"], 1)
+	assert.Equal(t, "ip:1.2.3.4", resp["blocks"][0].Key)
+
+	w = do(h, "GET", "/admin/keys?ip=1.2.3.4&tenant=acme", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var key keyResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &key))
+	assert.True(t, key.Blocked)
+
+	w = do(h, "DELETE", "/admin/blocks?ip=1.2.3.4&tenant=acme", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	blocked, err := store.IsBlocked(ctx, "ip:1.2.3.4")
+	require.NoError(t, err)
+	assert.False(t, blocked)
+
+	w = do(h, "GET", "/admin/blocks?tenant=initech", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, `{"error": "unknown tenant"}`, w.Body.String())
+}
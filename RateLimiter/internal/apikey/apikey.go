@@ -0,0 +1,349 @@
+package apikey
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goxprts/ratelimiter/internal/storage"
+)
+
+// keyPrefix namespaces the registry in the storage. versionKey is bumped on
+// every change so instances only rescan the keys when needed.
+const (
+	keyPrefix  = "apikey:"
+	versionKey = keyPrefix + "version"
+)
+
+// secretPrefix marks the keys issued by the registry
+const secretPrefix = "rlk_"
+
+// IDLength is the number of hex digits of the hash used as key ID
+const IDLength = 12
+
+var (
+	ErrUnknown  = errors.New("unknown API key")
+	ErrExpired  = errors.New("API key expired")
+	ErrRevoked  = errors.New("API key revoked")
+	ErrNotFound = errors.New("API key not found")
+)
+
+// Key describes an issued API key. The secret itself is never stored.
+type Key struct {
+	// ID identifies the key in logs, limiter keys and the CLI
+	ID string
+	// Hash is the hex SHA-256 of the secret
+	Hash      string
+	Owner     string
+	Plan      string
+	CreatedAt time.Time
+	// ExpiresAt is zero for keys that never expire
+	ExpiresAt time.Time
+	// RevokedAt is zero for keys still in use. A rotated key keeps working
+	// until its RevokedAt, at the end of the grace period.
+	RevokedAt time.Time
+}
+
+// Check returns ErrRevoked or ErrExpired for keys no longer valid at now
+func (k Key) Check(now time.Time) error {
+	if !k.RevokedAt.IsZero() && !now.Before(k.RevokedAt) {
+		return ErrRevoked
+	}
+	if !k.ExpiresAt.IsZero() && !now.Before(k.ExpiresAt) {
+		return ErrExpired
+	}
+	return nil
+}
+
+// Hash returns the hex SHA-256 of secret
+func Hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// ID returns the ID of secret, the prefix of its hash. Tokens configured
+// with their own limits are counted under their ID too, so no token ever
+// reaches the storage.
+func ID(secret string) string {
+	return Hash(secret)[:IDLength]
+}
+
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate API key: %w", err)
+	}
+	return secretPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// storageKey encodes the metadata of k in the key name, since the storage
+// only holds integers. The value is the revocation time.
+func storageKey(k Key) string {
+	fields := url.Values{}
+	fields.Set("owner", k.Owner)
+	fields.Set("plan", k.Plan)
+	fields.Set("created", strconv.FormatInt(k.CreatedAt.Unix(), 10))
+	if !k.ExpiresAt.IsZero() {
+		fields.Set("expires", strconv.FormatInt(k.ExpiresAt.Unix(), 10))
+	}
+	return keyPrefix + k.Hash + ":" + fields.Encode()
+}
+
+func parseEntry(e storage.Entry) (Key, bool) {
+	hash, encoded, ok := strings.Cut(strings.TrimPrefix(e.Key, keyPrefix), ":")
+	if !ok || len(hash) != sha256.Size*2 {
+		return Key{}, false
+	}
+	fields, err := url.ParseQuery(encoded)
+	if err != nil {
+		return Key{}, false
+	}
+
+	k := Key{
+		ID:        hash[:IDLength],
+		Hash:      hash,
+		Owner:     fields.Get("owner"),
+		Plan:      fields.Get("plan"),
+		CreatedAt: parseUnix(fields.Get("created")),
+		ExpiresAt: parseUnix(fields.Get("expires")),
+	}
+	if e.Value > 0 {
+		k.RevokedAt = time.Unix(e.Value, 0)
+	}
+	return k, true
+}
+
+func parseUnix(s string) time.Time {
+	sec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || s == "" {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+// Registry issues API keys and validates the keys sent by clients. Keys are
+// kept in the storage hashed with their owner, plan and expiry, and cached
+// locally; other instances pick up changes on their next refresh.
+type Registry struct {
+	storage storage.Storage
+	keys    atomic.Pointer[map[string]Key]
+	now     func() time.Time
+
+	mu      sync.Mutex
+	version int64
+}
+
+func NewRegistry(store storage.Storage) *Registry {
+	r := &Registry{storage: store, now: time.Now}
+	r.keys.Store(&map[string]Key{})
+	return r
+}
+
+// Lookup returns the key matching secret, or ErrUnknown, ErrExpired or
+// ErrRevoked
+func (r *Registry) Lookup(secret string) (Key, error) {
+	k, ok := (*r.keys.Load())[Hash(secret)]
+	if !ok {
+		return Key{}, ErrUnknown
+	}
+	return k, k.Check(r.now())
+}
+
+// Create issues a key for owner on plan. A zero expiresAt never expires.
+// The returned secret is not stored and cannot be shown again.
+func (r *Registry) Create(ctx context.Context, owner, plan string, expiresAt time.Time) (string, Key, error) {
+	secret, err := newSecret()
+	if err != nil {
+		return "", Key{}, err
+	}
+	hash := Hash(secret)
+	k := Key{
+		ID:        ID(secret),
+		Hash:      hash,
+		Owner:     owner,
+		Plan:      plan,
+		CreatedAt: r.now().Truncate(time.Second),
+		ExpiresAt: expiresAt.Truncate(time.Second),
+	}
+	if err := r.storage.Set(ctx, storageKey(k), 0, 0); err != nil {
+		return "", Key{}, fmt.Errorf("failed to store API key: %w", err)
+	}
+	return secret, k, r.changed(ctx)
+}
+
+// Rotate issues a new key with the owner, plan and expiry of key id. The old
+// key is revoked, or revoked after grace so clients can switch over.
+func (r *Registry) Rotate(ctx context.Context, id string, grace time.Duration) (string, Key, error) {
+	old, err := r.Get(ctx, id)
+	if err != nil {
+		return "", Key{}, err
+	}
+	if err := old.Check(r.now()); err != nil {
+		return "", Key{}, fmt.Errorf("cannot rotate %s: %w", id, err)
+	}
+
+	secret, k, err := r.Create(ctx, old.Owner, old.Plan, old.ExpiresAt)
+	if err != nil {
+		return "", Key{}, err
+	}
+
+	// The revocation time is the value of the stored key, so scheduling it
+	// is a single write
+	if _, err := r.revoke(ctx, old, r.now().Add(max(grace, 0))); err != nil {
+		return "", Key{}, err
+	}
+	return secret, k, nil
+}
+
+// Revoke disables key id on every instance. Revoking a key twice keeps the
+// first revocation time; revoking a key in its rotation grace period ends
+// the grace now.
+func (r *Registry) Revoke(ctx context.Context, id string) (Key, error) {
+	k, err := r.Get(ctx, id)
+	if err != nil {
+		return Key{}, err
+	}
+	return r.revoke(ctx, k, r.now())
+}
+
+// revoke disables k at, unless it is already revoked by then
+func (r *Registry) revoke(ctx context.Context, k Key, at time.Time) (Key, error) {
+	at = at.Truncate(time.Second)
+	if !k.RevokedAt.IsZero() && !k.RevokedAt.After(at) {
+		return k, nil
+	}
+	k.RevokedAt = at
+	if err := r.storage.Set(ctx, storageKey(k), k.RevokedAt.Unix(), 0); err != nil {
+		return Key{}, fmt.Errorf("failed to revoke API key %s: %w", k.ID, err)
+	}
+	return k, r.changed(ctx)
+}
+
+// Get returns the key with id from the storage
+func (r *Registry) Get(ctx context.Context, id string) (Key, error) {
+	if len(id) != IDLength {
+		return Key{}, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	keys, err := r.scan(ctx, keyPrefix+strings.ToLower(id))
+	if err != nil {
+		return Key{}, err
+	}
+	switch len(keys) {
+	case 0:
+		return Key{}, fmt.Errorf("%w: %s", ErrNotFound, id)
+	case 1:
+		return keys[0], nil
+	default:
+		return Key{}, fmt.Errorf("API key ID %s is ambiguous", id)
+	}
+}
+
+// List returns every key in the storage, oldest first
+func (r *Registry) List(ctx context.Context) ([]Key, error) {
+	keys, err := r.scan(ctx, keyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+func (r *Registry) scan(ctx context.Context, prefix string) ([]Key, error) {
+	stored, err := r.storage.Scan(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API keys: %w", err)
+	}
+	keys := make([]Key, 0, len(stored))
+	for _, e := range stored {
+		if k, ok := parseEntry(e); ok {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+// changed tells the other instances to reload the keys
+func (r *Registry) changed(ctx context.Context) error {
+	if _, err := r.storage.Increment(ctx, versionKey); err != nil {
+		return fmt.Errorf("failed to update API keys version: %w", err)
+	}
+	return r.Refresh(ctx)
+}
+
+// Refresh reloads the keys from the storage
+func (r *Registry) Refresh(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Read the version first so changes made during the scan are not missed
+	version, err := r.storage.Get(ctx, versionKey)
+	if err != nil {
+		return fmt.Errorf("failed to get API keys version: %w", err)
+	}
+	list, err := r.scan(ctx, keyPrefix)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]Key, len(list))
+	for _, k := range list {
+		keys[k.Hash] = k
+	}
+	r.keys.Store(&keys)
+	r.version = version
+	return nil
+}
+
+// poll reloads the keys if the version changed since the last refresh.
+// Expiry is checked on every lookup, so it needs no refresh.
+func (r *Registry) poll(ctx context.Context) error {
+	version, err := r.storage.Get(ctx, versionKey)
+	if err != nil {
+		return fmt.Errorf("failed to get API keys version: %w", err)
+	}
+
+	r.mu.Lock()
+	stale := version != r.version
+	r.mu.Unlock()
+
+	if !stale {
+		return nil
+	}
+	return r.Refresh(ctx)
+}
+
+// Run keeps the cached keys up to date, checking for changes every interval
+// until ctx is done. Failed refreshes keep the previous keys.
+func (r *Registry) Run(ctx context.Context, interval time.Duration) {
+	if err := r.Refresh(ctx); err != nil {
+		log.Printf("Failed to load API keys: %v", err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := r.poll(ctx); err != nil {
+			log.Printf("Failed to refresh API keys: %v", err)
+		}
+	}
+}
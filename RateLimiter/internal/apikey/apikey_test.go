@@ -0,0 +1,125 @@
+package apikey
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goxprts/ratelimiter/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestStorage(t *testing.T) *storage.MemoryStorage {
+	store := storage.NewMemoryStorage(storage.MemoryOptions{})
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestRegistry_Create(t *testing.T) {
+	store := newTestStorage(t)
+	r := NewRegistry(store)
+	ctx := context.Background()
+
+	expires := time.Now().Add(time.Hour)
+	secret, k, err := r.Create(ctx, "team:search", "pro", expires)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(secret, "rlk_"))
+	assert.Equal(t, Hash(secret)[:IDLength], k.ID)
+
+	got, err := r.Lookup(secret)
+	require.NoError(t, err)
+	assert.Equal(t, "team:search", got.Owner)
+	assert.Equal(t, "pro", got.Plan)
+	assert.Equal(t, expires.Unix(), got.ExpiresAt.Unix())
+
+	// Only the hash reaches the storage
+	entries, err := store.Scan(ctx, "apikey:")
+	require.NoError(t, err)
+	for _, e := range entries {
+		assert.NotContains(t, e.Key, secret)
+	}
+
+	_, err = r.Lookup("rlk_unknown")
+	assert.ErrorIs(t, err, ErrUnknown)
+}
+
+func TestRegistry_Expired(t *testing.T) {
+	r := NewRegistry(newTestStorage(t))
+	secret, _, err := r.Create(context.Background(), "alice", "free", time.Now().Add(time.Hour))
+	require.NoError(t, err)
+
+	r.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	_, err = r.Lookup(secret)
+	assert.ErrorIs(t, err, ErrExpired)
+}
+
+func TestRegistry_Revoke(t *testing.T) {
+	store := newTestStorage(t)
+	r := NewRegistry(store)
+	other := NewRegistry(store)
+	ctx := context.Background()
+
+	secret, k, err := r.Create(ctx, "alice", "free", time.Time{})
+	require.NoError(t, err)
+	require.NoError(t, other.Refresh(ctx))
+	_, err = other.Lookup(secret)
+	require.NoError(t, err)
+
+	revoked, err := r.Revoke(ctx, k.ID)
+	require.NoError(t, err)
+	assert.False(t, revoked.RevokedAt.IsZero())
+	_, err = r.Lookup(secret)
+	assert.ErrorIs(t, err, ErrRevoked)
+
+	// Other instances see the change on their next poll
+	require.NoError(t, other.poll(ctx))
+	_, err = other.Lookup(secret)
+	assert.ErrorIs(t, err, ErrRevoked)
+
+	_, err = r.Revoke(ctx, "000000000000")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestRegistry_Rotate(t *testing.T) {
+	r := NewRegistry(newTestStorage(t))
+	ctx := context.Background()
+
+	old, k, err := r.Create(ctx, "alice", "pro", time.Time{})
+	require.NoError(t, err)
+
+	// Without grace the old key stops working at once
+	secret, rotated, err := r.Rotate(ctx, k.ID, 0)
+	require.NoError(t, err)
+	assert.NotEqual(t, k.ID, rotated.ID)
+	assert.Equal(t, "alice", rotated.Owner)
+	assert.Equal(t, "pro", rotated.Plan)
+	_, err = r.Lookup(old)
+	assert.ErrorIs(t, err, ErrRevoked)
+	_, err = r.Lookup(secret)
+	assert.NoError(t, err)
+
+	// With grace both keys work until the old one is revoked
+	newer, _, err := r.Rotate(ctx, rotated.ID, time.Hour)
+	require.NoError(t, err)
+	prev, err := r.Lookup(secret)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), prev.RevokedAt, 2*time.Second)
+	assert.True(t, prev.ExpiresAt.IsZero())
+	_, err = r.Lookup(newer)
+	assert.NoError(t, err)
+
+	keys, err := r.List(ctx)
+	require.NoError(t, err)
+	assert.Len(t, keys, 3)
+
+	// Revoking ends the grace period
+	_, err = r.Revoke(ctx, rotated.ID)
+	require.NoError(t, err)
+	_, err = r.Lookup(secret)
+	assert.ErrorIs(t, err, ErrRevoked)
+
+	_, _, err = r.Rotate(ctx, k.ID, 0)
+	assert.ErrorIs(t, err, ErrRevoked)
+}
@@ -1,61 +1,494 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"strconv"
 	"strings"
 
+	"github.com/goxprts/ratelimiter/internal/access"
+	"github.com/goxprts/ratelimiter/internal/rules"
+	"github.com/goxprts/ratelimiter/internal/storage"
 	"github.com/joho/godotenv"
 )
 
 type Config struct {
+	Storage StorageConfig
 	Redis   RedisConfig
-	Limiter LimiterConfig
-	Server  ServerConfig
+	// Limiter holds the limits from the environment; LimitsFile overrides them
+	Limiter     LimiterConfig
+	LimitsFile  *FileConfig
+	Server      ServerConfig
+	Proxy       ProxyConfig
+	Concurrency ConcurrencyConfig
+	Keys        KeysConfig
+	Tracing     TracingConfig
+}
+
+// StorageConfig selects the storage backend used by the limiter
+type StorageConfig struct {
+	// Backend is either "redis" or "memory"
+	Backend               string
+	MemoryShards          int
+	MemoryMaxKeys         int
+	MemoryCleanupInterval int
+	// FailurePolicy is what happens when Redis fails: "closed" rejects
+	// requests, "open" lets them through and "local" limits them in memory
+	FailurePolicy string
+	// BreakerThreshold consecutive Redis failures open the circuit for
+	// BreakerTimeout seconds
+	BreakerThreshold int
+	BreakerTimeout   int
+	// Namespace prefixes every key, so applications sharing a Redis keep
+	// separate state
+	Namespace string
+}
+
+// ConcurrencyConfig caps the requests in flight per IP or token
+type ConcurrencyConfig struct {
+	// IPLimit and TokenLimit are the maximum concurrent requests; zero
+	// disables the limit
+	IPLimit    int
+	TokenLimit int
+	// LeaseTTL is how many seconds a slot stays taken when its instance
+	// stops renewing it
+	LeaseTTL int
+}
+
+// Enabled reports whether any concurrency limit is set
+func (c ConcurrencyConfig) Enabled() bool {
+	return c.IPLimit > 0 || c.TokenLimit > 0
+}
+
+// TracingConfig enables OpenTelemetry tracing of requests, limiter
+// decisions and storage operations
+type TracingConfig struct {
+	Enabled bool
+	// Endpoint is the URL of the OTLP/HTTP collector
+	Endpoint    string
+	ServiceName string
+	// SampleRatio is the share of new traces recorded, between 0 and 1
+	SampleRatio float64
+}
+
+// KeysConfig enables the API key registry
+type KeysConfig struct {
+	// Registry validates tokens without limits of their own against the
+	// registered keys, rejecting the unknown ones. Without it, unknown tokens
+	// fall back to the IP limit.
+	Registry bool
+	// RefreshPeriod is how often, in seconds, the keys are checked for
+	// changes made by other instances or the CLI
+	RefreshPeriod int
 }
 
 type RedisConfig struct {
+	// Mode is "standalone", "cluster" or "sentinel"
+	Mode     string
 	Host     string
 	Port     string
+	Username string
 	Password string
 	DB       int
+	// Addrs lists the cluster seed nodes or the sentinels; standalone mode
+	// uses Host and Port
+	Addrs []string
+	// MasterName and SentinelPassword are used in sentinel mode
+	MasterName       string
+	SentinelPassword string
+	TLS              RedisTLSConfig
+	// Pool sizes and timeouts in milliseconds; zero keeps the client defaults
+	PoolSize     int
+	MinIdleConns int
+	PoolTimeout  int
+	DialTimeout  int
+	ReadTimeout  int
+	WriteTimeout int
+	MaxRetries   int
+}
+
+// RedisTLSConfig enables TLS to Redis. CAFile replaces the system roots and
+// CertFile/KeyFile set a client certificate.
+type RedisTLSConfig struct {
+	Enabled            bool
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+// ProxyConfig turns the server into a reverse proxy when Routes is set
+type ProxyConfig struct {
+	Routes []ProxyRoute
+	// DialTimeout and ResponseTimeout are in seconds
+	DialTimeout     int
+	ResponseTimeout int
+	StripPrefix     bool
+	PreserveHost    bool
+}
+
+// ProxyRoute maps a path prefix to an upstream URL
+type ProxyRoute struct {
+	PathPrefix string
+	Upstream   string
 }
 
 type LimiterConfig struct {
 	IPRateLimit     int
 	IPBlockTime     int
+	IPAlgorithm     string
+	IPBurst         int
 	TokenRateLimits map[string]TokenLimit
+	// Plans holds the limits of the plans registered API keys are issued on
+	Plans map[string]TokenLimit
+	// Tenants holds the default limits of each tenant, replacing the IP limit
+	Tenants    map[string]TokenLimit
+	CIDRLimits []CIDRLimit
+	Rules      []RuleConfig
+	RuleMatch  string
+	JWTSecret  string
+	// BatchFraction enables local batching of fixed window limits, reserving
+	// this share of the limit at once; BatchOvershoot is the tolerated excess
+	BatchFraction  float64
+	BatchOvershoot float64
+	Penalty        PenaltyConfig
+	Access         AccessConfig
+}
+
+// AccessConfig lists IPs, CIDRs and "token:<token>" entries that skip the
+// limiter (Allow) or are always rejected (Deny)
+type AccessConfig struct {
+	Allow []string `json:"allow" yaml:"allow"`
+	Deny  []string `json:"deny" yaml:"deny"`
+}
+
+// PenaltyConfig makes blocks grow for keys that keep exceeding their limits.
+// Durations are in seconds; a Factor of one or less disables it.
+type PenaltyConfig struct {
+	Factor       float64 `json:"factor" yaml:"factor"`
+	Lookback     int     `json:"lookback" yaml:"lookback"`
+	MaxBlockTime int     `json:"max_block_time" yaml:"max_block_time"`
+}
+
+// RuleConfig declares a limit for requests matching a route, method,
+// header or JWT claim
+type RuleConfig struct {
+	Name       string            `json:"name" yaml:"name"`
+	PathPrefix string            `json:"path_prefix" yaml:"path_prefix"`
+	Methods    []string          `json:"methods" yaml:"methods"`
+	Headers    map[string]string `json:"headers" yaml:"headers"`
+	Claims     map[string]string `json:"claims" yaml:"claims"`
+	KeyBy      string            `json:"key_by" yaml:"key_by"`
+	RPS        int               `json:"rps" yaml:"rps"`
+	BlockTime  int               `json:"block_time" yaml:"block_time"`
+	Algorithm  string            `json:"algorithm" yaml:"algorithm"`
+	Burst      int               `json:"burst" yaml:"burst"`
+	// Cost is the number of units a matching request takes. With no rps the
+	// rule only weighs requests on the IP and token limits.
+	Cost int `json:"cost" yaml:"cost"`
+	// DryRun logs and counts the requests the rule would deny without
+	// denying them
+	DryRun bool `json:"dry_run" yaml:"dry_run"`
+	// QueueMaxWait is how many seconds requests over the limit wait for
+	// quota instead of being rejected; zero rejects them immediately
+	QueueMaxWait int `json:"queue_max_wait" yaml:"queue_max_wait"`
+	// QueueSize caps the requests waiting per key on each instance
+	QueueSize int `json:"queue_size" yaml:"queue_size"`
+}
+
+// CIDRLimit overrides the IP limit for addresses in CIDR
+type CIDRLimit struct {
+	CIDR      string
+	RPS       int
+	BlockTime int
+	Algorithm string
+	Burst     int
 }
 
 type TokenLimit struct {
 	RPS       int
 	BlockTime int
+	Algorithm string
+	Burst     int
+	// Plan is the name of the plan the limit comes from, if any
+	Plan string
+	// Quotas maps window names (minute, hour, day, month...) to limits
+	Quotas map[string]int
 }
 
 type ServerConfig struct {
 	Port string
+	// TrustedProxies lists the proxy CIDRs or IPs whose forwarding headers are honored
+	TrustedProxies []string
+	// TrustedIPHeader is the one forwarding header read from trusted proxies
+	TrustedIPHeader string
+	// IPv6PrefixLength aggregates IPv6 clients to a prefix (128 disables it)
+	IPv6PrefixLength int
+	// ConfigFile is an optional YAML or JSON limits file watched for changes
+	ConfigFile         string
+	ConfigReloadPeriod int
+	// AdminToken enables the admin API under /admin/ when set
+	AdminToken string
+	// AdminAddr serves the admin API on its own listen address, e.g.
+	// 127.0.0.1:9091, instead of the public port
+	AdminAddr string
+	// MetricsEnabled exposes Prometheus metrics on /metrics
+	MetricsEnabled bool
+	// AccessRefreshPeriod is how often the dynamic access lists are checked
+	// for changes made by other instances
+	AccessRefreshPeriod int
+	// TenantHeader names the request header carrying the tenant, read only
+	// from TrustedProxies; empty counts every request in the default
+	// namespace
+	TenantHeader string
+	// UsageRateLimit caps the /usage queries per client IP and second, 0
+	// disables the limit
+	UsageRateLimit int
+	// UsageBlockTime is how long, in seconds, an IP over the usage limit is
+	// blocked
+	UsageBlockTime int
 }
 
 func Load() (*Config, error) {
 	// Load .env file if exists
 	_ = godotenv.Load()
 
+	env := &envParser{}
 	config := &Config{
+		Storage: StorageConfig{
+			Backend:               strings.ToLower(getEnv("STORAGE_BACKEND", "redis")),
+			MemoryShards:          env.getInt("MEMORY_SHARDS", 32),
+			MemoryMaxKeys:         env.getInt("MEMORY_MAX_KEYS", 1000000),
+			MemoryCleanupInterval: env.getInt("MEMORY_CLEANUP_INTERVAL", 60),
+			FailurePolicy:         strings.ToLower(getEnv("STORAGE_FAILURE_POLICY", "closed")),
+			BreakerThreshold:      env.getInt("STORAGE_BREAKER_THRESHOLD", 5),
+			BreakerTimeout:        env.getInt("STORAGE_BREAKER_TIMEOUT", 10),
+			Namespace:             getEnv("STORAGE_NAMESPACE", ""),
+		},
 		Redis: RedisConfig{
-			Host:     getEnv("REDIS_HOST", "localhost"),
-			Port:     getEnv("REDIS_PORT", "6379"),
-			Password: getEnv("REDIS_PASSWORD", ""),
-			DB:       getEnvAsInt("REDIS_DB", 0),
+			Mode:             strings.ToLower(getEnv("REDIS_MODE", "standalone")),
+			Host:             getEnv("REDIS_HOST", "localhost"),
+			Port:             getEnv("REDIS_PORT", "6379"),
+			Username:         getEnv("REDIS_USERNAME", ""),
+			Password:         getEnv("REDIS_PASSWORD", ""),
+			DB:               env.getInt("REDIS_DB", 0),
+			Addrs:            parseList(getEnv("REDIS_ADDRS", "")),
+			MasterName:       getEnv("REDIS_MASTER_NAME", ""),
+			SentinelPassword: getEnv("REDIS_SENTINEL_PASSWORD", ""),
+			TLS: RedisTLSConfig{
+				Enabled:            env.getBool("REDIS_TLS", false),
+				CAFile:             getEnv("REDIS_TLS_CA_FILE", ""),
+				CertFile:           getEnv("REDIS_TLS_CERT_FILE", ""),
+				KeyFile:            getEnv("REDIS_TLS_KEY_FILE", ""),
+				ServerName:         getEnv("REDIS_TLS_SERVER_NAME", ""),
+				InsecureSkipVerify: env.getBool("REDIS_TLS_INSECURE_SKIP_VERIFY", false),
+			},
+			PoolSize:     env.getInt("REDIS_POOL_SIZE", 0),
+			MinIdleConns: env.getInt("REDIS_MIN_IDLE_CONNS", 0),
+			PoolTimeout:  env.getInt("REDIS_POOL_TIMEOUT_MS", 0),
+			DialTimeout:  env.getInt("REDIS_DIAL_TIMEOUT_MS", 0),
+			ReadTimeout:  env.getInt("REDIS_READ_TIMEOUT_MS", 0),
+			WriteTimeout: env.getInt("REDIS_WRITE_TIMEOUT_MS", 0),
+			MaxRetries:   env.getInt("REDIS_MAX_RETRIES", 0),
 		},
 		Limiter: LimiterConfig{
-			IPRateLimit:     getEnvAsInt("RATE_LIMIT_IP_RPS", 5),
-			IPBlockTime:     getEnvAsInt("RATE_LIMIT_IP_BLOCK_TIME", 300),
-			TokenRateLimits: parseTokenLimits(getEnv("RATE_LIMIT_TOKENS", "")),
+			IPRateLimit:    env.getInt("RATE_LIMIT_IP_RPS", 5),
+			IPBlockTime:    env.getInt("RATE_LIMIT_IP_BLOCK_TIME", 300),
+			IPAlgorithm:    getEnv("RATE_LIMIT_IP_ALGORITHM", "fixed_window"),
+			IPBurst:        env.getInt("RATE_LIMIT_IP_BURST", 0),
+			RuleMatch:      getEnv("RATE_LIMIT_RULE_MATCH", "first"),
+			JWTSecret:      getEnv("JWT_SECRET", ""),
+			BatchFraction:  env.getFloat("RATE_LIMIT_BATCH_FRACTION", 0),
+			BatchOvershoot: env.getFloat("RATE_LIMIT_BATCH_OVERSHOOT", 0),
+			Penalty: PenaltyConfig{
+				Factor:       env.getFloat("RATE_LIMIT_PENALTY_FACTOR", 0),
+				Lookback:     env.getInt("RATE_LIMIT_PENALTY_LOOKBACK", 3600),
+				MaxBlockTime: env.getInt("RATE_LIMIT_PENALTY_MAX_BLOCK_TIME", 86400),
+			},
+			Access: AccessConfig{
+				Allow: parseList(getEnv("ACCESS_ALLOW", "")),
+				Deny:  parseList(getEnv("ACCESS_DENY", "")),
+			},
 		},
 		Server: ServerConfig{
-			Port: getEnv("SERVER_PORT", "8080"),
+			Port:                getEnv("SERVER_PORT", "8080"),
+			TrustedProxies:      parseList(getEnv("TRUSTED_PROXIES", "")),
+			TrustedIPHeader:     getEnv("TRUSTED_IP_HEADER", "X-Forwarded-For"),
+			IPv6PrefixLength:    env.getInt("IPV6_PREFIX_LENGTH", 64),
+			ConfigFile:          getEnv("RATE_LIMIT_CONFIG_FILE", ""),
+			ConfigReloadPeriod:  env.getInt("RATE_LIMIT_CONFIG_RELOAD_PERIOD", 5),
+			AdminToken:          getEnv("ADMIN_TOKEN", ""),
+			AdminAddr:           getEnv("ADMIN_ADDR", ""),
+			MetricsEnabled:      env.getBool("METRICS_ENABLED", true),
+			AccessRefreshPeriod: env.getInt("ACCESS_REFRESH_PERIOD", 10),
+			TenantHeader:        getEnv("TENANT_HEADER", ""),
+			UsageRateLimit:      env.getInt("USAGE_RATE_LIMIT", 5),
+			UsageBlockTime:      env.getInt("USAGE_BLOCK_TIME", 60),
+		},
+		Proxy: ProxyConfig{
+			DialTimeout:     env.getInt("PROXY_DIAL_TIMEOUT", 5),
+			ResponseTimeout: env.getInt("PROXY_RESPONSE_TIMEOUT", 30),
+			StripPrefix:     env.getBool("PROXY_STRIP_PREFIX", false),
+			PreserveHost:    env.getBool("PROXY_PRESERVE_HOST", false),
+		},
+		Concurrency: ConcurrencyConfig{
+			IPLimit:    env.getInt("CONCURRENCY_IP_LIMIT", 0),
+			TokenLimit: env.getInt("CONCURRENCY_TOKEN_LIMIT", 0),
+			LeaseTTL:   env.getInt("CONCURRENCY_LEASE_TTL", 30),
 		},
+		Keys: KeysConfig{
+			Registry:      env.getBool("API_KEY_REGISTRY", true),
+			RefreshPeriod: env.getInt("API_KEY_REFRESH_PERIOD", 10),
+		},
+		Tracing: TracingConfig{
+			Enabled:     env.getBool("TRACING_ENABLED", false),
+			Endpoint:    getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4318"),
+			ServiceName: getEnv("OTEL_SERVICE_NAME", "ratelimiter"),
+			SampleRatio: env.getFloat("TRACING_SAMPLE_RATIO", 1),
+		},
+	}
+	if env.err != nil {
+		return nil, env.err
+	}
+
+	tokenLimits, err := parseTokenLimits(getEnv("RATE_LIMIT_TOKENS", ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid RATE_LIMIT_TOKENS: %w", err)
+	}
+	config.Limiter.TokenRateLimits = tokenLimits
+
+	tenantLimits, err := parseTokenLimits(getEnv("RATE_LIMIT_TENANTS", ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid RATE_LIMIT_TENANTS: %w", err)
+	}
+	for tenant := range tenantLimits {
+		if err := storage.ValidateNamespace(tenant); err != nil {
+			return nil, fmt.Errorf("invalid RATE_LIMIT_TENANTS: %w", err)
+		}
+	}
+	config.Limiter.Tenants = tenantLimits
+
+	proxyRoutes, err := parseProxyRoutes(getEnv("PROXY_ROUTES", ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY_ROUTES: %w", err)
+	}
+	config.Proxy.Routes = proxyRoutes
+
+	if ruleList := getEnv("RATE_LIMIT_RULES", ""); ruleList != "" {
+		if err := json.Unmarshal([]byte(ruleList), &config.Limiter.Rules); err != nil {
+			return nil, fmt.Errorf("invalid RATE_LIMIT_RULES: %w", err)
+		}
+		// Rules from the environment are held to the same checks as the file
+		if errs := (&FileConfig{Rules: config.Limiter.Rules}).validate(); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid RATE_LIMIT_RULES: %s: %s", errs[0].Path, errs[0].Message)
+		}
+	}
+	switch rules.MatchMode(config.Limiter.RuleMatch) {
+	case rules.FirstMatch, rules.MostSpecific:
+	default:
+		return nil, fmt.Errorf("invalid RATE_LIMIT_RULE_MATCH %q: must be %s or %s", config.Limiter.RuleMatch, rules.FirstMatch, rules.MostSpecific)
+	}
+
+	if config.Storage.Backend != "redis" && config.Storage.Backend != "memory" {
+		return nil, fmt.Errorf("invalid STORAGE_BACKEND %q: must be redis or memory", config.Storage.Backend)
+	}
+
+	switch config.Redis.Mode {
+	case "standalone":
+	case "cluster", "sentinel":
+		if len(config.Redis.Addrs) == 0 {
+			return nil, fmt.Errorf("REDIS_ADDRS is required in %s mode", config.Redis.Mode)
+		}
+		if config.Redis.Mode == "sentinel" && config.Redis.MasterName == "" {
+			return nil, fmt.Errorf("REDIS_MASTER_NAME is required in sentinel mode")
+		}
+		if config.Redis.Mode == "cluster" && config.Redis.DB != 0 {
+			return nil, fmt.Errorf("invalid REDIS_DB %d: cluster mode only supports database 0", config.Redis.DB)
+		}
+	default:
+		return nil, fmt.Errorf("invalid REDIS_MODE %q: must be standalone, cluster or sentinel", config.Redis.Mode)
+	}
+	if (config.Redis.TLS.CertFile == "") != (config.Redis.TLS.KeyFile == "") {
+		return nil, fmt.Errorf("REDIS_TLS_CERT_FILE and REDIS_TLS_KEY_FILE must be set together")
+	}
+
+	if config.Storage.Namespace != "" {
+		if err := storage.ValidateNamespace(config.Storage.Namespace); err != nil {
+			return nil, fmt.Errorf("invalid STORAGE_NAMESPACE: %w", err)
+		}
+	}
+
+	switch config.Storage.FailurePolicy {
+	case "open", "closed", "local":
+	default:
+		return nil, fmt.Errorf("invalid STORAGE_FAILURE_POLICY %q: must be open, closed or local", config.Storage.FailurePolicy)
+	}
+
+	if config.Limiter.BatchFraction < 0 || config.Limiter.BatchFraction > 1 {
+		return nil, fmt.Errorf("invalid RATE_LIMIT_BATCH_FRACTION %v: must be between 0 and 1", config.Limiter.BatchFraction)
+	}
+	if config.Limiter.BatchOvershoot < 0 {
+		return nil, fmt.Errorf("invalid RATE_LIMIT_BATCH_OVERSHOOT %v: must not be negative", config.Limiter.BatchOvershoot)
+	}
+	if config.Limiter.Penalty.Factor < 0 {
+		return nil, fmt.Errorf("invalid RATE_LIMIT_PENALTY_FACTOR %v: must not be negative", config.Limiter.Penalty.Factor)
+	}
+	if config.Limiter.Penalty.Lookback < 0 {
+		return nil, fmt.Errorf("invalid RATE_LIMIT_PENALTY_LOOKBACK %d: must not be negative", config.Limiter.Penalty.Lookback)
+	}
+	if config.Limiter.Penalty.MaxBlockTime < 0 {
+		return nil, fmt.Errorf("invalid RATE_LIMIT_PENALTY_MAX_BLOCK_TIME %d: must not be negative", config.Limiter.Penalty.MaxBlockTime)
+	}
+
+	if config.Concurrency.IPLimit < 0 {
+		return nil, fmt.Errorf("invalid CONCURRENCY_IP_LIMIT %d: must not be negative", config.Concurrency.IPLimit)
+	}
+	if config.Concurrency.TokenLimit < 0 {
+		return nil, fmt.Errorf("invalid CONCURRENCY_TOKEN_LIMIT %d: must not be negative", config.Concurrency.TokenLimit)
+	}
+	if config.Concurrency.LeaseTTL <= 0 {
+		return nil, fmt.Errorf("invalid CONCURRENCY_LEASE_TTL %d: must be positive", config.Concurrency.LeaseTTL)
+	}
+
+	if config.Server.UsageRateLimit < 0 {
+		return nil, fmt.Errorf("invalid USAGE_RATE_LIMIT %d: must not be negative", config.Server.UsageRateLimit)
+	}
+	if config.Server.UsageBlockTime < 0 {
+		return nil, fmt.Errorf("invalid USAGE_BLOCK_TIME %d: must not be negative", config.Server.UsageBlockTime)
+	}
+	if config.Server.TenantHeader != "" && len(config.Server.TrustedProxies) == 0 {
+		return nil, fmt.Errorf("TENANT_HEADER requires TRUSTED_PROXIES: the header is only read from trusted proxies")
+	}
+	if config.Server.AccessRefreshPeriod <= 0 {
+		return nil, fmt.Errorf("invalid ACCESS_REFRESH_PERIOD %d: must be positive", config.Server.AccessRefreshPeriod)
+	}
+	if config.Server.ConfigReloadPeriod <= 0 {
+		return nil, fmt.Errorf("invalid RATE_LIMIT_CONFIG_RELOAD_PERIOD %d: must be positive", config.Server.ConfigReloadPeriod)
+	}
+
+	if config.Keys.RefreshPeriod <= 0 {
+		return nil, fmt.Errorf("invalid API_KEY_REFRESH_PERIOD %d: must be positive", config.Keys.RefreshPeriod)
+	}
+
+	if config.Tracing.SampleRatio < 0 || config.Tracing.SampleRatio > 1 {
+		return nil, fmt.Errorf("invalid TRACING_SAMPLE_RATIO %v: must be between 0 and 1", config.Tracing.SampleRatio)
+	}
+
+	if _, err := access.ParseEntries(config.Limiter.Access.Allow); err != nil {
+		return nil, fmt.Errorf("invalid ACCESS_ALLOW: %w", err)
+	}
+	if _, err := access.ParseEntries(config.Limiter.Access.Deny); err != nil {
+		return nil, fmt.Errorf("invalid ACCESS_DENY: %w", err)
+	}
+
+	if config.Server.ConfigFile != "" {
+		file, err := LoadFile(config.Server.ConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		config.LimitsFile = file
 	}
 
 	return config, nil
@@ -69,50 +502,139 @@ func getEnv(key, defaultValue string) string {
 	return value
 }
 
-func getEnvAsInt(key string, defaultValue int) int {
+// envParser reads typed environment variables, keeping the first value that
+// fails to parse so Load can report it instead of using the default
+type envParser struct {
+	err error
+}
+
+func (p *envParser) fail(key, value, kind string) {
+	if p.err == nil {
+		p.err = fmt.Errorf("invalid %s %q: must be %s", key, value, kind)
+	}
+}
+
+func (p *envParser) getInt(key string, defaultValue int) int {
 	valueStr := os.Getenv(key)
 	if valueStr == "" {
 		return defaultValue
 	}
 	value, err := strconv.Atoi(valueStr)
 	if err != nil {
+		p.fail(key, valueStr, "an integer")
 		return defaultValue
 	}
 	return value
 }
 
-func parseTokenLimits(tokens string) map[string]TokenLimit {
+func (p *envParser) getFloat(key string, defaultValue float64) float64 {
+	valueStr := os.Getenv(key)
+	if valueStr == "" {
+		return defaultValue
+	}
+	value, err := strconv.ParseFloat(valueStr, 64)
+	if err != nil {
+		p.fail(key, valueStr, "a number")
+		return defaultValue
+	}
+	return value
+}
+
+func (p *envParser) getBool(key string, defaultValue bool) bool {
+	valueStr := os.Getenv(key)
+	if valueStr == "" {
+		return defaultValue
+	}
+	value, err := strconv.ParseBool(valueStr)
+	if err != nil {
+		p.fail(key, valueStr, "true or false")
+		return defaultValue
+	}
+	return value
+}
+
+func parseList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseProxyRoutes parses entries in the PATH_PREFIX=UPSTREAM_URL format
+func parseProxyRoutes(value string) ([]ProxyRoute, error) {
+	var routes []ProxyRoute
+	for i, entry := range parseList(value) {
+		prefix, upstream, ok := strings.Cut(entry, "=")
+		prefix, upstream = strings.TrimSpace(prefix), strings.TrimSpace(upstream)
+		if !ok || prefix == "" || upstream == "" {
+			return nil, fmt.Errorf("entry %d (%q): expected PATH_PREFIX=UPSTREAM_URL", i+1, entry)
+		}
+		routes = append(routes, ProxyRoute{PathPrefix: prefix, Upstream: upstream})
+	}
+	return routes, nil
+}
+
+// parseTokenLimits parses entries in the TOKEN:RPS:BLOCK_TIME[:ALGORITHM[:BURST]] format
+func parseTokenLimits(tokens string) (map[string]TokenLimit, error) {
 	limits := make(map[string]TokenLimit)
 	if tokens == "" {
-		return limits
+		return limits, nil
 	}
 
 	tokenList := strings.Split(tokens, ",")
-	for _, token := range tokenList {
-		parts := strings.Split(strings.TrimSpace(token), ":")
-		if len(parts) != 3 {
-			continue
+	for i, token := range tokenList {
+		entry := strings.TrimSpace(token)
+		parts := strings.Split(entry, ":")
+		if len(parts) < 3 || len(parts) > 5 || parts[0] == "" {
+			return nil, fmt.Errorf("entry %d (%q): expected TOKEN:RPS:BLOCK_TIME[:ALGORITHM[:BURST]]", i+1, entry)
 		}
 
 		rps, err := strconv.Atoi(parts[1])
-		if err != nil {
-			continue
+		if err != nil || rps <= 0 {
+			return nil, fmt.Errorf("entry %d (%q): rps must be a positive integer", i+1, entry)
 		}
 
 		blockTime, err := strconv.Atoi(parts[2])
-		if err != nil {
-			continue
+		if err != nil || blockTime < 0 {
+			return nil, fmt.Errorf("entry %d (%q): block time must be a non-negative integer", i+1, entry)
 		}
 
-		limits[parts[0]] = TokenLimit{
+		limit := TokenLimit{
 			RPS:       rps,
 			BlockTime: blockTime,
 		}
+		if len(parts) > 3 {
+			limit.Algorithm = parts[3]
+		}
+		if len(parts) > 4 {
+			burst, err := strconv.Atoi(parts[4])
+			if err != nil || burst < 0 {
+				return nil, fmt.Errorf("entry %d (%q): burst must be a non-negative integer", i+1, entry)
+			}
+			limit.Burst = burst
+		}
+
+		if _, exists := limits[parts[0]]; exists {
+			return nil, fmt.Errorf("entry %d (%q): duplicate token", i+1, entry)
+		}
+		limits[parts[0]] = limit
 	}
 
-	return limits
+	return limits, nil
 }
 
 func (c *RedisConfig) Address() string {
 	return fmt.Sprintf("%s:%s", c.Host, c.Port)
 }
+
+// Addresses returns the nodes to connect to: Addrs in cluster and sentinel
+// modes, Host and Port otherwise
+func (c *RedisConfig) Addresses() []string {
+	if c.Mode == "cluster" || c.Mode == "sentinel" {
+		return c.Addrs
+	}
+	return []string{c.Address()}
+}
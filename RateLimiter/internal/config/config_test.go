@@ -16,12 +16,20 @@ func TestLoad_DefaultValues(t *testing.T) {
 	assert.NotNil(t, cfg)
 
 	// Check default values
+	assert.Equal(t, "redis", cfg.Storage.Backend)
+	assert.Equal(t, 32, cfg.Storage.MemoryShards)
+	assert.Equal(t, 1000000, cfg.Storage.MemoryMaxKeys)
+	assert.Equal(t, 60, cfg.Storage.MemoryCleanupInterval)
 	assert.Equal(t, "localhost", cfg.Redis.Host)
 	assert.Equal(t, "6379", cfg.Redis.Port)
 	assert.Equal(t, 0, cfg.Redis.DB)
 	assert.Equal(t, 5, cfg.Limiter.IPRateLimit)
 	assert.Equal(t, 300, cfg.Limiter.IPBlockTime)
+	assert.Equal(t, "fixed_window", cfg.Limiter.IPAlgorithm)
+	assert.Equal(t, 0, cfg.Limiter.IPBurst)
 	assert.Equal(t, "8080", cfg.Server.Port)
+	assert.Empty(t, cfg.Server.TrustedProxies)
+	assert.Equal(t, 64, cfg.Server.IPv6PrefixLength)
 }
 
 func TestLoad_CustomValues(t *testing.T) {
@@ -32,6 +40,10 @@ func TestLoad_CustomValues(t *testing.T) {
 	os.Setenv("RATE_LIMIT_IP_RPS", "10")
 	os.Setenv("RATE_LIMIT_IP_BLOCK_TIME", "600")
 	os.Setenv("SERVER_PORT", "9090")
+	os.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 172.16.0.1")
+	os.Setenv("TRUSTED_IP_HEADER", "Forwarded")
+	os.Setenv("ADMIN_ADDR", "127.0.0.1:9091")
+	os.Setenv("IPV6_PREFIX_LENGTH", "56")
 
 	cfg, err := Load()
 	assert.NoError(t, err)
@@ -44,11 +56,354 @@ func TestLoad_CustomValues(t *testing.T) {
 	assert.Equal(t, 10, cfg.Limiter.IPRateLimit)
 	assert.Equal(t, 600, cfg.Limiter.IPBlockTime)
 	assert.Equal(t, "9090", cfg.Server.Port)
+	assert.Equal(t, []string{"10.0.0.0/8", "172.16.0.1"}, cfg.Server.TrustedProxies)
+	assert.Equal(t, "Forwarded", cfg.Server.TrustedIPHeader)
+	assert.Equal(t, "127.0.0.1:9091", cfg.Server.AdminAddr)
+	assert.Equal(t, 56, cfg.Server.IPv6PrefixLength)
 
 	// Cleanup
 	os.Clearenv()
 }
 
+func TestLoad_MemoryBackend(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("STORAGE_BACKEND", "Memory")
+	os.Setenv("MEMORY_MAX_KEYS", "500")
+	defer os.Clearenv()
+
+	cfg, err := Load()
+	assert.NoError(t, err)
+	assert.Equal(t, "memory", cfg.Storage.Backend)
+	assert.Equal(t, 500, cfg.Storage.MemoryMaxKeys)
+}
+
+func TestLoad_InvalidBackend(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("STORAGE_BACKEND", "memcached")
+	defer os.Clearenv()
+
+	_, err := Load()
+	assert.Error(t, err)
+}
+
+func TestLoad_FailurePolicy(t *testing.T) {
+	os.Clearenv()
+	defer os.Clearenv()
+
+	cfg, err := Load()
+	assert.NoError(t, err)
+	assert.Equal(t, "closed", cfg.Storage.FailurePolicy)
+	assert.Equal(t, 5, cfg.Storage.BreakerThreshold)
+	assert.Equal(t, 10, cfg.Storage.BreakerTimeout)
+
+	os.Setenv("STORAGE_FAILURE_POLICY", "Local")
+	cfg, err = Load()
+	assert.NoError(t, err)
+	assert.Equal(t, "local", cfg.Storage.FailurePolicy)
+
+	os.Setenv("STORAGE_FAILURE_POLICY", "retry")
+	_, err = Load()
+	assert.Error(t, err)
+}
+
+func TestLoad_ProxyRoutes(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("PROXY_ROUTES", "/api=http://api:8080/v1, /=http://web:3000")
+	os.Setenv("PROXY_STRIP_PREFIX", "true")
+	defer os.Clearenv()
+
+	cfg, err := Load()
+	assert.NoError(t, err)
+	assert.Equal(t, []ProxyRoute{
+		{PathPrefix: "/api", Upstream: "http://api:8080/v1"},
+		{PathPrefix: "/", Upstream: "http://web:3000"},
+	}, cfg.Proxy.Routes)
+	assert.True(t, cfg.Proxy.StripPrefix)
+	assert.Equal(t, 30, cfg.Proxy.ResponseTimeout)
+
+	os.Setenv("PROXY_ROUTES", "/api")
+	_, err = Load()
+	assert.Error(t, err)
+}
+
+func TestLoad_Batching(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("RATE_LIMIT_BATCH_FRACTION", "0.1")
+	os.Setenv("RATE_LIMIT_BATCH_OVERSHOOT", "0.05")
+	defer os.Clearenv()
+
+	cfg, err := Load()
+	assert.NoError(t, err)
+	assert.Equal(t, 0.1, cfg.Limiter.BatchFraction)
+	assert.Equal(t, 0.05, cfg.Limiter.BatchOvershoot)
+
+	os.Setenv("RATE_LIMIT_BATCH_FRACTION", "2")
+	_, err = Load()
+	assert.Error(t, err)
+}
+
+func TestLoad_Penalty(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("RATE_LIMIT_PENALTY_FACTOR", "2")
+	os.Setenv("RATE_LIMIT_PENALTY_LOOKBACK", "600")
+	defer os.Clearenv()
+
+	cfg, err := Load()
+	assert.NoError(t, err)
+	assert.Equal(t, PenaltyConfig{Factor: 2, Lookback: 600, MaxBlockTime: 86400}, cfg.Limiter.Penalty)
+
+	os.Setenv("RATE_LIMIT_PENALTY_MAX_BLOCK_TIME", "-1")
+	_, err = Load()
+	assert.Error(t, err)
+}
+
+func TestLoad_AccessLists(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("ACCESS_ALLOW", "10.0.0.0/8, token:health")
+	os.Setenv("ACCESS_DENY", "203.0.113.0/24")
+	defer os.Clearenv()
+
+	cfg, err := Load()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.0/8", "token:health"}, cfg.Limiter.Access.Allow)
+	assert.Equal(t, []string{"203.0.113.0/24"}, cfg.Limiter.Access.Deny)
+	assert.Equal(t, 10, cfg.Server.AccessRefreshPeriod)
+
+	os.Setenv("ACCESS_DENY", "203.0.113.0/33")
+	_, err = Load()
+	assert.Error(t, err)
+}
+
+func TestLoad_RedisModes(t *testing.T) {
+	os.Clearenv()
+	defer os.Clearenv()
+
+	cfg, err := Load()
+	assert.NoError(t, err)
+	assert.Equal(t, "standalone", cfg.Redis.Mode)
+	assert.Equal(t, []string{"localhost:6379"}, cfg.Redis.Addresses())
+
+	os.Setenv("REDIS_MODE", "cluster")
+	_, err = Load()
+	assert.Error(t, err)
+
+	os.Setenv("REDIS_ADDRS", "redis-1:6379, redis-2:6379")
+	os.Setenv("REDIS_POOL_SIZE", "50")
+	os.Setenv("REDIS_READ_TIMEOUT_MS", "200")
+	cfg, err = Load()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"redis-1:6379", "redis-2:6379"}, cfg.Redis.Addresses())
+	assert.Equal(t, 50, cfg.Redis.PoolSize)
+	assert.Equal(t, 200, cfg.Redis.ReadTimeout)
+
+	os.Setenv("REDIS_MODE", "sentinel")
+	_, err = Load()
+	assert.Error(t, err)
+	os.Setenv("REDIS_MASTER_NAME", "mymaster")
+	_, err = Load()
+	assert.NoError(t, err)
+
+	os.Setenv("REDIS_TLS", "true")
+	os.Setenv("REDIS_TLS_CERT_FILE", "client.crt")
+	_, err = Load()
+	assert.Error(t, err)
+
+	os.Setenv("REDIS_MODE", "replica")
+	_, err = Load()
+	assert.Error(t, err)
+}
+
+func TestLoad_Concurrency(t *testing.T) {
+	os.Clearenv()
+	defer os.Clearenv()
+
+	cfg, err := Load()
+	assert.NoError(t, err)
+	assert.False(t, cfg.Concurrency.Enabled())
+
+	os.Setenv("CONCURRENCY_IP_LIMIT", "10")
+	os.Setenv("CONCURRENCY_TOKEN_LIMIT", "50")
+	os.Setenv("CONCURRENCY_LEASE_TTL", "60")
+	cfg, err = Load()
+	assert.NoError(t, err)
+	assert.True(t, cfg.Concurrency.Enabled())
+	assert.Equal(t, ConcurrencyConfig{IPLimit: 10, TokenLimit: 50, LeaseTTL: 60}, cfg.Concurrency)
+
+	os.Setenv("CONCURRENCY_LEASE_TTL", "0")
+	_, err = Load()
+	assert.Error(t, err)
+}
+
+func TestLoad_Keys(t *testing.T) {
+	os.Clearenv()
+	defer os.Clearenv()
+
+	cfg, err := Load()
+	assert.NoError(t, err)
+	assert.Equal(t, KeysConfig{Registry: true, RefreshPeriod: 10}, cfg.Keys)
+
+	os.Setenv("API_KEY_REGISTRY", "false")
+	os.Setenv("API_KEY_REFRESH_PERIOD", "30")
+	cfg, err = Load()
+	assert.NoError(t, err)
+	assert.Equal(t, KeysConfig{Registry: false, RefreshPeriod: 30}, cfg.Keys)
+
+	os.Setenv("API_KEY_REFRESH_PERIOD", "0")
+	_, err = Load()
+	assert.Error(t, err)
+}
+
+func TestLoad_InvalidReloadPeriod(t *testing.T) {
+	os.Clearenv()
+	defer os.Clearenv()
+
+	os.Setenv("RATE_LIMIT_CONFIG_RELOAD_PERIOD", "0")
+	_, err := Load()
+	assert.Error(t, err)
+}
+
+func TestLoad_InvalidAccessRefreshPeriod(t *testing.T) {
+	os.Clearenv()
+	defer os.Clearenv()
+
+	os.Setenv("ACCESS_REFRESH_PERIOD", "0")
+	_, err := Load()
+	assert.Error(t, err)
+}
+
+func TestLoad_UsageLimit(t *testing.T) {
+	os.Clearenv()
+	defer os.Clearenv()
+
+	cfg, err := Load()
+	assert.NoError(t, err)
+	assert.Equal(t, 5, cfg.Server.UsageRateLimit)
+	assert.Equal(t, 60, cfg.Server.UsageBlockTime)
+
+	os.Setenv("USAGE_RATE_LIMIT", "-1")
+	_, err = Load()
+	assert.Error(t, err)
+}
+
+func TestLoad_Tenants(t *testing.T) {
+	os.Clearenv()
+	defer os.Clearenv()
+
+	cfg, err := Load()
+	assert.NoError(t, err)
+	assert.Empty(t, cfg.Storage.Namespace)
+	assert.Empty(t, cfg.Server.TenantHeader)
+	assert.Empty(t, cfg.Limiter.Tenants)
+
+	os.Setenv("STORAGE_NAMESPACE", "shop")
+	os.Setenv("TENANT_HEADER", "X-Tenant-ID")
+	os.Setenv("RATE_LIMIT_TENANTS", "acme:50:60,globex:10:300:token_bucket:20")
+	_, err = Load()
+	assert.ErrorContains(t, err, "TRUSTED_PROXIES")
+
+	os.Setenv("TRUSTED_PROXIES", "10.0.0.0/8")
+	cfg, err = Load()
+	assert.NoError(t, err)
+	assert.Equal(t, "shop", cfg.Storage.Namespace)
+	assert.Equal(t, "X-Tenant-ID", cfg.Server.TenantHeader)
+	assert.Equal(t, TokenLimit{RPS: 50, BlockTime: 60}, cfg.Limiter.Tenants["acme"])
+	assert.Equal(t, TokenLimit{RPS: 10, BlockTime: 300, Algorithm: "token_bucket", Burst: 20}, cfg.Limiter.Tenants["globex"])
+
+	os.Setenv("RATE_LIMIT_TENANTS", "acme/eu:50:60")
+	_, err = Load()
+	assert.Error(t, err)
+
+	os.Setenv("RATE_LIMIT_TENANTS", "")
+	os.Setenv("STORAGE_NAMESPACE", "shop:v2")
+	_, err = Load()
+	assert.Error(t, err)
+}
+
+func TestLoad_Tracing(t *testing.T) {
+	os.Clearenv()
+	defer os.Clearenv()
+
+	cfg, err := Load()
+	assert.NoError(t, err)
+	assert.Equal(t, TracingConfig{
+		Enabled:     false,
+		Endpoint:    "http://localhost:4318",
+		ServiceName: "ratelimiter",
+		SampleRatio: 1,
+	}, cfg.Tracing)
+
+	os.Setenv("TRACING_ENABLED", "true")
+	os.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://otel-collector:4318")
+	os.Setenv("OTEL_SERVICE_NAME", "edge-limiter")
+	os.Setenv("TRACING_SAMPLE_RATIO", "0.1")
+	cfg, err = Load()
+	assert.NoError(t, err)
+	assert.Equal(t, TracingConfig{
+		Enabled:     true,
+		Endpoint:    "http://otel-collector:4318",
+		ServiceName: "edge-limiter",
+		SampleRatio: 0.1,
+	}, cfg.Tracing)
+
+	os.Setenv("TRACING_SAMPLE_RATIO", "1.5")
+	_, err = Load()
+	assert.Error(t, err)
+}
+
+func TestLoad_Rules(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("RATE_LIMIT_RULES", `[{"name":"search","path_prefix":"/search","methods":["GET"],"key_by":"claim:sub","rps":2,"block_time":60}]`)
+	os.Setenv("RATE_LIMIT_RULE_MATCH", "most_specific")
+	defer os.Clearenv()
+
+	cfg, err := Load()
+	assert.NoError(t, err)
+	assert.Equal(t, "most_specific", cfg.Limiter.RuleMatch)
+	assert.Len(t, cfg.Limiter.Rules, 1)
+	assert.Equal(t, "search", cfg.Limiter.Rules[0].Name)
+	assert.Equal(t, "claim:sub", cfg.Limiter.Rules[0].KeyBy)
+	assert.Equal(t, 2, cfg.Limiter.Rules[0].RPS)
+
+	os.Setenv("RATE_LIMIT_RULES", `[{"name":`)
+	_, err = Load()
+	assert.Error(t, err)
+
+	// Rules from the environment are validated like the limits file
+	invalid := []string{
+		`[{"name":"a","rps":1},{"name":"a","rps":1}]`,
+		`[{"name":"a","rps":0}]`,
+		`[{"name":"a","rps":1,"algorithm":"leaky"}]`,
+	}
+	for _, value := range invalid {
+		os.Setenv("RATE_LIMIT_RULES", value)
+		_, err = Load()
+		assert.Error(t, err, value)
+	}
+
+	os.Setenv("RATE_LIMIT_RULES", "")
+	os.Setenv("RATE_LIMIT_RULE_MATCH", "last")
+	_, err = Load()
+	assert.ErrorContains(t, err, "RATE_LIMIT_RULE_MATCH")
+}
+
+func TestLoad_InvalidNumbers(t *testing.T) {
+	tests := map[string]string{
+		"RATE_LIMIT_IP_RPS":         "abc",
+		"RATE_LIMIT_BATCH_FRACTION": "half",
+		"METRICS_ENABLED":           "yes please",
+		"TRACING_SAMPLE_RATIO":      "1,0",
+		"CONCURRENCY_LEASE_TTL":     "30s",
+	}
+	for key, value := range tests {
+		os.Clearenv()
+		os.Setenv(key, value)
+
+		_, err := Load()
+		assert.ErrorContains(t, err, key)
+	}
+	os.Clearenv()
+}
+
 func TestParseTokenLimits(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -71,15 +426,16 @@ func TestParseTokenLimits(t *testing.T) {
 			expected: 2,
 		},
 		{
-			name:     "invalid format",
-			input:    "invalid",
-			expected: 0,
+			name:     "algorithm and burst",
+			input:    "abc123:10:300:token_bucket:20,xyz789:100:600:sliding_window_log",
+			expected: 2,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := parseTokenLimits(tt.input)
+			result, err := parseTokenLimits(tt.input)
+			assert.NoError(t, err)
 			assert.Equal(t, tt.expected, len(result))
 		})
 	}
@@ -87,7 +443,8 @@ func TestParseTokenLimits(t *testing.T) {
 
 func TestParseTokenLimits_Values(t *testing.T) {
 	input := "abc123:10:300,xyz789:100:600"
-	result := parseTokenLimits(input)
+	result, err := parseTokenLimits(input)
+	assert.NoError(t, err)
 
 	assert.Equal(t, 2, len(result))
 
@@ -102,6 +459,46 @@ func TestParseTokenLimits_Values(t *testing.T) {
 	assert.Equal(t, 600, token2.BlockTime)
 }
 
+func TestParseTokenLimits_Algorithm(t *testing.T) {
+	result, err := parseTokenLimits("abc123:10:300:token_bucket:20")
+	assert.NoError(t, err)
+
+	token, exists := result["abc123"]
+	assert.True(t, exists)
+	assert.Equal(t, "token_bucket", token.Algorithm)
+	assert.Equal(t, 20, token.Burst)
+}
+
+func TestParseTokenLimits_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		message string
+	}{
+		{name: "invalid format", input: "invalid", message: `entry 1 ("invalid")`},
+		{name: "invalid rps", input: "abc123:10:300,xyz789:many:600", message: `entry 2 ("xyz789:many:600"): rps`},
+		{name: "negative block time", input: "abc123:10:-1", message: "block time"},
+		{name: "invalid burst", input: "abc123:10:300:token_bucket:x", message: "burst"},
+		{name: "duplicate token", input: "abc123:10:300,abc123:5:60", message: "duplicate token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseTokenLimits(tt.input)
+			assert.ErrorContains(t, err, tt.message)
+		})
+	}
+}
+
+func TestLoad_InvalidTokens(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("RATE_LIMIT_TOKENS", "abc123:10")
+	defer os.Clearenv()
+
+	_, err := Load()
+	assert.Error(t, err)
+}
+
 func TestRedisConfig_Address(t *testing.T) {
 	cfg := RedisConfig{
 		Host: "localhost",
@@ -0,0 +1,429 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/goxprts/ratelimiter/internal/access"
+	"github.com/goxprts/ratelimiter/internal/limiter"
+	"github.com/goxprts/ratelimiter/internal/rules"
+	"github.com/goxprts/ratelimiter/internal/storage"
+	"gopkg.in/yaml.v3"
+)
+
+// FileConfig is the structure of the limits file. Sections left out keep the
+// values loaded from the environment.
+type FileConfig struct {
+	IP        *LimitSpec   `json:"ip" yaml:"ip"`
+	Plans     []PlanSpec   `json:"plans" yaml:"plans"`
+	Tokens    []TokenSpec  `json:"tokens" yaml:"tokens"`
+	Tenants   []TenantSpec `json:"tenants" yaml:"tenants"`
+	CIDRs     []CIDRSpec   `json:"cidrs" yaml:"cidrs"`
+	Rules     []RuleConfig `json:"rules" yaml:"rules"`
+	RuleMatch string       `json:"rule_match" yaml:"rule_match"`
+	// Penalty replaces the progressive block settings as a whole
+	Penalty *PenaltyConfig `json:"penalty" yaml:"penalty"`
+	// Access replaces the static allow and deny lists as a whole
+	Access *AccessConfig `json:"access" yaml:"access"`
+}
+
+type LimitSpec struct {
+	RPS       int    `json:"rps" yaml:"rps"`
+	BlockTime int    `json:"block_time" yaml:"block_time"`
+	Algorithm string `json:"algorithm" yaml:"algorithm"`
+	Burst     int    `json:"burst" yaml:"burst"`
+}
+
+// PlanSpec combines an RPS limit with quotas over longer windows
+type PlanSpec struct {
+	Name      string `json:"name" yaml:"name"`
+	LimitSpec `yaml:",inline"`
+	// Quotas maps window names (second, minute, hour, day, month) to limits
+	Quotas map[string]int `json:"quotas" yaml:"quotas"`
+}
+
+// TokenSpec sets the limit of a token, either inline or from a plan
+type TokenSpec struct {
+	Token     string `json:"token" yaml:"token"`
+	Plan      string `json:"plan" yaml:"plan"`
+	LimitSpec `yaml:",inline"`
+}
+
+// TenantSpec sets the default limit of the requests of a tenant
+type TenantSpec struct {
+	Name      string `json:"name" yaml:"name"`
+	LimitSpec `yaml:",inline"`
+}
+
+type CIDRSpec struct {
+	CIDR      string `json:"cidr" yaml:"cidr"`
+	LimitSpec `yaml:",inline"`
+}
+
+// FieldError reports an invalid value in the limits file
+type FieldError struct {
+	Path string
+	// Line is the line of the field in YAML files, zero when unknown
+	Line    int
+	Message string
+}
+
+// ValidationError lists every invalid value found in the limits file
+type ValidationError struct {
+	File   string
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, len(e.Errors))
+	for i, fe := range e.Errors {
+		location := e.File
+		if fe.Line > 0 {
+			location = fmt.Sprintf("%s:%d", e.File, fe.Line)
+		}
+		lines[i] = fmt.Sprintf("%s: %s: %s", location, fe.Path, fe.Message)
+	}
+	return "invalid limits file:\n" + strings.Join(lines, "\n")
+}
+
+// LoadFile reads and validates a limits file. Files ending in .json are
+// parsed as JSON, anything else as YAML. Unknown fields are rejected.
+func LoadFile(path string) (*FileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read limits file: %w", err)
+	}
+
+	file := &FileConfig{}
+	var root *yaml.Node
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(file); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	} else {
+		root = &yaml.Node{}
+		if err := yaml.Unmarshal(data, root); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(file); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	}
+
+	if errs := file.validate(); len(errs) > 0 {
+		for i := range errs {
+			errs[i].Line = yamlLine(root, errs[i].Path)
+		}
+		return nil, &ValidationError{File: path, Errors: errs}
+	}
+
+	return file, nil
+}
+
+func (f *FileConfig) validate() []FieldError {
+	var errs []FieldError
+	add := func(path, format string, args ...interface{}) {
+		errs = append(errs, FieldError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+	checkLimit := func(path string, spec LimitSpec) {
+		if spec.RPS <= 0 {
+			add(path+".rps", "must be positive")
+		}
+		if spec.BlockTime < 0 {
+			add(path+".block_time", "must not be negative")
+		}
+		if spec.Burst < 0 {
+			add(path+".burst", "must not be negative")
+		}
+		if _, err := limiter.ParseAlgorithm(spec.Algorithm); err != nil {
+			add(path+".algorithm", "%v", err)
+		}
+	}
+
+	if f.IP != nil {
+		checkLimit("ip", *f.IP)
+	}
+
+	plans := make(map[string]bool)
+	for i, plan := range f.Plans {
+		path := fmt.Sprintf("plans[%d]", i)
+		if plan.Name == "" {
+			add(path+".name", "is required")
+		} else if plans[plan.Name] {
+			add(path+".name", "duplicate plan name %q", plan.Name)
+		}
+		plans[plan.Name] = true
+		checkLimit(path, plan.LimitSpec)
+		windows := make([]string, 0, len(plan.Quotas))
+		for window := range plan.Quotas {
+			windows = append(windows, window)
+		}
+		sort.Strings(windows)
+		for _, window := range windows {
+			if _, err := limiter.ParseQuotaWindow(window); err != nil {
+				add(path+".quotas", "%v", err)
+			} else if plan.Quotas[window] <= 0 {
+				add(path+".quotas", "%s quota must be positive", window)
+			}
+		}
+	}
+
+	tokens := make(map[string]bool)
+	for i, token := range f.Tokens {
+		path := fmt.Sprintf("tokens[%d]", i)
+		if token.Token == "" {
+			add(path+".token", "is required")
+		} else if tokens[token.Token] {
+			add(path+".token", "duplicate token")
+		}
+		tokens[token.Token] = true
+		if token.Plan == "" {
+			checkLimit(path, token.LimitSpec)
+		} else if !plans[token.Plan] {
+			add(path+".plan", "unknown plan %q", token.Plan)
+		} else if token.LimitSpec != (LimitSpec{}) {
+			add(path+".plan", "cannot be combined with inline limits")
+		}
+	}
+
+	tenants := make(map[string]bool)
+	for i, tenant := range f.Tenants {
+		path := fmt.Sprintf("tenants[%d]", i)
+		if err := storage.ValidateNamespace(tenant.Name); err != nil {
+			add(path+".name", "%v", err)
+		} else if tenants[tenant.Name] {
+			add(path+".name", "duplicate tenant name %q", tenant.Name)
+		}
+		tenants[tenant.Name] = true
+		checkLimit(path, tenant.LimitSpec)
+	}
+
+	for i, cidr := range f.CIDRs {
+		path := fmt.Sprintf("cidrs[%d]", i)
+		if _, err := netip.ParsePrefix(cidr.CIDR); err != nil {
+			add(path+".cidr", "invalid CIDR %q", cidr.CIDR)
+		}
+		checkLimit(path, cidr.LimitSpec)
+	}
+
+	names := make(map[string]bool)
+	for i, rule := range f.Rules {
+		path := fmt.Sprintf("rules[%d]", i)
+		if rule.Name == "" {
+			add(path+".name", "is required")
+		} else if names[rule.Name] {
+			add(path+".name", "duplicate rule name %q", rule.Name)
+		}
+		names[rule.Name] = true
+		if err := rules.ValidateKeyBy(rule.KeyBy); err != nil {
+			add(path+".key_by", "%v", err)
+		}
+		if rule.Cost < 0 {
+			add(path+".cost", "must not be negative")
+		}
+		if rule.QueueMaxWait < 0 {
+			add(path+".queue_max_wait", "must not be negative")
+		} else if rule.QueueMaxWait > 0 && rule.RPS == 0 && rule.Cost > 0 {
+			add(path+".queue_max_wait", "requires rps")
+		}
+		if rule.QueueSize < 0 {
+			add(path+".queue_size", "must not be negative")
+		}
+		if rule.RPS != 0 || rule.Cost == 0 {
+			checkLimit(path, LimitSpec{RPS: rule.RPS, BlockTime: rule.BlockTime, Algorithm: rule.Algorithm, Burst: rule.Burst})
+			capacity := rule.RPS
+			if algorithm, _ := limiter.ParseAlgorithm(rule.Algorithm); algorithm == limiter.TokenBucket && rule.Burst > 0 {
+				capacity = rule.Burst
+			}
+			if rule.RPS > 0 && rule.Cost > capacity {
+				add(path+".cost", "must not exceed the limit (%d)", capacity)
+			}
+		}
+	}
+
+	if f.Penalty != nil {
+		if f.Penalty.Factor < 0 {
+			add("penalty.factor", "must not be negative")
+		}
+		if f.Penalty.Lookback < 0 {
+			add("penalty.lookback", "must not be negative")
+		}
+		if f.Penalty.MaxBlockTime < 0 {
+			add("penalty.max_block_time", "must not be negative")
+		}
+	}
+
+	if f.Access != nil {
+		checkEntries := func(path string, values []string) {
+			for i, value := range values {
+				if _, err := access.ParseEntry(value); err != nil {
+					add(fmt.Sprintf("%s[%d]", path, i), "%v", err)
+				}
+			}
+		}
+		checkEntries("access.allow", f.Access.Allow)
+		checkEntries("access.deny", f.Access.Deny)
+	}
+
+	switch rules.MatchMode(f.RuleMatch) {
+	case "", rules.FirstMatch, rules.MostSpecific:
+	default:
+		add("rule_match", "must be %q or %q", rules.FirstMatch, rules.MostSpecific)
+	}
+
+	return errs
+}
+
+// yamlLine returns the line of the node addressed by a path such as
+// tokens[1].rps, or zero if it cannot be found
+func yamlLine(root *yaml.Node, path string) int {
+	if root == nil || len(root.Content) == 0 {
+		return 0
+	}
+
+	node, line := root.Content[0], 0
+	for _, part := range strings.Split(path, ".") {
+		name, index := part, -1
+		if open := strings.Index(part, "["); open >= 0 {
+			name = part[:open]
+			index, _ = strconv.Atoi(strings.TrimSuffix(part[open+1:], "]"))
+		}
+
+		if node.Kind != yaml.MappingNode {
+			return line
+		}
+		var value *yaml.Node
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == name {
+				value, line = node.Content[i+1], node.Content[i].Line
+				break
+			}
+		}
+		if value == nil {
+			return line
+		}
+
+		if index >= 0 {
+			if value.Kind != yaml.SequenceNode || index >= len(value.Content) {
+				return line
+			}
+			value = value.Content[index]
+			line = value.Line
+		}
+		node = value
+	}
+	return line
+}
+
+// Apply returns a copy of c with the sections present in file. A nil file
+// leaves c unchanged.
+func (c LimiterConfig) Apply(file *FileConfig) LimiterConfig {
+	if file == nil {
+		return c
+	}
+
+	if file.IP != nil {
+		c.IPRateLimit = file.IP.RPS
+		c.IPBlockTime = file.IP.BlockTime
+		c.IPAlgorithm = file.IP.Algorithm
+		c.IPBurst = file.IP.Burst
+	}
+
+	if file.Tokens != nil {
+		tokens := make(map[string]TokenLimit, len(c.TokenRateLimits)+len(file.Tokens))
+		for token, limit := range c.TokenRateLimits {
+			tokens[token] = limit
+		}
+		plans := make(map[string]PlanSpec, len(file.Plans))
+		for _, plan := range file.Plans {
+			plans[plan.Name] = plan
+		}
+		for _, spec := range file.Tokens {
+			limit := spec.LimitSpec
+			var quotas map[string]int
+			if plan, ok := plans[spec.Plan]; ok {
+				limit, quotas = plan.LimitSpec, plan.Quotas
+			}
+			tokens[spec.Token] = TokenLimit{
+				RPS:       limit.RPS,
+				BlockTime: limit.BlockTime,
+				Algorithm: limit.Algorithm,
+				Burst:     limit.Burst,
+				Plan:      spec.Plan,
+				Quotas:    quotas,
+			}
+		}
+		c.TokenRateLimits = tokens
+	}
+
+	if file.Plans != nil {
+		c.Plans = make(map[string]TokenLimit, len(file.Plans))
+		for _, plan := range file.Plans {
+			c.Plans[plan.Name] = TokenLimit{
+				RPS:       plan.RPS,
+				BlockTime: plan.BlockTime,
+				Algorithm: plan.Algorithm,
+				Burst:     plan.Burst,
+				Plan:      plan.Name,
+				Quotas:    plan.Quotas,
+			}
+		}
+	}
+
+	if file.Tenants != nil {
+		tenants := make(map[string]TokenLimit, len(c.Tenants)+len(file.Tenants))
+		for tenant, limit := range c.Tenants {
+			tenants[tenant] = limit
+		}
+		for _, spec := range file.Tenants {
+			tenants[spec.Name] = TokenLimit{
+				RPS:       spec.RPS,
+				BlockTime: spec.BlockTime,
+				Algorithm: spec.Algorithm,
+				Burst:     spec.Burst,
+			}
+		}
+		c.Tenants = tenants
+	}
+
+	if file.CIDRs != nil {
+		c.CIDRLimits = make([]CIDRLimit, len(file.CIDRs))
+		for i, spec := range file.CIDRs {
+			c.CIDRLimits[i] = CIDRLimit{
+				CIDR:      spec.CIDR,
+				RPS:       spec.RPS,
+				BlockTime: spec.BlockTime,
+				Algorithm: spec.Algorithm,
+				Burst:     spec.Burst,
+			}
+		}
+	}
+
+	if file.Rules != nil {
+		c.Rules = file.Rules
+	}
+	if file.RuleMatch != "" {
+		c.RuleMatch = file.RuleMatch
+	}
+	if file.Penalty != nil {
+		c.Penalty = *file.Penalty
+	}
+	if file.Access != nil {
+		c.Access = *file.Access
+	}
+
+	return c
+}
@@ -0,0 +1,324 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	return path
+}
+
+const validYAML = `
+ip:
+  rps: 5
+  block_time: 300
+tokens:
+  - token: abc123
+    rps: 10
+    block_time: 60
+    algorithm: token_bucket
+    burst: 20
+cidrs:
+  - cidr: 10.0.0.0/8
+    rps: 100
+    block_time: 0
+rules:
+  - name: search
+    path_prefix: /search
+    key_by: claim:sub
+    rps: 2
+rule_match: most_specific
+`
+
+func TestLoadFile_YAML(t *testing.T) {
+	file, err := LoadFile(writeFile(t, "limits.yaml", validYAML))
+	require.NoError(t, err)
+
+	assert.Equal(t, 5, file.IP.RPS)
+	assert.Equal(t, "abc123", file.Tokens[0].Token)
+	assert.Equal(t, 20, file.Tokens[0].Burst)
+	assert.Equal(t, "10.0.0.0/8", file.CIDRs[0].CIDR)
+	assert.Equal(t, "search", file.Rules[0].Name)
+	assert.Equal(t, "most_specific", file.RuleMatch)
+}
+
+func TestLoadFile_JSON(t *testing.T) {
+	file, err := LoadFile(writeFile(t, "limits.json", `{"tokens":[{"token":"abc123","rps":10,"block_time":60}]}`))
+	require.NoError(t, err)
+
+	assert.Nil(t, file.IP)
+	assert.Equal(t, 10, file.Tokens[0].RPS)
+
+	_, err = LoadFile(writeFile(t, "limits.json", `{"tokens":[{"token":"abc123","rps":10,"blocktime":60}]}`))
+	assert.ErrorContains(t, err, "blocktime")
+}
+
+func TestLoadFile_ValidationErrors(t *testing.T) {
+	path := writeFile(t, "limits.yaml", `
+tokens:
+  - token: abc123
+    rps: 10
+  - token: abc123
+    rps: 0
+cidrs:
+  - cidr: 10.0.0.0/33
+    rps: 1
+rules:
+  - name: search
+    key_by: cookie:id
+    rps: 1
+    algorithm: leaky
+`)
+
+	_, err := LoadFile(path)
+	var validationErr *ValidationError
+	require.ErrorAs(t, err, &validationErr)
+
+	assert.Equal(t, []FieldError{
+		{Path: "tokens[1].token", Line: 5, Message: "duplicate token"},
+		{Path: "tokens[1].rps", Line: 6, Message: "must be positive"},
+		{Path: "cidrs[0].cidr", Line: 8, Message: `invalid CIDR "10.0.0.0/33"`},
+		{Path: "rules[0].key_by", Line: 12, Message: `invalid key_by "cookie:id"`},
+		{Path: "rules[0].algorithm", Line: 14, Message: `unknown rate limit algorithm "leaky"`},
+	}, validationErr.Errors)
+	assert.Contains(t, err.Error(), path+":6: tokens[1].rps: must be positive")
+}
+
+func TestLoadFile_RuleCost(t *testing.T) {
+	file, err := LoadFile(writeFile(t, "limits.yaml", `
+rules:
+  - name: search
+    path_prefix: /search
+    cost: 10
+`))
+	require.NoError(t, err)
+	assert.Equal(t, 10, file.Rules[0].Cost)
+
+	_, err = LoadFile(writeFile(t, "limits.yaml", "rules:\n  - name: search\n    rps: 5\n    cost: -1\n"))
+	var verr *ValidationError
+	require.ErrorAs(t, err, &verr)
+	assert.Equal(t, []FieldError{{Path: "rules[0].cost", Line: 4, Message: "must not be negative"}}, verr.Errors)
+
+	_, err = LoadFile(writeFile(t, "limits.yaml", "rules:\n  - name: search\n    rps: 5\n    cost: 6\n"))
+	require.ErrorAs(t, err, &verr)
+	assert.Equal(t, []FieldError{{Path: "rules[0].cost", Line: 4, Message: "must not exceed the limit (5)"}}, verr.Errors)
+
+	// A token bucket may take up to its burst, however the algorithm is spelled
+	file, err = LoadFile(writeFile(t, "limits.yaml", "rules:\n  - name: search\n    rps: 5\n    algorithm: Token_Bucket\n    burst: 10\n    cost: 8\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 8, file.Rules[0].Cost)
+
+	_, err = LoadFile(writeFile(t, "limits.yaml", "rules:\n  - name: search\n    rps: 5\n    algorithm: Token_Bucket\n    burst: 10\n    cost: 11\n"))
+	require.ErrorAs(t, err, &verr)
+	assert.Equal(t, []FieldError{{Path: "rules[0].cost", Line: 6, Message: "must not exceed the limit (10)"}}, verr.Errors)
+}
+
+func TestLoadFile_RuleDryRun(t *testing.T) {
+	file, err := LoadFile(writeFile(t, "limits.yaml", `
+rules:
+  - name: search
+    path_prefix: /search
+    rps: 1
+    dry_run: true
+`))
+	require.NoError(t, err)
+	assert.True(t, file.Rules[0].DryRun)
+}
+
+func TestLoadFile_RuleQueue(t *testing.T) {
+	file, err := LoadFile(writeFile(t, "limits.yaml", `
+rules:
+  - name: batch
+    path_prefix: /batch
+    rps: 10
+    algorithm: token_bucket
+    queue_max_wait: 30
+    queue_size: 50
+`))
+	require.NoError(t, err)
+	assert.Equal(t, 30, file.Rules[0].QueueMaxWait)
+	assert.Equal(t, 50, file.Rules[0].QueueSize)
+
+	_, err = LoadFile(writeFile(t, "limits.yaml", "rules:\n  - name: batch\n    rps: 5\n    queue_max_wait: -1\n"))
+	var verr *ValidationError
+	require.ErrorAs(t, err, &verr)
+	assert.Equal(t, []FieldError{{Path: "rules[0].queue_max_wait", Line: 4, Message: "must not be negative"}}, verr.Errors)
+}
+
+func TestLoadFile_UnknownField(t *testing.T) {
+	_, err := LoadFile(writeFile(t, "limits.yaml", "ip:\n  rps: 5\n  blocktime: 10\n"))
+	assert.ErrorContains(t, err, "line 3")
+}
+
+func TestLimiterConfig_Apply(t *testing.T) {
+	base := LimiterConfig{
+		IPRateLimit:     5,
+		IPBlockTime:     300,
+		TokenRateLimits: map[string]TokenLimit{"env": {RPS: 1}, "abc123": {RPS: 1}},
+		RuleMatch:       "first",
+	}
+
+	file, err := LoadFile(writeFile(t, "limits.yaml", validYAML))
+	require.NoError(t, err)
+
+	applied := base.Apply(file)
+	assert.Equal(t, 10, applied.TokenRateLimits["abc123"].RPS)
+	assert.Equal(t, 1, applied.TokenRateLimits["env"].RPS)
+	assert.Equal(t, []CIDRLimit{{CIDR: "10.0.0.0/8", RPS: 100}}, applied.CIDRLimits)
+	assert.Equal(t, "most_specific", applied.RuleMatch)
+
+	// The base configuration is not modified
+	assert.Equal(t, 1, base.TokenRateLimits["abc123"].RPS)
+	assert.Equal(t, base, base.Apply(nil))
+}
+
+func TestLoadFile_Plans(t *testing.T) {
+	file, err := LoadFile(writeFile(t, "limits.yaml", `
+plans:
+  - name: pro
+    rps: 10
+    block_time: 60
+    quotas:
+      minute: 300
+      month: 100000
+tokens:
+  - token: abc123
+    plan: pro
+`))
+	require.NoError(t, err)
+
+	applied := LimiterConfig{}.Apply(file)
+	assert.Equal(t, TokenLimit{
+		RPS:       10,
+		BlockTime: 60,
+		Plan:      "pro",
+		Quotas:    map[string]int{"minute": 300, "month": 100000},
+	}, applied.TokenRateLimits["abc123"])
+	// Plans also apply to registered API keys
+	assert.Equal(t, applied.TokenRateLimits["abc123"], applied.Plans["pro"])
+
+	_, err = LoadFile(writeFile(t, "limits.yaml", `
+plans:
+  - name: pro
+    rps: 10
+    quotas:
+      week: 5
+      day: 0
+tokens:
+  - token: abc123
+    plan: free
+  - token: xyz789
+    plan: pro
+    rps: 5
+`))
+	var validationErr *ValidationError
+	require.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, []FieldError{
+		{Path: "plans[0].quotas", Line: 5, Message: "day quota must be positive"},
+		{Path: "plans[0].quotas", Line: 5, Message: `unknown quota window "week"`},
+		{Path: "tokens[0].plan", Line: 10, Message: `unknown plan "free"`},
+		{Path: "tokens[1].plan", Line: 12, Message: "cannot be combined with inline limits"},
+	}, validationErr.Errors)
+}
+
+func TestLoadFile_Tenants(t *testing.T) {
+	file, err := LoadFile(writeFile(t, "limits.yaml", `
+tenants:
+  - name: acme
+    rps: 50
+    block_time: 60
+`))
+	require.NoError(t, err)
+
+	applied := LimiterConfig{Tenants: map[string]TokenLimit{
+		"acme":   {RPS: 5, BlockTime: 10},
+		"globex": {RPS: 10, BlockTime: 300},
+	}}.Apply(file)
+	assert.Equal(t, TokenLimit{RPS: 50, BlockTime: 60}, applied.Tenants["acme"])
+	assert.Equal(t, TokenLimit{RPS: 10, BlockTime: 300}, applied.Tenants["globex"])
+
+	_, err = LoadFile(writeFile(t, "limits.yaml", `
+tenants:
+  - name: acme
+    rps: 50
+  - name: acme
+    rps: 10
+  - name: a:b
+    rps: 10
+`))
+	var validationErr *ValidationError
+	require.ErrorAs(t, err, &validationErr)
+	require.Len(t, validationErr.Errors, 2)
+	assert.Equal(t, "tenants[1].name", validationErr.Errors[0].Path)
+	assert.Equal(t, "tenants[2].name", validationErr.Errors[1].Path)
+}
+
+func TestWatchFile(t *testing.T) {
+	path := writeFile(t, "limits.yaml", "ip:\n  rps: 5\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changes := make(chan *FileConfig, 1)
+	go WatchFile(ctx, path, 10*time.Millisecond, func(file *FileConfig) { changes <- file })
+
+	// Invalid files are ignored
+	time.Sleep(30 * time.Millisecond)
+	require.NoError(t, os.WriteFile(path, []byte("ip:\n  rps: -1\n"), 0o644))
+	time.Sleep(30 * time.Millisecond)
+	require.NoError(t, os.WriteFile(path, []byte("ip:\n  rps: 50\n"), 0o644))
+
+	select {
+	case file := <-changes:
+		require.NotNil(t, file.IP)
+		assert.Equal(t, 50, file.IP.RPS)
+	case <-time.After(time.Second):
+		t.Fatal("change not detected")
+	}
+}
+
+func TestLoadFile_Penalty(t *testing.T) {
+	file, err := LoadFile(writeFile(t, "limits.yaml", `
+penalty:
+  factor: 2
+  lookback: 600
+  max_block_time: 3600
+`))
+	require.NoError(t, err)
+
+	applied := LimiterConfig{Penalty: PenaltyConfig{Factor: 3}}.Apply(file)
+	assert.Equal(t, PenaltyConfig{Factor: 2, Lookback: 600, MaxBlockTime: 3600}, applied.Penalty)
+
+	_, err = LoadFile(writeFile(t, "limits.yaml", "penalty:\n  factor: -1\n"))
+	var verr *ValidationError
+	require.ErrorAs(t, err, &verr)
+	assert.Equal(t, "penalty.factor", verr.Errors[0].Path)
+	assert.Equal(t, 2, verr.Errors[0].Line)
+}
+
+func TestLoadFile_Access(t *testing.T) {
+	file, err := LoadFile(writeFile(t, "limits.yaml", `
+access:
+  allow: [10.0.0.0/8, "token:health"]
+  deny: [203.0.113.0/24]
+`))
+	require.NoError(t, err)
+
+	applied := LimiterConfig{Access: AccessConfig{Deny: []string{"1.2.3.4"}}}.Apply(file)
+	assert.Equal(t, AccessConfig{Allow: []string{"10.0.0.0/8", "token:health"}, Deny: []string{"203.0.113.0/24"}}, applied.Access)
+
+	_, err = LoadFile(writeFile(t, "limits.yaml", "access:\n  deny:\n    - 1.2.3.4\n    - not-an-ip\n"))
+	var verr *ValidationError
+	require.ErrorAs(t, err, &verr)
+	assert.Equal(t, "access.deny[1]", verr.Errors[0].Path)
+	assert.Equal(t, 4, verr.Errors[0].Line)
+}
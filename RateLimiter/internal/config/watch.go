@@ -0,0 +1,59 @@
+package config
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+)
+
+// WatchFile polls path every interval and calls onChange with the new
+// contents whenever the file is modified. A change is only loaded once the
+// file stays the same for a whole interval, so half-written files are not
+// picked up. Invalid files are logged and ignored, keeping the last valid
+// configuration in place.
+func WatchFile(ctx context.Context, path string, interval time.Duration, onChange func(*FileConfig)) {
+	last := fileVersion(path)
+	pending := last
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		version := fileVersion(path)
+		if version != pending {
+			pending = version
+			continue
+		}
+		if version == last {
+			continue
+		}
+		last = version
+
+		file, err := LoadFile(path)
+		if err != nil {
+			log.Printf("Ignoring limits file change: %v", err)
+			continue
+		}
+		onChange(file)
+	}
+}
+
+type version struct {
+	modTime time.Time
+	size    int64
+}
+
+func fileVersion(path string) version {
+	info, err := os.Stat(path)
+	if err != nil {
+		return version{}
+	}
+	return version{modTime: info.ModTime(), size: info.Size()}
+}
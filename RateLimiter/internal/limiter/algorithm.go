@@ -0,0 +1,37 @@
+package limiter
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Algorithm identifies the strategy used to count requests against a limit
+type Algorithm string
+
+const (
+	// FixedWindow counts requests in consecutive one-second windows
+	FixedWindow Algorithm = "fixed_window"
+	// SlidingWindowLog keeps a timestamp per request and counts the last second
+	SlidingWindowLog Algorithm = "sliding_window_log"
+	// SlidingWindowCounter weights the previous window by its overlap with the last second
+	SlidingWindowCounter Algorithm = "sliding_window_counter"
+	// TokenBucket refills RPS tokens per second up to a configurable burst
+	TokenBucket Algorithm = "token_bucket"
+)
+
+// window is the interval over which RPS limits are measured
+const window = time.Second
+
+// ParseAlgorithm converts a configuration value into an Algorithm.
+// An empty name selects the fixed window.
+func ParseAlgorithm(name string) (Algorithm, error) {
+	algorithm := Algorithm(strings.ToLower(strings.TrimSpace(name)))
+	switch algorithm {
+	case "":
+		return FixedWindow, nil
+	case FixedWindow, SlidingWindowLog, SlidingWindowCounter, TokenBucket:
+		return algorithm, nil
+	}
+	return "", fmt.Errorf("unknown rate limit algorithm %q", name)
+}
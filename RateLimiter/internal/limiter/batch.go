@@ -0,0 +1,275 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/goxprts/ratelimiter/internal/storage"
+)
+
+// BatchOptions configures local pre-aggregation of fixed window limits
+type BatchOptions struct {
+	// BatchFraction is the share of a key's limit reserved from the storage
+	// at once, between 0 and 1. Smaller batches are more accurate but reach
+	// the storage more often.
+	BatchFraction float64
+	// Overshoot is the share of the limit the instances together may admit
+	// beyond it, compensating quota stranded in other instances' batches
+	Overshoot float64
+}
+
+// BatchObserver is implemented by observers that also track local batching.
+// The share of reserved units that end up unused is the approximation error
+// on the admitting side, and the overshoot units admitted beyond the limit
+// the error on the other.
+type BatchObserver interface {
+	ObserveReserved(units int)
+	ObserveUnused(units int)
+	ObserveOvershoot(units int)
+}
+
+// leaseShards is the number of independently locked lease maps
+const leaseShards = 64
+
+// blockRecheck is how long a block is served locally before the storage is
+// asked again, so blocks lifted elsewhere, e.g. by the admin API, end soon
+// on every instance
+const blockRecheck = time.Second
+
+// WithLocalBatching serves fixed window limits from batches of quota
+// reserved from the storage, so most requests are decided without reaching
+// it. The other algorithms keep evaluating every request in the storage.
+func WithLocalBatching(opts BatchOptions) Option {
+	return func(rl *RateLimiter) {
+		b := &batcher{opts: opts}
+		for i := range b.shards {
+			b.shards[i].leases = make(map[string]*lease)
+		}
+		rl.batcher = b
+	}
+}
+
+// batcher keeps the batch reserved by this instance for each key
+type batcher struct {
+	opts   BatchOptions
+	shards [leaseShards]leaseShard
+}
+
+// leaseShard holds the leases of part of the keys. Leases of past windows
+// are swept at most once per second, a shard at a time.
+type leaseShard struct {
+	mu        sync.Mutex
+	leases    map[string]*lease
+	lastSweep time.Time
+}
+
+// lease is the quota of one key held locally for the current window
+type lease struct {
+	mu     sync.Mutex
+	window int64
+	// end is when the window of the lease ends
+	end time.Time
+	// available units were reserved and not served yet
+	available int
+	// beyond is the part of available reserved beyond the limit, out of the
+	// overshoot
+	beyond int
+	// remaining is the shared quota left at the last reservation
+	remaining int
+	// exhausted is set once the storage granted less than asked
+	exhausted    bool
+	blockedUntil time.Time
+	// recheckAt is when the storage is asked again about the block
+	recheckAt time.Time
+	// dropped is set once the lease is removed from its shard; requests
+	// that got it before look the key up again
+	dropped bool
+}
+
+// evaluate decides a request locally, reserving a new batch when the
+// current one is used up
+func (b *batcher) evaluate(ctx context.Context, rl *RateLimiter, key string, policy storage.Policy, now time.Time) (*storage.Decision, error) {
+	index := now.UnixNano() / int64(policy.Window)
+	windowEnd := time.Unix(0, (index+1)*int64(policy.Window))
+	// Tenants share the key names, each in its own namespace
+	l := b.acquire(rl, leaseKey(ctx, key), index, windowEnd, now)
+	defer l.mu.Unlock()
+
+	if l.window != index {
+		rl.observeUnused(l.available)
+		l.window, l.end, l.available, l.beyond, l.remaining, l.exhausted = index, windowEnd, 0, 0, 0, false
+	}
+
+	if now.Before(l.blockedUntil) {
+		if now.Before(l.recheckAt) {
+			return &storage.Decision{Blocked: true, ResetAfter: l.blockedUntil.Sub(now)}, nil
+		}
+		l.blockedUntil, l.exhausted = time.Time{}, false
+	}
+
+	cost := max(1, policy.Cost)
+	if l.available < cost && !l.exhausted {
+		n := max(b.batchSize(policy.Limit), cost-l.available)
+		shared := policy
+		shared.Limit += int(float64(policy.Limit) * b.opts.Overshoot)
+		// A batch too small for the request is of no use
+		shared.Cost = cost - l.available
+
+		r, err := rl.storage.Reserve(ctx, key, shared, n, now)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reserve quota: %w", err)
+		}
+		rl.observeReserved(r.Granted)
+
+		if r.Blocked {
+			l.block(now, r.ResetAfter)
+			return &storage.Decision{Blocked: true, ResetAfter: r.ResetAfter}, nil
+		}
+		l.beyond += overshoot(policy.Limit, shared.Limit-r.Remaining, r.Granted)
+		l.available += r.Granted
+		l.remaining = r.Remaining
+		l.exhausted = r.Granted < n
+		if r.Granted == 0 && policy.BlockTime > 0 {
+			l.block(now, r.ResetAfter)
+			return &storage.Decision{ResetAfter: r.ResetAfter}, nil
+		}
+	}
+
+	if l.available < cost {
+		return &storage.Decision{ResetAfter: windowEnd.Sub(now)}, nil
+	}
+
+	// Units within the limit are served first
+	if over := cost - (l.available - l.beyond); over > 0 {
+		l.beyond -= over
+		rl.observeOvershoot(over)
+	}
+	l.available -= cost
+	return &storage.Decision{
+		Allowed:    true,
+		Remaining:  min(policy.Limit, l.available+l.remaining),
+		ResetAfter: windowEnd.Sub(now),
+	}, nil
+}
+
+// batchSize is the number of units reserved at once, at least one
+func (b *batcher) batchSize(limit int) int {
+	return max(1, int(math.Ceil(float64(limit)*b.opts.BatchFraction)))
+}
+
+// block serves the block of the key locally for a while
+func (l *lease) block(now time.Time, d time.Duration) {
+	l.blockedUntil = now.Add(d)
+	l.recheckAt = now.Add(min(d, blockRecheck))
+}
+
+// overshoot returns how many of the granted units, the last ones of the used
+// shared quota, are beyond limit
+func overshoot(limit, used, granted int) int {
+	return max(0, used-limit) - max(0, used-granted-limit)
+}
+
+// leaseKey names the lease of key. Tenants share the key names, each in its
+// own namespace.
+func leaseKey(ctx context.Context, key string) string {
+	return storage.Namespace(ctx) + "/" + key
+}
+
+func (b *batcher) shard(key string) *leaseShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &b.shards[h.Sum32()%leaseShards]
+}
+
+// lease returns the lease of key, dropping the leases of the shard whose
+// window ended so idle keys don't accumulate
+func (b *batcher) lease(rl *RateLimiter, key string, index int64, windowEnd, now time.Time) *lease {
+	s := b.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) >= time.Second {
+		s.lastSweep = now
+		for k, l := range s.leases {
+			// Leases in use are skipped, they'll be swept next time
+			if !l.mu.TryLock() {
+				continue
+			}
+			if !now.Before(l.end) && !now.Before(l.blockedUntil) {
+				rl.observeUnused(l.available)
+				l.dropped = true
+				delete(s.leases, k)
+			}
+			l.mu.Unlock()
+		}
+	}
+
+	l, ok := s.leases[key]
+	if !ok {
+		l = &lease{window: index, end: windowEnd}
+		s.leases[key] = l
+	}
+	return l
+}
+
+// acquire returns the lease of key locked. A lease dropped between the
+// lookup and the lock would keep the units reserved into it away from the
+// key, so it is looked up again.
+func (b *batcher) acquire(rl *RateLimiter, key string, index int64, windowEnd, now time.Time) *lease {
+	for {
+		l := b.lease(rl, key, index, windowEnd, now)
+		l.mu.Lock()
+		if !l.dropped {
+			return l
+		}
+		l.mu.Unlock()
+	}
+}
+
+// forget drops the lease of key, returning its units as unused
+func (b *batcher) forget(rl *RateLimiter, key string) {
+	s := b.shard(key)
+	s.mu.Lock()
+	l, ok := s.leases[key]
+	delete(s.leases, key)
+	s.mu.Unlock()
+
+	if ok {
+		l.mu.Lock()
+		rl.observeUnused(l.available)
+		l.available = 0
+		l.dropped = true
+		l.mu.Unlock()
+	}
+}
+
+// Forget drops what this instance holds locally about key, e.g. the batch
+// and block cached by local batching, so the next request asks the storage.
+// The admin API calls it after unblocking or resetting key.
+func (rl *RateLimiter) Forget(ctx context.Context, key string) {
+	if rl.batcher != nil {
+		rl.batcher.forget(rl, leaseKey(ctx, key))
+	}
+}
+
+func (rl *RateLimiter) observeReserved(units int) {
+	if o, ok := rl.observer.(BatchObserver); ok && units > 0 {
+		o.ObserveReserved(units)
+	}
+}
+
+func (rl *RateLimiter) observeUnused(units int) {
+	if o, ok := rl.observer.(BatchObserver); ok && units > 0 {
+		o.ObserveUnused(units)
+	}
+}
+
+func (rl *RateLimiter) observeOvershoot(units int) {
+	if o, ok := rl.observer.(BatchObserver); ok && units > 0 {
+		o.ObserveOvershoot(units)
+	}
+}
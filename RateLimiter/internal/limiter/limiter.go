@@ -2,29 +2,183 @@ package limiter
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/netip"
+	"sync"
 	"time"
 
+	"github.com/goxprts/ratelimiter/internal/apikey"
 	"github.com/goxprts/ratelimiter/internal/storage"
+	"github.com/goxprts/ratelimiter/internal/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type RateLimiter struct {
-	storage         storage.Storage
-	ipRateLimit     int
-	ipBlockTime     time.Duration
-	tokenRateLimits map[string]TokenConfig
+	storage  storage.Storage
+	mu       sync.RWMutex
+	limits   Limits
+	observer Observer
+	batcher  *batcher
+	tracer   trace.Tracer
+	now      func() time.Time
+}
+
+const tracerName = "github.com/goxprts/ratelimiter/internal/limiter"
+
+// Key types reported in LimitResult.KeyType
+const (
+	KeyTypeIP    = "ip"
+	KeyTypeToken = "token"
+	KeyTypeRule  = "rule"
+)
+
+// Observer is notified of every decision taken by a RateLimiter
+type Observer interface {
+	ObserveDecision(keyType string, allowed bool)
+}
+
+// DryRunObserver is implemented by observers that also count the requests
+// a dry run limit would have denied. Those are not reported to
+// ObserveDecision.
+type DryRunObserver interface {
+	ObserveWouldBlock(keyType string)
+}
+
+// Limits holds the limits applied by a RateLimiter
+type Limits struct {
+	IP     TokenConfig
+	Tokens map[string]TokenConfig
+	// Plans holds the limits of the plans registered API keys are issued on
+	Plans map[string]TokenConfig
+	// Tenants replace the IP limit for the requests of a tenant, set on the
+	// context with storage.WithNamespace. The storage must be a
+	// NamespacedStorage for tenants to be counted apart.
+	Tenants map[string]TokenConfig
+	// CIDRs override the IP limit for addresses in their range. The longest
+	// matching prefix wins.
+	CIDRs []CIDRLimit
+	// Penalty lengthens the blocks of keys that keep exceeding their limits
+	Penalty Penalty
+}
+
+// Penalty makes blocks progressive. Each violation within Lookback after the
+// end of the previous block multiplies BlockTime by Factor, up to MaxBlockTime.
+// The zero value keeps blocks fixed. Limits served from local batches are
+// not affected.
+type Penalty struct {
+	Factor       float64
+	Lookback     time.Duration
+	MaxBlockTime time.Duration
+}
+
+// CIDRLimit applies Limit to every IP in Prefix, counted per IP
+type CIDRLimit struct {
+	Prefix netip.Prefix
+	Limit  TokenConfig
 }
 
 type TokenConfig struct {
 	RPS       int
 	BlockTime time.Duration
+	// Algorithm defaults to FixedWindow when empty
+	Algorithm Algorithm
+	// Burst is the token bucket capacity, defaulting to RPS
+	Burst int
+	// Plan names the plan the limits come from, if any
+	Plan string
+	// Quotas are evaluated together with RPS, shortest window first
+	Quotas []Quota
+	// DryRun counts keys as usual but never blocks them or records
+	// violations, and allows the requests that would have been denied,
+	// flagging them with LimitResult.WouldBlock
+	DryRun bool
+}
+
+// Capacity is the largest cost a single request can be allowed: the bucket
+// capacity for the token bucket, RPS otherwise
+func (c TokenConfig) Capacity() int {
+	if c.Algorithm == TokenBucket && c.Burst > 0 {
+		return c.Burst
+	}
+	return c.RPS
+}
+
+// ErrCostExceedsLimit is returned for requests costing more than the limit or
+// a quota they are checked against, which could never be allowed
+var ErrCostExceedsLimit = errors.New("request cost exceeds the limit")
+
+// checkCost rejects a cost cfg can never allow
+func (c TokenConfig) checkCost(cost int) error {
+	if limit := c.Capacity(); limit > 0 && cost > limit {
+		return fmt.Errorf("%w: cost %d, limit %d", ErrCostExceedsLimit, cost, limit)
+	}
+	for _, q := range c.Quotas {
+		if q.Limit > 0 && cost > q.Limit {
+			return fmt.Errorf("%w: cost %d, %s quota %d", ErrCostExceedsLimit, cost, q.Name, q.Limit)
+		}
+	}
+	return nil
 }
 
 type LimitResult struct {
-	Allowed   bool
+	Allowed bool
+	// KeyType is the kind of key the request was counted under
+	KeyType string
+	// Limit is the number of requests allowed per window, or the bucket
+	// capacity for the token bucket
+	Limit     int
 	Remaining int
 	ResetTime time.Time
 	Message   string
+	// PenaltyLevel is the number of recent violations of the key, including
+	// the one behind the current block. Zero when penalties are disabled.
+	PenaltyLevel int
+	// WouldBlock is set on requests allowed only because the limit is a
+	// dry run
+	WouldBlock bool
+}
+
+// Option configures optional RateLimiter behavior
+type Option func(*RateLimiter)
+
+// WithIPAlgorithm sets the algorithm and burst used for IP-based limits
+func WithIPAlgorithm(algorithm Algorithm, burst int) Option {
+	return func(rl *RateLimiter) {
+		rl.limits.IP.Algorithm = algorithm
+		rl.limits.IP.Burst = burst
+	}
+}
+
+// WithObserver reports every decision to o
+func WithObserver(o Observer) Option {
+	return func(rl *RateLimiter) {
+		rl.observer = o
+	}
+}
+
+// WithTracerProvider records the spans of limiter decisions with provider
+// instead of the global one
+func WithTracerProvider(provider trace.TracerProvider) Option {
+	return func(rl *RateLimiter) {
+		rl.tracer = provider.Tracer(tracerName)
+	}
+}
+
+// WithPenalty makes blocks grow for keys that keep exceeding their limits
+func WithPenalty(p Penalty) Option {
+	return func(rl *RateLimiter) {
+		rl.limits.Penalty = p
+	}
+}
+
+// WithCIDRLimits overrides the IP limit for the given ranges
+func WithCIDRLimits(cidrs []CIDRLimit) Option {
+	return func(rl *RateLimiter) {
+		rl.limits.CIDRs = cidrs
+	}
 }
 
 func NewRateLimiter(
@@ -32,82 +186,244 @@ func NewRateLimiter(
 	ipRateLimit int,
 	ipBlockTime int,
 	tokenLimits map[string]TokenConfig,
+	opts ...Option,
 ) *RateLimiter {
-	return &RateLimiter{
-		storage:         store,
-		ipRateLimit:     ipRateLimit,
-		ipBlockTime:     time.Duration(ipBlockTime) * time.Second,
-		tokenRateLimits: tokenLimits,
+	rl := &RateLimiter{
+		storage: store,
+		limits: Limits{
+			IP: TokenConfig{
+				RPS:       ipRateLimit,
+				BlockTime: time.Duration(ipBlockTime) * time.Second,
+				Algorithm: FixedWindow,
+			},
+			Tokens: tokenLimits,
+		},
+		tracer: otel.Tracer(tracerName),
+		now:    time.Now,
 	}
+	for _, opt := range opts {
+		opt(rl)
+	}
+	return rl
+}
+
+// SetLimits replaces the limits applied to subsequent requests
+func (rl *RateLimiter) SetLimits(limits Limits) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.limits = limits
+}
+
+// Limits returns the limits currently applied
+func (rl *RateLimiter) Limits() Limits {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	return rl.limits
 }
 
 // Allow checks if a request is allowed based on IP or token
 func (rl *RateLimiter) Allow(ctx context.Context, ip string, token string) (*LimitResult, error) {
-	// Check if token is provided and has specific limits
+	return rl.AllowN(ctx, ip, token, 1)
+}
+
+// AllowN is Allow for a request costing n units of the limit, e.g. an
+// expensive endpoint. Costs below one count as one; costs the limit can
+// never allow fail with ErrCostExceedsLimit.
+func (rl *RateLimiter) AllowN(ctx context.Context, ip string, token string, n int) (*LimitResult, error) {
+	limits := rl.Limits()
+
+	// Check if token is provided and has specific limits. Like registered
+	// keys, it is counted under its ID.
 	if token != "" {
-		if tokenConfig, exists := rl.tokenRateLimits[token]; exists {
-			return rl.checkLimit(ctx, fmt.Sprintf("token:%s", token), tokenConfig.RPS, tokenConfig.BlockTime)
+		if tokenConfig, exists := limits.Tokens[token]; exists {
+			return rl.checkLimit(ctx, KeyTypeToken, fmt.Sprintf("token:%s", apikey.ID(token)), tokenConfig, n)
 		}
 	}
 
 	// Fall back to IP-based limiting
-	return rl.checkLimit(ctx, fmt.Sprintf("ip:%s", ip), rl.ipRateLimit, rl.ipBlockTime)
+	return rl.checkLimit(ctx, KeyTypeIP, fmt.Sprintf("ip:%s", ip), limits.ipLimit(ctx, ip), n)
 }
 
-func (rl *RateLimiter) checkLimit(ctx context.Context, key string, limit int, blockTime time.Duration) (*LimitResult, error) {
-	// Check if the key is currently blocked
-	blocked, err := rl.storage.IsBlocked(ctx, key)
-	if err != nil {
-		return nil, fmt.Errorf("failed to check if key is blocked: %w", err)
+// AllowKeyN checks a request made with a registered API key against the
+// limits of its plan, counting it under the key ID so the key itself never
+// reaches the storage. Keys on a plan without limits are counted by IP.
+func (rl *RateLimiter) AllowKeyN(ctx context.Context, ip string, id string, plan string, n int) (*LimitResult, error) {
+	limits := rl.Limits()
+	if planConfig, exists := limits.Plans[plan]; exists {
+		return rl.checkLimit(ctx, KeyTypeToken, fmt.Sprintf("token:%s", id), planConfig, n)
 	}
+	return rl.checkLimit(ctx, KeyTypeIP, fmt.Sprintf("ip:%s", ip), limits.ipLimit(ctx, ip), n)
+}
 
-	if blocked {
-		return &LimitResult{
-			Allowed:   false,
-			Remaining: 0,
-			ResetTime: time.Now().Add(blockTime),
-			Message:   "you have reached the maximum number of requests or actions allowed within a certain time frame",
-		}, nil
+// ipLimit returns the limit of the most specific CIDR containing ip, or the
+// IP limit of the tenant of ctx, or the default IP limit. ip may also be an
+// aggregated IPv6 prefix.
+func (l Limits) ipLimit(ctx context.Context, ip string) TokenConfig {
+	base := l.IP
+	if tenant, ok := l.Tenants[storage.Namespace(ctx)]; ok {
+		base = tenant
 	}
 
-	// Increment the counter
-	count, err := rl.storage.Increment(ctx, key)
+	addr, err := netip.ParseAddr(ip)
 	if err != nil {
-		return nil, fmt.Errorf("failed to increment counter: %w", err)
+		prefix, err := netip.ParsePrefix(ip)
+		if err != nil {
+			return base
+		}
+		addr = prefix.Addr()
 	}
+	addr = addr.Unmap()
 
-	// If this is the first request, set expiration to 1 second
-	if count == 1 {
-		if err := rl.storage.SetExpiration(ctx, key, time.Second); err != nil {
-			return nil, fmt.Errorf("failed to set expiration: %w", err)
+	limit, bits := base, -1
+	for _, cidr := range l.CIDRs {
+		if cidr.Prefix.Bits() > bits && cidr.Prefix.Contains(addr) {
+			limit, bits = cidr.Limit, cidr.Prefix.Bits()
 		}
 	}
+	return limit
+}
+
+// AllowRule checks a request against a named rule, counting it under identity
+func (rl *RateLimiter) AllowRule(ctx context.Context, rule string, identity string, cfg TokenConfig) (*LimitResult, error) {
+	return rl.AllowRuleN(ctx, rule, identity, cfg, 1)
+}
 
-	// Check if limit is exceeded
-	if count > int64(limit) {
-		// Block the key
-		if err := rl.storage.Block(ctx, key, blockTime); err != nil {
-			return nil, fmt.Errorf("failed to block key: %w", err)
+// AllowRuleN is AllowRule for a request costing n units of the limit
+func (rl *RateLimiter) AllowRuleN(ctx context.Context, rule string, identity string, cfg TokenConfig, n int) (*LimitResult, error) {
+	return rl.checkLimit(ctx, KeyTypeRule, ruleKey(rule, identity), cfg, n)
+}
+
+// BlockRule denies identity under a named rule for d, on every instance
+// sharing the storage
+func (rl *RateLimiter) BlockRule(ctx context.Context, rule string, identity string, d time.Duration) error {
+	return rl.storage.Block(ctx, ruleKey(rule, identity), d)
+}
+
+// RuleBlocked reports whether identity is denied under a named rule, e.g.
+// by BlockRule on another instance
+func (rl *RateLimiter) RuleBlocked(ctx context.Context, rule string, identity string) (bool, error) {
+	return rl.storage.IsBlocked(ctx, ruleKey(rule, identity))
+}
+
+func ruleKey(rule, identity string) string {
+	return fmt.Sprintf("rule:%s:%s", rule, identity)
+}
+
+// checkLimit decides on a request counted under key, recording the decision
+// in a span
+func (rl *RateLimiter) checkLimit(ctx context.Context, keyType string, key string, cfg TokenConfig, cost int) (*LimitResult, error) {
+	cost = max(1, cost)
+	ctx, span := rl.tracer.Start(ctx, "ratelimiter.check", trace.WithAttributes(
+		tracing.KeyType.String(keyType),
+		tracing.Cost.Int(cost),
+	))
+	defer span.End()
+
+	result, err := rl.decide(ctx, keyType, key, cfg, cost)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	span.SetAttributes(
+		tracing.Allowed.Bool(result.Allowed),
+		tracing.Remaining.Int(result.Remaining),
+		tracing.Limit.Int(result.Limit),
+	)
+	if result.WouldBlock {
+		span.SetAttributes(tracing.WouldBlock.Bool(true))
+	}
+	return result, nil
+}
+
+func (rl *RateLimiter) decide(ctx context.Context, keyType string, key string, cfg TokenConfig, cost int) (*LimitResult, error) {
+	if err := cfg.checkCost(cost); err != nil {
+		return nil, err
+	}
+
+	now := rl.now()
+	penalty := rl.Limits().Penalty
+
+	policy := storage.Policy{
+		Algorithm:       string(cfg.Algorithm),
+		Limit:           cfg.RPS,
+		Burst:           cfg.Burst,
+		Window:          window,
+		BlockTime:       cfg.BlockTime,
+		PenaltyFactor:   penalty.Factor,
+		PenaltyLookback: penalty.Lookback,
+		MaxBlockTime:    penalty.MaxBlockTime,
+		Cost:            cost,
+	}
+	// A dry run must leave no trace an enforced limit would act on
+	if cfg.DryRun {
+		policy.BlockTime = 0
+	}
+
+	// Check, count and block in a single storage operation, or locally from
+	// a reserved batch
+	var d *storage.Decision
+	var err error
+	if rl.batcher != nil && (cfg.Algorithm == FixedWindow || cfg.Algorithm == "") {
+		d, err = rl.batcher.evaluate(ctx, rl, key, policy, now)
+	} else {
+		d, err = rl.storage.Evaluate(ctx, key, policy, now)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to evaluate limit: %w", err)
+	}
+
+	limit := cfg.Capacity()
+
+	// Report whichever quota is closest to running out
+	if d.Allowed && len(cfg.Quotas) > 0 {
+		quotaLimit, qd, err := rl.checkQuotas(ctx, key, cfg.Quotas, cost, now)
+		if err != nil {
+			return nil, err
 		}
+		if !qd.Allowed || qd.Remaining < d.Remaining {
+			limit, d = quotaLimit, qd
+		}
+	}
 
-		// Reset the counter
-		if err := rl.storage.Reset(ctx, key); err != nil {
-			return nil, fmt.Errorf("failed to reset counter: %w", err)
+	if !d.Allowed && cfg.DryRun {
+		if o, ok := rl.observer.(DryRunObserver); ok {
+			o.ObserveWouldBlock(keyType)
 		}
+		return &LimitResult{
+			Allowed:      true,
+			KeyType:      keyType,
+			Limit:        limit,
+			Remaining:    0,
+			ResetTime:    now.Add(d.ResetAfter),
+			PenaltyLevel: d.PenaltyLevel,
+			WouldBlock:   true,
+		}, nil
+	}
+
+	if rl.observer != nil {
+		rl.observer.ObserveDecision(keyType, d.Allowed)
+	}
 
+	if !d.Allowed {
 		return &LimitResult{
-			Allowed:   false,
-			Remaining: 0,
-			ResetTime: time.Now().Add(blockTime),
-			Message:   "you have reached the maximum number of requests or actions allowed within a certain time frame",
+			Allowed:      false,
+			KeyType:      keyType,
+			Limit:        limit,
+			Remaining:    0,
+			ResetTime:    now.Add(d.ResetAfter),
+			Message:      "you have reached the maximum number of requests or actions allowed within a certain time frame",
+			PenaltyLevel: d.PenaltyLevel,
 		}, nil
 	}
 
-	remaining := limit - int(count)
 	return &LimitResult{
-		Allowed:   true,
-		Remaining: remaining,
-		ResetTime: time.Now().Add(time.Second),
-		Message:   "",
+		Allowed:      true,
+		KeyType:      keyType,
+		Limit:        limit,
+		Remaining:    d.Remaining,
+		ResetTime:    now.Add(d.ResetAfter),
+		Message:      "",
+		PenaltyLevel: d.PenaltyLevel,
 	}, nil
 }
@@ -2,63 +2,30 @@ package limiter
 
 import (
 	"context"
+	"net/netip"
 	"testing"
 	"time"
 
+	"github.com/goxprts/ratelimiter/internal/apikey"
+	"github.com/goxprts/ratelimiter/internal/storage"
+	"github.com/goxprts/ratelimiter/internal/tracing"
 	"github.com/stretchr/testify/assert"
-	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
-// MockStorage is a mock implementation of storage.Storage
-type MockStorage struct {
-	mock.Mock
-	counters map[string]int64
-	blocked  map[string]bool
-}
-
-func NewMockStorage() *MockStorage {
-	return &MockStorage{
-		counters: make(map[string]int64),
-		blocked:  make(map[string]bool),
-	}
-}
-
-func (m *MockStorage) Increment(ctx context.Context, key string) (int64, error) {
-	m.counters[key]++
-	return m.counters[key], nil
-}
-
-func (m *MockStorage) Get(ctx context.Context, key string) (int64, error) {
-	return m.counters[key], nil
-}
-
-func (m *MockStorage) SetExpiration(ctx context.Context, key string, expiration time.Duration) error {
-	return nil
-}
-
-func (m *MockStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
-	return m.blocked[key], nil
-}
-
-func (m *MockStorage) Block(ctx context.Context, key string, duration time.Duration) error {
-	m.blocked[key] = true
-	return nil
-}
-
-func (m *MockStorage) Reset(ctx context.Context, key string) error {
-	m.counters[key] = 0
-	return nil
-}
-
-func (m *MockStorage) Close() error {
-	return nil
+func newTestStorage(t *testing.T) *storage.MemoryStorage {
+	store := storage.NewMemoryStorage(storage.MemoryOptions{})
+	t.Cleanup(func() { store.Close() })
+	return store
 }
 
 func TestRateLimiter_Allow_IPLimit(t *testing.T) {
-	storage := NewMockStorage()
+	store := newTestStorage(t)
 	tokenLimits := make(map[string]TokenConfig)
 
-	limiter := NewRateLimiter(storage, 5, 300, tokenLimits)
+	limiter := NewRateLimiter(store, 5, 300, tokenLimits)
 
 	ctx := context.Background()
 	ip := "192.168.1.1"
@@ -68,6 +35,7 @@ func TestRateLimiter_Allow_IPLimit(t *testing.T) {
 		result, err := limiter.Allow(ctx, ip, "")
 		assert.NoError(t, err)
 		assert.True(t, result.Allowed)
+		assert.Equal(t, 5, result.Limit)
 		assert.Equal(t, 5-i-1, result.Remaining)
 	}
 
@@ -84,7 +52,7 @@ func TestRateLimiter_Allow_IPLimit(t *testing.T) {
 }
 
 func TestRateLimiter_Allow_TokenLimit(t *testing.T) {
-	storage := NewMockStorage()
+	store := newTestStorage(t)
 	tokenLimits := map[string]TokenConfig{
 		"abc123": {
 			RPS:       10,
@@ -92,7 +60,7 @@ func TestRateLimiter_Allow_TokenLimit(t *testing.T) {
 		},
 	}
 
-	limiter := NewRateLimiter(storage, 5, 300, tokenLimits)
+	limiter := NewRateLimiter(store, 5, 300, tokenLimits)
 
 	ctx := context.Background()
 	ip := "192.168.1.1"
@@ -110,10 +78,21 @@ func TestRateLimiter_Allow_TokenLimit(t *testing.T) {
 	result, err := limiter.Allow(ctx, ip, token)
 	assert.NoError(t, err)
 	assert.False(t, result.Allowed)
+
+	// The token is counted under its ID, never stored itself
+	entries, err := store.Scan(ctx, "")
+	require.NoError(t, err)
+	require.NotEmpty(t, entries)
+	for _, e := range entries {
+		assert.NotContains(t, e.Key, token)
+	}
+	blocked, err := store.IsBlocked(ctx, "token:"+apikey.ID(token))
+	require.NoError(t, err)
+	assert.True(t, blocked)
 }
 
 func TestRateLimiter_Allow_TokenOverridesIP(t *testing.T) {
-	storage := NewMockStorage()
+	store := newTestStorage(t)
 	tokenLimits := map[string]TokenConfig{
 		"xyz789": {
 			RPS:       100,
@@ -121,7 +100,7 @@ func TestRateLimiter_Allow_TokenOverridesIP(t *testing.T) {
 		},
 	}
 
-	limiter := NewRateLimiter(storage, 5, 300, tokenLimits)
+	limiter := NewRateLimiter(store, 5, 300, tokenLimits)
 
 	ctx := context.Background()
 	ip := "192.168.1.1"
@@ -136,10 +115,10 @@ func TestRateLimiter_Allow_TokenOverridesIP(t *testing.T) {
 }
 
 func TestRateLimiter_Allow_DifferentIPs(t *testing.T) {
-	storage := NewMockStorage()
+	store := newTestStorage(t)
 	tokenLimits := make(map[string]TokenConfig)
 
-	limiter := NewRateLimiter(storage, 5, 300, tokenLimits)
+	limiter := NewRateLimiter(store, 5, 300, tokenLimits)
 
 	ctx := context.Background()
 
@@ -156,3 +135,688 @@ func TestRateLimiter_Allow_DifferentIPs(t *testing.T) {
 	assert.True(t, result.Allowed)
 	assert.Equal(t, 4, result.Remaining)
 }
+
+func TestRateLimiter_Allow_SlidingWindowLog(t *testing.T) {
+	store := newTestStorage(t)
+	tokenLimits := map[string]TokenConfig{
+		"log": {RPS: 3, Algorithm: SlidingWindowLog},
+	}
+
+	limiter := NewRateLimiter(store, 5, 300, tokenLimits)
+	now := time.Unix(1000, 0)
+	limiter.now = func() time.Time { return now }
+
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		result, err := limiter.Allow(ctx, "192.168.1.1", "log")
+		assert.NoError(t, err)
+		assert.True(t, result.Allowed)
+		now = now.Add(400 * time.Millisecond)
+	}
+
+	// The first request has left the window, so one more fits in
+	result, err := limiter.Allow(ctx, "192.168.1.1", "log")
+	assert.NoError(t, err)
+	assert.True(t, result.Allowed)
+
+	result, err = limiter.Allow(ctx, "192.168.1.1", "log")
+	assert.NoError(t, err)
+	assert.False(t, result.Allowed)
+}
+
+func TestRateLimiter_Allow_SlidingWindowCounter(t *testing.T) {
+	store := newTestStorage(t)
+	tokenLimits := map[string]TokenConfig{
+		"counter": {RPS: 4, Algorithm: SlidingWindowCounter},
+	}
+
+	limiter := NewRateLimiter(store, 5, 300, tokenLimits)
+	now := time.Unix(1000, 900*int64(time.Millisecond))
+	limiter.now = func() time.Time { return now }
+
+	ctx := context.Background()
+
+	// Use the whole limit at the end of a window
+	for i := 0; i < 4; i++ {
+		result, err := limiter.Allow(ctx, "192.168.1.1", "counter")
+		assert.NoError(t, err)
+		assert.True(t, result.Allowed)
+	}
+
+	// Right after the boundary the previous window still counts almost fully,
+	// which prevents the 2x burst allowed by fixed windows
+	now = time.Unix(1001, 100*int64(time.Millisecond))
+	result, err := limiter.Allow(ctx, "192.168.1.1", "counter")
+	assert.NoError(t, err)
+	assert.False(t, result.Allowed)
+}
+
+func TestRateLimiter_Allow_TokenBucket(t *testing.T) {
+	store := newTestStorage(t)
+	limiter := NewRateLimiter(store, 2, 0, map[string]TokenConfig{}, WithIPAlgorithm(TokenBucket, 4))
+	now := time.Unix(1000, 0)
+	limiter.now = func() time.Time { return now }
+
+	ctx := context.Background()
+
+	// The burst allows 4 requests at once
+	for i := 0; i < 4; i++ {
+		result, err := limiter.Allow(ctx, "192.168.1.1", "")
+		assert.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, 4, result.Limit)
+		assert.Equal(t, 4-i-1, result.Remaining)
+	}
+
+	result, err := limiter.Allow(ctx, "192.168.1.1", "")
+	assert.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, now.Add(500*time.Millisecond), result.ResetTime)
+
+	// Tokens refill at 2 per second
+	now = now.Add(time.Second)
+	for i := 0; i < 2; i++ {
+		result, err = limiter.Allow(ctx, "192.168.1.1", "")
+		assert.NoError(t, err)
+		assert.True(t, result.Allowed)
+	}
+
+	result, err = limiter.Allow(ctx, "192.168.1.1", "")
+	assert.NoError(t, err)
+	assert.False(t, result.Allowed)
+}
+
+func TestParseAlgorithm(t *testing.T) {
+	algorithm, err := ParseAlgorithm("")
+	assert.NoError(t, err)
+	assert.Equal(t, FixedWindow, algorithm)
+
+	algorithm, err = ParseAlgorithm("Token_Bucket")
+	assert.NoError(t, err)
+	assert.Equal(t, TokenBucket, algorithm)
+
+	_, err = ParseAlgorithm("leaky")
+	assert.Error(t, err)
+}
+
+func TestRateLimiter_Allow_CIDRLimits(t *testing.T) {
+	store := newTestStorage(t)
+	limiter := NewRateLimiter(store, 1, 300, map[string]TokenConfig{}, WithCIDRLimits([]CIDRLimit{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Limit: TokenConfig{RPS: 3}},
+		{Prefix: netip.MustParsePrefix("10.1.0.0/16"), Limit: TokenConfig{RPS: 2}},
+	}))
+
+	ctx := context.Background()
+	allowed := func(ip string) int {
+		count := 0
+		for i := 0; i < 5; i++ {
+			result, err := limiter.Allow(ctx, ip, "")
+			assert.NoError(t, err)
+			if result.Allowed {
+				count++
+			}
+		}
+		return count
+	}
+
+	assert.Equal(t, 3, allowed("10.2.0.1"))
+	assert.Equal(t, 2, allowed("10.1.0.1"))
+	assert.Equal(t, 1, allowed("192.168.1.1"))
+}
+
+func TestRateLimiter_SetLimits(t *testing.T) {
+	store := newTestStorage(t)
+	limiter := NewRateLimiter(store, 5, 300, map[string]TokenConfig{})
+
+	limiter.SetLimits(Limits{
+		IP:     TokenConfig{RPS: 1},
+		Tokens: map[string]TokenConfig{"new": {RPS: 10}},
+	})
+
+	ctx := context.Background()
+	result, err := limiter.Allow(ctx, "192.168.1.1", "new")
+	assert.NoError(t, err)
+	assert.Equal(t, 9, result.Remaining)
+
+	result, err = limiter.Allow(ctx, "192.168.1.1", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, result.Remaining)
+}
+
+// countingStorage counts the reservations reaching the shared storage
+type countingStorage struct {
+	*storage.MemoryStorage
+	reserves int
+}
+
+func (s *countingStorage) Reserve(ctx context.Context, key string, policy storage.Policy, n int, now time.Time) (*storage.Reservation, error) {
+	s.reserves++
+	return s.MemoryStorage.Reserve(ctx, key, policy, n, now)
+}
+
+type batchCounter struct {
+	reserved, unused, overshoot int
+}
+
+func (c *batchCounter) ObserveDecision(keyType string, allowed bool) {}
+func (c *batchCounter) ObserveReserved(units int)                    { c.reserved += units }
+func (c *batchCounter) ObserveUnused(units int)                      { c.unused += units }
+func (c *batchCounter) ObserveOvershoot(units int)                   { c.overshoot += units }
+
+func TestRateLimiter_LocalBatching(t *testing.T) {
+	store := &countingStorage{MemoryStorage: newTestStorage(t)}
+	counter := &batchCounter{}
+	limiter := NewRateLimiter(store, 10, 0, map[string]TokenConfig{},
+		WithLocalBatching(BatchOptions{BatchFraction: 0.5}),
+		WithObserver(counter),
+	)
+	now := time.Unix(1000, 0)
+	limiter.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for i := 0; i < 10; i++ {
+		result, err := limiter.Allow(ctx, "192.168.1.1", "")
+		assert.NoError(t, err)
+		assert.True(t, result.Allowed, "request %d", i+1)
+	}
+	result, err := limiter.Allow(ctx, "192.168.1.1", "")
+	assert.NoError(t, err)
+	assert.False(t, result.Allowed)
+
+	// Two batches of 5 and one empty reservation instead of 11 evaluations
+	assert.Equal(t, 3, store.reserves)
+	assert.Equal(t, 10, counter.reserved)
+
+	// The next window starts a fresh batch
+	now = now.Add(time.Second)
+	result, err = limiter.Allow(ctx, "192.168.1.1", "")
+	assert.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 4, store.reserves)
+}
+
+func TestRateLimiter_AllowN(t *testing.T) {
+	store := newTestStorage(t)
+	limiter := NewRateLimiter(store, 10, 0, map[string]TokenConfig{
+		"abc123": {RPS: 100, Quotas: []Quota{{Name: "minute", Limit: 25, Window: time.Minute}}},
+	})
+	ctx := context.Background()
+
+	for _, remaining := range []int{6, 2} {
+		result, err := limiter.AllowN(ctx, "192.168.1.1", "", 4)
+		assert.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, remaining, result.Remaining)
+	}
+	result, err := limiter.AllowN(ctx, "192.168.1.1", "", 4)
+	assert.NoError(t, err)
+	assert.False(t, result.Allowed)
+
+	// The cost is taken from quotas as well
+	for _, remaining := range []int{15, 5} {
+		result, err = limiter.AllowN(ctx, "192.168.1.1", "abc123", 10)
+		assert.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, remaining, result.Remaining)
+	}
+	result, err = limiter.AllowN(ctx, "192.168.1.1", "abc123", 10)
+	assert.NoError(t, err)
+	assert.False(t, result.Allowed)
+
+	// Costs no limit or quota could ever allow are errors
+	_, err = limiter.AllowN(ctx, "192.168.1.2", "", 11)
+	assert.ErrorIs(t, err, ErrCostExceedsLimit)
+	_, err = limiter.AllowN(ctx, "192.168.1.2", "abc123", 30)
+	assert.ErrorIs(t, err, ErrCostExceedsLimit)
+}
+
+type wouldBlockCounter struct {
+	denied, wouldBlock int
+}
+
+func (c *wouldBlockCounter) ObserveDecision(keyType string, allowed bool) {
+	if !allowed {
+		c.denied++
+	}
+}
+func (c *wouldBlockCounter) ObserveWouldBlock(keyType string) { c.wouldBlock++ }
+
+func TestRateLimiter_AllowRule_DryRun(t *testing.T) {
+	store := newTestStorage(t)
+	counter := &wouldBlockCounter{}
+	limiter := NewRateLimiter(store, 10, 0, map[string]TokenConfig{}, WithObserver(counter))
+	ctx := context.Background()
+	cfg := TokenConfig{RPS: 2, BlockTime: time.Minute, DryRun: true}
+
+	for i := 0; i < 2; i++ {
+		result, err := limiter.AllowRule(ctx, "search", "192.168.1.1", cfg)
+		assert.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.False(t, result.WouldBlock)
+	}
+
+	// Denials are reported but the requests go through
+	for i := 0; i < 3; i++ {
+		result, err := limiter.AllowRule(ctx, "search", "192.168.1.1", cfg)
+		assert.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.True(t, result.WouldBlock)
+		assert.Equal(t, 0, result.Remaining)
+	}
+	assert.Equal(t, 3, counter.wouldBlock)
+	assert.Equal(t, 0, counter.denied)
+
+	// Nothing is blocked, so enforcing the limit later starts clean
+	blocked, err := store.ListBlocked(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, blocked)
+	violations, err := store.Scan(ctx, "violations:")
+	assert.NoError(t, err)
+	assert.Empty(t, violations)
+}
+
+func TestRateLimiter_AllowKeyN(t *testing.T) {
+	store := newTestStorage(t)
+	limiter := NewRateLimiter(store, 1, 0, map[string]TokenConfig{})
+	limiter.SetLimits(Limits{
+		IP:    TokenConfig{RPS: 1},
+		Plans: map[string]TokenConfig{"pro": {RPS: 3, Plan: "pro"}},
+	})
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		result, err := limiter.AllowKeyN(ctx, "192.168.1.1", "0123456789ab", "pro", 1)
+		assert.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, KeyTypeToken, result.KeyType)
+	}
+	result, err := limiter.AllowKeyN(ctx, "192.168.1.1", "0123456789ab", "pro", 1)
+	assert.NoError(t, err)
+	assert.False(t, result.Allowed)
+
+	// Counted under the key ID
+	entries, err := store.Scan(ctx, storage.HashTag("token:0123456789ab"))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, entries)
+
+	// Plans without limits fall back to the IP limit
+	result, err = limiter.AllowKeyN(ctx, "192.168.1.1", "ba9876543210", "unknown", 1)
+	assert.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, KeyTypeIP, result.KeyType)
+}
+
+func TestRateLimiter_Tenants(t *testing.T) {
+	store := storage.NewNamespacedStorage(newTestStorage(t), "")
+	limiter := NewRateLimiter(store, 1, 0, map[string]TokenConfig{})
+	limits := limiter.Limits()
+	limits.Tenants = map[string]TokenConfig{"acme": {RPS: 3}}
+	limiter.SetLimits(limits)
+
+	acme := storage.WithNamespace(context.Background(), "acme")
+	globex := storage.WithNamespace(context.Background(), "globex")
+
+	// Tenants get their own default limit and counters
+	for i := 0; i < 3; i++ {
+		result, err := limiter.Allow(acme, "192.168.1.1", "")
+		assert.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, 3, result.Limit)
+	}
+	result, err := limiter.Allow(acme, "192.168.1.1", "")
+	assert.NoError(t, err)
+	assert.False(t, result.Allowed)
+
+	// Unknown tenants keep the default limit, in their own namespace
+	result, err = limiter.Allow(globex, "192.168.1.1", "")
+	assert.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 1, result.Limit)
+	result, err = limiter.Allow(context.Background(), "192.168.1.1", "")
+	assert.NoError(t, err)
+	assert.True(t, result.Allowed)
+}
+
+func TestRateLimiter_BlockRule(t *testing.T) {
+	store := newTestStorage(t)
+	limiter := NewRateLimiter(store, 10, 0, map[string]TokenConfig{})
+	ctx := context.Background()
+	cfg := TokenConfig{RPS: 10}
+
+	assert.NoError(t, limiter.BlockRule(ctx, "outbound", "api.example.com", 50*time.Millisecond))
+
+	result, err := limiter.AllowRule(ctx, "outbound", "api.example.com", cfg)
+	assert.NoError(t, err)
+	assert.False(t, result.Allowed)
+
+	// Other identities of the rule are not affected
+	result, err = limiter.AllowRule(ctx, "outbound", "other.example.com", cfg)
+	assert.NoError(t, err)
+	assert.True(t, result.Allowed)
+
+	time.Sleep(100 * time.Millisecond)
+	result, err = limiter.AllowRule(ctx, "outbound", "api.example.com", cfg)
+	assert.NoError(t, err)
+	assert.True(t, result.Allowed)
+}
+
+func TestRateLimiter_LocalBatching_Cost(t *testing.T) {
+	store := &countingStorage{MemoryStorage: newTestStorage(t)}
+	limiter := NewRateLimiter(store, 10, 0, map[string]TokenConfig{},
+		WithLocalBatching(BatchOptions{BatchFraction: 0.2}),
+	)
+	limiter.now = func() time.Time { return time.Unix(1000, 0) }
+	ctx := context.Background()
+
+	// A cost above the batch size reserves what it needs
+	result, err := limiter.AllowN(ctx, "192.168.1.1", "", 5)
+	assert.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 1, store.reserves)
+
+	result, err = limiter.AllowN(ctx, "192.168.1.1", "", 5)
+	assert.NoError(t, err)
+	assert.True(t, result.Allowed)
+
+	result, err = limiter.AllowN(ctx, "192.168.1.1", "", 1)
+	assert.NoError(t, err)
+	assert.False(t, result.Allowed)
+}
+
+func TestRateLimiter_LocalBatching_SharedQuota(t *testing.T) {
+	store := newTestStorage(t)
+	counter := &batchCounter{}
+	newInstance := func() *RateLimiter {
+		rl := NewRateLimiter(store, 10, 0, map[string]TokenConfig{},
+			WithLocalBatching(BatchOptions{BatchFraction: 0.4, Overshoot: 0.2}),
+			WithObserver(counter),
+		)
+		rl.now = func() time.Time { return time.Unix(1000, 0) }
+		return rl
+	}
+	a, b := newInstance(), newInstance()
+	ctx := context.Background()
+
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		for _, rl := range []*RateLimiter{a, b} {
+			result, err := rl.Allow(ctx, "192.168.1.1", "")
+			assert.NoError(t, err)
+			if result.Allowed {
+				allowed++
+			}
+		}
+	}
+
+	// The instances together admit the limit plus the overshoot
+	assert.Equal(t, 12, allowed)
+	assert.Equal(t, 12, counter.reserved)
+	assert.Equal(t, 2, counter.overshoot)
+}
+
+func TestRateLimiter_LocalBatching_Blocks(t *testing.T) {
+	store := newTestStorage(t)
+	limiter := NewRateLimiter(store, 2, 60, map[string]TokenConfig{},
+		WithLocalBatching(BatchOptions{BatchFraction: 1}),
+	)
+	ctx := context.Background()
+
+	limiter.Allow(ctx, "192.168.1.1", "")
+	limiter.Allow(ctx, "192.168.1.1", "")
+	result, err := limiter.Allow(ctx, "192.168.1.1", "")
+	assert.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), result.ResetTime, time.Second)
+
+	blocked, err := store.IsBlocked(ctx, "ip:192.168.1.1")
+	assert.NoError(t, err)
+	assert.True(t, blocked)
+}
+
+func TestRateLimiter_LocalBatching_Unblock(t *testing.T) {
+	store := &countingStorage{MemoryStorage: newTestStorage(t)}
+	limiter := NewRateLimiter(store, 1, 60, map[string]TokenConfig{},
+		WithLocalBatching(BatchOptions{BatchFraction: 1}),
+	)
+	now := time.Unix(1000, 0)
+	limiter.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	limiter.Allow(ctx, "192.168.1.1", "")
+	result, err := limiter.Allow(ctx, "192.168.1.1", "")
+	assert.NoError(t, err)
+	assert.False(t, result.Allowed)
+
+	// The block is served locally for a while
+	reserves := store.reserves
+	limiter.Allow(ctx, "192.168.1.1", "")
+	assert.Equal(t, reserves, store.reserves)
+
+	// and asked again soon, so a block lifted elsewhere ends here too
+	assert.NoError(t, store.Unblock(ctx, "ip:192.168.1.1"))
+	now = now.Add(blockRecheck)
+	result, err = limiter.Allow(ctx, "192.168.1.1", "")
+	assert.NoError(t, err)
+	assert.True(t, result.Allowed)
+
+	// Forget drops the local block right away
+	limiter.Allow(ctx, "192.168.1.1", "")
+	assert.NoError(t, store.Unblock(ctx, "ip:192.168.1.1"))
+	limiter.Forget(ctx, "ip:192.168.1.1")
+	result, err = limiter.Allow(ctx, "192.168.1.1", "")
+	assert.NoError(t, err)
+	assert.True(t, result.Allowed)
+}
+
+func TestRateLimiter_LocalBatching_Sweep(t *testing.T) {
+	limiter := NewRateLimiter(newTestStorage(t), 10, 0, map[string]TokenConfig{},
+		WithLocalBatching(BatchOptions{BatchFraction: 0.5}),
+	)
+	b := limiter.batcher
+	now := time.Unix(1000, 0)
+
+	// A request got the lease but has not locked it yet when the window
+	// ends and the sweep drops it
+	stale := b.lease(limiter, "/ip:192.168.1.1", 1000, now.Add(time.Second), now)
+	now = now.Add(2 * time.Second)
+	current := b.acquire(limiter, "/ip:192.168.1.1", 1002, now.Add(time.Second), now)
+	current.mu.Unlock()
+
+	assert.True(t, stale.dropped)
+	assert.NotSame(t, stale, current)
+	assert.Same(t, current, b.shard("/ip:192.168.1.1").leases["/ip:192.168.1.1"])
+
+	// so the request looks the key up again instead of reserving into it
+	l := b.acquire(limiter, "/ip:192.168.1.1", 1002, now.Add(time.Second), now)
+	l.mu.Unlock()
+	assert.Same(t, current, l)
+}
+
+func TestRateLimiter_Allow_Quotas(t *testing.T) {
+	store := newTestStorage(t)
+	limiter := NewRateLimiter(store, 5, 300, map[string]TokenConfig{
+		"abc123": {
+			RPS:       10,
+			BlockTime: time.Minute,
+			Plan:      "pro",
+			Quotas: []Quota{
+				{Name: "minute", Limit: 4, Window: time.Minute},
+				{Name: "day", Limit: 6, Window: 24 * time.Hour},
+			},
+		},
+	})
+	now := time.Date(2026, time.March, 1, 10, 0, 30, 0, time.UTC)
+	limiter.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	// The minute quota is the tightest
+	result, err := limiter.Allow(ctx, "192.168.1.1", "abc123")
+	assert.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 4, result.Limit)
+	assert.Equal(t, 3, result.Remaining)
+	assert.Equal(t, now.Add(30*time.Second), result.ResetTime)
+
+	for i := 0; i < 3; i++ {
+		result, _ = limiter.Allow(ctx, "192.168.1.1", "abc123")
+		assert.True(t, result.Allowed)
+	}
+	result, err = limiter.Allow(ctx, "192.168.1.1", "abc123")
+	assert.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, 4, result.Limit)
+	assert.Equal(t, now.Add(30*time.Second), result.ResetTime)
+
+	// Next minute the day quota runs out after two more requests
+	now = now.Add(time.Minute)
+	for i := 0; i < 2; i++ {
+		result, _ = limiter.Allow(ctx, "192.168.1.1", "abc123")
+		assert.True(t, result.Allowed)
+	}
+	assert.Equal(t, 6, result.Limit)
+	assert.Equal(t, 0, result.Remaining)
+
+	result, _ = limiter.Allow(ctx, "192.168.1.1", "abc123")
+	assert.False(t, result.Allowed)
+	assert.Equal(t, 6, result.Limit)
+	assert.Equal(t, time.Date(2026, time.March, 2, 0, 0, 0, 0, time.UTC), result.ResetTime)
+
+	// The request rejected by the day quota was given back to the minute quota
+	usage, err := limiter.Usage(ctx, "abc123")
+	assert.NoError(t, err)
+	assert.Equal(t, "pro", usage.Plan)
+	assert.Equal(t, []QuotaUsage{
+		{Name: "minute", Limit: 4, Used: 2, Remaining: 2, ResetTime: now.Add(30 * time.Second)},
+		{Name: "day", Limit: 6, Used: 6, Remaining: 0, ResetTime: time.Date(2026, time.March, 2, 0, 0, 0, 0, time.UTC)},
+	}, usage.Quotas)
+
+	_, err = limiter.Usage(ctx, "unknown")
+	assert.ErrorIs(t, err, ErrUnknownToken)
+}
+
+func TestRateLimiter_AllowN_QuotasUnchangedOnReject(t *testing.T) {
+	store := newTestStorage(t)
+	limiter := NewRateLimiter(store, 5, 0, map[string]TokenConfig{
+		"abc123": {
+			RPS: 100,
+			Quotas: []Quota{
+				{Name: "minute", Limit: 10, Window: time.Minute},
+				{Name: "hour", Limit: 5, Window: time.Hour},
+				{Name: "day", Limit: 20, Window: 24 * time.Hour},
+			},
+		},
+	})
+	now := time.Date(2026, time.March, 1, 10, 0, 30, 0, time.UTC)
+	limiter.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	result, err := limiter.AllowN(ctx, "192.168.1.1", "abc123", 3)
+	assert.NoError(t, err)
+	assert.True(t, result.Allowed)
+	before, err := limiter.Usage(ctx, "abc123")
+	assert.NoError(t, err)
+
+	// The hour quota has 2 left: the request takes nothing from any quota
+	result, err = limiter.AllowN(ctx, "192.168.1.1", "abc123", 3)
+	assert.NoError(t, err)
+	assert.False(t, result.Allowed)
+	after, err := limiter.Usage(ctx, "abc123")
+	assert.NoError(t, err)
+	assert.Equal(t, before, after)
+
+	for _, q := range after.Quotas {
+		assert.Equal(t, 3, q.Used, q.Name)
+	}
+
+	// so a cheaper request still fits
+	result, err = limiter.AllowN(ctx, "192.168.1.1", "abc123", 2)
+	assert.NoError(t, err)
+	assert.True(t, result.Allowed)
+}
+
+func TestParseQuotaWindow(t *testing.T) {
+	window, err := ParseQuotaWindow("Day")
+	assert.NoError(t, err)
+	assert.Equal(t, 24*time.Hour, window)
+
+	window, err = ParseQuotaWindow("month")
+	assert.NoError(t, err)
+	assert.Equal(t, storage.CalendarMonth, window)
+
+	_, err = ParseQuotaWindow("week")
+	assert.Error(t, err)
+}
+
+func TestRateLimiter_Allow_ProgressivePenalty(t *testing.T) {
+	store := newTestStorage(t)
+	limiter := NewRateLimiter(store, 1, 10, map[string]TokenConfig{},
+		WithPenalty(Penalty{Factor: 2, Lookback: time.Hour, MaxBlockTime: 25 * time.Second}),
+	)
+	ctx := context.Background()
+
+	for i, want := range []time.Duration{10 * time.Second, 20 * time.Second, 25 * time.Second} {
+		result, err := limiter.Allow(ctx, "192.168.1.1", "")
+		assert.NoError(t, err)
+		assert.True(t, result.Allowed)
+
+		result, err = limiter.Allow(ctx, "192.168.1.1", "")
+		assert.NoError(t, err)
+		assert.False(t, result.Allowed)
+		assert.Equal(t, i+1, result.PenaltyLevel)
+		assert.WithinDuration(t, time.Now().Add(want), result.ResetTime, time.Second)
+
+		result, err = limiter.Allow(ctx, "192.168.1.1", "")
+		assert.NoError(t, err)
+		assert.False(t, result.Allowed)
+		assert.Equal(t, i+1, result.PenaltyLevel)
+
+		// Let the block expire early, the violation stays on record
+		assert.NoError(t, store.Reset(ctx, "block:{ip:192.168.1.1}"))
+	}
+}
+
+func TestRateLimiter_Tracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	store := tracing.NewStorage(newTestStorage(t), "memory", provider)
+	rl := NewRateLimiter(store, 1, 60, map[string]TokenConfig{}, WithTracerProvider(provider))
+
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "request")
+	_, err := rl.Allow(ctx, "192.168.1.1", "")
+	require.NoError(t, err)
+	_, err = rl.Allow(ctx, "192.168.1.1", "")
+	require.NoError(t, err)
+	parent.End()
+
+	var checks []sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		switch span.Name() {
+		case "ratelimiter.check":
+			// Decisions are traced under the request
+			assert.Equal(t, parent.SpanContext().SpanID(), span.Parent().SpanID())
+			checks = append(checks, span)
+		case "memory evaluate":
+			// Storage operations under the decision
+			assert.NotEqual(t, parent.SpanContext().SpanID(), span.Parent().SpanID())
+			assert.Equal(t, parent.SpanContext().TraceID(), span.SpanContext().TraceID())
+		}
+	}
+	require.Len(t, checks, 2)
+
+	attrs := func(span sdktrace.ReadOnlySpan) map[string]any {
+		m := make(map[string]any)
+		for _, kv := range span.Attributes() {
+			m[string(kv.Key)] = kv.Value.AsInterface()
+		}
+		return m
+	}
+	assert.Equal(t, map[string]any{
+		"ratelimit.key_type":  "ip",
+		"ratelimit.cost":      int64(1),
+		"ratelimit.allowed":   true,
+		"ratelimit.remaining": int64(0),
+		"ratelimit.limit":     int64(1),
+	}, attrs(checks[0]))
+	assert.Equal(t, false, attrs(checks[1])["ratelimit.allowed"])
+}
@@ -0,0 +1,141 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/goxprts/ratelimiter/internal/apikey"
+	"github.com/goxprts/ratelimiter/internal/storage"
+)
+
+// ErrUnknownToken is returned by Usage for tokens without configured limits
+var ErrUnknownToken = errors.New("unknown token")
+
+// Quota caps the requests of a key over a longer window than the RPS limit
+type Quota struct {
+	// Name is the window name, e.g. "day"
+	Name   string
+	Limit  int
+	Window time.Duration
+}
+
+// quotaWindows are the windows a Quota may use. Months follow the calendar.
+var quotaWindows = map[string]time.Duration{
+	"second": time.Second,
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+	"month":  storage.CalendarMonth,
+}
+
+// ParseQuotaWindow returns the window of a quota named second, minute, hour,
+// day or month
+func ParseQuotaWindow(name string) (time.Duration, error) {
+	window, ok := quotaWindows[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown quota window %q", name)
+	}
+	return window, nil
+}
+
+// QuotaUsage reports how much of a quota was used in the current window
+type QuotaUsage struct {
+	Name      string
+	Limit     int
+	Used      int
+	Remaining int
+	ResetTime time.Time
+}
+
+// Usage reports the quota usage of a token
+type Usage struct {
+	Plan   string
+	Quotas []QuotaUsage
+}
+
+// Usage returns the quota usage of token without counting a request
+func (rl *RateLimiter) Usage(ctx context.Context, token string) (*Usage, error) {
+	cfg, ok := rl.Limits().Tokens[token]
+	if !ok {
+		return nil, ErrUnknownToken
+	}
+	return rl.usage(ctx, fmt.Sprintf("token:%s", apikey.ID(token)), cfg)
+}
+
+// KeyUsage returns the quota usage of a registered API key on plan
+func (rl *RateLimiter) KeyUsage(ctx context.Context, id string, plan string) (*Usage, error) {
+	cfg, ok := rl.Limits().Plans[plan]
+	if !ok {
+		return nil, ErrUnknownToken
+	}
+	return rl.usage(ctx, fmt.Sprintf("token:%s", id), cfg)
+}
+
+func (rl *RateLimiter) usage(ctx context.Context, key string, cfg TokenConfig) (*Usage, error) {
+	now := rl.now()
+	usage := &Usage{Plan: cfg.Plan, Quotas: make([]QuotaUsage, 0, len(cfg.Quotas))}
+	for _, q := range cfg.Quotas {
+		counter, resetAfter := storage.WindowKey(quotaKey(key, q), q.Window, now)
+		used, err := rl.storage.Get(ctx, counter)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get %s quota usage: %w", q.Name, err)
+		}
+		usage.Quotas = append(usage.Quotas, QuotaUsage{
+			Name:      q.Name,
+			Limit:     q.Limit,
+			Used:      int(used),
+			Remaining: max(0, q.Limit-int(used)),
+			ResetTime: now.Add(resetAfter),
+		})
+	}
+	return usage, nil
+}
+
+// releaseQuotas gives the cost of a rejected request back to quotas
+func (rl *RateLimiter) releaseQuotas(ctx context.Context, key string, quotas []Quota, cost int, now time.Time) error {
+	for _, q := range quotas {
+		counter, resetAfter := storage.WindowKey(quotaKey(key, q), q.Window, now)
+		if _, err := rl.storage.IncrementBy(ctx, counter, -int64(cost)); err != nil {
+			return fmt.Errorf("failed to release %s quota: %w", q.Name, err)
+		}
+		// The counter may have expired meanwhile, don't let it outlive the window
+		if err := rl.storage.SetExpiration(ctx, counter, resetAfter); err != nil {
+			return fmt.Errorf("failed to release %s quota: %w", q.Name, err)
+		}
+	}
+	return nil
+}
+
+func quotaKey(key string, q Quota) string {
+	return fmt.Sprintf("%s:quota:%s", key, q.Name)
+}
+
+// checkQuotas counts the cost of a request against every quota, stopping at
+// the first one without enough left. It returns the limit and decision of
+// the tightest quota. A rejected request is given back to the quotas
+// counted before the rejecting one, so it uses up none of them.
+func (rl *RateLimiter) checkQuotas(ctx context.Context, key string, quotas []Quota, cost int, now time.Time) (int, *storage.Decision, error) {
+	var limit int
+	var tightest *storage.Decision
+
+	for i, q := range quotas {
+		r, err := rl.storage.Reserve(ctx, quotaKey(key, q), storage.Policy{Limit: q.Limit, Window: q.Window, Cost: cost}, cost, now)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to count %s quota: %w", q.Name, err)
+		}
+		if r.Granted < cost {
+			if err := rl.releaseQuotas(ctx, key, quotas[:i], cost, now); err != nil {
+				return 0, nil, err
+			}
+			return q.Limit, &storage.Decision{ResetAfter: r.ResetAfter}, nil
+		}
+		if tightest == nil || r.Remaining < tightest.Remaining {
+			limit = q.Limit
+			tightest = &storage.Decision{Allowed: true, Remaining: r.Remaining, ResetAfter: r.ResetAfter}
+		}
+	}
+	return limit, tightest, nil
+}
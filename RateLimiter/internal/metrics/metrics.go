@@ -0,0 +1,166 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/goxprts/ratelimiter/internal/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// blockedScanTimeout bounds each storage scan counting the blocked keys
+const blockedScanTimeout = 2 * time.Second
+
+// DefaultBlockedRefresh is how often RefreshBlocked counts the blocked keys
+const DefaultBlockedRefresh = 15 * time.Second
+
+// Metrics collects rate limiter telemetry in its own Prometheus registry
+type Metrics struct {
+	registry       *prometheus.Registry
+	decisions      *prometheus.CounterVec
+	storageLatency *prometheus.HistogramVec
+	storageErrors  *prometheus.CounterVec
+	batchReserved  prometheus.Counter
+	batchUnused    prometheus.Counter
+	batchOvershoot prometheus.Counter
+	store          storage.Storage
+	lastBlocked    atomic.Int64
+}
+
+// New creates the limiter metrics. The number of blocked keys is counted
+// from store by RefreshBlocked, not on every scrape, since listing them scans
+// the whole keyspace.
+func New(store storage.Storage) *Metrics {
+	m := &Metrics{
+		store:    store,
+		registry: prometheus.NewRegistry(),
+		decisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ratelimiter_decisions_total",
+			Help: "Rate limit decisions by key type and result.",
+		}, []string{"key_type", "result"}),
+		storageLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ratelimiter_storage_operation_duration_seconds",
+			Help:    "Latency of storage operations.",
+			Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}, []string{"operation"}),
+		storageErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ratelimiter_storage_errors_total",
+			Help: "Failed storage operations.",
+		}, []string{"operation"}),
+		batchReserved: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ratelimiter_batch_reserved_units_total",
+			Help: "Quota units reserved from the storage by local batching.",
+		}),
+		batchUnused: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ratelimiter_batch_unused_units_total",
+			Help: "Reserved quota units that expired without being served.",
+		}),
+		batchOvershoot: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ratelimiter_batch_overshoot_units_total",
+			Help: "Quota units admitted beyond the limit, out of the batching overshoot.",
+		}),
+	}
+
+	blocked := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ratelimiter_blocked_keys",
+		Help: "Keys currently blocked.",
+	}, func() float64 {
+		return float64(m.lastBlocked.Load())
+	})
+
+	m.registry.MustRegister(
+		m.decisions,
+		m.storageLatency,
+		m.storageErrors,
+		m.batchReserved,
+		m.batchUnused,
+		m.batchOvershoot,
+		blocked,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// RefreshBlocked counts the blocked keys right away and then every period
+// until ctx is done
+func (m *Metrics) RefreshBlocked(ctx context.Context, period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		m.countBlocked(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// countBlocked updates the number of blocked keys, keeping the last known
+// value if the storage cannot be read
+func (m *Metrics) countBlocked(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, blockedScanTimeout)
+	defer cancel()
+
+	blocked, err := m.store.ListBlocked(ctx)
+	if err != nil {
+		m.storageErrors.WithLabelValues("list_blocked").Inc()
+		return
+	}
+	m.lastBlocked.Store(int64(len(blocked)))
+}
+
+// ObserveDecision implements limiter.Observer
+func (m *Metrics) ObserveDecision(keyType string, allowed bool) {
+	result := "denied"
+	if allowed {
+		result = "allowed"
+	}
+	m.decisions.WithLabelValues(keyType, result).Inc()
+}
+
+// ObserveWouldBlock implements limiter.DryRunObserver
+func (m *Metrics) ObserveWouldBlock(keyType string) {
+	m.decisions.WithLabelValues(keyType, "would_block").Inc()
+}
+
+// ObserveReserved implements limiter.BatchObserver
+func (m *Metrics) ObserveReserved(units int) {
+	m.batchReserved.Add(float64(units))
+}
+
+// ObserveUnused implements limiter.BatchObserver
+func (m *Metrics) ObserveUnused(units int) {
+	m.batchUnused.Add(float64(units))
+}
+
+// ObserveOvershoot implements limiter.BatchObserver
+func (m *Metrics) ObserveOvershoot(units int) {
+	m.batchOvershoot.Add(float64(units))
+}
+
+// Registry exposes the registry so other components can add collectors
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+// Handler serves the metrics in the Prometheus text format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// observe records the latency and outcome of a storage operation. Calls
+// canceled by their caller are not storage errors.
+func (m *Metrics) observe(operation string, start time.Time, err error) {
+	m.storageLatency.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil && !errors.Is(err, context.Canceled) {
+		m.storageErrors.WithLabelValues(operation).Inc()
+	}
+}
@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goxprts/ratelimiter/internal/limiter"
+	"github.com/goxprts/ratelimiter/internal/storage"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMetrics(t *testing.T) (*Metrics, *InstrumentedStorage) {
+	store := storage.NewMemoryStorage(storage.MemoryOptions{})
+	t.Cleanup(func() { store.Close() })
+	m := New(store)
+	return m, m.InstrumentStorage(store)
+}
+
+func TestMetrics_Decisions(t *testing.T) {
+	m, store := newTestMetrics(t)
+	rl := limiter.NewRateLimiter(store, 1, 60, map[string]limiter.TokenConfig{
+		"abc": {RPS: 1, BlockTime: time.Minute},
+	}, limiter.WithObserver(m))
+	ctx := context.Background()
+
+	_, err := rl.Allow(ctx, "192.168.1.1", "")
+	require.NoError(t, err)
+	_, err = rl.Allow(ctx, "192.168.1.1", "")
+	require.NoError(t, err)
+	_, err = rl.Allow(ctx, "192.168.1.1", "abc")
+	require.NoError(t, err)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.decisions.WithLabelValues("ip", "allowed")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.decisions.WithLabelValues("ip", "denied")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.decisions.WithLabelValues("token", "allowed")))
+}
+
+func TestMetrics_BatchUnits(t *testing.T) {
+	m, store := newTestMetrics(t)
+	rl := limiter.NewRateLimiter(store, 10, 0, map[string]limiter.TokenConfig{},
+		limiter.WithLocalBatching(limiter.BatchOptions{BatchFraction: 0.5}),
+		limiter.WithObserver(m),
+	)
+
+	_, err := rl.Allow(context.Background(), "192.168.1.1", "")
+	require.NoError(t, err)
+
+	assert.Equal(t, 5.0, testutil.ToFloat64(m.batchReserved))
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.batchUnused))
+}
+
+func TestMetrics_BlockedKeys(t *testing.T) {
+	m, store := newTestMetrics(t)
+	ctx := context.Background()
+
+	require.NoError(t, store.Block(ctx, "ip:10.0.0.1", time.Minute))
+	require.NoError(t, store.Block(ctx, "token:abc", time.Minute))
+
+	// Scrapes read the last count, not the storage
+	expected := `
+# HELP ratelimiter_blocked_keys Keys currently blocked.
+# TYPE ratelimiter_blocked_keys gauge
+ratelimiter_blocked_keys 0
+`
+	assert.NoError(t, testutil.GatherAndCompare(m.Registry(), strings.NewReader(expected), "ratelimiter_blocked_keys"))
+
+	m.countBlocked(ctx)
+	expected = `
+# HELP ratelimiter_blocked_keys Keys currently blocked.
+# TYPE ratelimiter_blocked_keys gauge
+ratelimiter_blocked_keys 2
+`
+	assert.NoError(t, testutil.GatherAndCompare(m.Registry(), strings.NewReader(expected), "ratelimiter_blocked_keys"))
+}
+
+func TestMetrics_StorageOperations(t *testing.T) {
+	m, store := newTestMetrics(t)
+	ctx := context.Background()
+
+	_, err := store.Increment(ctx, "counter")
+	require.NoError(t, err)
+	_, err = store.Evaluate(ctx, "ip:10.0.0.1", storage.Policy{Limit: 1, Window: time.Second}, time.Now())
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, testutil.CollectAndCount(m.storageLatency))
+	assert.Equal(t, 0, testutil.CollectAndCount(m.storageErrors))
+
+	m.observe("evaluate", time.Now(), errors.New("connection refused"))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.storageErrors.WithLabelValues("evaluate")))
+
+	// Callers giving up are not storage errors
+	m.observe("evaluate", time.Now(), context.Canceled)
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.storageErrors.WithLabelValues("evaluate")))
+}
+
+func TestMetrics_Handler(t *testing.T) {
+	m, _ := newTestMetrics(t)
+	m.ObserveDecision(limiter.KeyTypeRule, false)
+	m.ObserveWouldBlock(limiter.KeyTypeRule)
+
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), `ratelimiter_decisions_total{key_type="rule",result="denied"} 1`)
+	assert.Contains(t, w.Body.String(), `ratelimiter_decisions_total{key_type="rule",result="would_block"} 1`)
+}
@@ -0,0 +1,136 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/goxprts/ratelimiter/internal/storage"
+)
+
+// InstrumentedStorage records the latency and errors of every operation of
+// the wrapped Storage
+type InstrumentedStorage struct {
+	next    storage.Storage
+	metrics *Metrics
+}
+
+// InstrumentStorage wraps s so its operations are measured
+func (m *Metrics) InstrumentStorage(s storage.Storage) *InstrumentedStorage {
+	return &InstrumentedStorage{next: s, metrics: m}
+}
+
+func (s *InstrumentedStorage) Increment(ctx context.Context, key string) (int64, error) {
+	start := time.Now()
+	count, err := s.next.Increment(ctx, key)
+	s.metrics.observe("increment", start, err)
+	return count, err
+}
+
+func (s *InstrumentedStorage) IncrementBy(ctx context.Context, key string, n int64) (int64, error) {
+	start := time.Now()
+	count, err := s.next.IncrementBy(ctx, key, n)
+	s.metrics.observe("increment", start, err)
+	return count, err
+}
+
+func (s *InstrumentedStorage) Acquire(ctx context.Context, key string, lease string, limit int, ttl time.Duration, now time.Time) (*storage.Acquisition, error) {
+	start := time.Now()
+	a, err := s.next.Acquire(ctx, key, lease, limit, ttl, now)
+	s.metrics.observe("acquire", start, err)
+	return a, err
+}
+
+func (s *InstrumentedStorage) Release(ctx context.Context, key string, lease string) error {
+	start := time.Now()
+	err := s.next.Release(ctx, key, lease)
+	s.metrics.observe("release", start, err)
+	return err
+}
+
+func (s *InstrumentedStorage) Get(ctx context.Context, key string) (int64, error) {
+	start := time.Now()
+	value, err := s.next.Get(ctx, key)
+	s.metrics.observe("get", start, err)
+	return value, err
+}
+
+func (s *InstrumentedStorage) SetExpiration(ctx context.Context, key string, expiration time.Duration) error {
+	start := time.Now()
+	err := s.next.SetExpiration(ctx, key, expiration)
+	s.metrics.observe("set_expiration", start, err)
+	return err
+}
+
+func (s *InstrumentedStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
+	start := time.Now()
+	blocked, err := s.next.IsBlocked(ctx, key)
+	s.metrics.observe("is_blocked", start, err)
+	return blocked, err
+}
+
+func (s *InstrumentedStorage) Block(ctx context.Context, key string, duration time.Duration) error {
+	start := time.Now()
+	err := s.next.Block(ctx, key, duration)
+	s.metrics.observe("block", start, err)
+	return err
+}
+
+func (s *InstrumentedStorage) Set(ctx context.Context, key string, value int64, expiration time.Duration) error {
+	start := time.Now()
+	err := s.next.Set(ctx, key, value, expiration)
+	s.metrics.observe("set", start, err)
+	return err
+}
+
+func (s *InstrumentedStorage) AppendTimestamp(ctx context.Context, key string, ts time.Time, window time.Duration) (int64, error) {
+	start := time.Now()
+	count, err := s.next.AppendTimestamp(ctx, key, ts, window)
+	s.metrics.observe("append_timestamp", start, err)
+	return count, err
+}
+
+func (s *InstrumentedStorage) Evaluate(ctx context.Context, key string, policy storage.Policy, now time.Time) (*storage.Decision, error) {
+	start := time.Now()
+	d, err := s.next.Evaluate(ctx, key, policy, now)
+	s.metrics.observe("evaluate", start, err)
+	return d, err
+}
+
+func (s *InstrumentedStorage) Reserve(ctx context.Context, key string, policy storage.Policy, n int, now time.Time) (*storage.Reservation, error) {
+	start := time.Now()
+	r, err := s.next.Reserve(ctx, key, policy, n, now)
+	s.metrics.observe("reserve", start, err)
+	return r, err
+}
+
+func (s *InstrumentedStorage) ListBlocked(ctx context.Context) ([]storage.Entry, error) {
+	start := time.Now()
+	entries, err := s.next.ListBlocked(ctx)
+	s.metrics.observe("list_blocked", start, err)
+	return entries, err
+}
+
+func (s *InstrumentedStorage) Scan(ctx context.Context, prefix string) ([]storage.Entry, error) {
+	start := time.Now()
+	entries, err := s.next.Scan(ctx, prefix)
+	s.metrics.observe("scan", start, err)
+	return entries, err
+}
+
+func (s *InstrumentedStorage) Unblock(ctx context.Context, key string) error {
+	start := time.Now()
+	err := s.next.Unblock(ctx, key)
+	s.metrics.observe("unblock", start, err)
+	return err
+}
+
+func (s *InstrumentedStorage) Reset(ctx context.Context, key string) error {
+	start := time.Now()
+	err := s.next.Reset(ctx, key)
+	s.metrics.observe("reset", start, err)
+	return err
+}
+
+func (s *InstrumentedStorage) Close() error {
+	return s.next.Close()
+}
@@ -0,0 +1,190 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// DefaultTrustedHeader is the forwarding header read from trusted proxies
+// unless WithTrustedHeader sets another one
+const DefaultTrustedHeader = "X-Forwarded-For"
+
+// IPExtractor resolves the client IP of a request. A single forwarding
+// header is only honored when the request comes from a trusted proxy, and
+// its chain is walked right to left so clients cannot spoof their address.
+type IPExtractor struct {
+	trustedProxies []netip.Prefix
+	trustedHeader  string
+	ipv6PrefixLen  int
+}
+
+// IPExtractorOption configures optional IPExtractor behavior
+type IPExtractorOption func(*IPExtractor)
+
+// WithTrustedHeader reads the client address from header, e.g. Forwarded
+// or X-Real-IP, instead of X-Forwarded-For. Only the header the proxies
+// set may be trusted: other forwarding headers are passed through from
+// clients unchanged, so they are never read.
+func WithTrustedHeader(header string) IPExtractorOption {
+	return func(e *IPExtractor) {
+		e.trustedHeader = http.CanonicalHeaderKey(header)
+	}
+}
+
+// NewIPExtractor builds an extractor trusting the given proxy CIDRs or IPs.
+// IPv6 clients are aggregated to ipv6PrefixLen bits; 0 or 128 disables it.
+func NewIPExtractor(trustedProxies []string, ipv6PrefixLen int, opts ...IPExtractorOption) (*IPExtractor, error) {
+	if ipv6PrefixLen < 0 || ipv6PrefixLen > 128 {
+		return nil, fmt.Errorf("invalid IPv6 prefix length %d", ipv6PrefixLen)
+	}
+	if ipv6PrefixLen == 0 {
+		ipv6PrefixLen = 128
+	}
+
+	e := &IPExtractor{ipv6PrefixLen: ipv6PrefixLen, trustedHeader: DefaultTrustedHeader}
+	for _, opt := range opts {
+		opt(e)
+	}
+	if e.trustedHeader == "" {
+		return nil, fmt.Errorf("empty trusted IP header")
+	}
+	for _, proxy := range trustedProxies {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			addr, err := netip.ParseAddr(proxy)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+			}
+			addr = addr.Unmap()
+			e.trustedProxies = append(e.trustedProxies, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		e.trustedProxies = append(e.trustedProxies, prefix.Masked())
+	}
+	return e, nil
+}
+
+// ClientIP returns the rate limiting key for the client of r: the IP itself
+// for IPv4 and the aggregated prefix (e.g. 2001:db8::/64) for IPv6
+func (e *IPExtractor) ClientIP(r *http.Request) string {
+	addr, ok := parseHost(r.RemoteAddr)
+	if !ok {
+		return r.RemoteAddr
+	}
+	return e.key(e.resolve(r, addr))
+}
+
+// ClientAddr returns the address of the client of r, without the IPv6
+// aggregation of ClientIP, for checks that match single addresses
+func (e *IPExtractor) ClientAddr(r *http.Request) string {
+	addr, ok := parseHost(r.RemoteAddr)
+	if !ok {
+		return r.RemoteAddr
+	}
+	return e.resolve(r, addr).String()
+}
+
+// TrustedPeer reports whether r comes directly from a trusted proxy, so its
+// forwarding headers may be passed on
+func (e *IPExtractor) TrustedPeer(r *http.Request) bool {
+	addr, ok := parseHost(r.RemoteAddr)
+	return ok && e.trusted(addr)
+}
+
+func (e *IPExtractor) resolve(r *http.Request, remote netip.Addr) netip.Addr {
+	if !e.trusted(remote) {
+		return remote
+	}
+
+	var chain []string
+	if e.trustedHeader == "Forwarded" {
+		chain = forwardedFor(r.Header.Values("Forwarded"))
+	} else {
+		chain = splitList(r.Header.Values(e.trustedHeader))
+	}
+
+	client := remote
+	for i := len(chain) - 1; i >= 0; i-- {
+		addr, ok := parseHost(chain[i])
+		if !ok {
+			// Nothing left of an unparseable hop can be trusted
+			return client
+		}
+		client = addr
+		if !e.trusted(addr) {
+			return addr
+		}
+	}
+	return client
+}
+
+func (e *IPExtractor) trusted(addr netip.Addr) bool {
+	for _, prefix := range e.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *IPExtractor) key(addr netip.Addr) string {
+	if addr.Is4() || e.ipv6PrefixLen == 128 {
+		return addr.String()
+	}
+	prefix, _ := addr.Prefix(e.ipv6PrefixLen)
+	return prefix.String()
+}
+
+// parseHost parses an address that may carry a port, brackets or quotes
+func parseHost(value string) (netip.Addr, bool) {
+	value = strings.Trim(strings.TrimSpace(value), `"`)
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+func splitList(values []string) []string {
+	var items []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+// forwardedFor returns the for= parameters of RFC 7239 Forwarded headers.
+// Elements without for= are kept as empty hops so they stop the walk.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, element := range splitList(values) {
+		hop := ""
+		for _, pair := range strings.Split(element, ";") {
+			name, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+			if found && strings.EqualFold(name, "for") {
+				hop = value
+			}
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
@@ -0,0 +1,141 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestExtractor(t *testing.T, proxies ...string) *IPExtractor {
+	extractor, err := NewIPExtractor(proxies, 64)
+	require.NoError(t, err)
+	return extractor
+}
+
+func TestClientIP_XForwardedFor(t *testing.T) {
+	extractor := newTestExtractor(t, "192.168.0.0/16", "198.51.100.1")
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Forwarded-For", "203.0.113.1, 198.51.100.1")
+	req.RemoteAddr = "192.168.1.1:1234"
+
+	assert.Equal(t, "203.0.113.1", extractor.ClientIP(req))
+}
+
+func TestClientIP_SpoofedXForwardedFor(t *testing.T) {
+	extractor := newTestExtractor(t, "192.168.0.0/16")
+
+	// The client prepended a fake address; the proxy appended the real one
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Forwarded-For", "1.2.3.4, 203.0.113.7")
+	req.RemoteAddr = "192.168.1.1:1234"
+	assert.Equal(t, "203.0.113.7", extractor.ClientIP(req))
+
+	// Headers from untrusted peers are ignored
+	req.RemoteAddr = "203.0.113.9:1234"
+	assert.Equal(t, "203.0.113.9", extractor.ClientIP(req))
+}
+
+func TestClientIP_SpoofedOtherHeader(t *testing.T) {
+	extractor := newTestExtractor(t, "192.168.0.0/16")
+
+	// The proxy only appends to X-Forwarded-For and passes the client's own
+	// Forwarded and X-Real-IP through unchanged
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Forwarded", "for=1.2.3.4")
+	req.Header.Set("X-Real-IP", "5.6.7.8")
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	req.RemoteAddr = "192.168.1.1:1234"
+	assert.Equal(t, "203.0.113.7", extractor.ClientIP(req))
+
+	// Without the configured header the peer itself is the client
+	req.Header.Del("X-Forwarded-For")
+	assert.Equal(t, "192.168.1.1", extractor.ClientIP(req))
+}
+
+func TestClientIP_NoTrustedProxies(t *testing.T) {
+	extractor := newTestExtractor(t)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Forwarded-For", "203.0.113.1")
+	req.Header.Set("X-Real-IP", "203.0.113.1")
+	req.RemoteAddr = "192.168.1.1:1234"
+
+	assert.Equal(t, "192.168.1.1", extractor.ClientIP(req))
+}
+
+func TestClientIP_XRealIP(t *testing.T) {
+	extractor, err := NewIPExtractor([]string{"192.168.1.1"}, 64, WithTrustedHeader("x-real-ip"))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Real-IP", "203.0.113.1")
+	req.RemoteAddr = "192.168.1.1:1234"
+
+	assert.Equal(t, "203.0.113.1", extractor.ClientIP(req))
+}
+
+func newForwardedExtractor(t *testing.T, proxies ...string) *IPExtractor {
+	extractor, err := NewIPExtractor(proxies, 64, WithTrustedHeader("Forwarded"))
+	require.NoError(t, err)
+	return extractor
+}
+
+func TestClientIP_Forwarded(t *testing.T) {
+	extractor := newForwardedExtractor(t, "10.0.0.0/8")
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Add("Forwarded", `for=198.51.100.17;proto=https, for="[2001:db8:cafe::17]:4711"`)
+	req.Header.Add("Forwarded", "for=10.0.0.2;by=10.0.0.3")
+	req.Header.Set("X-Forwarded-For", "203.0.113.1")
+	req.RemoteAddr = "10.0.0.1:1234"
+
+	assert.Equal(t, "2001:db8:cafe::/64", extractor.ClientIP(req))
+}
+
+func TestClientIP_UnparseableHop(t *testing.T) {
+	extractor := newForwardedExtractor(t, "10.0.0.0/8")
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Forwarded", "for=unknown, for=10.0.0.2")
+	req.RemoteAddr = "10.0.0.1:1234"
+
+	assert.Equal(t, "10.0.0.2", extractor.ClientIP(req))
+}
+
+func TestClientIP_IPv6Aggregation(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "[2001:db8:1:2:3:4:5:6]:443"
+
+	assert.Equal(t, "2001:db8:1:2::/64", newTestExtractor(t).ClientIP(req))
+
+	extractor, err := NewIPExtractor(nil, 128)
+	require.NoError(t, err)
+	assert.Equal(t, "2001:db8:1:2:3:4:5:6", extractor.ClientIP(req))
+
+	req.RemoteAddr = "[::ffff:192.0.2.1]:443"
+	assert.Equal(t, "192.0.2.1", extractor.ClientIP(req))
+}
+
+func TestClientIP_RemoteAddr(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.168.1.1:1234"
+
+	assert.Equal(t, "192.168.1.1", newTestExtractor(t).ClientIP(req))
+}
+
+func TestNewIPExtractor_Invalid(t *testing.T) {
+	_, err := NewIPExtractor([]string{"10.0.0.0/40"}, 64)
+	assert.Error(t, err)
+
+	_, err = NewIPExtractor([]string{"proxy.local"}, 64)
+	assert.Error(t, err)
+
+	_, err = NewIPExtractor(nil, 129)
+	assert.Error(t, err)
+
+	_, err = NewIPExtractor(nil, 64, WithTrustedHeader(""))
+	assert.Error(t, err)
+}
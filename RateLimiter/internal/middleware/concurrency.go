@@ -0,0 +1,188 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/goxprts/ratelimiter/internal/access"
+	"github.com/goxprts/ratelimiter/internal/apikey"
+	"github.com/goxprts/ratelimiter/internal/storage"
+)
+
+// DefaultLeaseTTL is how long a slot stays taken when its holder stops
+// renewing it, e.g. because the instance crashed
+const DefaultLeaseTTL = 30 * time.Second
+
+// ErrSlotLost is the cause of the request context canceled when its slot
+// could not be renewed before expiring, so the request no longer counts
+// against the limit
+var ErrSlotLost = errors.New("concurrency slot lost")
+
+// ConcurrencyOptions configures a ConcurrencyMiddleware
+type ConcurrencyOptions struct {
+	// IPLimit caps the in-flight requests of each IP; zero means unlimited
+	IPLimit int
+	// TokenLimit caps the in-flight requests of each known token; zero
+	// means unlimited
+	TokenLimit int
+	// KnownToken reports whether a token is counted under its own key.
+	// Requests with unknown tokens are counted by IP, as in the RateLimiter.
+	KnownToken func(token string) bool
+	// Keys counts the requests of valid registered keys under the key ID
+	Keys *apikey.Registry
+	// LeaseTTL defaults to DefaultLeaseTTL. Slots of requests running longer
+	// are renewed every half TTL.
+	LeaseTTL      time.Duration
+	FailurePolicy FailurePolicy
+	// Access lets allowed requests skip the limit
+	Access *access.List
+	// Tenants counts the requests of each tenant in its namespace
+	Tenants *TenantResolver
+}
+
+// ConcurrencyMiddleware caps the requests in flight per IP or token, sharing
+// the count between instances through the storage
+type ConcurrencyMiddleware struct {
+	storage     storage.Storage
+	opts        ConcurrencyOptions
+	ipExtractor *IPExtractor
+	now         func() time.Time
+}
+
+func NewConcurrencyMiddleware(store storage.Storage, ipExtractor *IPExtractor, opts ConcurrencyOptions) *ConcurrencyMiddleware {
+	if opts.LeaseTTL <= 0 {
+		opts.LeaseTTL = DefaultLeaseTTL
+	}
+	if opts.FailurePolicy == "" {
+		opts.FailurePolicy = FailClosed
+	}
+	if ipExtractor == nil {
+		ipExtractor = &IPExtractor{ipv6PrefixLen: 128}
+	}
+	return &ConcurrencyMiddleware{
+		storage:     store,
+		opts:        opts,
+		ipExtractor: ipExtractor,
+		now:         time.Now,
+	}
+}
+
+// Middleware returns an HTTP middleware holding a slot while next runs
+func (m *ConcurrencyMiddleware) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := m.ipExtractor.ClientIP(r)
+		token := r.Header.Get("API_KEY")
+
+		if m.opts.Access != nil && m.opts.Access.Check(m.ipExtractor.ClientAddr(r), token) == access.Allow {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key, limit := m.key(ip, token)
+		if limit <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tenantCtx, err := m.opts.Tenants.Context(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		// Keep the trace and tenant of the request but not its cancellation,
+		// so the slot is still released when the client goes away
+		lease := newLeaseID()
+		ctx := context.WithoutCancel(tenantCtx)
+		acquiredAt := m.now()
+		a, err := m.storage.Acquire(ctx, key, lease, limit, m.opts.LeaseTTL, acquiredAt)
+		if err != nil {
+			logUnavailable("concurrency limiter", m.opts.FailurePolicy, err)
+			if m.opts.FailurePolicy == FailOpen {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("Retry-After", failureRetryAfter)
+			writeError(w, http.StatusServiceUnavailable, "rate limiter unavailable")
+			return
+		}
+		if !a.Acquired {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusTooManyRequests, "too many concurrent requests")
+			return
+		}
+
+		reqCtx, cancel := context.WithCancelCause(r.Context())
+		defer cancel(nil)
+		done, stopped := make(chan struct{}), make(chan struct{})
+		go m.renew(ctx, key, lease, limit, acquiredAt, cancel, done, stopped)
+		defer func() {
+			// A renewal running after the release would take the slot again
+			close(done)
+			<-stopped
+			if err := m.storage.Release(ctx, key, lease); err != nil {
+				log.Printf("failed to release concurrency slot, it expires in %v: %v", m.opts.LeaseTTL, err)
+			}
+		}()
+
+		next.ServeHTTP(w, r.WithContext(reqCtx))
+	})
+}
+
+// key returns the semaphore counting the request and its limit
+func (m *ConcurrencyMiddleware) key(ip, token string) (string, int) {
+	if token != "" && m.opts.KnownToken != nil && m.opts.KnownToken(token) {
+		return fmt.Sprintf("concurrency:token:%s", apikey.ID(token)), m.opts.TokenLimit
+	}
+	if token != "" && m.opts.Keys != nil {
+		if k, err := m.opts.Keys.Lookup(token); err == nil {
+			return fmt.Sprintf("concurrency:token:%s", k.ID), m.opts.TokenLimit
+		}
+	}
+	return fmt.Sprintf("concurrency:ip:%s", ip), m.opts.IPLimit
+}
+
+// renew extends the lease every half TTL until done is closed, so long
+// requests keep their slot. When the slot is taken by another request, or
+// the lease expires while the storage fails and the failure policy is
+// closed, the request is canceled with ErrSlotLost.
+func (m *ConcurrencyMiddleware) renew(ctx context.Context, key, lease string, limit int, renewedAt time.Time, cancel context.CancelCauseFunc, done, stopped chan struct{}) {
+	defer close(stopped)
+	ticker := time.NewTicker(m.opts.LeaseTTL / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		now := m.now()
+		a, err := m.storage.Acquire(ctx, key, lease, limit, m.opts.LeaseTTL, now)
+		switch {
+		case err == nil && a.Acquired:
+			renewedAt = now
+		case err == nil:
+			log.Printf("concurrency slot of %s expired and was taken, canceling the request", key)
+			cancel(ErrSlotLost)
+			return
+		case m.opts.FailurePolicy == FailClosed && now.Sub(renewedAt) >= m.opts.LeaseTTL:
+			log.Printf("failed to renew concurrency slot of %s before it expired, canceling the request: %v", key, err)
+			cancel(ErrSlotLost)
+			return
+		case !errors.Is(err, storage.ErrCircuitOpen):
+			log.Printf("failed to renew concurrency slot of %s: %v", key, err)
+		}
+	}
+}
+
+func newLeaseID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,311 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goxprts/ratelimiter/internal/apikey"
+	"github.com/goxprts/ratelimiter/internal/limiter"
+	"github.com/goxprts/ratelimiter/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingHandler holds every request until release is closed
+type blockingHandler struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func newBlockingHandler() *blockingHandler {
+	return &blockingHandler{started: make(chan struct{}, 10), release: make(chan struct{})}
+}
+
+func (h *blockingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.started <- struct{}{}
+	<-h.release
+	w.WriteHeader(http.StatusOK)
+}
+
+func concurrentRequest(remoteAddr, token string) *http.Request {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = remoteAddr
+	if token != "" {
+		req.Header.Set("API_KEY", token)
+	}
+	return req
+}
+
+func TestConcurrencyMiddleware(t *testing.T) {
+	store := newTestStorage(t)
+	m := NewConcurrencyMiddleware(store, nil, ConcurrencyOptions{
+		IPLimit:    2,
+		TokenLimit: 3,
+		KnownToken: func(token string) bool { return token == "abc123" },
+	})
+	next := newBlockingHandler()
+	handler := m.Middleware(next)
+
+	// Fill the IP slots with requests still running
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handler.ServeHTTP(httptest.NewRecorder(), concurrentRequest("192.168.1.1:1234", ""))
+		}()
+		<-next.started
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, concurrentRequest("192.168.1.1:1234", ""))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.JSONEq(t, `{"error": "too many concurrent requests"}`, w.Body.String())
+
+	// Known tokens have their own slots, unknown ones count against the IP
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, concurrentRequest("192.168.1.1:1234", "unknown"))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		handler.ServeHTTP(httptest.NewRecorder(), concurrentRequest("192.168.1.1:1234", "abc123"))
+	}()
+	<-next.started
+
+	// Finished requests give their slots back
+	close(next.release)
+	wg.Wait()
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, concurrentRequest("192.168.1.1:1234", ""))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestConcurrencyMiddleware_RenewsLease(t *testing.T) {
+	store := newTestStorage(t)
+	m := NewConcurrencyMiddleware(store, nil, ConcurrencyOptions{IPLimit: 1, LeaseTTL: 100 * time.Millisecond})
+	next := newBlockingHandler()
+	handler := m.Middleware(next)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(httptest.NewRecorder(), concurrentRequest("192.168.1.1:1234", ""))
+	}()
+	<-next.started
+
+	// The slot outlives its TTL while the request is running
+	time.Sleep(300 * time.Millisecond)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, concurrentRequest("192.168.1.1:1234", ""))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	close(next.release)
+	<-done
+}
+
+func TestConcurrencyMiddleware_KeyRegistry(t *testing.T) {
+	store := newTestStorage(t)
+	registry := apikey.NewRegistry(store)
+	secret, k, err := registry.Create(context.Background(), "alice", "pro", time.Time{})
+	require.NoError(t, err)
+
+	m := NewConcurrencyMiddleware(store, nil, ConcurrencyOptions{IPLimit: 1, TokenLimit: 1, Keys: registry})
+	next := newBlockingHandler()
+	handler := m.Middleware(next)
+
+	// A registered key holds a slot of its own, counted under its ID
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(httptest.NewRecorder(), concurrentRequest("192.168.1.1:1234", secret))
+	}()
+	<-next.started
+
+	entries, err := store.Scan(context.Background(), "concurrency:")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "concurrency:token:"+k.ID, entries[0].Key)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, concurrentRequest("192.168.1.1:1234", secret))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	close(next.release)
+	<-done
+}
+
+// flakySemaphore fails every acquisition after the first
+type flakySemaphore struct {
+	storage.Storage
+	mu    sync.Mutex
+	calls int
+}
+
+func (s *flakySemaphore) Acquire(ctx context.Context, key, lease string, limit int, ttl time.Duration, now time.Time) (*storage.Acquisition, error) {
+	s.mu.Lock()
+	s.calls++
+	first := s.calls == 1
+	s.mu.Unlock()
+	if !first {
+		return nil, errors.New("connection refused")
+	}
+	return s.Storage.Acquire(ctx, key, lease, limit, ttl, now)
+}
+
+func TestConcurrencyMiddleware_LostLease(t *testing.T) {
+	serve := func(store storage.Storage, policy FailurePolicy) error {
+		var cause error
+		m := NewConcurrencyMiddleware(store, nil, ConcurrencyOptions{IPLimit: 1, LeaseTTL: 50 * time.Millisecond, FailurePolicy: policy})
+		m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+				cause = context.Cause(r.Context())
+			case <-time.After(300 * time.Millisecond):
+			}
+		})).ServeHTTP(httptest.NewRecorder(), concurrentRequest("192.168.1.1:1234", ""))
+		return cause
+	}
+
+	// Requests whose slot expired while the storage was failing stop
+	assert.ErrorIs(t, serve(&flakySemaphore{Storage: newTestStorage(t)}, FailClosed), ErrSlotLost)
+	assert.NoError(t, serve(&flakySemaphore{Storage: newTestStorage(t)}, FailOpen))
+
+	// So do requests whose expired slot was taken by another one
+	store := newTestStorage(t)
+	m := NewConcurrencyMiddleware(store, nil, ConcurrencyOptions{IPLimit: 1, LeaseTTL: 50 * time.Millisecond})
+	var offset time.Duration
+	var mu sync.Mutex
+	m.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return time.Now().Add(offset)
+	}
+	started := make(chan struct{})
+	var cause error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			select {
+			case <-r.Context().Done():
+				cause = context.Cause(r.Context())
+			case <-time.After(300 * time.Millisecond):
+			}
+		})).ServeHTTP(httptest.NewRecorder(), concurrentRequest("192.168.1.1:1234", ""))
+	}()
+	<-started
+	mu.Lock()
+	offset = time.Minute
+	mu.Unlock()
+	a, err := store.Acquire(context.Background(), "concurrency:ip:192.168.1.1", "other", 1, time.Hour, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	require.True(t, a.Acquired)
+	<-done
+	assert.ErrorIs(t, cause, ErrSlotLost)
+}
+
+func TestConcurrencyMiddleware_ExpiredLease(t *testing.T) {
+	store := newTestStorage(t)
+	ctx := context.Background()
+
+	// A lease left behind by a crashed instance frees its slot once it expires
+	a, err := store.Acquire(ctx, "concurrency:ip:192.168.1.1", "crashed", 1, 50*time.Millisecond, time.Now())
+	require.NoError(t, err)
+	require.True(t, a.Acquired)
+
+	m := NewConcurrencyMiddleware(store, nil, ConcurrencyOptions{IPLimit: 1})
+	handler := m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, concurrentRequest("192.168.1.1:1234", ""))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	time.Sleep(100 * time.Millisecond)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, concurrentRequest("192.168.1.1:1234", ""))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+// unavailableSemaphore fails every acquisition like an unreachable Redis
+type unavailableSemaphore struct {
+	storage.Storage
+}
+
+func (unavailableSemaphore) Acquire(ctx context.Context, key, lease string, limit int, ttl time.Duration, now time.Time) (*storage.Acquisition, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestConcurrencyMiddleware_FailurePolicy(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	w := httptest.NewRecorder()
+	NewConcurrencyMiddleware(unavailableSemaphore{}, nil, ConcurrencyOptions{IPLimit: 1}).
+		Middleware(next).ServeHTTP(w, concurrentRequest("192.168.1.1:1234", ""))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.JSONEq(t, `{"error": "rate limiter unavailable"}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	NewConcurrencyMiddleware(unavailableSemaphore{}, nil, ConcurrencyOptions{IPLimit: 1, FailurePolicy: FailOpen}).
+		Middleware(next).ServeHTTP(w, concurrentRequest("192.168.1.1:1234", ""))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestConcurrencyMiddleware_Tenants(t *testing.T) {
+	store := storage.NewNamespacedStorage(newTestStorage(t), "")
+	rl := limiter.NewRateLimiter(store, 5, 0, map[string]limiter.TokenConfig{})
+	limits := rl.Limits()
+	limits.Tenants = map[string]limiter.TokenConfig{"acme": {RPS: 5}}
+	rl.SetLimits(limits)
+
+	extractor, err := NewIPExtractor([]string{"10.0.0.1"}, 64)
+	require.NoError(t, err)
+	m := NewConcurrencyMiddleware(store, extractor, ConcurrencyOptions{
+		IPLimit: 1,
+		Tenants: NewTenantResolver("X-Tenant-ID", extractor, rl),
+	})
+	next := newBlockingHandler()
+	handler := m.Middleware(next)
+	send := func(tenant string) *httptest.ResponseRecorder {
+		req := concurrentRequest("10.0.0.1:1234", "")
+		req.Header.Set("X-Forwarded-For", "192.168.1.1")
+		req.Header.Set("X-Tenant-ID", tenant)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		send("acme")
+	}()
+	<-next.started
+
+	// The slot is taken in the namespace of the tenant only
+	assert.Equal(t, http.StatusTooManyRequests, send("acme").Code)
+	entries, err := store.Scan(context.Background(), "")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "acme/concurrency:ip:192.168.1.1", entries[0].Key)
+
+	w := send("initech")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, `{"error": "unknown tenant"}`, w.Body.String())
+
+	close(next.release)
+	<-done
+}
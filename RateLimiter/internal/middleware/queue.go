@@ -0,0 +1,157 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/goxprts/ratelimiter/internal/limiter"
+	"github.com/goxprts/ratelimiter/internal/rules"
+	"github.com/goxprts/ratelimiter/internal/storage"
+)
+
+// minQueueRetry keeps waiting requests from retrying in a busy loop when the
+// limiter reports a reset time already past
+const minQueueRetry = 5 * time.Millisecond
+
+// waitQueues holds the requests waiting for quota on this instance, per
+// tenant and rule key
+type waitQueues struct {
+	mu     sync.Mutex
+	queues map[string]*waitQueue
+}
+
+type waitQueue struct {
+	waiting int
+	// turn is held by the request at the head of the queue. Goroutines
+	// blocked on a channel are woken in order, so requests retry FIFO.
+	turn chan struct{}
+}
+
+func newWaitQueues() *waitQueues {
+	return &waitQueues{queues: make(map[string]*waitQueue)}
+}
+
+// busy reports whether requests are waiting on key
+func (w *waitQueues) busy(key string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.queues[key] != nil
+}
+
+// join adds a request to the queue of key, or returns nil if size requests
+// are already waiting
+func (w *waitQueues) join(key string, size int) *waitQueue {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	q := w.queues[key]
+	if q == nil {
+		q = &waitQueue{turn: make(chan struct{}, 1)}
+		q.turn <- struct{}{}
+		w.queues[key] = q
+	}
+	if q.waiting >= size {
+		return nil
+	}
+	q.waiting++
+	return q
+}
+
+// leave removes a request from the queue of key, dropping the queue once empty
+func (w *waitQueues) leave(key string, q *waitQueue) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	q.waiting--
+	if q.waiting == 0 {
+		delete(w.queues, key)
+	}
+}
+
+// allowQueued checks a rule with a queue. Requests over the limit wait in
+// line until quota frees up, giving up when the rule's max wait would be
+// exceeded or the queue is full. A client going away ends the wait with the
+// context error, so it is not counted as a rejection. New requests skip the
+// limiter while others are waiting so they cannot jump the queue.
+func (m *RateLimiterMiddleware) allowQueued(ctx context.Context, r *http.Request, match *rules.Match, cost int) (*limiter.LimitResult, error) {
+	rule := match.Rule
+	key := storage.Namespace(ctx) + "/" + rule.Name + ":" + match.Identity
+	allow := func() (*limiter.LimitResult, error) {
+		return m.limiter.AllowRuleN(ctx, rule.Name, match.Identity, rule.Limit, cost)
+	}
+
+	var result *limiter.LimitResult
+	if !m.queues.busy(key) {
+		var err error
+		if result, err = allow(); err != nil || result.Allowed {
+			return result, err
+		}
+	}
+
+	giveUp := time.Now().Add(rule.Queue.MaxWait)
+	if result != nil && result.ResetTime.After(giveUp) {
+		return result, nil
+	}
+
+	size := rule.Queue.Size
+	if size == 0 {
+		size = rules.DefaultQueueSize
+	}
+	q := m.queues.join(key, size)
+	if q == nil {
+		return queueRejection(rule, result, giveUp), nil
+	}
+	defer m.queues.leave(key, q)
+
+	deadline := time.NewTimer(rule.Queue.MaxWait)
+	defer deadline.Stop()
+
+	select {
+	case <-q.turn:
+	case <-deadline.C:
+		return queueRejection(rule, result, giveUp), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { q.turn <- struct{}{} }()
+
+	for {
+		if result != nil {
+			if result.ResetTime.After(giveUp) {
+				return result, nil
+			}
+			retry := time.NewTimer(max(time.Until(result.ResetTime), minQueueRetry))
+			select {
+			case <-retry.C:
+			case <-deadline.C:
+				retry.Stop()
+				return result, nil
+			case <-ctx.Done():
+				retry.Stop()
+				return nil, ctx.Err()
+			}
+		}
+
+		var err error
+		if result, err = allow(); err != nil || result.Allowed {
+			return result, err
+		}
+	}
+}
+
+// queueRejection is the result of a request that gave up before getting a
+// decision of its own from the limiter
+func queueRejection(rule *rules.Rule, last *limiter.LimitResult, giveUp time.Time) *limiter.LimitResult {
+	if last != nil {
+		return last
+	}
+	return &limiter.LimitResult{
+		Allowed:   false,
+		KeyType:   limiter.KeyTypeRule,
+		Limit:     rule.Limit.RPS,
+		ResetTime: giveUp,
+		Message:   "too many requests waiting",
+	}
+}
@@ -0,0 +1,126 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goxprts/ratelimiter/internal/limiter"
+	"github.com/goxprts/ratelimiter/internal/rules"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newQueuedHandler(t *testing.T, limit limiter.TokenConfig, queue rules.Queue) http.Handler {
+	rl := limiter.NewRateLimiter(newTestStorage(t), 100, 300, map[string]limiter.TokenConfig{})
+	engine, err := rules.NewEngine([]rules.Rule{
+		{Name: "batch", PathPrefix: "/batch", Limit: limit, Queue: queue},
+	}, rules.FirstMatch)
+	require.NoError(t, err)
+
+	return NewRateLimiterMiddleware(rl, WithRules(engine)).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+func sendBatch(ctx context.Context, handler http.Handler) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/batch", nil).WithContext(ctx)
+	req.RemoteAddr = "192.168.1.1:1234"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestRateLimiterMiddleware_Queue(t *testing.T) {
+	// One request every 100ms
+	handler := newQueuedHandler(t,
+		limiter.TokenConfig{RPS: 10, Burst: 1, Algorithm: limiter.TokenBucket},
+		rules.Queue{MaxWait: time.Second},
+	)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	codes := make([]int, 4)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = sendBatch(context.Background(), handler).Code
+		}(i)
+	}
+	wg.Wait()
+
+	// Requests over the limit are delayed instead of rejected
+	assert.Equal(t, []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusOK}, codes)
+	assert.GreaterOrEqual(t, time.Since(start), 250*time.Millisecond)
+}
+
+func TestRateLimiterMiddleware_Queue_MaxWait(t *testing.T) {
+	handler := newQueuedHandler(t,
+		limiter.TokenConfig{RPS: 1, Algorithm: limiter.TokenBucket},
+		rules.Queue{MaxWait: 50 * time.Millisecond},
+	)
+
+	assert.Equal(t, http.StatusOK, sendBatch(context.Background(), handler).Code)
+
+	// The next token is further away than the max wait
+	start := time.Now()
+	w := sendBatch(context.Background(), handler)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Less(t, time.Since(start), 50*time.Millisecond)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+}
+
+func TestRateLimiterMiddleware_Queue_FullAndCancelled(t *testing.T) {
+	handler := newQueuedHandler(t,
+		limiter.TokenConfig{RPS: 1, Algorithm: limiter.TokenBucket},
+		rules.Queue{MaxWait: 5 * time.Second, Size: 1},
+	)
+	assert.Equal(t, http.StatusOK, sendBatch(context.Background(), handler).Code)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	waiting := make(chan *httptest.ResponseRecorder)
+	go func() { waiting <- sendBatch(ctx, handler) }()
+	time.Sleep(50 * time.Millisecond)
+
+	// The queue already holds one request
+	w := sendBatch(context.Background(), handler)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.JSONEq(t, `{"error": "too many requests waiting"}`, w.Body.String())
+
+	// Waiting requests give up when their client goes away, without being
+	// rejected by the limiter
+	start := time.Now()
+	cancel()
+	w = <-waiting
+	assert.Equal(t, StatusClientClosedRequest, w.Code)
+	assert.JSONEq(t, `{"error": "request canceled"}`, w.Body.String())
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestRateLimiterMiddleware_Queue_CancelledWaitingForTurn(t *testing.T) {
+	handler := newQueuedHandler(t,
+		limiter.TokenConfig{RPS: 1, Algorithm: limiter.TokenBucket},
+		rules.Queue{MaxWait: 5 * time.Second},
+	)
+	assert.Equal(t, http.StatusOK, sendBatch(context.Background(), handler).Code)
+
+	// The first request waits for quota, the second for its turn behind it
+	head, cancelHead := context.WithCancel(context.Background())
+	defer cancelHead()
+	go sendBatch(head, handler)
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	waiting := make(chan *httptest.ResponseRecorder)
+	go func() { waiting <- sendBatch(ctx, handler) }()
+	time.Sleep(50 * time.Millisecond)
+
+	cancel()
+	w := <-waiting
+	assert.Equal(t, StatusClientClosedRequest, w.Code)
+	assert.Empty(t, w.Header().Get("Retry-After"))
+}
@@ -2,78 +2,300 @@ package middleware
 
 import (
 	"context"
-	"net"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
 	"net/http"
-	"strings"
+	"strconv"
+	"sync/atomic"
+	"time"
 
+	"github.com/goxprts/ratelimiter/internal/access"
+	"github.com/goxprts/ratelimiter/internal/apikey"
 	"github.com/goxprts/ratelimiter/internal/limiter"
+	"github.com/goxprts/ratelimiter/internal/rules"
+	"github.com/goxprts/ratelimiter/internal/storage"
 )
 
+// FailurePolicy decides what happens to a request when the limiter fails
+type FailurePolicy string
+
+const (
+	// FailClosed rejects requests with 503 while the limiter is unavailable
+	FailClosed FailurePolicy = "closed"
+	// FailOpen lets requests through unlimited while the limiter is unavailable
+	FailOpen FailurePolicy = "open"
+)
+
+// failureRetryAfter is the Retry-After sent when failing closed
+const failureRetryAfter = "1"
+
+// StatusClientClosedRequest answers requests canceled by their client before
+// the limiter decided, following the nginx convention. The client is gone,
+// so the status only shows up in access logs.
+const StatusClientClosedRequest = 499
+
+// logUnavailable logs a failed limiter check. Calls rejected by the open
+// circuit breaker are skipped: the breaker reports the outage once when it
+// opens rather than once per request.
+func logUnavailable(name string, policy FailurePolicy, err error) {
+	if errors.Is(err, storage.ErrCircuitOpen) {
+		return
+	}
+	log.Printf("%s unavailable (failing %s): %v", name, policy, err)
+}
+
 type RateLimiterMiddleware struct {
-	limiter *limiter.RateLimiter
+	limiter       *limiter.RateLimiter
+	rules         atomic.Pointer[rules.Engine]
+	ipExtractor   *IPExtractor
+	failurePolicy FailurePolicy
+	access        *access.List
+	keys          *apikey.Registry
+	tenants       *TenantResolver
+	cost          func(*http.Request) int
+	queues        *waitQueues
 }
 
-func NewRateLimiterMiddleware(limiter *limiter.RateLimiter) *RateLimiterMiddleware {
-	return &RateLimiterMiddleware{
-		limiter: limiter,
+// Option configures optional middleware behavior
+type Option func(*RateLimiterMiddleware)
+
+// WithRules applies the limit of the matching rule instead of the IP/token
+// limits. Requests matching no rule or a dry run rule fall back to the
+// IP/token limits.
+func WithRules(engine *rules.Engine) Option {
+	return func(m *RateLimiterMiddleware) {
+		m.rules.Store(engine)
 	}
 }
 
-// Middleware returns an HTTP middleware function
-func (m *RateLimiterMiddleware) Middleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Extract IP address
-		ip := extractIP(r)
+// WithIPExtractor sets how client IPs are resolved. By default forwarding
+// headers are ignored and the connection address is used.
+func WithIPExtractor(extractor *IPExtractor) Option {
+	return func(m *RateLimiterMiddleware) {
+		m.ipExtractor = extractor
+	}
+}
 
-		// Extract API key from header
-		token := r.Header.Get("API_KEY")
+// WithFailurePolicy sets how requests are handled when the limiter returns
+// an error. The default is FailClosed.
+func WithFailurePolicy(policy FailurePolicy) Option {
+	return func(m *RateLimiterMiddleware) {
+		m.failurePolicy = policy
+	}
+}
 
-		// Check rate limit
-		ctx := context.Background()
-		result, err := m.limiter.Allow(ctx, ip, token)
-		if err != nil {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
+// WithAccessList checks requests against allow and deny lists before the
+// limiter. Allowed requests are not counted, denied ones get a 403.
+func WithAccessList(list *access.List) Option {
+	return func(m *RateLimiterMiddleware) {
+		m.access = list
+	}
+}
+
+// WithKeyRegistry validates the tokens not configured with their own limits
+// against a key registry. Requests with unknown, expired or revoked keys get
+// a 401 instead of falling back to the IP limit, and registered keys are
+// limited by the plan they were issued on.
+func WithKeyRegistry(registry *apikey.Registry) Option {
+	return func(m *RateLimiterMiddleware) {
+		m.keys = registry
+	}
+}
+
+// WithTenants counts the requests of each tenant resolved by tenants in its
+// namespace, under the tenant's default limits. Requests naming a tenant
+// without configured limits get a 400; requests without a tenant use the
+// default namespace.
+func WithTenants(tenants *TenantResolver) Option {
+	return func(m *RateLimiterMiddleware) {
+		m.tenants = tenants
+	}
+}
+
+// WithCost sets the number of units each request takes from the limit, e.g.
+// from the size of a batch request. Results below one fall back to the cost
+// of the matching rule, or one.
+func WithCost(fn func(*http.Request) int) Option {
+	return func(m *RateLimiterMiddleware) {
+		m.cost = fn
+	}
+}
+
+func NewRateLimiterMiddleware(limiter *limiter.RateLimiter, opts ...Option) *RateLimiterMiddleware {
+	m := &RateLimiterMiddleware{
+		limiter:       limiter,
+		ipExtractor:   &IPExtractor{ipv6PrefixLen: 128},
+		failurePolicy: FailClosed,
+		queues:        newWaitQueues(),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Verdict is the outcome of checking a request
+type Verdict struct {
+	// Status is the HTTP status rejecting the request, or 0 when it may
+	// proceed
+	Status int
+	// Error says why the request was rejected
+	Error string
+	// Result is the limit applied, nil when the limiter was not consulted
+	Result *limiter.LimitResult
+}
+
+// Check applies the access lists, key registry, tenant and limits to r
+// without answering it. Other transports, e.g. gRPC, check the requests they
+// build from their own calls.
+func (m *RateLimiterMiddleware) Check(r *http.Request) Verdict {
+	// Extract IP address
+	ip := m.ipExtractor.ClientIP(r)
+
+	// Extract API key from header
+	token := r.Header.Get("API_KEY")
+
+	if m.access != nil {
+		switch m.access.Check(m.ipExtractor.ClientAddr(r), token) {
+		case access.Allow:
+			return Verdict{}
+		case access.Deny:
+			return Verdict{Status: http.StatusForbidden, Error: "access denied"}
 		}
+	}
 
-		if !result.Allowed {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusTooManyRequests)
-			w.Write([]byte(`{"error": "` + result.Message + `"}`))
-			return
+	var key *apikey.Key
+	if token != "" && m.keys != nil {
+		if _, configured := m.limiter.Limits().Tokens[token]; !configured {
+			k, err := m.keys.Lookup(token)
+			if err != nil {
+				// The reason stays in the log so clients can't probe keys
+				log.Printf("rejected API key %s: %v", apikey.ID(token), err)
+				return Verdict{Status: http.StatusUnauthorized, Error: "invalid API key"}
+			}
+			key = &k
 		}
+	}
 
-		// Add rate limit headers
-		w.Header().Set("X-RateLimit-Remaining", string(rune(result.Remaining)))
+	// Storage calls are canceled with the request and traced under it
+	ctx, err := m.tenants.Context(r)
+	if err != nil {
+		return Verdict{Status: http.StatusBadRequest, Error: err.Error()}
+	}
+
+	// Check rate limit
+	result, err := m.check(ctx, r, ip, token, key)
+	if errors.Is(err, limiter.ErrCostExceedsLimit) {
+		return Verdict{Status: http.StatusBadRequest, Error: "request cost exceeds the limit"}
+	}
+	// A client giving up is not a limiter failure
+	if errors.Is(err, context.Canceled) {
+		return Verdict{Status: StatusClientClosedRequest, Error: "request canceled"}
+	}
+	if err != nil {
+		logUnavailable("rate limiter", m.failurePolicy, err)
+		if m.failurePolicy == FailOpen {
+			return Verdict{}
+		}
+		return Verdict{Status: http.StatusServiceUnavailable, Error: "rate limiter unavailable"}
+	}
+	if !result.Allowed {
+		return Verdict{Status: http.StatusTooManyRequests, Error: result.Message, Result: result}
+	}
+	return Verdict{Result: result}
+}
 
-		// Continue to the next handler
-		next.ServeHTTP(w, r)
+// Middleware returns an HTTP middleware function
+func (m *RateLimiterMiddleware) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := m.Check(r)
+		if v.Result != nil {
+			writeRateLimitHeaders(w, v.Result, time.Now())
+		}
+		if v.Status == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if v.Status == http.StatusServiceUnavailable {
+			w.Header().Set("Retry-After", failureRetryAfter)
+		}
+		writeError(w, v.Status, v.Error)
 	})
 }
 
-// extractIP extracts the IP address from the request
-func extractIP(r *http.Request) string {
-	// Check X-Forwarded-For header first
-	forwarded := r.Header.Get("X-Forwarded-For")
-	if forwarded != "" {
-		// X-Forwarded-For can contain multiple IPs, get the first one
-		ips := strings.Split(forwarded, ",")
-		if len(ips) > 0 {
-			return strings.TrimSpace(ips[0])
+// writeError writes a JSON error body. Messages can hold request values,
+// e.g. rule names, so they are encoded rather than concatenated.
+func writeError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// writeRateLimitHeaders sets the IETF RateLimit headers and, for rejected
+// requests, Retry-After. Reset values are whole seconds rounded up.
+func writeRateLimitHeaders(w http.ResponseWriter, result *limiter.LimitResult, now time.Time) {
+	reset := int(math.Ceil(result.ResetTime.Sub(now).Seconds()))
+	if reset < 0 {
+		reset = 0
+	}
+
+	header := w.Header()
+	header.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(reset))
+	header.Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+
+	if !result.Allowed {
+		if reset < 1 {
+			reset = 1
 		}
+		header.Set("Retry-After", strconv.Itoa(reset))
 	}
+}
+
+// SetRules replaces the rule engine used for subsequent requests
+func (m *RateLimiterMiddleware) SetRules(engine *rules.Engine) {
+	m.rules.Store(engine)
+}
 
-	// Check X-Real-IP header
-	realIP := r.Header.Get("X-Real-IP")
-	if realIP != "" {
-		return realIP
+// check applies the matching rule or the IP/token limits. Requests are
+// identified by the key ID rather than the key itself.
+func (m *RateLimiterMiddleware) check(ctx context.Context, r *http.Request, ip string, token string, key *apikey.Key) (*limiter.LimitResult, error) {
+	cost := 0
+	if m.cost != nil {
+		cost = m.cost(r)
 	}
 
-	// Fall back to RemoteAddr
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return r.RemoteAddr
+	identity := ""
+	if key != nil {
+		identity = key.ID
+	} else if token != "" {
+		identity = apikey.ID(token)
 	}
 
-	return ip
+	if engine := m.rules.Load(); engine != nil {
+		if match := engine.Match(r, ip, identity); match != nil {
+			if cost < 1 {
+				cost = match.Rule.Cost
+			}
+			if match.Rule.Queue.Enabled() && !match.Rule.Limit.DryRun {
+				return m.allowQueued(ctx, r, match, cost)
+			}
+			if !match.Rule.WeightOnly() {
+				result, err := m.limiter.AllowRuleN(ctx, match.Rule.Name, match.Identity, match.Rule.Limit, cost)
+				if err != nil || !match.Rule.Limit.DryRun {
+					return result, err
+				}
+				// Requests matching a dry run rule stay under the IP/token
+				// limits; the would be denials are counted by the observer
+			}
+		}
+	}
+	if key != nil {
+		return m.limiter.AllowKeyN(ctx, ip, key.ID, key.Plan, cost)
+	}
+	return m.limiter.AllowN(ctx, ip, token, cost)
 }
@@ -1,63 +1,37 @@
 package middleware
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strconv"
 	"testing"
 	"time"
 
+	"github.com/goxprts/ratelimiter/internal/access"
+	"github.com/goxprts/ratelimiter/internal/apikey"
 	"github.com/goxprts/ratelimiter/internal/limiter"
+	"github.com/goxprts/ratelimiter/internal/rules"
+	"github.com/goxprts/ratelimiter/internal/storage"
+	"github.com/goxprts/ratelimiter/internal/storage/storagetest"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-type MockStorage struct {
-	counters map[string]int64
-	blocked  map[string]bool
-}
-
-func NewMockStorage() *MockStorage {
-	return &MockStorage{
-		counters: make(map[string]int64),
-		blocked:  make(map[string]bool),
-	}
-}
-
-func (m *MockStorage) Increment(ctx context.Context, key string) (int64, error) {
-	m.counters[key]++
-	return m.counters[key], nil
-}
-
-func (m *MockStorage) Get(ctx context.Context, key string) (int64, error) {
-	return m.counters[key], nil
-}
-
-func (m *MockStorage) SetExpiration(ctx context.Context, key string, expiration time.Duration) error {
-	return nil
-}
-
-func (m *MockStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
-	return m.blocked[key], nil
-}
-
-func (m *MockStorage) Block(ctx context.Context, key string, duration time.Duration) error {
-	m.blocked[key] = true
-	return nil
-}
-
-func (m *MockStorage) Reset(ctx context.Context, key string) error {
-	m.counters[key] = 0
-	return nil
-}
-
-func (m *MockStorage) Close() error {
-	return nil
+func newTestStorage(t *testing.T) *storage.MemoryStorage {
+	store := storage.NewMemoryStorage(storage.MemoryOptions{})
+	t.Cleanup(func() { store.Close() })
+	return store
 }
 
 func TestRateLimiterMiddleware_AllowedRequest(t *testing.T) {
-	storage := NewMockStorage()
+	store := newTestStorage(t)
 	tokenLimits := make(map[string]limiter.TokenConfig)
-	rl := limiter.NewRateLimiter(storage, 5, 300, tokenLimits)
+	rl := limiter.NewRateLimiter(store, 5, 300, tokenLimits)
 	middleware := NewRateLimiterMiddleware(rl)
 
 	handler := middleware.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -76,9 +50,9 @@ func TestRateLimiterMiddleware_AllowedRequest(t *testing.T) {
 }
 
 func TestRateLimiterMiddleware_BlockedRequest(t *testing.T) {
-	storage := NewMockStorage()
+	store := newTestStorage(t)
 	tokenLimits := make(map[string]limiter.TokenConfig)
-	rl := limiter.NewRateLimiter(storage, 2, 300, tokenLimits)
+	rl := limiter.NewRateLimiter(store, 2, 300, tokenLimits)
 	middleware := NewRateLimiterMiddleware(rl)
 
 	handler := middleware.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -106,14 +80,14 @@ func TestRateLimiterMiddleware_BlockedRequest(t *testing.T) {
 }
 
 func TestRateLimiterMiddleware_WithToken(t *testing.T) {
-	storage := NewMockStorage()
+	store := newTestStorage(t)
 	tokenLimits := map[string]limiter.TokenConfig{
 		"test-token": {
 			RPS:       10,
 			BlockTime: 300 * time.Second,
 		},
 	}
-	rl := limiter.NewRateLimiter(storage, 2, 300, tokenLimits)
+	rl := limiter.NewRateLimiter(store, 2, 300, tokenLimits)
 	middleware := NewRateLimiterMiddleware(rl)
 
 	handler := middleware.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -132,28 +106,561 @@ func TestRateLimiterMiddleware_WithToken(t *testing.T) {
 	}
 }
 
-func TestExtractIP_XForwardedFor(t *testing.T) {
-	req := httptest.NewRequest("GET", "/", nil)
-	req.Header.Set("X-Forwarded-For", "203.0.113.1, 198.51.100.1")
-	req.RemoteAddr = "192.168.1.1:1234"
+func TestRateLimiterMiddleware_WithRules(t *testing.T) {
+	store := newTestStorage(t)
+	rl := limiter.NewRateLimiter(store, 5, 300, map[string]limiter.TokenConfig{})
+	engine, err := rules.NewEngine([]rules.Rule{
+		{Name: "search", PathPrefix: "/search", Limit: limiter.TokenConfig{RPS: 1, BlockTime: 300 * time.Second}},
+	}, rules.FirstMatch)
+	assert.NoError(t, err)
+	middleware := NewRateLimiterMiddleware(rl, WithRules(engine))
 
-	ip := extractIP(req)
-	assert.Equal(t, "203.0.113.1", ip)
+	handler := middleware.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	codes := []int{}
+	for _, path := range []string{"/search", "/search", "/", "/"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = "192.168.1.1:1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		codes = append(codes, w.Code)
+	}
+
+	// The rule limit only applies to /search
+	assert.Equal(t, []int{http.StatusOK, http.StatusTooManyRequests, http.StatusOK, http.StatusOK}, codes)
 }
 
-func TestExtractIP_XRealIP(t *testing.T) {
-	req := httptest.NewRequest("GET", "/", nil)
-	req.Header.Set("X-Real-IP", "203.0.113.1")
+func TestRateLimiterMiddleware_DryRunRule(t *testing.T) {
+	store := newTestStorage(t)
+	rl := limiter.NewRateLimiter(store, 3, 300, map[string]limiter.TokenConfig{})
+	engine, err := rules.NewEngine([]rules.Rule{
+		{Name: "search", PathPrefix: "/search", Limit: limiter.TokenConfig{RPS: 1, BlockTime: 300 * time.Second, DryRun: true}},
+	}, rules.FirstMatch)
+	assert.NoError(t, err)
+	middleware := NewRateLimiterMiddleware(rl, WithRules(engine))
+
+	handler := middleware.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	codes := []int{}
+	for i := 0; i < 4; i++ {
+		req := httptest.NewRequest("GET", "/search", nil)
+		req.RemoteAddr = "192.168.1.1:1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		codes = append(codes, w.Code)
+		if w.Code == http.StatusOK {
+			assert.Equal(t, "3", w.Header().Get("RateLimit-Limit"))
+		}
+	}
+
+	// The dry run rule lets requests through, the IP limit is still enforced
+	assert.Equal(t, []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusTooManyRequests}, codes)
+}
+
+func TestRateLimiterMiddleware_Cost(t *testing.T) {
+	store := newTestStorage(t)
+	rl := limiter.NewRateLimiter(store, 20, 300, map[string]limiter.TokenConfig{})
+	engine, err := rules.NewEngine([]rules.Rule{
+		{Name: "search", PathPrefix: "/search", Cost: 10},
+	}, rules.FirstMatch)
+	assert.NoError(t, err)
+	middleware := NewRateLimiterMiddleware(rl, WithRules(engine), WithCost(func(r *http.Request) int {
+		n, _ := strconv.Atoi(r.URL.Query().Get("batch"))
+		return n
+	}))
+
+	handler := middleware.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	send := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		req.RemoteAddr = "192.168.1.1:1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Searches weigh 10 on the IP limit, batches their size, the rest one
+	assert.Equal(t, "10", send("/search").Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "7", send("/items?batch=3").Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "6", send("/").Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, http.StatusTooManyRequests, send("/search").Code)
+
+	// A batch larger than the limit can never pass
+	w := send("/items?batch=50")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, `{"error": "request cost exceeds the limit"}`, w.Body.String())
+}
+
+func TestRateLimiterMiddleware_Headers(t *testing.T) {
+	store := newTestStorage(t)
+	rl := limiter.NewRateLimiter(store, 2, 300, map[string]limiter.TokenConfig{})
+	middleware := NewRateLimiterMiddleware(rl)
+
+	handler := middleware.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.168.1.1:1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve()
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Reset"))
+	assert.Equal(t, "1", w.Header().Get("X-RateLimit-Remaining"))
+	assert.Empty(t, w.Header().Get("Retry-After"))
+
+	serve()
+	w = serve()
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "300", w.Header().Get("RateLimit-Reset"))
+	assert.Equal(t, "300", w.Header().Get("Retry-After"))
+}
+
+func TestWriteRateLimitHeaders_RetryAfterAtLeastOneSecond(t *testing.T) {
+	now := time.Now()
+	w := httptest.NewRecorder()
+
+	writeRateLimitHeaders(w, &limiter.LimitResult{Limit: 5, ResetTime: now.Add(200 * time.Millisecond)}, now)
+
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Reset"))
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+}
+
+func TestRateLimiterMiddleware_FailurePolicy(t *testing.T) {
+	rl := limiter.NewRateLimiter(storagetest.Unavailable{}, 5, 300, map[string]limiter.TokenConfig{})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	serve := func(m *RateLimiterMiddleware) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.168.1.1:1234"
+		w := httptest.NewRecorder()
+		m.Middleware(next).ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve(NewRateLimiterMiddleware(rl))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.JSONEq(t, `{"error": "rate limiter unavailable"}`, w.Body.String())
+
+	w = serve(NewRateLimiterMiddleware(rl, WithFailurePolicy(FailOpen)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("RateLimit-Limit"))
+}
+
+// canceledStorage fails evaluations with the error of their context
+type canceledStorage struct {
+	storagetest.Unavailable
+}
+
+func (canceledStorage) Evaluate(ctx context.Context, key string, policy storage.Policy, now time.Time) (*storage.Decision, error) {
+	return nil, ctx.Err()
+}
+
+func TestRateLimiterMiddleware_ClientCanceled(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	rl := limiter.NewRateLimiter(canceledStorage{}, 5, 300, map[string]limiter.TokenConfig{})
+	handler := NewRateLimiterMiddleware(rl, WithFailurePolicy(FailOpen)).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("canceled request reached the handler")
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
 	req.RemoteAddr = "192.168.1.1:1234"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
 
-	ip := extractIP(req)
-	assert.Equal(t, "203.0.113.1", ip)
+	// Neither the failure policy nor the outage log apply
+	assert.Equal(t, StatusClientClosedRequest, w.Code)
+	assert.Empty(t, w.Header().Get("Retry-After"))
+	assert.Empty(t, logged.String())
 }
 
-func TestExtractIP_RemoteAddr(t *testing.T) {
-	req := httptest.NewRequest("GET", "/", nil)
+func TestRateLimiterMiddleware_AccessList(t *testing.T) {
+	store := newTestStorage(t)
+	rl := limiter.NewRateLimiter(store, 1, 300, map[string]limiter.TokenConfig{})
+	allow, _ := access.ParseEntries([]string{"10.0.0.0/8"})
+	deny, _ := access.ParseEntries([]string{"203.0.113.0/24", "token:banned"})
+	middleware := NewRateLimiterMiddleware(rl, WithAccessList(access.New(store, access.Lists{Allow: allow, Deny: deny})))
+
+	handler := middleware.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	send := func(remoteAddr, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		if token != "" {
+			req.Header.Set("API_KEY", token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Allowed networks are not counted
+	for i := 0; i < 3; i++ {
+		w := send("10.1.2.3:1234", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Header().Get("RateLimit-Limit"))
+	}
+
+	w := send("203.0.113.5:1234", "")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.JSONEq(t, `{"error": "access denied"}`, w.Body.String())
+	assert.Equal(t, http.StatusForbidden, send("192.168.1.1:1234", "banned").Code)
+
+	assert.Equal(t, http.StatusOK, send("192.168.1.1:1234", "").Code)
+	assert.Equal(t, http.StatusTooManyRequests, send("192.168.1.1:1234", "").Code)
+}
+
+func TestRateLimiterMiddleware_AccessList_IPv6Address(t *testing.T) {
+	store := newTestStorage(t)
+	rl := limiter.NewRateLimiter(store, 100, 0, map[string]limiter.TokenConfig{})
+	deny, _ := access.ParseEntries([]string{"2001:db8::7"})
+	extractor, err := NewIPExtractor(nil, 64)
+	require.NoError(t, err)
+	middleware := NewRateLimiterMiddleware(rl,
+		WithIPExtractor(extractor),
+		WithAccessList(access.New(store, access.Lists{Deny: deny})),
+	)
+
+	handler := middleware.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	send := func(remoteAddr string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Single addresses match although limits apply to the whole /64
+	assert.Equal(t, http.StatusForbidden, send("[2001:db8::7]:1234"))
+	assert.Equal(t, http.StatusOK, send("[2001:db8::8]:1234"))
+}
+
+func TestRateLimiterMiddleware_KeyRegistry(t *testing.T) {
+	store := newTestStorage(t)
+	rl := limiter.NewRateLimiter(store, 1, 0, map[string]limiter.TokenConfig{"abc123": {RPS: 5}})
+	limits := rl.Limits()
+	limits.Plans = map[string]limiter.TokenConfig{"pro": {RPS: 2, Plan: "pro"}}
+	rl.SetLimits(limits)
+
+	ctx := context.Background()
+	registry := apikey.NewRegistry(store)
+	valid, _, err := registry.Create(ctx, "alice", "pro", time.Time{})
+	assert.NoError(t, err)
+	revoked, k, err := registry.Create(ctx, "bob", "pro", time.Time{})
+	assert.NoError(t, err)
+	_, err = registry.Revoke(ctx, k.ID)
+	assert.NoError(t, err)
+
+	handler := NewRateLimiterMiddleware(rl, WithKeyRegistry(registry)).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	send := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.168.1.1:1234"
+		req.Header.Set("API_KEY", token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Registered keys get the limit of their plan
+	for i := 0; i < 2; i++ {
+		w := send(valid)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+	}
+	assert.Equal(t, http.StatusTooManyRequests, send(valid).Code)
+
+	// Unknown keys no longer fall back to the IP limit
+	// and get the same answer whatever the reason, so keys can't be probed
+	w := send("unknown")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.JSONEq(t, `{"error": "invalid API key"}`, w.Body.String())
+	w = send(revoked)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.JSONEq(t, `{"error": "invalid API key"}`, w.Body.String())
+
+	// Tokens configured with their own limits keep working
+	assert.Equal(t, http.StatusOK, send("abc123").Code)
+}
+
+func TestRateLimiterMiddleware_Tenants(t *testing.T) {
+	store := storage.NewNamespacedStorage(newTestStorage(t), "")
+	rl := limiter.NewRateLimiter(store, 1, 0, map[string]limiter.TokenConfig{})
+	limits := rl.Limits()
+	limits.Tenants = map[string]limiter.TokenConfig{"acme": {RPS: 2}, "globex": {RPS: 1}}
+	rl.SetLimits(limits)
+
+	extractor, err := NewIPExtractor([]string{"10.0.0.1"}, 64)
+	require.NoError(t, err)
+	handler := NewRateLimiterMiddleware(rl,
+		WithIPExtractor(extractor),
+		WithTenants(NewTenantResolver("X-Tenant-ID", extractor, rl)),
+	).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	send := func(tenant string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-Forwarded-For", "192.168.1.1")
+		if tenant != "" {
+			req.Header.Set("X-Tenant-ID", tenant)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Each tenant has its own limit and counters for the same IP
+	assert.Equal(t, http.StatusOK, send("acme").Code)
+	assert.Equal(t, http.StatusOK, send("acme").Code)
+	assert.Equal(t, http.StatusTooManyRequests, send("acme").Code)
+	assert.Equal(t, http.StatusOK, send("globex").Code)
+	assert.Equal(t, http.StatusTooManyRequests, send("globex").Code)
+	assert.Equal(t, http.StatusOK, send("").Code)
+
+	w := send("initech")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, `{"error": "unknown tenant"}`, w.Body.String())
+}
+
+func TestRateLimiterMiddleware_Tenants_UntrustedPeer(t *testing.T) {
+	store := storage.NewNamespacedStorage(newTestStorage(t), "")
+	rl := limiter.NewRateLimiter(store, 1, 0, map[string]limiter.TokenConfig{})
+	limits := rl.Limits()
+	limits.Tenants = map[string]limiter.TokenConfig{"acme": {RPS: 100}}
+	rl.SetLimits(limits)
+
+	extractor, err := NewIPExtractor([]string{"10.0.0.1"}, 64)
+	require.NoError(t, err)
+	handler := NewRateLimiterMiddleware(rl,
+		WithIPExtractor(extractor),
+		WithTenants(NewTenantResolver("X-Tenant-ID", extractor, rl)),
+	).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	send := func(tenant string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.168.1.1:1234"
+		req.Header.Set("X-Tenant-ID", tenant)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Clients connecting directly can't pick the tenant with the highest
+	// limit: the header is ignored and the default IP limit applies
+	assert.Equal(t, http.StatusOK, send("acme").Code)
+	assert.Equal(t, http.StatusTooManyRequests, send("acme").Code)
+	assert.Equal(t, http.StatusTooManyRequests, send("initech").Code)
+}
+
+// contextStorage records the context of the last evaluation
+type contextStorage struct {
+	*storage.MemoryStorage
+	ctx context.Context
+}
+
+func (s *contextStorage) Evaluate(ctx context.Context, key string, policy storage.Policy, now time.Time) (*storage.Decision, error) {
+	s.ctx = ctx
+	return s.MemoryStorage.Evaluate(ctx, key, policy, now)
+}
+
+func TestRateLimiterMiddleware_RequestContext(t *testing.T) {
+	store := &contextStorage{MemoryStorage: newTestStorage(t)}
+	rl := limiter.NewRateLimiter(store, 5, 300, map[string]limiter.TokenConfig{})
+	limits := rl.Limits()
+	limits.Tenants = map[string]limiter.TokenConfig{"acme": {RPS: 5}}
+	rl.SetLimits(limits)
+
+	extractor, err := NewIPExtractor([]string{"192.168.1.1"}, 64)
+	require.NoError(t, err)
+	handler := NewRateLimiterMiddleware(rl,
+		WithIPExtractor(extractor),
+		WithTenants(NewTenantResolver("X-Tenant-ID", extractor, rl)),
+	).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	type requestKey struct{}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), requestKey{}, "request"))
+	req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
 	req.RemoteAddr = "192.168.1.1:1234"
+	req.Header.Set("X-Tenant-ID", "acme")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// The storage sees the values, cancellation and tenant of the request
+	assert.Equal(t, "request", store.ctx.Value(requestKey{}))
+	assert.Equal(t, "acme", storage.Namespace(store.ctx))
+	cancel()
+	assert.ErrorIs(t, store.ctx.Err(), context.Canceled)
+}
+
+func TestUsageHandler(t *testing.T) {
+	store := newTestStorage(t)
+	rl := limiter.NewRateLimiter(store, 5, 300, map[string]limiter.TokenConfig{
+		"abc123": {RPS: 10, Plan: "pro", Quotas: []limiter.Quota{{Name: "day", Limit: 100, Window: 24 * time.Hour}}},
+	})
+	rl.Allow(context.Background(), "192.168.1.1", "abc123")
+
+	serve := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/usage", nil)
+		if token != "" {
+			req.Header.Set("API_KEY", token)
+		}
+		w := httptest.NewRecorder()
+		UsageHandler(rl, nil).ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve("abc123")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var body struct {
+		Plan   string
+		Quotas []struct {
+			Window    string
+			Limit     int
+			Used      int
+			Remaining int
+		}
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, "pro", body.Plan)
+	assert.Len(t, body.Quotas, 1)
+	assert.Equal(t, "day", body.Quotas[0].Window)
+	assert.Equal(t, 1, body.Quotas[0].Used)
+	assert.Equal(t, 99, body.Quotas[0].Remaining)
+
+	assert.Equal(t, http.StatusUnauthorized, serve("").Code)
+	assert.Equal(t, http.StatusUnauthorized, serve("unknown").Code)
+}
+
+func TestUsageHandler_KeyRegistry(t *testing.T) {
+	store := newTestStorage(t)
+	rl := limiter.NewRateLimiter(store, 5, 300, map[string]limiter.TokenConfig{})
+	rl.SetLimits(limiter.Limits{
+		IP:    limiter.TokenConfig{RPS: 5},
+		Plans: map[string]limiter.TokenConfig{"pro": {RPS: 10, Plan: "pro", Quotas: []limiter.Quota{{Name: "day", Limit: 100, Window: 24 * time.Hour}}}},
+	})
+	registry := apikey.NewRegistry(store)
+	secret, k, err := registry.Create(context.Background(), "alice", "pro", time.Time{})
+	assert.NoError(t, err)
+	rl.AllowKeyN(context.Background(), "192.168.1.1", k.ID, k.Plan, 3)
+
+	req := httptest.NewRequest("GET", "/usage", nil)
+	req.Header.Set("API_KEY", secret)
+	w := httptest.NewRecorder()
+	UsageHandler(rl, registry).ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"used":3`)
+
+	req.Header.Set("API_KEY", "unknown")
+	w = httptest.NewRecorder()
+	UsageHandler(rl, registry).ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.JSONEq(t, `{"error": "invalid API key"}`, w.Body.String())
+
+	// Revoked keys can't be told apart from unknown ones
+	_, err = registry.Revoke(context.Background(), k.ID)
+	assert.NoError(t, err)
+	req.Header.Set("API_KEY", secret)
+	w = httptest.NewRecorder()
+	UsageHandler(rl, registry).ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.JSONEq(t, `{"error": "invalid API key"}`, w.Body.String())
+}
+
+func TestUsageHandler_IPLimit(t *testing.T) {
+	store := newTestStorage(t)
+	rl := limiter.NewRateLimiter(store, 5, 300, map[string]limiter.TokenConfig{
+		"abc123": {RPS: 10},
+	})
+	handler := UsageHandler(rl, nil, WithUsageIPLimit(&IPExtractor{ipv6PrefixLen: 128}, limiter.TokenConfig{RPS: 2, BlockTime: time.Minute}))
+
+	serve := func(ip, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/usage", nil)
+		req.RemoteAddr = ip + ":1234"
+		req.Header.Set("API_KEY", token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Guesses count against the IP, valid key or not
+	assert.Equal(t, http.StatusUnauthorized, serve("192.168.1.1", "guess1").Code)
+	assert.Equal(t, http.StatusOK, serve("192.168.1.1", "abc123").Code)
+	w := serve("192.168.1.1", "abc123")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+
+	assert.Equal(t, http.StatusOK, serve("192.168.1.2", "abc123").Code)
+}
+
+func TestWriteError_EscapesMessage(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeError(w, http.StatusBadRequest, `bad "value"`)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"error": "bad \"value\""}`, w.Body.String())
+}
+
+func TestUsageHandler_Tenants(t *testing.T) {
+	store := storage.NewNamespacedStorage(newTestStorage(t), "")
+	rl := limiter.NewRateLimiter(store, 5, 300, map[string]limiter.TokenConfig{
+		"abc123": {RPS: 10, Quotas: []limiter.Quota{{Name: "day", Limit: 100, Window: 24 * time.Hour}}},
+	})
+	limits := rl.Limits()
+	limits.Tenants = map[string]limiter.TokenConfig{"acme": {RPS: 5}}
+	rl.SetLimits(limits)
+	rl.Allow(storage.WithNamespace(context.Background(), "acme"), "192.168.1.1", "abc123")
+
+	extractor, err := NewIPExtractor([]string{"10.0.0.1"}, 64)
+	require.NoError(t, err)
+	handler := UsageHandler(rl, nil, WithUsageTenants(NewTenantResolver("X-Tenant-ID", extractor, rl)))
+	used := func(remoteAddr string) int {
+		req := httptest.NewRequest("GET", "/usage", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("API_KEY", "abc123")
+		req.Header.Set("X-Tenant-ID", "acme")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var body struct{ Quotas []struct{ Used int } }
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		require.Len(t, body.Quotas, 1)
+		return body.Quotas[0].Used
+	}
 
-	ip := extractIP(req)
-	assert.Equal(t, "192.168.1.1", ip)
+	// The usage of the tenant is only reported through a trusted proxy
+	assert.Equal(t, 1, used("10.0.0.1:1234"))
+	assert.Equal(t, 0, used("192.168.1.1:1234"))
 }
@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/goxprts/ratelimiter/internal/limiter"
+	"github.com/goxprts/ratelimiter/internal/storage"
+)
+
+// ErrUnknownTenant is returned for tenants without configured limits
+var ErrUnknownTenant = errors.New("unknown tenant")
+
+// TenantResolver resolves the tenant requests are counted under. The tenant
+// header is only read from requests coming directly from a trusted proxy,
+// which must set or strip it; clients connecting directly cannot pick a
+// tenant and are counted in the default namespace.
+type TenantResolver struct {
+	header      string
+	ipExtractor *IPExtractor
+	limiter     *limiter.RateLimiter
+}
+
+// NewTenantResolver reads the tenant from header on requests from the
+// proxies trusted by ipExtractor. Tenants are known while rl has limits for
+// them, so reloaded limits apply at once.
+func NewTenantResolver(header string, ipExtractor *IPExtractor, rl *limiter.RateLimiter) *TenantResolver {
+	return &TenantResolver{header: header, ipExtractor: ipExtractor, limiter: rl}
+}
+
+// Tenant returns the tenant named by r, empty for none. A nil resolver
+// never finds one.
+func (t *TenantResolver) Tenant(r *http.Request) string {
+	if t == nil || t.header == "" || !t.ipExtractor.TrustedPeer(r) {
+		return ""
+	}
+	return r.Header.Get(t.header)
+}
+
+// Context returns the context of r in the namespace of its tenant, or
+// ErrUnknownTenant
+func (t *TenantResolver) Context(r *http.Request) (context.Context, error) {
+	return t.Namespace(r.Context(), t.Tenant(r))
+}
+
+// Namespace returns ctx in the namespace of tenant, e.g. one named by an
+// admin. An empty tenant leaves ctx unchanged.
+func (t *TenantResolver) Namespace(ctx context.Context, tenant string) (context.Context, error) {
+	if tenant == "" {
+		return ctx, nil
+	}
+	if t == nil {
+		return nil, ErrUnknownTenant
+	}
+	if _, known := t.limiter.Limits().Tenants[tenant]; !known {
+		return nil, ErrUnknownTenant
+	}
+	return storage.WithNamespace(ctx, tenant), nil
+}
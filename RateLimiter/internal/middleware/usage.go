@@ -0,0 +1,140 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/goxprts/ratelimiter/internal/apikey"
+	"github.com/goxprts/ratelimiter/internal/limiter"
+)
+
+type usageResponse struct {
+	Plan   string       `json:"plan,omitempty"`
+	Quotas []quotaUsage `json:"quotas"`
+}
+
+type quotaUsage struct {
+	Window       string    `json:"window"`
+	Limit        int       `json:"limit"`
+	Used         int       `json:"used"`
+	Remaining    int       `json:"remaining"`
+	Reset        time.Time `json:"reset"`
+	ResetSeconds int       `json:"reset_seconds"`
+}
+
+// usageRule names the limit on usage queries per client IP
+const usageRule = "usage"
+
+// UsageOption configures optional UsageHandler behavior
+type UsageOption func(*usageHandler)
+
+// WithUsageTenants reports the usage counted in the namespace of the tenant
+// of each query
+func WithUsageTenants(tenants *TenantResolver) UsageOption {
+	return func(h *usageHandler) {
+		h.tenants = tenants
+	}
+}
+
+// WithUsageIPLimit limits the usage queries of each client IP, resolved by
+// extractor, so the endpoint can't be used to guess keys
+func WithUsageIPLimit(extractor *IPExtractor, limit limiter.TokenConfig) UsageOption {
+	return func(h *usageHandler) {
+		h.ipExtractor = extractor
+		h.ipLimit = &limit
+	}
+}
+
+type usageHandler struct {
+	limiter     *limiter.RateLimiter
+	registry    *apikey.Registry
+	ipExtractor *IPExtractor
+	ipLimit     *limiter.TokenConfig
+	tenants     *TenantResolver
+}
+
+// UsageHandler reports the quota usage of the token sent in the API_KEY
+// header, which may also be a key of registry when it is not nil. Querying
+// it does not count against the limits it reports. Unknown, expired and
+// revoked keys get the same 401, so the answers tell nothing about them.
+func UsageHandler(rl *limiter.RateLimiter, registry *apikey.Registry, opts ...UsageOption) http.Handler {
+	h := &usageHandler{limiter: rl, registry: registry}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+func (h *usageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	ctx, err := h.tenants.Context(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if h.ipLimit != nil {
+		result, err := h.limiter.AllowRule(ctx, usageRule, h.ipExtractor.ClientIP(r), *h.ipLimit)
+		if err != nil {
+			logUnavailable("usage limiter", FailClosed, err)
+			writeError(w, http.StatusServiceUnavailable, "usage unavailable")
+			return
+		}
+		writeRateLimitHeaders(w, result, time.Now())
+		if !result.Allowed {
+			writeError(w, http.StatusTooManyRequests, result.Message)
+			return
+		}
+	}
+
+	token := r.Header.Get("API_KEY")
+	if token == "" {
+		writeError(w, http.StatusUnauthorized, "missing API_KEY header")
+		return
+	}
+
+	usage, err := h.limiter.Usage(ctx, token)
+	if errors.Is(err, limiter.ErrUnknownToken) && h.registry != nil {
+		if key, keyErr := h.registry.Lookup(token); keyErr == nil {
+			usage, err = h.limiter.KeyUsage(ctx, key.ID, key.Plan)
+		}
+	}
+	if errors.Is(err, limiter.ErrUnknownToken) {
+		writeError(w, http.StatusUnauthorized, "invalid API key")
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		writeError(w, StatusClientClosedRequest, "request canceled")
+		return
+	}
+	if err != nil {
+		log.Printf("failed to get quota usage: %v", err)
+		writeError(w, http.StatusServiceUnavailable, "usage unavailable")
+		return
+	}
+
+	now := time.Now()
+	resp := usageResponse{Plan: usage.Plan, Quotas: make([]quotaUsage, 0, len(usage.Quotas))}
+	for _, q := range usage.Quotas {
+		resp.Quotas = append(resp.Quotas, quotaUsage{
+			Window:       q.Name,
+			Limit:        q.Limit,
+			Used:         q.Used,
+			Remaining:    q.Remaining,
+			Reset:        q.ResetTime.UTC(),
+			ResetSeconds: max(0, int(math.Ceil(q.ResetTime.Sub(now).Seconds()))),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
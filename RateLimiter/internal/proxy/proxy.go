@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Route sends requests whose path starts with PathPrefix to Upstream
+type Route struct {
+	PathPrefix string
+	Upstream   string
+}
+
+// Options configures the reverse proxy. Zero values use the defaults.
+type Options struct {
+	// DialTimeout bounds connecting to an upstream (default 5s)
+	DialTimeout time.Duration
+	// ResponseTimeout bounds waiting for the upstream response headers
+	// (default 30s). Bodies are streamed without a deadline.
+	ResponseTimeout time.Duration
+	// StripPrefix removes the route prefix from the forwarded path
+	StripPrefix bool
+	// PreserveHost forwards the client Host header instead of the upstream's
+	PreserveHost bool
+	// TrustForwarded reports whether the X-Forwarded-For chain of a request
+	// is kept. Untrusted chains are replaced by the connection address.
+	TrustForwarded func(*http.Request) bool
+}
+
+// Proxy forwards requests to the upstream of the longest matching route
+type Proxy struct {
+	routes []route
+}
+
+type route struct {
+	prefix  string
+	handler *httputil.ReverseProxy
+}
+
+// New validates the routes and builds the proxy
+func New(routes []Route, opts Options) (*Proxy, error) {
+	if len(routes) == 0 {
+		return nil, errors.New("no proxy routes")
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = 5 * time.Second
+	}
+	if opts.ResponseTimeout <= 0 {
+		opts.ResponseTimeout = 30 * time.Second
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   opts.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.ResponseHeaderTimeout = opts.ResponseTimeout
+
+	p := &Proxy{}
+	for i, r := range routes {
+		if !strings.HasPrefix(r.PathPrefix, "/") {
+			return nil, fmt.Errorf("route %d: path prefix %q must start with /", i+1, r.PathPrefix)
+		}
+		target, err := url.Parse(r.Upstream)
+		if err != nil {
+			return nil, fmt.Errorf("route %d: invalid upstream: %w", i+1, err)
+		}
+		if (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			return nil, fmt.Errorf("route %d: upstream %q must be an absolute http or https URL", i+1, r.Upstream)
+		}
+
+		p.routes = append(p.routes, route{
+			prefix:  r.PathPrefix,
+			handler: newReverseProxy(r.PathPrefix, target, transport, opts),
+		})
+	}
+
+	// Longest prefix first so the most specific route wins
+	sort.SliceStable(p.routes, func(i, j int) bool {
+		return len(p.routes[i].prefix) > len(p.routes[j].prefix)
+	})
+	return p, nil
+}
+
+func newReverseProxy(prefix string, target *url.URL, transport http.RoundTripper, opts Options) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			if opts.StripPrefix {
+				path := strings.TrimPrefix(pr.In.URL.Path, prefix)
+				if !strings.HasPrefix(path, "/") {
+					path = "/" + path
+				}
+				pr.Out.URL.Path = path
+				pr.Out.URL.RawPath = ""
+			}
+			pr.SetURL(target)
+			if opts.PreserveHost {
+				pr.Out.Host = pr.In.Host
+			}
+			if opts.TrustForwarded != nil && opts.TrustForwarded(pr.In) {
+				pr.Out.Header["X-Forwarded-For"] = pr.In.Header["X-Forwarded-For"]
+			}
+			pr.SetXForwarded()
+		},
+		Transport: transport,
+		// Flush every write so streamed responses reach the client immediately
+		FlushInterval: -1,
+		ErrorHandler:  handleError,
+	}
+}
+
+// handleError answers 504 when the upstream timed out and 502 otherwise
+func handleError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, context.Canceled) {
+		// The client went away, nobody is reading the response
+		return
+	}
+	log.Printf("proxy error for %s %s: %v", r.Method, r.URL.Path, err)
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		writeError(w, http.StatusGatewayTimeout, "upstream timed out")
+		return
+	}
+	writeError(w, http.StatusBadGateway, "upstream unavailable")
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, route := range p.routes {
+		if strings.HasPrefix(r.URL.Path, route.prefix) {
+			route.handler.ServeHTTP(w, r)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "no upstream for path")
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
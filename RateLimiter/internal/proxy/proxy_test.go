@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echoUpstream answers with its name and the path and headers it received
+func echoUpstream(t *testing.T, name string) *httptest.Server {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s|%s|%s|%s", name, r.Method, r.URL.RequestURI(), r.Header.Get("X-Forwarded-For"), r.Header.Get("API_KEY"), body)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func serve(h http.Handler, method, target, body string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.RemoteAddr = "192.168.1.1:1234"
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestProxy_Routes(t *testing.T) {
+	api := echoUpstream(t, "api")
+	web := echoUpstream(t, "web")
+	p, err := New([]Route{
+		{PathPrefix: "/", Upstream: web.URL},
+		{PathPrefix: "/api", Upstream: api.URL + "/v1"},
+	}, Options{})
+	require.NoError(t, err)
+
+	w := serve(p, "POST", "/api/users?page=2", "payload", http.Header{"Api_key": {"abc123"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "api POST /v1/api/users?page=2|192.168.1.1|abc123|payload", w.Body.String())
+
+	w = serve(p, "GET", "/index.html", "", nil)
+	assert.Equal(t, "web GET /index.html|192.168.1.1||", w.Body.String())
+}
+
+func TestProxy_StripPrefix(t *testing.T) {
+	api := echoUpstream(t, "api")
+	p, err := New([]Route{{PathPrefix: "/api", Upstream: api.URL}}, Options{StripPrefix: true})
+	require.NoError(t, err)
+
+	assert.Equal(t, "api GET /users|192.168.1.1||", serve(p, "GET", "/api/users", "", nil).Body.String())
+	assert.Equal(t, "api GET /|192.168.1.1||", serve(p, "GET", "/api", "", nil).Body.String())
+}
+
+func TestProxy_ForwardedFor(t *testing.T) {
+	api := echoUpstream(t, "api")
+	header := http.Header{"X-Forwarded-For": {"203.0.113.7"}}
+
+	p, err := New([]Route{{PathPrefix: "/", Upstream: api.URL}}, Options{})
+	require.NoError(t, err)
+	assert.Equal(t, "api GET /|192.168.1.1||", serve(p, "GET", "/", "", header).Body.String())
+
+	p, err = New([]Route{{PathPrefix: "/", Upstream: api.URL}}, Options{
+		TrustForwarded: func(*http.Request) bool { return true },
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "api GET /|203.0.113.7, 192.168.1.1||", serve(p, "GET", "/", "", header).Body.String())
+}
+
+func TestProxy_Streaming(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first\n"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("second\n"))
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	p, err := New([]Route{{PathPrefix: "/", Upstream: upstream.URL}}, Options{})
+	require.NoError(t, err)
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	// The first chunk arrives while the upstream is still writing
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "first\n", line)
+}
+
+func TestProxy_Errors(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	p, err := New([]Route{
+		{PathPrefix: "/slow", Upstream: slow.URL},
+		{PathPrefix: "/down", Upstream: down.URL},
+	}, Options{ResponseTimeout: 50 * time.Millisecond})
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusGatewayTimeout, serve(p, "GET", "/slow", "", nil).Code)
+	assert.Equal(t, http.StatusBadGateway, serve(p, "GET", "/down", "", nil).Code)
+
+	w := serve(p, "GET", "/other", "", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.JSONEq(t, `{"error": "no upstream for path"}`, w.Body.String())
+}
+
+func TestNew_InvalidRoutes(t *testing.T) {
+	_, err := New(nil, Options{})
+	assert.Error(t, err)
+
+	_, err = New([]Route{{PathPrefix: "api", Upstream: "http://api"}}, Options{})
+	assert.Error(t, err)
+
+	_, err = New([]Route{{PathPrefix: "/api", Upstream: "api:8080"}}, Options{})
+	assert.Error(t, err)
+}
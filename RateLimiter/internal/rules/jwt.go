@@ -0,0 +1,86 @@
+package rules
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseClaims returns the claims of the bearer token in the Authorization
+// header. The token must carry a valid HS256 signature with secret and be
+// valid at now according to its exp and nbf claims.
+func parseClaims(r *http.Request, secret []byte, now time.Time) map[string]string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return nil
+	}
+
+	parts := strings.Split(strings.TrimSpace(auth[7:]), ".")
+	if len(parts) != 3 {
+		return nil
+	}
+
+	if !validSignature(parts, secret) {
+		return nil
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(payload, &raw); err != nil {
+		return nil
+	}
+
+	if exp, ok := raw["exp"].(float64); ok && !now.Before(time.Unix(int64(exp), 0)) {
+		return nil
+	}
+	if nbf, ok := raw["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0)) {
+		return nil
+	}
+
+	claims := make(map[string]string, len(raw))
+	for name, value := range raw {
+		switch v := value.(type) {
+		case string:
+			claims[name] = v
+		case float64:
+			claims[name] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			claims[name] = strconv.FormatBool(v)
+		}
+	}
+	return claims
+}
+
+func validSignature(parts []string, secret []byte) bool {
+	if len(secret) == 0 {
+		return false
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(header, &h); err != nil || h.Alg != "HS256" {
+		return false
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	return hmac.Equal(signature, mac.Sum(nil))
+}
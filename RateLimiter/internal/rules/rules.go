@@ -0,0 +1,271 @@
+package rules
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/goxprts/ratelimiter/internal/limiter"
+)
+
+// MatchMode decides which rule applies when several match a request
+type MatchMode string
+
+const (
+	// FirstMatch applies the first matching rule in declaration order
+	FirstMatch MatchMode = "first"
+	// MostSpecific applies the matching rule with the most conditions,
+	// breaking ties by the longest path prefix
+	MostSpecific MatchMode = "most_specific"
+)
+
+// Rule declares a limit for requests matching all of its conditions.
+// Empty conditions match every request.
+type Rule struct {
+	Name       string
+	PathPrefix string
+	Methods    []string
+	// Headers maps header names to required values; an empty value only
+	// requires the header to be present
+	Headers map[string]string
+	// Claims maps JWT claim names to required values; an empty value only
+	// requires the claim to be present
+	Claims map[string]string
+	// KeyBy selects what the counter is keyed on: ip (default), token,
+	// header:<name>, claim:<name> or global
+	KeyBy string
+	Limit limiter.TokenConfig
+	// Cost is the number of units a matching request takes, defaulting to
+	// one. A rule with a cost and no RPS only weighs requests on the IP and
+	// token limits instead of applying a limit of its own.
+	Cost int
+	// Queue delays requests over the limit until quota frees up instead of
+	// rejecting them. The zero value rejects immediately.
+	Queue Queue
+}
+
+// Queue bounds how requests wait for quota
+type Queue struct {
+	// MaxWait is the longest a request waits before being rejected
+	MaxWait time.Duration
+	// Size caps the requests waiting per key on each instance, defaulting
+	// to DefaultQueueSize
+	Size int
+}
+
+// DefaultQueueSize is the queue size used when Queue.Size is zero
+const DefaultQueueSize = 100
+
+// Enabled reports whether requests wait instead of being rejected
+func (q Queue) Enabled() bool {
+	return q.MaxWait > 0
+}
+
+// WeightOnly reports whether the rule only sets the cost of requests
+func (r *Rule) WeightOnly() bool {
+	return r.Limit.RPS == 0 && r.Cost > 0
+}
+
+// Match is the rule applied to a request and the identity it is counted under
+type Match struct {
+	Rule     *Rule
+	Identity string
+}
+
+// Option configures optional Engine behavior
+type Option func(*Engine)
+
+// WithJWTSecret requires JWT claims to carry a valid HS256 signature
+func WithJWTSecret(secret []byte) Option {
+	return func(e *Engine) {
+		e.jwtSecret = secret
+	}
+}
+
+// Engine selects the rule that applies to each request
+type Engine struct {
+	rules     []Rule
+	mode      MatchMode
+	jwtSecret []byte
+	now       func() time.Time
+}
+
+func NewEngine(rules []Rule, mode MatchMode, opts ...Option) (*Engine, error) {
+	if mode == "" {
+		mode = FirstMatch
+	}
+	if mode != FirstMatch && mode != MostSpecific {
+		return nil, fmt.Errorf("unknown rule match mode %q", mode)
+	}
+
+	names := make(map[string]bool, len(rules))
+	for i, rule := range rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("rule %d: name is required", i)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("rule %q: duplicate name", rule.Name)
+		}
+		names[rule.Name] = true
+
+		if err := ValidateKeyBy(rule.KeyBy); err != nil {
+			return nil, fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+		if rule.Cost < 0 {
+			return nil, fmt.Errorf("rule %q: cost must not be negative", rule.Name)
+		}
+		if rule.Limit.RPS <= 0 && !rule.WeightOnly() {
+			return nil, fmt.Errorf("rule %q: rps must be positive", rule.Name)
+		}
+		if !rule.WeightOnly() && rule.Cost > rule.Limit.Capacity() {
+			return nil, fmt.Errorf("rule %q: cost must not exceed the limit", rule.Name)
+		}
+		if rule.Queue.MaxWait < 0 || rule.Queue.Size < 0 {
+			return nil, fmt.Errorf("rule %q: queue max wait and size must not be negative", rule.Name)
+		}
+		if rule.Queue.Enabled() && rule.WeightOnly() {
+			return nil, fmt.Errorf("rule %q: queue requires a limit of its own", rule.Name)
+		}
+	}
+
+	e := &Engine{
+		rules: rules,
+		mode:  mode,
+		now:   time.Now,
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+
+	// Unsigned claims could be forged to pick any identity or condition
+	if e.usesClaims() && len(e.jwtSecret) == 0 {
+		return nil, fmt.Errorf("rules with claim conditions or key_by claim: require a JWT secret")
+	}
+	return e, nil
+}
+
+// ValidateKeyBy reports whether keyBy is a supported Rule.KeyBy value
+func ValidateKeyBy(keyBy string) error {
+	switch {
+	case keyBy == "", keyBy == "ip", keyBy == "token", keyBy == "global":
+		return nil
+	case strings.HasPrefix(keyBy, "header:") && len(keyBy) > len("header:"):
+		return nil
+	case strings.HasPrefix(keyBy, "claim:") && len(keyBy) > len("claim:"):
+		return nil
+	}
+	return fmt.Errorf("invalid key_by %q", keyBy)
+}
+
+// Match returns the rule that applies to r, or nil if none does
+func (e *Engine) Match(r *http.Request, ip string, token string) *Match {
+	var claims map[string]string
+	if e.usesClaims() {
+		claims = parseClaims(r, e.jwtSecret, e.now())
+	}
+
+	var best *Match
+	bestScore := -1
+	for i := range e.rules {
+		rule := &e.rules[i]
+		if !rule.matches(r, claims) {
+			continue
+		}
+
+		identity, ok := rule.identity(r, ip, token, claims)
+		if !ok {
+			continue
+		}
+
+		if e.mode == FirstMatch {
+			return &Match{Rule: rule, Identity: identity}
+		}
+		if score := rule.specificity(); score > bestScore {
+			best, bestScore = &Match{Rule: rule, Identity: identity}, score
+		}
+	}
+	return best
+}
+
+func (e *Engine) usesClaims() bool {
+	for _, rule := range e.rules {
+		if len(rule.Claims) > 0 || strings.HasPrefix(rule.KeyBy, "claim:") {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *Rule) matches(r *http.Request, claims map[string]string) bool {
+	if rule.PathPrefix != "" && !matchesPath(r.URL.Path, rule.PathPrefix) {
+		return false
+	}
+
+	if len(rule.Methods) > 0 {
+		found := false
+		for _, method := range rule.Methods {
+			if strings.EqualFold(method, r.Method) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for name, want := range rule.Headers {
+		got := r.Header.Get(name)
+		if got == "" || (want != "" && got != want) {
+			return false
+		}
+	}
+
+	for name, want := range rule.Claims {
+		got, ok := claims[name]
+		if !ok || (want != "" && got != want) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchesPath reports whether path is prefix or lies under it, so /api
+// matches /api and /api/users but not /apix
+func matchesPath(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// identity returns the value the rule counts requests under
+func (rule *Rule) identity(r *http.Request, ip string, token string, claims map[string]string) (string, bool) {
+	switch {
+	case rule.KeyBy == "" || rule.KeyBy == "ip":
+		return ip, true
+	case rule.KeyBy == "token":
+		return token, token != ""
+	case rule.KeyBy == "global":
+		return "global", true
+	case strings.HasPrefix(rule.KeyBy, "header:"):
+		value := r.Header.Get(strings.TrimPrefix(rule.KeyBy, "header:"))
+		return value, value != ""
+	default:
+		value, ok := claims[strings.TrimPrefix(rule.KeyBy, "claim:")]
+		return value, ok && value != ""
+	}
+}
+
+func (rule *Rule) specificity() int {
+	conditions := len(rule.Headers) + len(rule.Claims)
+	if rule.PathPrefix != "" {
+		conditions++
+	}
+	if len(rule.Methods) > 0 {
+		conditions++
+	}
+	return conditions<<16 + len(rule.PathPrefix)
+}
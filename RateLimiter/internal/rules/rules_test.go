@@ -0,0 +1,153 @@
+package rules
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/goxprts/ratelimiter/internal/limiter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func makeJWT(payload string, secret []byte) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	body := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(header + "." + body))
+	return header + "." + body + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+var limit = limiter.TokenConfig{RPS: 1}
+
+func TestEngine_FirstMatch(t *testing.T) {
+	engine, err := NewEngine([]Rule{
+		{Name: "api", PathPrefix: "/api", Limit: limit},
+		{Name: "search", PathPrefix: "/api/search", Methods: []string{"GET"}, Limit: limit},
+	}, FirstMatch)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/api/search?q=go", nil)
+	match := engine.Match(req, "10.0.0.1", "")
+	require.NotNil(t, match)
+	assert.Equal(t, "api", match.Rule.Name)
+	assert.Equal(t, "10.0.0.1", match.Identity)
+
+	assert.Nil(t, engine.Match(httptest.NewRequest("GET", "/other", nil), "10.0.0.1", ""))
+
+	// Prefixes end at path segments
+	assert.NotNil(t, engine.Match(httptest.NewRequest("GET", "/api", nil), "10.0.0.1", ""))
+	assert.Nil(t, engine.Match(httptest.NewRequest("GET", "/apix", nil), "10.0.0.1", ""))
+}
+
+func TestEngine_MostSpecific(t *testing.T) {
+	engine, err := NewEngine([]Rule{
+		{Name: "api", PathPrefix: "/api", Limit: limit},
+		{Name: "search", PathPrefix: "/api/search", Limit: limit},
+		{Name: "search-post", PathPrefix: "/api/search", Methods: []string{"POST"}, Limit: limit},
+	}, MostSpecific)
+	require.NoError(t, err)
+
+	match := engine.Match(httptest.NewRequest("GET", "/api/search", nil), "10.0.0.1", "")
+	require.NotNil(t, match)
+	assert.Equal(t, "search", match.Rule.Name)
+
+	match = engine.Match(httptest.NewRequest("POST", "/api/search", nil), "10.0.0.1", "")
+	require.NotNil(t, match)
+	assert.Equal(t, "search-post", match.Rule.Name)
+}
+
+func TestEngine_HeaderKey(t *testing.T) {
+	engine, err := NewEngine([]Rule{
+		{Name: "client", Headers: map[string]string{"X-Env": "prod"}, KeyBy: "header:X-Client-ID", Limit: limit},
+	}, FirstMatch)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Env", "prod")
+	assert.Nil(t, engine.Match(req, "10.0.0.1", ""), "key header missing")
+
+	req.Header.Set("X-Client-ID", "mobile")
+	match := engine.Match(req, "10.0.0.1", "")
+	require.NotNil(t, match)
+	assert.Equal(t, "mobile", match.Identity)
+
+	req.Header.Set("X-Env", "staging")
+	assert.Nil(t, engine.Match(req, "10.0.0.1", ""))
+}
+
+func TestEngine_ClaimKey(t *testing.T) {
+	secret := []byte("secret")
+	engine, err := NewEngine([]Rule{
+		{Name: "tenant", Claims: map[string]string{"tenant": "acme"}, KeyBy: "claim:sub", Limit: limit},
+	}, FirstMatch, WithJWTSecret(secret))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+makeJWT(`{"sub":"user-1","tenant":"acme"}`, secret))
+	match := engine.Match(req, "10.0.0.1", "")
+	require.NotNil(t, match)
+	assert.Equal(t, "user-1", match.Identity)
+
+	// Tokens signed with another secret are ignored
+	req.Header.Set("Authorization", "Bearer "+makeJWT(`{"sub":"user-1","tenant":"acme"}`, []byte("other")))
+	assert.Nil(t, engine.Match(req, "10.0.0.1", ""))
+}
+
+func TestEngine_ClaimExpiry(t *testing.T) {
+	secret := []byte("secret")
+	engine, err := NewEngine([]Rule{
+		{Name: "user", KeyBy: "claim:sub", Limit: limit},
+	}, FirstMatch, WithJWTSecret(secret))
+	require.NoError(t, err)
+	now := time.Unix(1700000000, 0)
+	engine.now = func() time.Time { return now }
+
+	match := func(payload string) *Match {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+makeJWT(payload, secret))
+		return engine.Match(req, "10.0.0.1", "")
+	}
+	assert.NotNil(t, match(`{"sub":"user-1","nbf":1699999000,"exp":1700001000}`))
+	assert.Nil(t, match(`{"sub":"user-1","exp":1700000000}`), "expired")
+	assert.Nil(t, match(`{"sub":"user-1","nbf":1700001000}`), "not valid yet")
+}
+
+func TestNewEngine_Validation(t *testing.T) {
+	_, err := NewEngine([]Rule{{Name: "a", Limit: limit}, {Name: "a", Limit: limit}}, FirstMatch)
+	assert.Error(t, err)
+
+	_, err = NewEngine([]Rule{{Name: "a", KeyBy: "cookie:id", Limit: limit}}, FirstMatch)
+	assert.Error(t, err)
+
+	_, err = NewEngine([]Rule{{Name: "a"}}, FirstMatch)
+	assert.Error(t, err)
+
+	_, err = NewEngine([]Rule{{Name: "a", Limit: limit, Cost: -1}}, FirstMatch)
+	assert.Error(t, err)
+
+	_, err = NewEngine([]Rule{{Name: "a", Limit: limit, Cost: limit.RPS + 1}}, FirstMatch)
+	assert.Error(t, err)
+
+	// A rule may only set the cost of requests
+	_, err = NewEngine([]Rule{{Name: "a", Cost: 10}}, FirstMatch)
+	assert.NoError(t, err)
+
+	_, err = NewEngine([]Rule{{Name: "a", Limit: limit, Queue: Queue{MaxWait: -time.Second}}}, FirstMatch)
+	assert.Error(t, err)
+
+	_, err = NewEngine([]Rule{{Name: "a", Cost: 10, Queue: Queue{MaxWait: time.Second}}}, FirstMatch)
+	assert.Error(t, err)
+
+	_, err = NewEngine(nil, "random")
+	assert.Error(t, err)
+
+	// Claims cannot be trusted without a secret to verify them
+	_, err = NewEngine([]Rule{{Name: "a", KeyBy: "claim:sub", Limit: limit}}, FirstMatch)
+	assert.Error(t, err)
+	_, err = NewEngine([]Rule{{Name: "a", Claims: map[string]string{"plan": "pro"}, Limit: limit}}, FirstMatch)
+	assert.Error(t, err)
+}
@@ -0,0 +1,186 @@
+package setup
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/goxprts/ratelimiter/internal/access"
+	"github.com/goxprts/ratelimiter/internal/config"
+	"github.com/goxprts/ratelimiter/internal/limiter"
+	"github.com/goxprts/ratelimiter/internal/middleware"
+	"github.com/goxprts/ratelimiter/internal/rules"
+)
+
+func newTokenConfig(rps, blockTime int, algorithm string, burst int) (limiter.TokenConfig, error) {
+	alg, err := limiter.ParseAlgorithm(algorithm)
+	if err != nil {
+		return limiter.TokenConfig{}, err
+	}
+	return limiter.TokenConfig{
+		RPS:       rps,
+		BlockTime: time.Duration(blockTime) * time.Second,
+		Algorithm: alg,
+		Burst:     burst,
+	}, nil
+}
+
+// NewLimits converts the configured IP, token, plan, tenant and CIDR limits
+func NewLimits(lc config.LimiterConfig) (limiter.Limits, error) {
+	ip, err := newTokenConfig(lc.IPRateLimit, lc.IPBlockTime, lc.IPAlgorithm, lc.IPBurst)
+	if err != nil {
+		return limiter.Limits{}, fmt.Errorf("ip: %w", err)
+	}
+
+	tokens := make(map[string]limiter.TokenConfig, len(lc.TokenRateLimits))
+	for token, limit := range lc.TokenRateLimits {
+		cfg, err := newPlanConfig(limit)
+		if err != nil {
+			return limiter.Limits{}, fmt.Errorf("token %s: %w", token, err)
+		}
+		tokens[token] = cfg
+	}
+
+	plans := make(map[string]limiter.TokenConfig, len(lc.Plans))
+	for name, limit := range lc.Plans {
+		cfg, err := newPlanConfig(limit)
+		if err != nil {
+			return limiter.Limits{}, fmt.Errorf("plan %s: %w", name, err)
+		}
+		plans[name] = cfg
+	}
+
+	tenants := make(map[string]limiter.TokenConfig, len(lc.Tenants))
+	for name, limit := range lc.Tenants {
+		cfg, err := newTokenConfig(limit.RPS, limit.BlockTime, limit.Algorithm, limit.Burst)
+		if err != nil {
+			return limiter.Limits{}, fmt.Errorf("tenant %s: %w", name, err)
+		}
+		tenants[name] = cfg
+	}
+
+	cidrs := make([]limiter.CIDRLimit, 0, len(lc.CIDRLimits))
+	for _, limit := range lc.CIDRLimits {
+		prefix, err := netip.ParsePrefix(limit.CIDR)
+		if err != nil {
+			return limiter.Limits{}, fmt.Errorf("cidr %s: %w", limit.CIDR, err)
+		}
+		cfg, err := newTokenConfig(limit.RPS, limit.BlockTime, limit.Algorithm, limit.Burst)
+		if err != nil {
+			return limiter.Limits{}, fmt.Errorf("cidr %s: %w", limit.CIDR, err)
+		}
+		cidrs = append(cidrs, limiter.CIDRLimit{Prefix: prefix.Masked(), Limit: cfg})
+	}
+
+	penalty := limiter.Penalty{
+		Factor:       lc.Penalty.Factor,
+		Lookback:     time.Duration(lc.Penalty.Lookback) * time.Second,
+		MaxBlockTime: time.Duration(lc.Penalty.MaxBlockTime) * time.Second,
+	}
+
+	return limiter.Limits{IP: ip, Tokens: tokens, Plans: plans, Tenants: tenants, CIDRs: cidrs, Penalty: penalty}, nil
+}
+
+// newPlanConfig converts the limit of a token or plan, with its quotas
+func newPlanConfig(limit config.TokenLimit) (limiter.TokenConfig, error) {
+	cfg, err := newTokenConfig(limit.RPS, limit.BlockTime, limit.Algorithm, limit.Burst)
+	if err != nil {
+		return limiter.TokenConfig{}, err
+	}
+	cfg.Plan = limit.Plan
+	if cfg.Quotas, err = newQuotas(limit.Quotas); err != nil {
+		return limiter.TokenConfig{}, err
+	}
+	return cfg, nil
+}
+
+// newQuotas converts quotas keyed by window name, shortest window first
+func newQuotas(quotas map[string]int) ([]limiter.Quota, error) {
+	list := make([]limiter.Quota, 0, len(quotas))
+	for name, limit := range quotas {
+		window, err := limiter.ParseQuotaWindow(name)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, limiter.Quota{Name: strings.ToLower(name), Limit: limit, Window: window})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Window < list[j].Window
+	})
+	return list, nil
+}
+
+// NewAccessLists parses the configured allow and deny lists
+func NewAccessLists(lc config.LimiterConfig) (access.Lists, error) {
+	allow, err := access.ParseEntries(lc.Access.Allow)
+	if err != nil {
+		return access.Lists{}, fmt.Errorf("allow: %w", err)
+	}
+	deny, err := access.ParseEntries(lc.Access.Deny)
+	if err != nil {
+		return access.Lists{}, fmt.Errorf("deny: %w", err)
+	}
+	return access.Lists{Allow: allow, Deny: deny}, nil
+}
+
+// NewRuleEngine builds the engine of the configured rules
+func NewRuleEngine(lc config.LimiterConfig) (*rules.Engine, error) {
+	ruleList := make([]rules.Rule, 0, len(lc.Rules))
+	for _, rc := range lc.Rules {
+		limit, err := newTokenConfig(rc.RPS, rc.BlockTime, rc.Algorithm, rc.Burst)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", rc.Name, err)
+		}
+		limit.DryRun = rc.DryRun
+		ruleList = append(ruleList, rules.Rule{
+			Name:       rc.Name,
+			PathPrefix: rc.PathPrefix,
+			Methods:    rc.Methods,
+			Headers:    rc.Headers,
+			Claims:     rc.Claims,
+			KeyBy:      rc.KeyBy,
+			Limit:      limit,
+			Cost:       rc.Cost,
+			Queue: rules.Queue{
+				MaxWait: time.Duration(rc.QueueMaxWait) * time.Second,
+				Size:    rc.QueueSize,
+			},
+		})
+	}
+
+	var opts []rules.Option
+	if lc.JWTSecret != "" {
+		opts = append(opts, rules.WithJWTSecret([]byte(lc.JWTSecret)))
+	}
+	return rules.NewEngine(ruleList, rules.MatchMode(lc.RuleMatch), opts...)
+}
+
+// ReloadLimits applies a changed config file on top of the environment
+// configuration. Nothing is replaced unless the whole file is valid.
+func ReloadLimits(base config.LimiterConfig, file *config.FileConfig, rl *limiter.RateLimiter, m *middleware.RateLimiterMiddleware, list *access.List) {
+	lc := base.Apply(file)
+
+	limits, err := NewLimits(lc)
+	if err != nil {
+		log.Printf("Ignoring limits file change: %v", err)
+		return
+	}
+	engine, err := NewRuleEngine(lc)
+	if err != nil {
+		log.Printf("Ignoring limits file change: %v", err)
+		return
+	}
+	static, err := NewAccessLists(lc)
+	if err != nil {
+		log.Printf("Ignoring limits file change: %v", err)
+		return
+	}
+
+	rl.SetLimits(limits)
+	m.SetRules(engine)
+	list.SetStatic(static)
+	log.Printf("Limits reloaded: %d tokens, %d plans, %d tenants, %d CIDR overrides, %d rules", len(limits.Tokens), len(limits.Plans), len(limits.Tenants), len(limits.CIDRs), len(lc.Rules))
+}
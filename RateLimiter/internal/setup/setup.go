@@ -0,0 +1,107 @@
+// Package setup builds the rate limiter from the configuration, for the
+// server and for the packages embedding the limiter in other services
+package setup
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/goxprts/ratelimiter/internal/access"
+	"github.com/goxprts/ratelimiter/internal/apikey"
+	"github.com/goxprts/ratelimiter/internal/config"
+	"github.com/goxprts/ratelimiter/internal/limiter"
+	"github.com/goxprts/ratelimiter/internal/middleware"
+	"github.com/goxprts/ratelimiter/internal/rules"
+	"github.com/goxprts/ratelimiter/internal/storage"
+)
+
+// Stack is the rate limiter with the components built around it
+type Stack struct {
+	// Config is the limiter configuration with the limits file applied
+	Config       config.LimiterConfig
+	Limits       limiter.Limits
+	StaticAccess access.Lists
+	RateLimiter  *limiter.RateLimiter
+	Access       *access.List
+	Rules        *rules.Engine
+	IPExtractor  *middleware.IPExtractor
+	// Tenants is nil unless the tenant header is set
+	Tenants *middleware.TenantResolver
+	// Keys is nil unless the key registry is enabled
+	Keys       *apikey.Registry
+	Middleware *middleware.RateLimiterMiddleware
+}
+
+// NewStack builds the limiter over store, applying opts after the configured
+// ones. The access lists and the key registry read sharedStore, which should
+// skip any local fallback, and are refreshed until ctx is done.
+func NewStack(ctx context.Context, cfg *config.Config, store, sharedStore storage.Storage, opts ...limiter.Option) (*Stack, error) {
+	s := &Stack{Config: cfg.Limiter.Apply(cfg.LimitsFile)}
+
+	var err error
+	if s.Limits, err = NewLimits(s.Config); err != nil {
+		return nil, fmt.Errorf("invalid rate limits: %w", err)
+	}
+
+	limiterOpts := []limiter.Option{
+		limiter.WithIPAlgorithm(s.Limits.IP.Algorithm, s.Limits.IP.Burst),
+		limiter.WithCIDRLimits(s.Limits.CIDRs),
+		limiter.WithPenalty(s.Limits.Penalty),
+	}
+	if s.Config.BatchFraction > 0 {
+		limiterOpts = append(limiterOpts, limiter.WithLocalBatching(limiter.BatchOptions{
+			BatchFraction: s.Config.BatchFraction,
+			Overshoot:     s.Config.BatchOvershoot,
+		}))
+	}
+	s.RateLimiter = limiter.NewRateLimiter(
+		store,
+		s.Config.IPRateLimit,
+		s.Config.IPBlockTime,
+		s.Limits.Tokens,
+		append(limiterOpts, opts...)...,
+	)
+
+	if s.StaticAccess, err = NewAccessLists(s.Config); err != nil {
+		return nil, fmt.Errorf("invalid access lists: %w", err)
+	}
+	s.Access = access.New(sharedStore, s.StaticAccess)
+	go s.Access.Run(ctx, time.Duration(cfg.Server.AccessRefreshPeriod)*time.Second)
+
+	if s.Rules, err = NewRuleEngine(s.Config); err != nil {
+		return nil, fmt.Errorf("invalid rate limit rules: %w", err)
+	}
+
+	s.IPExtractor, err = middleware.NewIPExtractor(cfg.Server.TrustedProxies, cfg.Server.IPv6PrefixLength,
+		middleware.WithTrustedHeader(cfg.Server.TrustedIPHeader))
+	if err != nil {
+		return nil, fmt.Errorf("invalid client IP configuration: %w", err)
+	}
+
+	middlewareOpts := []middleware.Option{
+		middleware.WithRules(s.Rules),
+		middleware.WithIPExtractor(s.IPExtractor),
+		middleware.WithFailurePolicy(FailurePolicy(cfg.Storage)),
+		middleware.WithAccessList(s.Access),
+	}
+	if cfg.Server.TenantHeader != "" {
+		s.Tenants = middleware.NewTenantResolver(cfg.Server.TenantHeader, s.IPExtractor, s.RateLimiter)
+		middlewareOpts = append(middlewareOpts, middleware.WithTenants(s.Tenants))
+	}
+	// Like the access lists, the registry keeps the last keys loaded while
+	// Redis is down
+	if cfg.Keys.Registry {
+		s.Keys = apikey.NewRegistry(sharedStore)
+		go s.Keys.Run(ctx, time.Duration(cfg.Keys.RefreshPeriod)*time.Second)
+		middlewareOpts = append(middlewareOpts, middleware.WithKeyRegistry(s.Keys))
+	}
+	s.Middleware = middleware.NewRateLimiterMiddleware(s.RateLimiter, middlewareOpts...)
+	return s, nil
+}
+
+// Reload applies a changed config file on top of the environment
+// configuration
+func (s *Stack) Reload(base config.LimiterConfig, file *config.FileConfig) {
+	ReloadLimits(base, file, s.RateLimiter, s.Middleware, s.Access)
+}
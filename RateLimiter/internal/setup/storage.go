@@ -0,0 +1,118 @@
+package setup
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/goxprts/ratelimiter/internal/config"
+	"github.com/goxprts/ratelimiter/internal/middleware"
+	"github.com/goxprts/ratelimiter/internal/storage"
+)
+
+// NewStorage connects to the configured backend. Keys are prefixed with the
+// storage namespace and the tenant of each request.
+func NewStorage(cfg *config.Config) (storage.Storage, error) {
+	store, err := newBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewNamespacedStorage(store, cfg.Storage.Namespace), nil
+}
+
+func newBackend(cfg *config.Config) (storage.Storage, error) {
+	if cfg.Storage.Backend == "memory" {
+		return storage.NewMemoryStorage(storage.MemoryOptions{
+			Shards:          cfg.Storage.MemoryShards,
+			MaxKeys:         cfg.Storage.MemoryMaxKeys,
+			CleanupInterval: time.Duration(cfg.Storage.MemoryCleanupInterval) * time.Second,
+		}), nil
+	}
+
+	tlsConfig, err := newRedisTLSConfig(cfg.Redis.TLS)
+	if err != nil {
+		return nil, err
+	}
+	ms := func(v int) time.Duration { return time.Duration(v) * time.Millisecond }
+	return storage.NewRedisStorageWithOptions(storage.RedisOptions{
+		Mode:             storage.RedisMode(cfg.Redis.Mode),
+		Addrs:            cfg.Redis.Addresses(),
+		Username:         cfg.Redis.Username,
+		Password:         cfg.Redis.Password,
+		DB:               cfg.Redis.DB,
+		MasterName:       cfg.Redis.MasterName,
+		SentinelPassword: cfg.Redis.SentinelPassword,
+		TLSConfig:        tlsConfig,
+		PoolSize:         cfg.Redis.PoolSize,
+		MinIdleConns:     cfg.Redis.MinIdleConns,
+		PoolTimeout:      ms(cfg.Redis.PoolTimeout),
+		DialTimeout:      ms(cfg.Redis.DialTimeout),
+		ReadTimeout:      ms(cfg.Redis.ReadTimeout),
+		WriteTimeout:     ms(cfg.Redis.WriteTimeout),
+		MaxRetries:       cfg.Redis.MaxRetries,
+	})
+}
+
+// newRedisTLSConfig returns nil when TLS is disabled
+func newRedisTLSConfig(cfg config.RedisTLSConfig) (*tls.Config, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Redis CA file: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in Redis CA file %s", cfg.CAFile)
+		}
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load Redis client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// NewCircuitBreaker wraps store with a breaker that falls back to a local
+// memory storage under the "local" failure policy
+func NewCircuitBreaker(cfg config.StorageConfig, store storage.Storage) *storage.CircuitBreaker {
+	opts := storage.BreakerOptions{
+		FailureThreshold: cfg.BreakerThreshold,
+		OpenTimeout:      time.Duration(cfg.BreakerTimeout) * time.Second,
+		// Requests rejected by the open circuit are not logged one by one
+		OnStateChange: func(from, to storage.BreakerState) {
+			log.Printf("Storage circuit breaker %s -> %s", from, to)
+		},
+	}
+	if cfg.FailurePolicy == "local" {
+		opts.Fallback = storage.NewMemoryStorage(storage.MemoryOptions{
+			Shards:          cfg.MemoryShards,
+			MaxKeys:         cfg.MemoryMaxKeys,
+			CleanupInterval: time.Duration(cfg.MemoryCleanupInterval) * time.Second,
+		})
+	}
+	return storage.NewCircuitBreaker(store, opts)
+}
+
+// FailurePolicy maps the storage failure policy to the middleware one. With
+// the local fallback only errors of the fallback itself reach the middleware.
+func FailurePolicy(cfg config.StorageConfig) middleware.FailurePolicy {
+	if cfg.FailurePolicy == "open" {
+		return middleware.FailOpen
+	}
+	return middleware.FailClosed
+}
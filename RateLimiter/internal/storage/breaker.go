@@ -0,0 +1,247 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned while the circuit breaker rejects calls
+var ErrCircuitOpen = errors.New("storage circuit breaker is open")
+
+// BreakerState is the state of a CircuitBreaker
+type BreakerState string
+
+const (
+	// BreakerClosed lets every call through
+	BreakerClosed BreakerState = "closed"
+	// BreakerOpen rejects calls until the open timeout elapses
+	BreakerOpen BreakerState = "open"
+	// BreakerHalfOpen lets a single probe call through
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+// BreakerOptions configures a CircuitBreaker. Zero values use the defaults.
+type BreakerOptions struct {
+	// FailureThreshold is the number of consecutive failures that opens the
+	// circuit (default 5)
+	FailureThreshold int
+	// OpenTimeout is how long the circuit stays open before a probe is
+	// attempted (default 10s)
+	OpenTimeout time.Duration
+	// Fallback, when set, serves calls that fail or are rejected by the
+	// open circuit instead of returning the error
+	Fallback Storage
+	// OnStateChange, when set, is called on every state transition, e.g. to
+	// log an outage once instead of on every rejected call. It runs with the
+	// breaker locked and must not call it.
+	OnStateChange func(from, to BreakerState)
+}
+
+// CircuitBreaker stops calling a failing Storage for a while so requests
+// don't pile up behind timeouts, optionally serving them from a fallback
+type CircuitBreaker struct {
+	next        Storage
+	fallback    Storage
+	threshold   int
+	openTimeout time.Duration
+	onChange    func(from, to BreakerState)
+	now         func() time.Time
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// NewCircuitBreaker wraps next with a circuit breaker
+func NewCircuitBreaker(next Storage, opts BreakerOptions) *CircuitBreaker {
+	if opts.FailureThreshold <= 0 {
+		opts.FailureThreshold = 5
+	}
+	if opts.OpenTimeout <= 0 {
+		opts.OpenTimeout = 10 * time.Second
+	}
+	return &CircuitBreaker{
+		next:        next,
+		fallback:    opts.Fallback,
+		threshold:   opts.FailureThreshold,
+		openTimeout: opts.OpenTimeout,
+		onChange:    opts.OnStateChange,
+		now:         time.Now,
+		state:       BreakerClosed,
+	}
+}
+
+// State reports the current breaker state
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= b.openTimeout {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// allow reports whether a call may reach the wrapped storage
+func (b *CircuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Sub(b.openedAt) < b.openTimeout {
+			return false
+		}
+		b.setState(BreakerHalfOpen)
+		b.probing = true
+		return true
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record updates the breaker with the outcome of a call
+func (b *CircuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !isFailure(err) {
+		b.setState(BreakerClosed)
+		b.failures = 0
+		b.probing = false
+		return
+	}
+
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.setState(BreakerOpen)
+		b.openedAt = b.now()
+		b.probing = false
+	}
+}
+
+// setState moves the breaker to state, reporting the change. b.mu must be
+// held.
+func (b *CircuitBreaker) setState(state BreakerState) {
+	from := b.state
+	b.state = state
+	if from != state && b.onChange != nil {
+		b.onChange(from, state)
+	}
+}
+
+// isFailure tells storage failures apart from callers giving up
+func isFailure(err error) bool {
+	return err != nil && !errors.Is(err, context.Canceled)
+}
+
+// call runs op against the wrapped storage, or the fallback when the
+// circuit is open or the call fails
+func call[T any](b *CircuitBreaker, op func(Storage) (T, error)) (T, error) {
+	if !b.allow() {
+		if b.fallback != nil {
+			return op(b.fallback)
+		}
+		var zero T
+		return zero, ErrCircuitOpen
+	}
+
+	value, err := op(b.next)
+	b.record(err)
+	if isFailure(err) && b.fallback != nil {
+		return op(b.fallback)
+	}
+	return value, err
+}
+
+// callErr is call for operations returning only an error
+func callErr(b *CircuitBreaker, op func(Storage) error) error {
+	_, err := call(b, func(s Storage) (struct{}, error) {
+		return struct{}{}, op(s)
+	})
+	return err
+}
+
+func (b *CircuitBreaker) Increment(ctx context.Context, key string) (int64, error) {
+	return call(b, func(s Storage) (int64, error) { return s.Increment(ctx, key) })
+}
+
+func (b *CircuitBreaker) IncrementBy(ctx context.Context, key string, n int64) (int64, error) {
+	return call(b, func(s Storage) (int64, error) { return s.IncrementBy(ctx, key, n) })
+}
+
+func (b *CircuitBreaker) Acquire(ctx context.Context, key string, lease string, limit int, ttl time.Duration, now time.Time) (*Acquisition, error) {
+	return call(b, func(s Storage) (*Acquisition, error) { return s.Acquire(ctx, key, lease, limit, ttl, now) })
+}
+
+func (b *CircuitBreaker) Release(ctx context.Context, key string, lease string) error {
+	return callErr(b, func(s Storage) error { return s.Release(ctx, key, lease) })
+}
+
+func (b *CircuitBreaker) Get(ctx context.Context, key string) (int64, error) {
+	return call(b, func(s Storage) (int64, error) { return s.Get(ctx, key) })
+}
+
+func (b *CircuitBreaker) SetExpiration(ctx context.Context, key string, expiration time.Duration) error {
+	return callErr(b, func(s Storage) error { return s.SetExpiration(ctx, key, expiration) })
+}
+
+func (b *CircuitBreaker) IsBlocked(ctx context.Context, key string) (bool, error) {
+	return call(b, func(s Storage) (bool, error) { return s.IsBlocked(ctx, key) })
+}
+
+func (b *CircuitBreaker) Block(ctx context.Context, key string, duration time.Duration) error {
+	return callErr(b, func(s Storage) error { return s.Block(ctx, key, duration) })
+}
+
+func (b *CircuitBreaker) Set(ctx context.Context, key string, value int64, expiration time.Duration) error {
+	return callErr(b, func(s Storage) error { return s.Set(ctx, key, value, expiration) })
+}
+
+func (b *CircuitBreaker) AppendTimestamp(ctx context.Context, key string, ts time.Time, window time.Duration) (int64, error) {
+	return call(b, func(s Storage) (int64, error) { return s.AppendTimestamp(ctx, key, ts, window) })
+}
+
+func (b *CircuitBreaker) Evaluate(ctx context.Context, key string, policy Policy, now time.Time) (*Decision, error) {
+	return call(b, func(s Storage) (*Decision, error) { return s.Evaluate(ctx, key, policy, now) })
+}
+
+func (b *CircuitBreaker) Reserve(ctx context.Context, key string, policy Policy, n int, now time.Time) (*Reservation, error) {
+	return call(b, func(s Storage) (*Reservation, error) { return s.Reserve(ctx, key, policy, n, now) })
+}
+
+func (b *CircuitBreaker) ListBlocked(ctx context.Context) ([]Entry, error) {
+	return call(b, func(s Storage) ([]Entry, error) { return s.ListBlocked(ctx) })
+}
+
+func (b *CircuitBreaker) Scan(ctx context.Context, prefix string) ([]Entry, error) {
+	return call(b, func(s Storage) ([]Entry, error) { return s.Scan(ctx, prefix) })
+}
+
+func (b *CircuitBreaker) Unblock(ctx context.Context, key string) error {
+	return callErr(b, func(s Storage) error { return s.Unblock(ctx, key) })
+}
+
+func (b *CircuitBreaker) Reset(ctx context.Context, key string) error {
+	return callErr(b, func(s Storage) error { return s.Reset(ctx, key) })
+}
+
+// Close closes the wrapped storage and the fallback
+func (b *CircuitBreaker) Close() error {
+	err := b.next.Close()
+	if b.fallback != nil {
+		if ferr := b.fallback.Close(); err == nil {
+			err = ferr
+		}
+	}
+	return err
+}
@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errUnavailable = errors.New("connection refused")
+
+// flakyStorage fails every Evaluate while down is set
+type flakyStorage struct {
+	*MemoryStorage
+	down  bool
+	calls int
+}
+
+func (s *flakyStorage) Evaluate(ctx context.Context, key string, policy Policy, now time.Time) (*Decision, error) {
+	s.calls++
+	if s.down {
+		return nil, errUnavailable
+	}
+	return s.MemoryStorage.Evaluate(ctx, key, policy, now)
+}
+
+func newTestBreaker(t *testing.T, fallback Storage) (*CircuitBreaker, *flakyStorage, *time.Time) {
+	flaky := &flakyStorage{MemoryStorage: newTestMemoryStorage(t, MemoryOptions{})}
+	b := NewCircuitBreaker(flaky, BreakerOptions{FailureThreshold: 2, OpenTimeout: time.Second, Fallback: fallback})
+	now := time.Now()
+	b.now = func() time.Time { return now }
+	return b, flaky, &now
+}
+
+func TestCircuitBreaker_OpensAfterThreshold(t *testing.T) {
+	b, flaky, _ := newTestBreaker(t, nil)
+	ctx := context.Background()
+	policy := Policy{Limit: 10, Window: time.Second}
+	flaky.down = true
+
+	for i := 0; i < 2; i++ {
+		_, err := b.Evaluate(ctx, "ip:1", policy, time.Now())
+		assert.ErrorIs(t, err, errUnavailable)
+	}
+	assert.Equal(t, BreakerOpen, b.State())
+
+	_, err := b.Evaluate(ctx, "ip:1", policy, time.Now())
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, 2, flaky.calls)
+}
+
+func TestCircuitBreaker_OnStateChange(t *testing.T) {
+	var changes []BreakerState
+	flaky := &flakyStorage{MemoryStorage: newTestMemoryStorage(t, MemoryOptions{}), down: true}
+	b := NewCircuitBreaker(flaky, BreakerOptions{
+		FailureThreshold: 2,
+		OpenTimeout:      time.Second,
+		OnStateChange:    func(from, to BreakerState) { changes = append(changes, to) },
+	})
+	now := time.Now()
+	b.now = func() time.Time { return now }
+	ctx := context.Background()
+	policy := Policy{Limit: 10, Window: time.Second}
+
+	// Rejected calls don't report the open state again
+	for i := 0; i < 5; i++ {
+		b.Evaluate(ctx, "ip:1", policy, now)
+	}
+	assert.Equal(t, []BreakerState{BreakerOpen}, changes)
+
+	now = now.Add(time.Second)
+	flaky.down = false
+	_, err := b.Evaluate(ctx, "ip:1", policy, now)
+	require.NoError(t, err)
+	assert.Equal(t, []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerClosed}, changes)
+}
+
+func TestCircuitBreaker_HalfOpenProbe(t *testing.T) {
+	b, flaky, now := newTestBreaker(t, nil)
+	ctx := context.Background()
+	policy := Policy{Limit: 10, Window: time.Second}
+	flaky.down = true
+
+	for i := 0; i < 2; i++ {
+		b.Evaluate(ctx, "ip:1", policy, time.Now())
+	}
+
+	// A failed probe opens the circuit again
+	*now = now.Add(time.Second)
+	assert.Equal(t, BreakerHalfOpen, b.State())
+	_, err := b.Evaluate(ctx, "ip:1", policy, time.Now())
+	assert.ErrorIs(t, err, errUnavailable)
+	assert.Equal(t, BreakerOpen, b.State())
+
+	// A successful probe closes it
+	*now = now.Add(time.Second)
+	flaky.down = false
+	d, err := b.Evaluate(ctx, "ip:1", policy, time.Now())
+	require.NoError(t, err)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, BreakerClosed, b.State())
+}
+
+func TestCircuitBreaker_Fallback(t *testing.T) {
+	fallback := newTestMemoryStorage(t, MemoryOptions{})
+	b, flaky, _ := newTestBreaker(t, fallback)
+	ctx := context.Background()
+	policy := Policy{Limit: 1, Window: time.Second}
+	flaky.down = true
+
+	d, err := b.Evaluate(ctx, "ip:1", policy, time.Now())
+	require.NoError(t, err)
+	assert.True(t, d.Allowed)
+
+	b.Evaluate(ctx, "ip:1", policy, time.Now())
+	assert.Equal(t, BreakerOpen, b.State())
+
+	// The fallback keeps enforcing the limit while the circuit is open
+	d, err = b.Evaluate(ctx, "ip:1", policy, time.Now())
+	require.NoError(t, err)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, 2, flaky.calls)
+}
+
+func TestCircuitBreaker_IgnoresCanceledContext(t *testing.T) {
+	b, _, _ := newTestBreaker(t, nil)
+
+	for i := 0; i < 3; i++ {
+		b.record(context.Canceled)
+	}
+	assert.Equal(t, BreakerClosed, b.State())
+}
@@ -0,0 +1,433 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Algorithm names understood by Evaluate
+const (
+	algorithmFixedWindow          = "fixed_window"
+	algorithmSlidingWindowLog     = "sliding_window_log"
+	algorithmSlidingWindowCounter = "sliding_window_counter"
+	algorithmTokenBucket          = "token_bucket"
+)
+
+// Policy describes the limit applied to a key by Evaluate
+type Policy struct {
+	// Algorithm is one of fixed_window, sliding_window_log,
+	// sliding_window_counter or token_bucket. Empty means fixed_window.
+	Algorithm string
+	// Limit is the number of requests allowed per Window
+	Limit int
+	// Burst is the token bucket capacity, defaulting to Limit
+	Burst  int
+	Window time.Duration
+	// BlockTime is how long the key stays blocked after exceeding the limit.
+	// Zero rejects the request without blocking.
+	BlockTime time.Duration
+	// PenaltyFactor multiplies BlockTime for every earlier violation of the
+	// key within PenaltyLookback after its last block, up to MaxBlockTime,
+	// or MaxPenaltyBlockTime when it is zero. A factor of one or less keeps
+	// BlockTime fixed.
+	PenaltyFactor   float64
+	PenaltyLookback time.Duration
+	MaxBlockTime    time.Duration
+	// Cost is the number of units the request takes from the limit,
+	// defaulting to one
+	Cost int
+}
+
+// MaxPenaltyBlockTime caps progressive blocks of policies without a
+// MaxBlockTime
+const MaxPenaltyBlockTime = 30 * 24 * time.Hour
+
+func (p Policy) cost() int {
+	return max(1, p.Cost)
+}
+
+// progressive reports whether repeated violations lengthen the block
+func (p Policy) progressive() bool {
+	return p.BlockTime > 0 && p.PenaltyFactor > 1 && p.PenaltyLookback > 0
+}
+
+// penaltyBlockTime is the block applied at the given penalty level, starting
+// at one for the first violation
+func (p Policy) penaltyBlockTime(level int64) time.Duration {
+	// Compared as a float, the product overflows Duration long before the cap
+	block := math.Ceil(float64(p.BlockTime) * math.Pow(p.PenaltyFactor, float64(level-1)))
+	if limit := p.maxBlockTime(); block > float64(limit) {
+		return limit
+	}
+	return time.Duration(block)
+}
+
+// maxBlockTime is the longest block a progressive penalty can reach
+func (p Policy) maxBlockTime() time.Duration {
+	if p.MaxBlockTime > 0 {
+		return p.MaxBlockTime
+	}
+	return MaxPenaltyBlockTime
+}
+
+// Decision is the outcome of evaluating a request against a Policy
+type Decision struct {
+	Allowed bool
+	// Blocked reports that the key was already blocked before this request
+	Blocked   bool
+	Remaining int
+	// ResetAfter is the time until the quota is replenished or the block ends
+	ResetAfter time.Duration
+	// PenaltyLevel counts the violations within the penalty lookback,
+	// including the one that caused the current block
+	PenaltyLevel int
+}
+
+// Reservation is the outcome of reserving a batch of quota with Reserve
+type Reservation struct {
+	// Granted is the number of units taken, at most the number requested
+	// and either none or at least the policy cost
+	Granted int
+	// Blocked reports that the key was already blocked
+	Blocked bool
+	// Remaining is the quota left in the window after the grant
+	Remaining int
+	// ResetAfter is the time until the window ends or the block is lifted
+	ResetAfter time.Duration
+}
+
+// Acquisition is the outcome of taking a semaphore slot with Acquire
+type Acquisition struct {
+	Acquired bool
+	// InUse is the number of slots held, including the new one
+	InUse int
+}
+
+// CalendarMonth as a Reserve window counts calendar months in UTC instead
+// of fixed 31 day windows
+const CalendarMonth = 31 * 24 * time.Hour
+
+// HashTag wraps key in a Redis Cluster hash tag. Every key derived from a
+// limiter key embeds its tagged form, so the counters, block and violations
+// of a key share the slot the scripts run against.
+func HashTag(key string) string {
+	return "{" + key + "}"
+}
+
+// UntagKey removes the hash tag from a stored key, e.g. block:{ip:1.2.3.4}
+// becomes block:ip:1.2.3.4. Prefixes and suffixes never contain braces, so
+// the tag spans from the first to the last one.
+func UntagKey(stored string) string {
+	open, end := strings.IndexByte(stored, '{'), strings.LastIndexByte(stored, '}')
+	if open < 0 || end < open {
+		return stored
+	}
+	return stored[:open] + stored[open+1:end] + stored[end+1:]
+}
+
+// blockKey marks key as blocked while it exists
+func blockKey(key string) string {
+	return "block:" + HashTag(key)
+}
+
+// WindowKey returns the Reserve counter of key for the window containing
+// now, and the time left in that window. Windows are aligned to the epoch,
+// or to calendar months, so every instance agrees on when they end.
+func WindowKey(key string, window time.Duration, now time.Time) (string, time.Duration) {
+	if window == CalendarMonth {
+		now = now.UTC()
+		start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return fmt.Sprintf("%s:window:%d-%02d", HashTag(key), now.Year(), now.Month()), start.AddDate(0, 1, 0).Sub(now)
+	}
+	index := now.UnixNano() / int64(window)
+	offset := time.Duration(now.UnixNano() % int64(window))
+	return fmt.Sprintf("%s:window:%d", HashTag(key), index), window - offset
+}
+
+// blockTimer is implemented by storages that can tell how long a key stays
+// blocked
+type blockTimer interface {
+	BlockTTL(ctx context.Context, key string) (ttl time.Duration, blocked bool, err error)
+}
+
+// blockTTL returns the time left on the block of key, zero if it is not
+// blocked. Blocks of unknown length, or that never expire, last fallback.
+func blockTTL(ctx context.Context, s Storage, key string, fallback time.Duration) (time.Duration, error) {
+	var ttl time.Duration
+	var blocked bool
+	var err error
+	if t, ok := s.(blockTimer); ok {
+		ttl, blocked, err = t.BlockTTL(ctx, key)
+	} else {
+		blocked, err = s.IsBlocked(ctx, key)
+	}
+	if err != nil || !blocked {
+		return 0, err
+	}
+	if ttl <= 0 {
+		ttl = max(fallback, time.Second)
+	}
+	return ttl, nil
+}
+
+// ReserveSequential implements Reserve on top of the primitive Storage
+// operations. Like EvaluateSequential it must run under a lock on key.
+func ReserveSequential(ctx context.Context, s Storage, key string, policy Policy, n int, now time.Time) (*Reservation, error) {
+	blocked, err := blockTTL(ctx, s, key, policy.BlockTime)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check if key is blocked: %w", err)
+	}
+	if blocked > 0 {
+		return &Reservation{Blocked: true, ResetAfter: blocked}, nil
+	}
+
+	counter, resetAfter := WindowKey(key, policy.Window, now)
+	used, err := s.Get(ctx, counter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get reserved quota: %w", err)
+	}
+
+	left := max(0, policy.Limit-int(used))
+	granted := min(n, left)
+	if granted < min(n, policy.cost()) {
+		granted = 0
+	}
+	if granted > 0 {
+		if err := s.Set(ctx, counter, used+int64(granted), resetAfter); err != nil {
+			return nil, fmt.Errorf("failed to reserve quota: %w", err)
+		}
+		return &Reservation{Granted: granted, Remaining: left - granted, ResetAfter: resetAfter}, nil
+	}
+
+	if policy.BlockTime > 0 {
+		if err := s.Block(ctx, key, policy.BlockTime); err != nil {
+			return nil, fmt.Errorf("failed to block key: %w", err)
+		}
+		if err := s.Reset(ctx, counter); err != nil {
+			return nil, fmt.Errorf("failed to reset counter: %w", err)
+		}
+		resetAfter = policy.BlockTime
+	}
+	return &Reservation{ResetAfter: resetAfter}, nil
+}
+
+// violationsKey holds the number of recent violations of key
+func violationsKey(key string) string {
+	return "violations:" + HashTag(key)
+}
+
+// stateKeys returns the keys holding the algorithm state of key at now
+func stateKeys(key string, policy Policy, now time.Time) []string {
+	key = HashTag(key)
+	switch policy.Algorithm {
+	case algorithmSlidingWindowLog:
+		return []string{key + ":log"}
+	case algorithmSlidingWindowCounter:
+		index := now.UnixNano() / int64(policy.Window)
+		return []string{fmt.Sprintf("%s:%d", key, index), fmt.Sprintf("%s:%d", key, index-1)}
+	case algorithmTokenBucket:
+		return []string{key + ":tokens", key + ":ts"}
+	default:
+		return []string{key}
+	}
+}
+
+// EvaluateSequential implements Evaluate on top of the primitive Storage
+// operations. It is not atomic, so backends should only use it while holding
+// a lock on key. Rejected requests are only kept out of sliding logs on
+// storages that can count them without appending.
+func EvaluateSequential(ctx context.Context, s Storage, key string, policy Policy, now time.Time) (*Decision, error) {
+	blocked, err := blockTTL(ctx, s, key, policy.BlockTime)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check if key is blocked: %w", err)
+	}
+
+	var level int64
+	if policy.progressive() {
+		if level, err = s.Get(ctx, violationsKey(key)); err != nil {
+			return nil, fmt.Errorf("failed to get violations: %w", err)
+		}
+	}
+
+	if blocked > 0 {
+		return &Decision{Blocked: true, ResetAfter: blocked, PenaltyLevel: int(level)}, nil
+	}
+
+	keys := stateKeys(key, policy, now)
+
+	var d *Decision
+	switch policy.Algorithm {
+	case algorithmSlidingWindowLog:
+		d, err = slidingWindowLog(ctx, s, keys, policy, now)
+	case algorithmSlidingWindowCounter:
+		d, err = slidingWindowCounter(ctx, s, keys, policy, now)
+	case algorithmTokenBucket:
+		d, err = tokenBucket(ctx, s, keys, policy, now)
+	default:
+		d, err = fixedWindow(ctx, s, keys, policy)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !d.Allowed && policy.BlockTime > 0 {
+		block := policy.BlockTime
+		if policy.progressive() {
+			if level, err = s.Increment(ctx, violationsKey(key)); err != nil {
+				return nil, fmt.Errorf("failed to count violation: %w", err)
+			}
+			block = policy.penaltyBlockTime(level)
+			if err := s.SetExpiration(ctx, violationsKey(key), block+policy.PenaltyLookback); err != nil {
+				return nil, fmt.Errorf("failed to set violations expiration: %w", err)
+			}
+		}
+		if err := s.Block(ctx, key, block); err != nil {
+			return nil, fmt.Errorf("failed to block key: %w", err)
+		}
+		for _, k := range keys {
+			if err := s.Reset(ctx, k); err != nil {
+				return nil, fmt.Errorf("failed to reset counter: %w", err)
+			}
+		}
+		d.ResetAfter = block
+	}
+
+	d.PenaltyLevel = int(level)
+	return d, nil
+}
+
+func fixedWindow(ctx context.Context, s Storage, keys []string, policy Policy) (*Decision, error) {
+	count, err := s.IncrementBy(ctx, keys[0], int64(policy.cost()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to increment counter: %w", err)
+	}
+
+	// If this is the first request, set expiration to one window
+	if count == int64(policy.cost()) {
+		if err := s.SetExpiration(ctx, keys[0], policy.Window); err != nil {
+			return nil, fmt.Errorf("failed to set expiration: %w", err)
+		}
+	}
+
+	return decide(count, policy.Limit, policy.Window), nil
+}
+
+// timestampCounter is implemented by storages that can count a sliding log
+// without appending to it
+type timestampCounter interface {
+	CountTimestamps(ctx context.Context, key string, ts time.Time, window time.Duration) (int64, error)
+}
+
+func slidingWindowLog(ctx context.Context, s Storage, keys []string, policy Policy, now time.Time) (*Decision, error) {
+	// Like the Redis script, leave rejected requests out of the log
+	if c, ok := s.(timestampCounter); ok {
+		count, err := c.CountTimestamps(ctx, keys[0], now, policy.Window)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count request log: %w", err)
+		}
+		if count+int64(policy.cost()) > int64(policy.Limit) {
+			return &Decision{Remaining: max(0, policy.Limit-int(count)), ResetAfter: policy.Window}, nil
+		}
+	}
+
+	var count int64
+	for i := 0; i < policy.cost(); i++ {
+		var err error
+		if count, err = s.AppendTimestamp(ctx, keys[0], now, policy.Window); err != nil {
+			return nil, fmt.Errorf("failed to append to request log: %w", err)
+		}
+	}
+	return decide(count, policy.Limit, policy.Window), nil
+}
+
+func slidingWindowCounter(ctx context.Context, s Storage, keys []string, policy Policy, now time.Time) (*Decision, error) {
+	count, err := s.IncrementBy(ctx, keys[0], int64(policy.cost()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to increment counter: %w", err)
+	}
+
+	// The counter must outlive its own window to be weighted by the next one
+	if count == int64(policy.cost()) {
+		if err := s.SetExpiration(ctx, keys[0], 2*policy.Window); err != nil {
+			return nil, fmt.Errorf("failed to set expiration: %w", err)
+		}
+	}
+
+	previous, err := s.Get(ctx, keys[1])
+	if err != nil {
+		return nil, fmt.Errorf("failed to get previous window: %w", err)
+	}
+
+	offset := time.Duration(now.UnixNano() % int64(policy.Window))
+	elapsed := float64(offset) / float64(policy.Window)
+	estimate := float64(previous)*(1-elapsed) + float64(count)
+
+	return &Decision{
+		Allowed:    estimate <= float64(policy.Limit),
+		Remaining:  max(0, policy.Limit-int(math.Ceil(estimate))),
+		ResetAfter: policy.Window - offset,
+	}, nil
+}
+
+// tokenBucket stores the bucket level in thousandths of a token together with
+// the time of the last refill, both as integers so any Storage can hold them
+func tokenBucket(ctx context.Context, s Storage, keys []string, policy Policy, now time.Time) (*Decision, error) {
+	if policy.Limit <= 0 {
+		return &Decision{ResetAfter: policy.Window}, nil
+	}
+
+	burst := policy.Burst
+	if burst <= 0 {
+		burst = policy.Limit
+	}
+	capacity := float64(burst) * 1000
+	// rate is expressed in thousandths of a token per nanosecond
+	rate := float64(policy.Limit) * 1000 / float64(policy.Window)
+
+	lastRefill, err := s.Get(ctx, keys[1])
+	if err != nil {
+		return nil, fmt.Errorf("failed to get last refill: %w", err)
+	}
+
+	tokens := capacity
+	if lastRefill > 0 {
+		stored, err := s.Get(ctx, keys[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to get bucket level: %w", err)
+		}
+		elapsed := math.Max(0, float64(now.UnixNano()-lastRefill))
+		tokens = math.Min(capacity, float64(stored)+elapsed*rate)
+	}
+
+	cost := float64(policy.cost()) * 1000
+	if tokens < cost {
+		return &Decision{ResetAfter: time.Duration((cost - tokens) / rate)}, nil
+	}
+	tokens -= cost
+
+	// Keep the state until the bucket would be full again
+	ttl := time.Duration((capacity-tokens)/rate) + policy.Window
+	if err := s.Set(ctx, keys[0], int64(tokens), ttl); err != nil {
+		return nil, fmt.Errorf("failed to store bucket level: %w", err)
+	}
+	if err := s.Set(ctx, keys[1], now.UnixNano(), ttl); err != nil {
+		return nil, fmt.Errorf("failed to store last refill: %w", err)
+	}
+
+	return &Decision{
+		Allowed:    true,
+		Remaining:  int(tokens / 1000),
+		ResetAfter: time.Duration((1000 - math.Mod(tokens, 1000)) / rate),
+	}, nil
+}
+
+func decide(count int64, limit int, window time.Duration) *Decision {
+	return &Decision{
+		Allowed:    count <= int64(limit),
+		Remaining:  max(0, limit-int(count)),
+		ResetAfter: window,
+	}
+}
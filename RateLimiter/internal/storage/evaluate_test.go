@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWindowKey(t *testing.T) {
+	now := time.Date(2026, time.February, 10, 12, 0, 0, 0, time.UTC)
+
+	key, resetAfter := WindowKey("token:abc", 24*time.Hour, now)
+	assert.Equal(t, "{token:abc}:window:20494", key)
+	assert.Equal(t, 12*time.Hour, resetAfter)
+
+	key, resetAfter = WindowKey("token:abc", CalendarMonth, now)
+	assert.Equal(t, "{token:abc}:window:2026-02", key)
+	assert.Equal(t, 18*24*time.Hour+12*time.Hour, resetAfter)
+}
+
+func TestHashTag_SharedSlot(t *testing.T) {
+	// Redis Cluster hashes the part between the first { and the next }
+	slotTag := func(key string) string {
+		open := strings.IndexByte(key, '{')
+		end := strings.IndexByte(key[open+1:], '}')
+		return key[open+1 : open+1+end]
+	}
+
+	now := time.Unix(1000, 0)
+	for _, algorithm := range []string{algorithmFixedWindow, algorithmSlidingWindowLog, algorithmSlidingWindowCounter, algorithmTokenBucket} {
+		keys := append([]string{blockKey("ip:1.2.3.4"), violationsKey("ip:1.2.3.4")}, stateKeys("ip:1.2.3.4", Policy{Algorithm: algorithm, Window: time.Second}, now)...)
+		window, _ := WindowKey("ip:1.2.3.4", time.Second, now)
+		for _, key := range append(keys, window) {
+			assert.Equal(t, "ip:1.2.3.4", slotTag(key), key)
+		}
+	}
+}
+
+func TestUntagKey(t *testing.T) {
+	assert.Equal(t, "block:ip:1.2.3.4", UntagKey("block:"+HashTag("ip:1.2.3.4")))
+	assert.Equal(t, "token:a}b:window:7", UntagKey(HashTag("token:a}b")+":window:7"))
+	assert.Equal(t, "access:version", UntagKey("access:version"))
+}
+
+// testEvaluateCost checks that weighted requests take their cost from the
+// limit under every algorithm
+func testEvaluateCost(t *testing.T, store Storage) {
+	ctx := context.Background()
+	now := time.Unix(1000, 0)
+
+	for _, algorithm := range []string{algorithmFixedWindow, algorithmSlidingWindowLog, algorithmSlidingWindowCounter, algorithmTokenBucket} {
+		t.Run(algorithm, func(t *testing.T) {
+			key := "cost:" + algorithm
+			policy := Policy{Algorithm: algorithm, Limit: 10, Window: time.Minute, Cost: 4}
+
+			for _, remaining := range []int{6, 2} {
+				d, err := store.Evaluate(ctx, key, policy, now)
+				require.NoError(t, err)
+				assert.True(t, d.Allowed)
+				assert.Equal(t, remaining, d.Remaining)
+			}
+
+			d, err := store.Evaluate(ctx, key, policy, now)
+			require.NoError(t, err)
+			assert.False(t, d.Allowed)
+
+			// Rejected requests take nothing from sliding logs
+			if algorithm == algorithmSlidingWindowLog {
+				d, err = store.Evaluate(ctx, key, Policy{Algorithm: algorithm, Limit: 10, Window: time.Minute, Cost: 2}, now)
+				require.NoError(t, err)
+				assert.True(t, d.Allowed)
+				assert.Equal(t, 0, d.Remaining)
+			}
+		})
+	}
+}
+
+// testAcquire checks the semaphore semantics of Acquire and Release. setNow
+// moves the clock of storages that ignore the time passed to Acquire.
+func testAcquire(t *testing.T, store Storage, setNow func(time.Time)) {
+	ctx := context.Background()
+	start := time.Now()
+	ttl := 30 * time.Second
+	at := func(d time.Duration) time.Time {
+		setNow(start.Add(d))
+		return start.Add(d)
+	}
+
+	for _, lease := range []string{"a", "b"} {
+		a, err := store.Acquire(ctx, "concurrency:ip:1.1.1.1", lease, 2, ttl, at(0))
+		require.NoError(t, err)
+		assert.True(t, a.Acquired)
+	}
+
+	a, err := store.Acquire(ctx, "concurrency:ip:1.1.1.1", "c", 2, ttl, at(0))
+	require.NoError(t, err)
+	assert.False(t, a.Acquired)
+	assert.Equal(t, 2, a.InUse)
+
+	// Held leases can be renewed while the semaphore is full
+	a, err = store.Acquire(ctx, "concurrency:ip:1.1.1.1", "a", 2, ttl, at(10*time.Second))
+	require.NoError(t, err)
+	assert.True(t, a.Acquired)
+	assert.Equal(t, 2, a.InUse)
+
+	require.NoError(t, store.Release(ctx, "concurrency:ip:1.1.1.1", "b"))
+	a, err = store.Acquire(ctx, "concurrency:ip:1.1.1.1", "c", 2, ttl, at(0))
+	require.NoError(t, err)
+	assert.True(t, a.Acquired)
+
+	// Leases that are never released expire
+	a, err = store.Acquire(ctx, "concurrency:ip:1.1.1.1", "d", 2, ttl, at(35*time.Second))
+	require.NoError(t, err)
+	assert.True(t, a.Acquired)
+	assert.Equal(t, 2, a.InUse)
+}
+
+func TestPolicy_PenaltyBlockTime(t *testing.T) {
+	policy := Policy{BlockTime: time.Minute, PenaltyFactor: 10, PenaltyLookback: time.Hour}
+
+	assert.Equal(t, time.Minute, policy.penaltyBlockTime(1))
+	assert.Equal(t, 100*time.Minute, policy.penaltyBlockTime(3))
+	// Without MaxBlockTime the block still stops at the hard cap, even where
+	// the product overflows
+	assert.Equal(t, MaxPenaltyBlockTime, policy.penaltyBlockTime(40))
+
+	policy.MaxBlockTime = time.Hour
+	assert.Equal(t, time.Hour, policy.penaltyBlockTime(3))
+}
@@ -0,0 +1,458 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrCapacityExceeded is returned when a new key cannot be stored because the
+// memory cap is reached and no key could be evicted
+var ErrCapacityExceeded = errors.New("memory storage capacity exceeded")
+
+// evictionSamples is how many keys are inspected when choosing a victim,
+// mirroring the approximated eviction used by Redis
+const evictionSamples = 5
+
+// MemoryOptions configures a MemoryStorage
+type MemoryOptions struct {
+	// Shards is the number of independently locked maps (default 32)
+	Shards int
+	// MaxKeys caps the number of stored keys; zero means unlimited
+	MaxKeys int
+	// CleanupInterval is how often the janitor removes expired keys (default 1 minute)
+	CleanupInterval time.Duration
+}
+
+// MemoryStorage is an in-process Storage with sharded locks and per-key expiry.
+// State is not shared between instances.
+type MemoryStorage struct {
+	shards      []*memoryShard
+	maxPerShard int
+	// keyLocks serialize Evaluate and Reserve calls on the same key
+	keyLocks [256]sync.Mutex
+	stop     chan struct{}
+	once     sync.Once
+}
+
+type memoryShard struct {
+	mu    sync.Mutex
+	items map[string]*memoryItem
+}
+
+type memoryItem struct {
+	value int64
+	// log holds the sliding log timestamps in Unix nanoseconds
+	log []int64
+	// leases maps the semaphore leases to their expiry
+	leases    map[string]time.Time
+	expiresAt time.Time
+}
+
+func NewMemoryStorage(opts MemoryOptions) *MemoryStorage {
+	if opts.Shards <= 0 {
+		opts.Shards = 32
+	}
+	if opts.CleanupInterval <= 0 {
+		opts.CleanupInterval = time.Minute
+	}
+
+	m := &MemoryStorage{
+		shards: make([]*memoryShard, opts.Shards),
+		stop:   make(chan struct{}),
+	}
+	if opts.MaxKeys > 0 {
+		m.maxPerShard = (opts.MaxKeys + opts.Shards - 1) / opts.Shards
+	}
+	for i := range m.shards {
+		m.shards[i] = &memoryShard{items: make(map[string]*memoryItem)}
+	}
+
+	go m.janitor(opts.CleanupInterval)
+
+	return m
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+func (m *MemoryStorage) shard(key string) *memoryShard {
+	return m.shards[hashKey(key)%uint32(len(m.shards))]
+}
+
+// janitor periodically removes expired keys until Close is called
+func (m *MemoryStorage) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.deleteExpired(time.Now())
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+func (m *MemoryStorage) deleteExpired(now time.Time) {
+	for _, s := range m.shards {
+		s.mu.Lock()
+		for key, item := range s.items {
+			if item.expired(now) {
+				delete(s.items, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (i *memoryItem) expired(now time.Time) bool {
+	return !i.expiresAt.IsZero() && !now.Before(i.expiresAt)
+}
+
+// get returns the live item for key. The shard lock must be held.
+func (s *memoryShard) get(key string, now time.Time) *memoryItem {
+	item, ok := s.items[key]
+	if !ok {
+		return nil
+	}
+	if item.expired(now) {
+		delete(s.items, key)
+		return nil
+	}
+	return item
+}
+
+// getOrCreate returns the live item for key, creating it and evicting another
+// key if the shard is full. The shard lock must be held.
+func (s *memoryShard) getOrCreate(key string, now time.Time, maxKeys int) (*memoryItem, error) {
+	if item := s.get(key, now); item != nil {
+		return item, nil
+	}
+
+	if maxKeys > 0 && len(s.items) >= maxKeys {
+		s.evict(now)
+		if len(s.items) >= maxKeys {
+			return nil, fmt.Errorf("failed to store key %s: %w", key, ErrCapacityExceeded)
+		}
+	}
+
+	item := &memoryItem{}
+	s.items[key] = item
+	return item, nil
+}
+
+// evict removes an expired key or, failing that, the sampled key closest to
+// expiring. Keys without expiration are never evicted, nor are block and
+// violation keys, so flooding the storage with new keys cannot lift a block.
+func (s *memoryShard) evict(now time.Time) {
+	var victim string
+	var victimExpiry time.Time
+	sampled := 0
+
+	for key, item := range s.items {
+		if item.expired(now) {
+			delete(s.items, key)
+			return
+		}
+		if item.expiresAt.IsZero() || penaltyKey(key) {
+			continue
+		}
+		if victim == "" || item.expiresAt.Before(victimExpiry) {
+			victim, victimExpiry = key, item.expiresAt
+		}
+		sampled++
+		if sampled >= evictionSamples {
+			break
+		}
+	}
+
+	if victim != "" {
+		delete(s.items, victim)
+	}
+}
+
+// penaltyKey reports whether key holds a block or the violations leading to one
+func penaltyKey(key string) bool {
+	return strings.HasPrefix(key, "block:") || strings.HasPrefix(key, "violations:")
+}
+
+func (m *MemoryStorage) Increment(ctx context.Context, key string) (int64, error) {
+	return m.IncrementBy(ctx, key, 1)
+}
+
+func (m *MemoryStorage) IncrementBy(ctx context.Context, key string, n int64) (int64, error) {
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, err := s.getOrCreate(key, time.Now(), m.maxPerShard)
+	if err != nil {
+		return 0, err
+	}
+	item.value += n
+	return item.value, nil
+}
+
+func (m *MemoryStorage) Get(ctx context.Context, key string) (int64, error) {
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if item := s.get(key, time.Now()); item != nil {
+		return item.value, nil
+	}
+	return 0, nil
+}
+
+func (m *MemoryStorage) SetExpiration(ctx context.Context, key string, expiration time.Duration) error {
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if item := s.get(key, now); item != nil {
+		item.expiresAt = now.Add(expiration)
+	}
+	return nil
+}
+
+func (m *MemoryStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
+	block := blockKey(key)
+	s := m.shard(block)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.get(block, time.Now()) != nil, nil
+}
+
+// BlockTTL reports whether key is blocked and for how long, zero if the
+// block never expires
+func (m *MemoryStorage) BlockTTL(ctx context.Context, key string) (time.Duration, bool, error) {
+	block := blockKey(key)
+	s := m.shard(block)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	item := s.get(block, now)
+	if item == nil {
+		return 0, false, nil
+	}
+	if item.expiresAt.IsZero() {
+		return 0, true, nil
+	}
+	return item.expiresAt.Sub(now), true, nil
+}
+
+func (m *MemoryStorage) Block(ctx context.Context, key string, duration time.Duration) error {
+	return m.Set(ctx, blockKey(key), 1, duration)
+}
+
+func (m *MemoryStorage) Set(ctx context.Context, key string, value int64, expiration time.Duration) error {
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	item, err := s.getOrCreate(key, now, m.maxPerShard)
+	if err != nil {
+		return err
+	}
+	item.value = value
+	item.log = nil
+	item.expiresAt = time.Time{}
+	if expiration > 0 {
+		item.expiresAt = now.Add(expiration)
+	}
+	return nil
+}
+
+func (m *MemoryStorage) AppendTimestamp(ctx context.Context, key string, ts time.Time, window time.Duration) (int64, error) {
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	item, err := s.getOrCreate(key, now, m.maxPerShard)
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := ts.Add(-window).UnixNano()
+	kept := item.log[:0]
+	for _, t := range item.log {
+		if t > cutoff {
+			kept = append(kept, t)
+		}
+	}
+	item.log = append(kept, ts.UnixNano())
+	item.expiresAt = now.Add(window)
+
+	return int64(len(item.log)), nil
+}
+
+// CountTimestamps returns the number of timestamps in the log of key within
+// window before ts
+func (m *MemoryStorage) CountTimestamps(ctx context.Context, key string, ts time.Time, window time.Duration) (int64, error) {
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item := s.get(key, time.Now())
+	if item == nil {
+		return 0, nil
+	}
+	cutoff := ts.Add(-window).UnixNano()
+	var count int64
+	for _, t := range item.log {
+		if t > cutoff {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Evaluate runs EvaluateSequential while holding a lock on key
+func (m *MemoryStorage) Evaluate(ctx context.Context, key string, policy Policy, now time.Time) (*Decision, error) {
+	lock := &m.keyLocks[hashKey(key)%uint32(len(m.keyLocks))]
+	lock.Lock()
+	defer lock.Unlock()
+
+	return EvaluateSequential(ctx, m, key, policy, now)
+}
+
+// Reserve runs ReserveSequential while holding a lock on key
+func (m *MemoryStorage) Reserve(ctx context.Context, key string, policy Policy, n int, now time.Time) (*Reservation, error) {
+	lock := &m.keyLocks[hashKey(key)%uint32(len(m.keyLocks))]
+	lock.Lock()
+	defer lock.Unlock()
+
+	return ReserveSequential(ctx, m, key, policy, n, now)
+}
+
+func (m *MemoryStorage) Acquire(ctx context.Context, key string, lease string, limit int, ttl time.Duration, now time.Time) (*Acquisition, error) {
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, err := s.getOrCreate(key, now, m.maxPerShard)
+	if err != nil {
+		return nil, err
+	}
+	if item.leases == nil {
+		item.leases = make(map[string]time.Time)
+	}
+	for id, expiresAt := range item.leases {
+		if !now.Before(expiresAt) {
+			delete(item.leases, id)
+		}
+	}
+
+	_, held := item.leases[lease]
+	if !held && len(item.leases) >= limit {
+		item.value = int64(len(item.leases))
+		return &Acquisition{InUse: len(item.leases)}, nil
+	}
+
+	item.leases[lease] = now.Add(ttl)
+	item.value = int64(len(item.leases))
+	// Keep the semaphore until its last lease expires
+	for _, expiresAt := range item.leases {
+		if expiresAt.After(item.expiresAt) {
+			item.expiresAt = expiresAt
+		}
+	}
+	return &Acquisition{Acquired: true, InUse: len(item.leases)}, nil
+}
+
+func (m *MemoryStorage) Release(ctx context.Context, key string, lease string) error {
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if item := s.get(key, time.Now()); item != nil && item.leases != nil {
+		delete(item.leases, lease)
+		item.value = int64(len(item.leases))
+	}
+	return nil
+}
+
+func (m *MemoryStorage) ListBlocked(ctx context.Context) ([]Entry, error) {
+	entries, err := m.Scan(ctx, "block:")
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		entries[i].Key = UntagKey(strings.TrimPrefix(entries[i].Key, "block:"))
+		entries[i].Value = 0
+	}
+	return entries, nil
+}
+
+func (m *MemoryStorage) Scan(ctx context.Context, prefix string) ([]Entry, error) {
+	now := time.Now()
+	entries := []Entry{}
+	for _, s := range m.shards {
+		s.mu.Lock()
+		for key, item := range s.items {
+			if !strings.HasPrefix(key, prefix) || item.expired(now) {
+				continue
+			}
+			entry := Entry{Key: key, Value: item.value}
+			if item.log != nil {
+				entry.Value = int64(len(item.log))
+			}
+			if !item.expiresAt.IsZero() {
+				entry.TTL = item.expiresAt.Sub(now)
+			}
+			entries = append(entries, entry)
+		}
+		s.mu.Unlock()
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries, nil
+}
+
+func (m *MemoryStorage) Unblock(ctx context.Context, key string) error {
+	if err := m.Reset(ctx, violationsKey(key)); err != nil {
+		return err
+	}
+	return m.Reset(ctx, blockKey(key))
+}
+
+func (m *MemoryStorage) Reset(ctx context.Context, key string) error {
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.items, key)
+	return nil
+}
+
+// Len returns the number of stored keys, including expired ones not yet collected
+func (m *MemoryStorage) Len() int {
+	total := 0
+	for _, s := range m.shards {
+		s.mu.Lock()
+		total += len(s.items)
+		s.mu.Unlock()
+	}
+	return total
+}
+
+// Close stops the janitor goroutine
+func (m *MemoryStorage) Close() error {
+	m.once.Do(func() { close(m.stop) })
+	return nil
+}
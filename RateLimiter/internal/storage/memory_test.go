@@ -0,0 +1,259 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMemoryStorage(t *testing.T, opts MemoryOptions) *MemoryStorage {
+	store := NewMemoryStorage(opts)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestMemoryStorage_IncrementAndExpire(t *testing.T) {
+	store := newTestMemoryStorage(t, MemoryOptions{})
+	ctx := context.Background()
+
+	count, err := store.Increment(ctx, "ip:1.1.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+
+	count, err = store.Increment(ctx, "ip:1.1.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+
+	require.NoError(t, store.SetExpiration(ctx, "ip:1.1.1.1", 20*time.Millisecond))
+	time.Sleep(30 * time.Millisecond)
+
+	value, err := store.Get(ctx, "ip:1.1.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), value)
+}
+
+func TestMemoryStorage_Block(t *testing.T) {
+	store := newTestMemoryStorage(t, MemoryOptions{})
+	ctx := context.Background()
+
+	require.NoError(t, store.Block(ctx, "ip:1.1.1.1", 20*time.Millisecond))
+
+	blocked, err := store.IsBlocked(ctx, "ip:1.1.1.1")
+	require.NoError(t, err)
+	assert.True(t, blocked)
+
+	time.Sleep(30 * time.Millisecond)
+
+	blocked, err = store.IsBlocked(ctx, "ip:1.1.1.1")
+	require.NoError(t, err)
+	assert.False(t, blocked)
+}
+
+func TestMemoryStorage_Janitor(t *testing.T) {
+	store := newTestMemoryStorage(t, MemoryOptions{CleanupInterval: 10 * time.Millisecond})
+	ctx := context.Background()
+
+	require.NoError(t, store.Set(ctx, "short", 1, 5*time.Millisecond))
+	require.NoError(t, store.Set(ctx, "long", 1, time.Minute))
+
+	assert.Eventually(t, func() bool { return store.Len() == 1 }, time.Second, 10*time.Millisecond)
+}
+
+func TestMemoryStorage_MaxKeys(t *testing.T) {
+	store := newTestMemoryStorage(t, MemoryOptions{Shards: 1, MaxKeys: 2})
+	ctx := context.Background()
+
+	require.NoError(t, store.Set(ctx, "a", 1, time.Minute))
+	require.NoError(t, store.Set(ctx, "b", 1, time.Hour))
+
+	// The key closest to expiring is evicted
+	require.NoError(t, store.Set(ctx, "c", 1, time.Hour))
+	assert.Equal(t, 2, store.Len())
+
+	value, err := store.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), value)
+
+	// Keys without expiration are never evicted
+	full := newTestMemoryStorage(t, MemoryOptions{Shards: 1, MaxKeys: 1})
+	require.NoError(t, full.Set(ctx, "a", 1, 0))
+	assert.ErrorIs(t, full.Set(ctx, "b", 1, 0), ErrCapacityExceeded)
+
+	// Blocks and violations are never evicted, even when closest to expiring
+	penalties := newTestMemoryStorage(t, MemoryOptions{Shards: 1, MaxKeys: 3})
+	require.NoError(t, penalties.Block(ctx, "ip:1.2.3.4", time.Minute))
+	require.NoError(t, penalties.Set(ctx, violationsKey("ip:1.2.3.4"), 1, time.Minute))
+	require.NoError(t, penalties.Set(ctx, "a", 1, time.Hour))
+	require.NoError(t, penalties.Set(ctx, "b", 1, time.Hour))
+
+	blocked, err := penalties.IsBlocked(ctx, "ip:1.2.3.4")
+	require.NoError(t, err)
+	assert.True(t, blocked)
+	violations, err := penalties.Get(ctx, violationsKey("ip:1.2.3.4"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), violations)
+
+	require.NoError(t, penalties.Block(ctx, "ip:5.6.7.8", time.Minute))
+	assert.ErrorIs(t, penalties.Set(ctx, "c", 1, time.Hour), ErrCapacityExceeded)
+}
+
+func TestMemoryStorage_Evaluate_Concurrent(t *testing.T) {
+	store := newTestMemoryStorage(t, MemoryOptions{})
+	ctx := context.Background()
+	policy := Policy{Limit: 50, Window: time.Minute}
+	now := time.Now()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d, err := store.Evaluate(ctx, "ip:1.1.1.1", policy, now)
+			assert.NoError(t, err)
+			if d.Allowed {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 50, allowed)
+}
+
+func TestMemoryStorage_ScanAndUnblock(t *testing.T) {
+	store := newTestMemoryStorage(t, MemoryOptions{})
+	ctx := context.Background()
+
+	require.NoError(t, store.Set(ctx, "ip:1.1.1.1", 2, time.Minute))
+	_, err := store.AppendTimestamp(ctx, "ip:1.1.1.1:log", time.Now(), time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, store.Set(ctx, "token:abc", 1, 0))
+	require.NoError(t, store.Block(ctx, "ip:2.2.2.2", time.Minute))
+
+	entries, err := store.Scan(ctx, "ip:")
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "ip:1.1.1.1", entries[0].Key)
+	assert.Equal(t, int64(2), entries[0].Value)
+	assert.Equal(t, int64(1), entries[1].Value)
+
+	blocked, err := store.ListBlocked(ctx)
+	require.NoError(t, err)
+	require.Len(t, blocked, 1)
+	assert.Equal(t, "ip:2.2.2.2", blocked[0].Key)
+	assert.InDelta(t, time.Minute, blocked[0].TTL, float64(time.Second))
+
+	require.NoError(t, store.Unblock(ctx, "ip:2.2.2.2"))
+	isBlocked, err := store.IsBlocked(ctx, "ip:2.2.2.2")
+	require.NoError(t, err)
+	assert.False(t, isBlocked)
+}
+
+func TestMemoryStorage_Reserve(t *testing.T) {
+	store := newTestMemoryStorage(t, MemoryOptions{})
+	ctx := context.Background()
+	now := time.Now()
+	policy := Policy{Limit: 5, Window: time.Second, BlockTime: time.Minute}
+
+	granted := 0
+	for i := 0; i < 3; i++ {
+		r, err := store.Reserve(ctx, "ip:1.1.1.1", policy, 2, now)
+		require.NoError(t, err)
+		granted += r.Granted
+	}
+	assert.Equal(t, 5, granted)
+
+	r, err := store.Reserve(ctx, "ip:1.1.1.1", policy, 2, now)
+	require.NoError(t, err)
+	assert.Equal(t, 0, r.Granted)
+	assert.Equal(t, time.Minute, r.ResetAfter)
+
+	blocked, err := store.IsBlocked(ctx, "ip:1.1.1.1")
+	require.NoError(t, err)
+	assert.True(t, blocked)
+
+	// A blocked key reports the time left on its block, like Redis
+	require.NoError(t, store.Block(ctx, "ip:2.2.2.2", 10*time.Second))
+	r, err = store.Reserve(ctx, "ip:2.2.2.2", policy, 2, now)
+	require.NoError(t, err)
+	assert.True(t, r.Blocked)
+	assert.InDelta(t, 10*time.Second, r.ResetAfter, float64(time.Second))
+
+	// Nothing is taken when less than the cost is left
+	costly := Policy{Limit: 5, Window: time.Second, Cost: 3}
+	r, err = store.Reserve(ctx, "token:abc", costly, 3, now)
+	require.NoError(t, err)
+	assert.Equal(t, 3, r.Granted)
+	r, err = store.Reserve(ctx, "token:abc", costly, 3, now)
+	require.NoError(t, err)
+	assert.Equal(t, 0, r.Granted)
+
+	counter, _ := WindowKey("token:abc", time.Second, now)
+	used, err := store.Get(ctx, counter)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), used)
+}
+
+func TestMemoryStorage_IncrementBy(t *testing.T) {
+	store := newTestMemoryStorage(t, MemoryOptions{})
+	ctx := context.Background()
+
+	count, err := store.IncrementBy(ctx, "key", 5)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), count)
+
+	count, err = store.Increment(ctx, "key")
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), count)
+}
+
+func TestMemoryStorage_Evaluate_Cost(t *testing.T) {
+	testEvaluateCost(t, newTestMemoryStorage(t, MemoryOptions{}))
+}
+
+func TestMemoryStorage_Acquire(t *testing.T) {
+	testAcquire(t, newTestMemoryStorage(t, MemoryOptions{}), func(time.Time) {})
+}
+
+func TestMemoryStorage_Evaluate_ProgressiveBlock(t *testing.T) {
+	store := newTestMemoryStorage(t, MemoryOptions{})
+	ctx := context.Background()
+	now := time.Now()
+	policy := Policy{
+		Limit:           1,
+		Window:          time.Minute,
+		BlockTime:       10 * time.Second,
+		PenaltyFactor:   2,
+		PenaltyLookback: time.Minute,
+	}
+
+	_, err := store.Evaluate(ctx, "ip:1.1.1.1", policy, now)
+	require.NoError(t, err)
+	d, err := store.Evaluate(ctx, "ip:1.1.1.1", policy, now)
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Second, d.ResetAfter)
+
+	// An existing block reports the time it has left
+	require.NoError(t, store.Block(ctx, "ip:1.1.1.1", 3*time.Second))
+	d, err = store.Evaluate(ctx, "ip:1.1.1.1", policy, now)
+	require.NoError(t, err)
+	assert.True(t, d.Blocked)
+	assert.InDelta(t, 3*time.Second, d.ResetAfter, float64(time.Second))
+
+	// Unblocking forgets the violations, so the next block is the base one
+	require.NoError(t, store.Unblock(ctx, "ip:1.1.1.1"))
+	_, err = store.Evaluate(ctx, "ip:1.1.1.1", policy, now.Add(time.Minute))
+	require.NoError(t, err)
+	d, err = store.Evaluate(ctx, "ip:1.1.1.1", policy, now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Second, d.ResetAfter)
+	assert.Equal(t, 1, d.PenaltyLevel)
+}
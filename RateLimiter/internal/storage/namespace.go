@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type namespaceKey struct{}
+
+// WithNamespace returns a context whose storage operations go through a
+// NamespacedStorage under namespace, e.g. the tenant of a request
+func WithNamespace(ctx context.Context, namespace string) context.Context {
+	return context.WithValue(ctx, namespaceKey{}, namespace)
+}
+
+// Namespace returns the namespace set on ctx, if any
+func Namespace(ctx context.Context) string {
+	namespace, _ := ctx.Value(namespaceKey{}).(string)
+	return namespace
+}
+
+// ValidateNamespace checks that a namespace can be used in key names.
+// Separators and braces would let namespaces overlap or break hash tags.
+func ValidateNamespace(namespace string) error {
+	if namespace == "" {
+		return fmt.Errorf("empty namespace")
+	}
+	for _, r := range namespace {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return fmt.Errorf("invalid namespace %q: only letters, digits, '-', '_' and '.' are allowed", namespace)
+		}
+	}
+	return nil
+}
+
+// NamespacedStorage prefixes every key with a namespace, so applications
+// and tenants sharing a Redis keep separate counters, blocks and lists. The
+// namespace is the static one of the storage followed by the one set on the
+// context of each call, if any, each followed by a slash. Namespaces cannot
+// contain the colon ending the fixed key prefixes, so no namespaced key
+// matches one outside its namespace. Keys keep their hash tags: ip:1.2.3.4
+// under "shop" and tenant "acme" is stored as {shop/acme/ip:1.2.3.4}.
+type NamespacedStorage struct {
+	next      Storage
+	namespace string
+}
+
+// NewNamespacedStorage wraps next under namespace. An empty namespace only
+// applies the namespaces set on contexts.
+func NewNamespacedStorage(next Storage, namespace string) *NamespacedStorage {
+	return &NamespacedStorage{next: next, namespace: namespace}
+}
+
+// prefix returns the key prefix of a call, empty without a namespace
+func (s *NamespacedStorage) prefix(ctx context.Context) string {
+	var prefix string
+	if s.namespace != "" {
+		prefix = s.namespace + "/"
+	}
+	if namespace := Namespace(ctx); namespace != "" {
+		prefix += namespace + "/"
+	}
+	return prefix
+}
+
+// key places the namespace inside the hash tag of keys derived from a limiter
+// key, e.g. {ip:1.2.3.4}:window:7, where the storage stores them
+func (s *NamespacedStorage) key(ctx context.Context, key string) string {
+	prefix := s.prefix(ctx)
+	if prefix == "" {
+		return key
+	}
+	return scanPrefix(prefix, key)
+}
+
+// scanPrefix places the namespace inside the hash tag of tagged prefixes,
+// e.g. block:{ip:1.2.3.4 or {ip:1.2.3.4}:window, where the stored keys have it
+func scanPrefix(namespace, prefix string) string {
+	if open := strings.IndexByte(prefix, '{'); open >= 0 {
+		return prefix[:open+1] + namespace + prefix[open+1:]
+	}
+	return namespace + prefix
+}
+
+// stripPrefix removes the namespace from a stored key
+func stripPrefix(namespace, stored string) string {
+	if key, ok := strings.CutPrefix(stored, namespace); ok {
+		return key
+	}
+	return strings.Replace(stored, "{"+namespace, "{", 1)
+}
+
+func (s *NamespacedStorage) Increment(ctx context.Context, key string) (int64, error) {
+	return s.next.Increment(ctx, s.key(ctx, key))
+}
+
+func (s *NamespacedStorage) IncrementBy(ctx context.Context, key string, n int64) (int64, error) {
+	return s.next.IncrementBy(ctx, s.key(ctx, key), n)
+}
+
+func (s *NamespacedStorage) Get(ctx context.Context, key string) (int64, error) {
+	return s.next.Get(ctx, s.key(ctx, key))
+}
+
+func (s *NamespacedStorage) SetExpiration(ctx context.Context, key string, expiration time.Duration) error {
+	return s.next.SetExpiration(ctx, s.key(ctx, key), expiration)
+}
+
+func (s *NamespacedStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
+	return s.next.IsBlocked(ctx, s.key(ctx, key))
+}
+
+func (s *NamespacedStorage) Block(ctx context.Context, key string, duration time.Duration) error {
+	return s.next.Block(ctx, s.key(ctx, key), duration)
+}
+
+func (s *NamespacedStorage) Set(ctx context.Context, key string, value int64, expiration time.Duration) error {
+	return s.next.Set(ctx, s.key(ctx, key), value, expiration)
+}
+
+func (s *NamespacedStorage) AppendTimestamp(ctx context.Context, key string, ts time.Time, window time.Duration) (int64, error) {
+	return s.next.AppendTimestamp(ctx, s.key(ctx, key), ts, window)
+}
+
+func (s *NamespacedStorage) Evaluate(ctx context.Context, key string, policy Policy, now time.Time) (*Decision, error) {
+	return s.next.Evaluate(ctx, s.key(ctx, key), policy, now)
+}
+
+func (s *NamespacedStorage) Reserve(ctx context.Context, key string, policy Policy, n int, now time.Time) (*Reservation, error) {
+	return s.next.Reserve(ctx, s.key(ctx, key), policy, n, now)
+}
+
+func (s *NamespacedStorage) Acquire(ctx context.Context, key string, lease string, limit int, ttl time.Duration, now time.Time) (*Acquisition, error) {
+	return s.next.Acquire(ctx, s.key(ctx, key), lease, limit, ttl, now)
+}
+
+func (s *NamespacedStorage) Release(ctx context.Context, key string, lease string) error {
+	return s.next.Release(ctx, s.key(ctx, key), lease)
+}
+
+// ListBlocked returns the blocked keys of the namespace, without it. Keys
+// of the tenants nested in the namespace are left out.
+func (s *NamespacedStorage) ListBlocked(ctx context.Context) ([]Entry, error) {
+	entries, err := s.next.ListBlocked(ctx)
+	if err != nil {
+		return nil, err
+	}
+	prefix := s.prefix(ctx)
+	blocked := make([]Entry, 0, len(entries))
+	for _, e := range entries {
+		if key, ok := strings.CutPrefix(e.Key, prefix); ok && !nested(key) {
+			e.Key = key
+			blocked = append(blocked, e)
+		}
+	}
+	return blocked, nil
+}
+
+// nested reports whether key still carries a namespace, i.e. a slash before
+// the colon ending its fixed prefix
+func nested(key string) bool {
+	end := strings.IndexByte(key, ':')
+	if end < 0 {
+		end = len(key)
+	}
+	return strings.Contains(key[:end], "/")
+}
+
+// Scan returns the keys of the namespace starting with prefix, without the
+// namespace. Prefixes starting with a hash tag are matched inside it.
+func (s *NamespacedStorage) Scan(ctx context.Context, prefix string) ([]Entry, error) {
+	namespace := s.prefix(ctx)
+	entries, err := s.next.Scan(ctx, scanPrefix(namespace, prefix))
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		entries[i].Key = stripPrefix(namespace, entries[i].Key)
+	}
+	return entries, nil
+}
+
+func (s *NamespacedStorage) Unblock(ctx context.Context, key string) error {
+	return s.next.Unblock(ctx, s.key(ctx, key))
+}
+
+func (s *NamespacedStorage) Reset(ctx context.Context, key string) error {
+	return s.next.Reset(ctx, s.key(ctx, key))
+}
+
+func (s *NamespacedStorage) Close() error {
+	return s.next.Close()
+}
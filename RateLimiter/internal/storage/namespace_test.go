@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamespacedStorage_Isolation(t *testing.T) {
+	inner := newTestMemoryStorage(t, MemoryOptions{})
+	shop := NewNamespacedStorage(inner, "shop")
+	blog := NewNamespacedStorage(inner, "blog")
+	ctx := context.Background()
+	now := time.Now()
+	policy := Policy{Limit: 1, Window: time.Second, BlockTime: time.Minute}
+
+	d, err := shop.Evaluate(ctx, "ip:1.2.3.4", policy, now)
+	require.NoError(t, err)
+	assert.True(t, d.Allowed)
+	d, err = shop.Evaluate(ctx, "ip:1.2.3.4", policy, now)
+	require.NoError(t, err)
+	assert.False(t, d.Allowed)
+
+	// The same key of another application is untouched
+	d, err = blog.Evaluate(ctx, "ip:1.2.3.4", policy, now)
+	require.NoError(t, err)
+	assert.True(t, d.Allowed)
+
+	// And so is the same key of a tenant of the application
+	acme := WithNamespace(ctx, "acme")
+	d, err = shop.Evaluate(acme, "ip:1.2.3.4", policy, now)
+	require.NoError(t, err)
+	assert.True(t, d.Allowed)
+
+	blocked, err := shop.ListBlocked(ctx)
+	require.NoError(t, err)
+	require.Len(t, blocked, 1)
+	assert.Equal(t, "ip:1.2.3.4", blocked[0].Key)
+	blocked, err = blog.ListBlocked(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, blocked)
+
+	isBlocked, err := shop.IsBlocked(acme, "ip:1.2.3.4")
+	require.NoError(t, err)
+	assert.False(t, isBlocked)
+	require.NoError(t, shop.Unblock(ctx, "ip:1.2.3.4"))
+	isBlocked, err = shop.IsBlocked(ctx, "ip:1.2.3.4")
+	require.NoError(t, err)
+	assert.False(t, isBlocked)
+}
+
+func TestNamespacedStorage_ListBlocked_Default(t *testing.T) {
+	store := NewNamespacedStorage(newTestMemoryStorage(t, MemoryOptions{}), "")
+	ctx := context.Background()
+	acme := WithNamespace(ctx, "acme")
+
+	require.NoError(t, store.Block(ctx, "ip:1.2.3.4", time.Minute))
+	require.NoError(t, store.Block(acme, "ip:5.6.7.8", time.Minute))
+
+	// The default namespace lists only its own keys, so unblocking them
+	// targets the right one
+	blocked, err := store.ListBlocked(ctx)
+	require.NoError(t, err)
+	require.Len(t, blocked, 1)
+	assert.Equal(t, "ip:1.2.3.4", blocked[0].Key)
+
+	blocked, err = store.ListBlocked(acme)
+	require.NoError(t, err)
+	require.Len(t, blocked, 1)
+	assert.Equal(t, "ip:5.6.7.8", blocked[0].Key)
+
+	require.NoError(t, store.Unblock(ctx, blocked[0].Key))
+	isBlocked, err := store.IsBlocked(acme, "ip:5.6.7.8")
+	require.NoError(t, err)
+	assert.True(t, isBlocked)
+}
+
+func TestNamespacedStorage_Scan(t *testing.T) {
+	inner := newTestMemoryStorage(t, MemoryOptions{})
+	shop := NewNamespacedStorage(inner, "shop")
+	ctx := context.Background()
+
+	require.NoError(t, shop.Set(ctx, "access:deny:1.2.3.4", 1, 0))
+	_, err := shop.Evaluate(ctx, "ip:1.2.3.4", Policy{Limit: 5, Window: time.Second}, time.Now())
+	require.NoError(t, err)
+	require.NoError(t, NewNamespacedStorage(inner, "blog").Set(ctx, "access:deny:5.6.7.8", 1, 0))
+
+	entries, err := shop.Scan(ctx, "access:")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "access:deny:1.2.3.4", entries[0].Key)
+
+	// Tagged prefixes are matched inside the tag
+	entries, err = shop.Scan(ctx, HashTag("ip:1.2.3.4"))
+	require.NoError(t, err)
+	require.NotEmpty(t, entries)
+	assert.Equal(t, "ip:1.2.3.4", UntagKey(entries[0].Key)[:len("ip:1.2.3.4")])
+
+	// Stored keys keep the namespace inside the hash tag
+	stored, err := inner.Scan(ctx, "{shop/ip:")
+	require.NoError(t, err)
+	assert.NotEmpty(t, stored)
+
+	require.NoError(t, shop.Block(ctx, "ip:1.2.3.4", time.Minute))
+	entries, err = shop.Scan(ctx, "block:"+HashTag("ip:1.2.3.4"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "block:"+HashTag("ip:1.2.3.4"), entries[0].Key)
+}
+
+func TestNamespacedStorage_DerivedKeys(t *testing.T) {
+	inner := newTestMemoryStorage(t, MemoryOptions{})
+	shop := NewNamespacedStorage(inner, "shop")
+	ctx := WithNamespace(context.Background(), "acme")
+
+	// Keys derived from a limiter key keep the namespace inside the hash
+	// tag, where the storage writes them
+	_, err := shop.IncrementBy(ctx, "{token:abc}:window:7", 3)
+	require.NoError(t, err)
+	n, err := inner.Get(context.Background(), "{shop/acme/token:abc}:window:7")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+
+	require.NoError(t, shop.Reset(ctx, "{token:abc}:window:7"))
+	n, err = inner.Get(context.Background(), "{shop/acme/token:abc}:window:7")
+	require.NoError(t, err)
+	assert.Zero(t, n)
+}
+
+func TestValidateNamespace(t *testing.T) {
+	for _, valid := range []string{"shop", "tenant-1", "acme_corp", "eu.shop"} {
+		assert.NoError(t, ValidateNamespace(valid), valid)
+	}
+	for _, invalid := range []string{"", "a:b", "a/b", "{a}", "a b"} {
+		assert.Error(t, ValidateNamespace(invalid), invalid)
+	}
+}
@@ -2,36 +2,297 @@ package storage
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 )
 
+// RedisMode selects how RedisStorage connects to Redis
+type RedisMode string
+
+const (
+	// RedisStandalone connects to a single server
+	RedisStandalone RedisMode = "standalone"
+	// RedisCluster connects to a Redis Cluster. The keys derived from a
+	// limiter key are hash tagged, so the scripts always run on one slot.
+	RedisCluster RedisMode = "cluster"
+	// RedisSentinel follows the master elected by Sentinel
+	RedisSentinel RedisMode = "sentinel"
+)
+
+// RedisOptions configures a RedisStorage
+type RedisOptions struct {
+	// Mode defaults to RedisStandalone
+	Mode RedisMode
+	// Addrs holds the server address in standalone mode, the seed nodes in
+	// cluster mode and the sentinels in sentinel mode
+	Addrs    []string
+	Username string
+	Password string
+	// DB is not supported in cluster mode
+	DB int
+	// MasterName and SentinelPassword are used in sentinel mode
+	MasterName       string
+	SentinelPassword string
+	// TLSConfig enables TLS when set
+	TLSConfig *tls.Config
+
+	// Zero values keep the go-redis defaults
+	PoolSize     int
+	MinIdleConns int
+	PoolTimeout  time.Duration
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	MaxRetries   int
+}
+
 type RedisStorage struct {
-	client *redis.Client
+	client     redis.UniversalClient
+	evalSHA    string
+	reserveSHA string
+	acquireSHA string
 }
 
 func NewRedisStorage(addr, password string, db int) (*RedisStorage, error) {
-	client := redis.NewClient(&redis.Options{
-		Addr:     addr,
+	return NewRedisStorageWithOptions(RedisOptions{
+		Addrs:    []string{addr},
 		Password: password,
 		DB:       db,
 	})
+}
+
+// NewRedisStorageWithOptions connects to Redis in the configured mode and
+// loads the scripts on every master
+func NewRedisStorageWithOptions(opts RedisOptions) (*RedisStorage, error) {
+	client, err := newRedisClient(opts)
+	if err != nil {
+		return nil, err
+	}
 
 	// Test connection
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
 		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
 	}
 
-	return &RedisStorage{
+	r := &RedisStorage{
 		client: client,
+	}
+	if err := r.loadScripts(ctx); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func newRedisClient(opts RedisOptions) (redis.UniversalClient, error) {
+	if len(opts.Addrs) == 0 {
+		return nil, fmt.Errorf("no Redis address configured")
+	}
+
+	switch opts.Mode {
+	case RedisStandalone, "":
+		return redis.NewClient(&redis.Options{
+			Addr:         opts.Addrs[0],
+			Username:     opts.Username,
+			Password:     opts.Password,
+			DB:           opts.DB,
+			TLSConfig:    opts.TLSConfig,
+			PoolSize:     opts.PoolSize,
+			MinIdleConns: opts.MinIdleConns,
+			PoolTimeout:  opts.PoolTimeout,
+			DialTimeout:  opts.DialTimeout,
+			ReadTimeout:  opts.ReadTimeout,
+			WriteTimeout: opts.WriteTimeout,
+			MaxRetries:   opts.MaxRetries,
+		}), nil
+
+	case RedisCluster:
+		if opts.DB != 0 {
+			return nil, fmt.Errorf("database %d is not supported in cluster mode", opts.DB)
+		}
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        opts.Addrs,
+			Username:     opts.Username,
+			Password:     opts.Password,
+			TLSConfig:    opts.TLSConfig,
+			PoolSize:     opts.PoolSize,
+			MinIdleConns: opts.MinIdleConns,
+			PoolTimeout:  opts.PoolTimeout,
+			DialTimeout:  opts.DialTimeout,
+			ReadTimeout:  opts.ReadTimeout,
+			WriteTimeout: opts.WriteTimeout,
+			MaxRetries:   opts.MaxRetries,
+		}), nil
+
+	case RedisSentinel:
+		if opts.MasterName == "" {
+			return nil, fmt.Errorf("master name is required in sentinel mode")
+		}
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       opts.MasterName,
+			SentinelAddrs:    opts.Addrs,
+			SentinelPassword: opts.SentinelPassword,
+			Username:         opts.Username,
+			Password:         opts.Password,
+			DB:               opts.DB,
+			TLSConfig:        opts.TLSConfig,
+			PoolSize:         opts.PoolSize,
+			MinIdleConns:     opts.MinIdleConns,
+			PoolTimeout:      opts.PoolTimeout,
+			DialTimeout:      opts.DialTimeout,
+			ReadTimeout:      opts.ReadTimeout,
+			WriteTimeout:     opts.WriteTimeout,
+			MaxRetries:       opts.MaxRetries,
+		}), nil
+	}
+	return nil, fmt.Errorf("unknown Redis mode %q", opts.Mode)
+}
+
+// loadScripts registers the Lua scripts on the server so they can be run by SHA
+func (r *RedisStorage) loadScripts(ctx context.Context) error {
+	sha, err := r.client.ScriptLoad(ctx, evaluateScript).Result()
+	if err != nil {
+		return fmt.Errorf("failed to load evaluate script: %w", err)
+	}
+	r.evalSHA = sha
+
+	sha, err = r.client.ScriptLoad(ctx, reserveScript).Result()
+	if err != nil {
+		return fmt.Errorf("failed to load reserve script: %w", err)
+	}
+	r.reserveSHA = sha
+
+	sha, err = r.client.ScriptLoad(ctx, acquireScript).Result()
+	if err != nil {
+		return fmt.Errorf("failed to load acquire script: %w", err)
+	}
+	r.acquireSHA = sha
+	return nil
+}
+
+// evalSha runs a loaded script, reloading it once if the server lost its
+// script cache (e.g. after a restart or failover)
+func (r *RedisStorage) evalSha(ctx context.Context, sha *string, keys []string, args ...interface{}) (interface{}, error) {
+	result, err := r.client.EvalSha(ctx, *sha, keys, args...).Result()
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		if err := r.loadScripts(ctx); err != nil {
+			return nil, err
+		}
+		result, err = r.client.EvalSha(ctx, *sha, keys, args...).Result()
+	}
+	return result, err
+}
+
+// int64Reply converts a script reply made of n integers
+func int64Reply(result interface{}, n int) ([]int64, bool) {
+	values, ok := result.([]interface{})
+	if !ok || len(values) != n {
+		return nil, false
+	}
+	fields := make([]int64, len(values))
+	for i, v := range values {
+		fields[i], _ = v.(int64)
+	}
+	return fields, true
+}
+
+func (r *RedisStorage) Evaluate(ctx context.Context, key string, policy Policy, now time.Time) (*Decision, error) {
+	keys := append([]string{blockKey(key), violationsKey(key)}, stateKeys(key, policy, now)...)
+	nowMicros := now.UnixMicro()
+
+	result, err := r.evalSha(ctx, &r.evalSHA, keys,
+		policy.Algorithm,
+		policy.Limit,
+		policy.Burst,
+		policy.Window.Microseconds(),
+		policy.BlockTime.Microseconds(),
+		nowMicros,
+		fmt.Sprintf("%d-%d", nowMicros, rand.Int63()),
+		policy.PenaltyFactor,
+		policy.PenaltyLookback.Microseconds(),
+		policy.maxBlockTime().Microseconds(),
+		policy.cost(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to evaluate key %s: %w", key, err)
+	}
+
+	fields, ok := int64Reply(result, 5)
+	if !ok {
+		return nil, fmt.Errorf("unexpected evaluate reply for key %s: %v", key, result)
+	}
+
+	return &Decision{
+		Allowed:      fields[0] == 1,
+		Blocked:      fields[1] == 1,
+		Remaining:    int(fields[2]),
+		ResetAfter:   time.Duration(fields[3]) * time.Microsecond,
+		PenaltyLevel: int(fields[4]),
+	}, nil
+}
+
+func (r *RedisStorage) Reserve(ctx context.Context, key string, policy Policy, n int, now time.Time) (*Reservation, error) {
+	counter, resetAfter := WindowKey(key, policy.Window, now)
+
+	result, err := r.evalSha(ctx, &r.reserveSHA, []string{blockKey(key), counter},
+		policy.Limit,
+		n,
+		resetAfter.Microseconds(),
+		policy.BlockTime.Microseconds(),
+		policy.cost(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reserve quota for key %s: %w", key, err)
+	}
+
+	fields, ok := int64Reply(result, 4)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reserve reply for key %s: %v", key, result)
+	}
+
+	return &Reservation{
+		Granted:    int(fields[0]),
+		Blocked:    fields[1] == 1,
+		Remaining:  int(fields[2]),
+		ResetAfter: time.Duration(fields[3]) * time.Microsecond,
 	}, nil
 }
 
+// Acquire ignores now and expires leases by the Redis clock, shared by every
+// instance
+func (r *RedisStorage) Acquire(ctx context.Context, key string, lease string, limit int, ttl time.Duration, now time.Time) (*Acquisition, error) {
+	result, err := r.evalSha(ctx, &r.acquireSHA, []string{key}, lease, limit, ttl.Microseconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire slot for key %s: %w", key, err)
+	}
+
+	fields, ok := int64Reply(result, 2)
+	if !ok {
+		return nil, fmt.Errorf("unexpected acquire reply for key %s: %v", key, result)
+	}
+	return &Acquisition{Acquired: fields[0] == 1, InUse: int(fields[1])}, nil
+}
+
+func (r *RedisStorage) Release(ctx context.Context, key string, lease string) error {
+	if err := r.client.ZRem(ctx, key, lease).Err(); err != nil {
+		return fmt.Errorf("failed to release slot for key %s: %w", key, err)
+	}
+	return nil
+}
+
 func (r *RedisStorage) Increment(ctx context.Context, key string) (int64, error) {
 	count, err := r.client.Incr(ctx, key).Result()
 	if err != nil {
@@ -40,6 +301,14 @@ func (r *RedisStorage) Increment(ctx context.Context, key string) (int64, error)
 	return count, nil
 }
 
+func (r *RedisStorage) IncrementBy(ctx context.Context, key string, n int64) (int64, error) {
+	count, err := r.client.IncrBy(ctx, key, n).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to increment key %s: %w", key, err)
+	}
+	return count, nil
+}
+
 func (r *RedisStorage) Get(ctx context.Context, key string) (int64, error) {
 	val, err := r.client.Get(ctx, key).Int64()
 	if err == redis.Nil {
@@ -60,8 +329,7 @@ func (r *RedisStorage) SetExpiration(ctx context.Context, key string, expiration
 }
 
 func (r *RedisStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
-	blockKey := fmt.Sprintf("block:%s", key)
-	exists, err := r.client.Exists(ctx, blockKey).Result()
+	exists, err := r.client.Exists(ctx, blockKey(key)).Result()
 	if err != nil {
 		return false, fmt.Errorf("failed to check if key %s is blocked: %w", key, err)
 	}
@@ -69,14 +337,40 @@ func (r *RedisStorage) IsBlocked(ctx context.Context, key string) (bool, error)
 }
 
 func (r *RedisStorage) Block(ctx context.Context, key string, duration time.Duration) error {
-	blockKey := fmt.Sprintf("block:%s", key)
-	err := r.client.Set(ctx, blockKey, "1", duration).Err()
+	err := r.client.Set(ctx, blockKey(key), "1", duration).Err()
 	if err != nil {
 		return fmt.Errorf("failed to block key %s: %w", key, err)
 	}
 	return nil
 }
 
+func (r *RedisStorage) Set(ctx context.Context, key string, value int64, expiration time.Duration) error {
+	err := r.client.Set(ctx, key, value, expiration).Err()
+	if err != nil {
+		return fmt.Errorf("failed to set key %s: %w", key, err)
+	}
+	return nil
+}
+
+func (r *RedisStorage) AppendTimestamp(ctx context.Context, key string, ts time.Time, window time.Duration) (int64, error) {
+	now := ts.UnixNano()
+	// The random suffix keeps members unique when two requests share a timestamp
+	member := fmt.Sprintf("%d-%d", now, rand.Int63())
+
+	var card *redis.IntCmd
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRemRangeByScore(ctx, key, "-inf", strconv.FormatInt(now-window.Nanoseconds(), 10))
+		pipe.ZAdd(ctx, key, &redis.Z{Score: float64(now), Member: member})
+		card = pipe.ZCard(ctx, key)
+		pipe.PExpire(ctx, key, window)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to append timestamp to key %s: %w", key, err)
+	}
+	return card.Val(), nil
+}
+
 func (r *RedisStorage) Reset(ctx context.Context, key string) error {
 	err := r.client.Del(ctx, key).Err()
 	if err != nil {
@@ -85,6 +379,127 @@ func (r *RedisStorage) Reset(ctx context.Context, key string) error {
 	return nil
 }
 
+func (r *RedisStorage) ListBlocked(ctx context.Context) ([]Entry, error) {
+	entries, err := r.Scan(ctx, "block:")
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		entries[i].Key = UntagKey(strings.TrimPrefix(entries[i].Key, "block:"))
+		entries[i].Value = 0
+	}
+	return entries, nil
+}
+
+func (r *RedisStorage) Scan(ctx context.Context, prefix string) ([]Entry, error) {
+	var keys []string
+	var err error
+	// Every master of a cluster holds part of the keyspace
+	if cluster, ok := r.client.(*redis.ClusterClient); ok {
+		var mu sync.Mutex
+		err = cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			found, err := scanKeys(ctx, node, prefix)
+			mu.Lock()
+			keys = append(keys, found...)
+			mu.Unlock()
+			return err
+		})
+	} else {
+		keys, err = scanKeys(ctx, r.client, prefix)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan prefix %s: %w", prefix, err)
+	}
+
+	sort.Strings(keys)
+	return r.describe(ctx, keys)
+}
+
+func scanKeys(ctx context.Context, client redis.Cmdable, prefix string) ([]string, error) {
+	var keys []string
+	iter := client.Scan(ctx, 0, escapeGlob(prefix)+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+// describe fetches the value and TTL of keys in two pipelined round trips
+func (r *RedisStorage) describe(ctx context.Context, keys []string) ([]Entry, error) {
+	if len(keys) == 0 {
+		return []Entry{}, nil
+	}
+
+	types := make([]*redis.StatusCmd, len(keys))
+	ttls := make([]*redis.DurationCmd, len(keys))
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			types[i] = pipe.Type(ctx, key)
+			ttls[i] = pipe.PTTL(ctx, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe keys: %w", err)
+	}
+
+	values := make([]redis.Cmder, len(keys))
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			if types[i].Val() == "zset" {
+				values[i] = pipe.ZCard(ctx, key)
+			} else {
+				values[i] = pipe.Get(ctx, key)
+			}
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to describe keys: %w", err)
+	}
+
+	entries := make([]Entry, 0, len(keys))
+	for i, key := range keys {
+		// Keys may expire between the scan and the pipelines
+		if types[i].Val() == "none" {
+			continue
+		}
+		entry := Entry{Key: key}
+		if ttl := ttls[i].Val(); ttl > 0 {
+			entry.TTL = ttl
+		}
+		switch cmd := values[i].(type) {
+		case *redis.IntCmd:
+			entry.Value = cmd.Val()
+		case *redis.StringCmd:
+			entry.Value, _ = cmd.Int64()
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// escapeGlob escapes the characters SCAN MATCH treats as patterns
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (r *RedisStorage) Unblock(ctx context.Context, key string) error {
+	err := r.client.Del(ctx, blockKey(key), violationsKey(key)).Err()
+	if err != nil {
+		return fmt.Errorf("failed to unblock key %s: %w", key, err)
+	}
+	return nil
+}
+
 func (r *RedisStorage) Close() error {
 	return r.client.Close()
 }
@@ -0,0 +1,320 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRedisStorage(t *testing.T) (*RedisStorage, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+	store, err := NewRedisStorage(server.Addr(), "", 0)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	return store, server
+}
+
+func TestRedisStorage_Evaluate_FixedWindow(t *testing.T) {
+	store, server := newTestRedisStorage(t)
+	ctx := context.Background()
+	now := time.Unix(1000, 0)
+	policy := Policy{Limit: 2, Window: time.Second, BlockTime: 10 * time.Second}
+
+	for i := 0; i < 2; i++ {
+		d, err := store.Evaluate(ctx, "ip:1.1.1.1", policy, now)
+		require.NoError(t, err)
+		assert.True(t, d.Allowed)
+		assert.Equal(t, 2-i-1, d.Remaining)
+	}
+
+	d, err := store.Evaluate(ctx, "ip:1.1.1.1", policy, now)
+	require.NoError(t, err)
+	assert.False(t, d.Allowed)
+	assert.False(t, d.Blocked)
+	assert.Equal(t, 10*time.Second, d.ResetAfter)
+	assert.True(t, server.Exists("block:{ip:1.1.1.1}"))
+	assert.False(t, server.Exists("{ip:1.1.1.1}"))
+
+	d, err = store.Evaluate(ctx, "ip:1.1.1.1", policy, now)
+	require.NoError(t, err)
+	assert.False(t, d.Allowed)
+	assert.True(t, d.Blocked)
+}
+
+func TestRedisStorage_Evaluate_SlidingWindowLog(t *testing.T) {
+	store, _ := newTestRedisStorage(t)
+	ctx := context.Background()
+	now := time.Unix(1000, 0)
+	policy := Policy{Algorithm: algorithmSlidingWindowLog, Limit: 2, Window: time.Second}
+
+	for i := 0; i < 2; i++ {
+		d, err := store.Evaluate(ctx, "ip:1.1.1.1", policy, now)
+		require.NoError(t, err)
+		assert.True(t, d.Allowed)
+		now = now.Add(600 * time.Millisecond)
+	}
+
+	// The first request left the window
+	d, err := store.Evaluate(ctx, "ip:1.1.1.1", policy, now)
+	require.NoError(t, err)
+	assert.True(t, d.Allowed)
+
+	d, err = store.Evaluate(ctx, "ip:1.1.1.1", policy, now)
+	require.NoError(t, err)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, 400*time.Millisecond, d.ResetAfter)
+}
+
+func TestRedisStorage_Evaluate_SlidingWindowCounter(t *testing.T) {
+	store, _ := newTestRedisStorage(t)
+	ctx := context.Background()
+	policy := Policy{Algorithm: algorithmSlidingWindowCounter, Limit: 4, Window: time.Second}
+
+	now := time.Unix(1000, 900*int64(time.Millisecond))
+	for i := 0; i < 4; i++ {
+		d, err := store.Evaluate(ctx, "ip:1.1.1.1", policy, now)
+		require.NoError(t, err)
+		assert.True(t, d.Allowed)
+	}
+
+	now = time.Unix(1001, 100*int64(time.Millisecond))
+	d, err := store.Evaluate(ctx, "ip:1.1.1.1", policy, now)
+	require.NoError(t, err)
+	assert.False(t, d.Allowed)
+}
+
+func TestRedisStorage_Evaluate_TokenBucket(t *testing.T) {
+	store, _ := newTestRedisStorage(t)
+	ctx := context.Background()
+	now := time.Unix(1000, 0)
+	policy := Policy{Algorithm: algorithmTokenBucket, Limit: 2, Burst: 3, Window: time.Second}
+
+	for i := 0; i < 3; i++ {
+		d, err := store.Evaluate(ctx, "ip:1.1.1.1", policy, now)
+		require.NoError(t, err)
+		assert.True(t, d.Allowed)
+		assert.Equal(t, 3-i-1, d.Remaining)
+	}
+
+	d, err := store.Evaluate(ctx, "ip:1.1.1.1", policy, now)
+	require.NoError(t, err)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, 500*time.Millisecond, d.ResetAfter)
+
+	now = now.Add(500 * time.Millisecond)
+	d, err = store.Evaluate(ctx, "ip:1.1.1.1", policy, now)
+	require.NoError(t, err)
+	assert.True(t, d.Allowed)
+}
+
+func TestRedisStorage_Evaluate_ReloadsFlushedScript(t *testing.T) {
+	store, server := newTestRedisStorage(t)
+	ctx := context.Background()
+
+	server.FlushAll()
+	_, err := store.client.ScriptFlush(ctx).Result()
+	require.NoError(t, err)
+
+	d, err := store.Evaluate(ctx, "ip:1.1.1.1", Policy{Limit: 1, Window: time.Second}, time.Now())
+	require.NoError(t, err)
+	assert.True(t, d.Allowed)
+}
+
+func TestRedisStorage_ScanAndUnblock(t *testing.T) {
+	store, _ := newTestRedisStorage(t)
+	ctx := context.Background()
+
+	require.NoError(t, store.Set(ctx, "ip:1.1.1.1", 2, time.Minute))
+	_, err := store.AppendTimestamp(ctx, "ip:1.1.1.1:log", time.Now(), time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, store.Set(ctx, "ip:1.1.1.*", 5, 0))
+	require.NoError(t, store.Block(ctx, "ip:2.2.2.2", time.Minute))
+
+	entries, err := store.Scan(ctx, "ip:1.1.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, []Entry{
+		{Key: "ip:1.1.1.1", Value: 2, TTL: time.Minute},
+		{Key: "ip:1.1.1.1:log", Value: 1, TTL: time.Minute},
+	}, entries)
+
+	// Glob characters in the prefix are matched literally
+	entries, err = store.Scan(ctx, "ip:1.1.1.*")
+	require.NoError(t, err)
+	assert.Equal(t, []Entry{{Key: "ip:1.1.1.*", Value: 5}}, entries)
+
+	blocked, err := store.ListBlocked(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []Entry{{Key: "ip:2.2.2.2", TTL: time.Minute}}, blocked)
+
+	require.NoError(t, store.Unblock(ctx, "ip:2.2.2.2"))
+	isBlocked, err := store.IsBlocked(ctx, "ip:2.2.2.2")
+	require.NoError(t, err)
+	assert.False(t, isBlocked)
+}
+
+func TestRedisStorage_Reserve(t *testing.T) {
+	store, server := newTestRedisStorage(t)
+	ctx := context.Background()
+	now := time.Unix(1000, 250*int64(time.Millisecond))
+	policy := Policy{Limit: 5, Window: time.Second, BlockTime: 10 * time.Second}
+
+	r, err := store.Reserve(ctx, "ip:1.1.1.1", policy, 3, now)
+	require.NoError(t, err)
+	assert.Equal(t, &Reservation{Granted: 3, Remaining: 2, ResetAfter: 750 * time.Millisecond}, r)
+	assert.Equal(t, 750*time.Millisecond, server.TTL("{ip:1.1.1.1}:window:1000"))
+
+	// Only what is left of the window quota is granted
+	r, err = store.Reserve(ctx, "ip:1.1.1.1", policy, 3, now)
+	require.NoError(t, err)
+	assert.Equal(t, 2, r.Granted)
+	assert.Equal(t, 0, r.Remaining)
+
+	r, err = store.Reserve(ctx, "ip:1.1.1.1", policy, 3, now)
+	require.NoError(t, err)
+	assert.Equal(t, 0, r.Granted)
+	assert.Equal(t, 10*time.Second, r.ResetAfter)
+	assert.True(t, server.Exists("block:{ip:1.1.1.1}"))
+
+	r, err = store.Reserve(ctx, "ip:1.1.1.1", policy, 3, now)
+	require.NoError(t, err)
+	assert.True(t, r.Blocked)
+
+	// Nothing is taken when less than the cost is left
+	costly := Policy{Limit: 5, Window: time.Second, Cost: 3}
+	r, err = store.Reserve(ctx, "token:abc", costly, 3, now)
+	require.NoError(t, err)
+	assert.Equal(t, 3, r.Granted)
+	r, err = store.Reserve(ctx, "token:abc", costly, 3, now)
+	require.NoError(t, err)
+	assert.Equal(t, 0, r.Granted)
+
+	used, err := server.Get("{token:abc}:window:1000")
+	require.NoError(t, err)
+	assert.Equal(t, "3", used)
+}
+
+func TestRedisStorage_Evaluate_ProgressiveBlock(t *testing.T) {
+	store, server := newTestRedisStorage(t)
+	ctx := context.Background()
+	now := time.Unix(1000, 0)
+	policy := Policy{
+		Limit:           1,
+		Window:          time.Minute,
+		BlockTime:       10 * time.Second,
+		PenaltyFactor:   2,
+		PenaltyLookback: time.Minute,
+		MaxBlockTime:    30 * time.Second,
+	}
+
+	for i, want := range []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second} {
+		d, err := store.Evaluate(ctx, "ip:1.1.1.1", policy, now)
+		require.NoError(t, err)
+		assert.True(t, d.Allowed)
+		assert.Equal(t, i, d.PenaltyLevel)
+
+		d, err = store.Evaluate(ctx, "ip:1.1.1.1", policy, now)
+		require.NoError(t, err)
+		assert.False(t, d.Allowed)
+		assert.Equal(t, want, d.ResetAfter)
+		assert.Equal(t, i+1, d.PenaltyLevel)
+
+		server.FastForward(want)
+	}
+
+	// Violations are forgotten after a lookback without new blocks
+	server.FastForward(policy.PenaltyLookback)
+	assert.False(t, server.Exists("violations:{ip:1.1.1.1}"))
+
+	_, err := store.Evaluate(ctx, "ip:1.1.1.1", policy, now)
+	require.NoError(t, err)
+	d, err := store.Evaluate(ctx, "ip:1.1.1.1", policy, now)
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Second, d.ResetAfter)
+	assert.Equal(t, 1, d.PenaltyLevel)
+
+	d, err = store.Evaluate(ctx, "ip:1.1.1.1", policy, now)
+	require.NoError(t, err)
+	assert.True(t, d.Blocked)
+	assert.Equal(t, 1, d.PenaltyLevel)
+
+	// Unblocking forgets the violations
+	require.NoError(t, store.Unblock(ctx, "ip:1.1.1.1"))
+	assert.False(t, server.Exists("violations:{ip:1.1.1.1}"))
+}
+
+func TestRedisStorage_Evaluate_PenaltyCap(t *testing.T) {
+	store, server := newTestRedisStorage(t)
+	ctx := context.Background()
+	now := time.Unix(1000, 0)
+	policy := Policy{Limit: 1, Window: time.Minute, BlockTime: time.Minute, PenaltyFactor: 10, PenaltyLookback: time.Hour}
+
+	server.Set("violations:{ip:1.1.1.1}", "40")
+	_, err := store.Evaluate(ctx, "ip:1.1.1.1", policy, now)
+	require.NoError(t, err)
+	d, err := store.Evaluate(ctx, "ip:1.1.1.1", policy, now)
+	require.NoError(t, err)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, MaxPenaltyBlockTime, d.ResetAfter)
+	assert.Equal(t, MaxPenaltyBlockTime, server.TTL("block:{ip:1.1.1.1}"))
+}
+
+func TestRedisStorage_Evaluate_Cost(t *testing.T) {
+	store, _ := newTestRedisStorage(t)
+	testEvaluateCost(t, store)
+}
+
+func TestRedisStorage_Acquire(t *testing.T) {
+	store, server := newTestRedisStorage(t)
+	testAcquire(t, store, server.SetTime)
+
+	// Leases expire by the Redis clock, whatever time the caller passes
+	a, err := store.Acquire(context.Background(), "concurrency:ip:2.2.2.2", "a", 1, time.Second, time.Unix(0, 0))
+	require.NoError(t, err)
+	assert.True(t, a.Acquired)
+	a, err = store.Acquire(context.Background(), "concurrency:ip:2.2.2.2", "b", 1, time.Second, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.False(t, a.Acquired)
+}
+
+func TestRedisStorage_Cluster(t *testing.T) {
+	// miniredis answers CLUSTER SLOTS as a single node owning every slot
+	server := miniredis.RunT(t)
+	store, err := NewRedisStorageWithOptions(RedisOptions{Mode: RedisCluster, Addrs: []string{server.Addr()}})
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	ctx := context.Background()
+	now := time.Unix(1000, 0)
+
+	for _, algorithm := range []string{algorithmFixedWindow, algorithmSlidingWindowLog, algorithmSlidingWindowCounter, algorithmTokenBucket} {
+		policy := Policy{Algorithm: algorithm, Limit: 1, Window: time.Second, BlockTime: time.Minute, PenaltyFactor: 2, MaxBlockTime: time.Hour}
+		key := "ip:" + algorithm
+
+		d, err := store.Evaluate(ctx, key, policy, now)
+		require.NoError(t, err, algorithm)
+		assert.True(t, d.Allowed, algorithm)
+		d, err = store.Evaluate(ctx, key, policy, now)
+		require.NoError(t, err, algorithm)
+		assert.False(t, d.Allowed, algorithm)
+	}
+
+	blocked, err := store.ListBlocked(ctx)
+	require.NoError(t, err)
+	assert.Len(t, blocked, 4)
+	assert.Equal(t, "ip:fixed_window", blocked[0].Key)
+
+	_, err = NewRedisStorageWithOptions(RedisOptions{Mode: RedisCluster, Addrs: []string{server.Addr()}, DB: 1})
+	assert.Error(t, err)
+}
+
+func TestNewRedisStorageWithOptions_Invalid(t *testing.T) {
+	_, err := NewRedisStorageWithOptions(RedisOptions{})
+	assert.Error(t, err)
+	_, err = NewRedisStorageWithOptions(RedisOptions{Mode: RedisSentinel, Addrs: []string{"localhost:26379"}})
+	assert.Error(t, err)
+	_, err = NewRedisStorageWithOptions(RedisOptions{Mode: "replica", Addrs: []string{"localhost:6379"}})
+	assert.Error(t, err)
+}
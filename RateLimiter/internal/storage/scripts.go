@@ -0,0 +1,214 @@
+package storage
+
+// evaluateScript runs the whole check-increment-block decision of Evaluate
+// in a single round trip. Times are passed in microseconds.
+//
+// KEYS[1] block key, KEYS[2] violations key, KEYS[3..] state keys as
+// returned by stateKeys
+// ARGV[1] algorithm, ARGV[2] limit, ARGV[3] burst, ARGV[4] window,
+// ARGV[5] block time, ARGV[6] now, ARGV[7] unique sliding log member prefixed by now,
+// ARGV[8] penalty factor, ARGV[9] penalty lookback, ARGV[10] max block time (never zero),
+// ARGV[11] cost of the request
+//
+// Returns {allowed, blocked, remaining, reset after in microseconds, penalty level}
+const evaluateScript = `
+local algorithm = ARGV[1]
+local limit = tonumber(ARGV[2])
+local burst = tonumber(ARGV[3])
+local window = tonumber(ARGV[4])
+local block = tonumber(ARGV[5])
+local now = tonumber(ARGV[6])
+local factor = tonumber(ARGV[8])
+local lookback = tonumber(ARGV[9])
+local max_block = tonumber(ARGV[10])
+local cost = tonumber(ARGV[11])
+
+local function ms(us)
+  return math.max(1, math.ceil(us / 1000))
+end
+
+local level = 0
+local progressive = block > 0 and factor > 1 and lookback > 0
+if progressive then
+  level = tonumber(redis.call('GET', KEYS[2]) or '0')
+end
+
+local block_ttl = redis.call('PTTL', KEYS[1])
+if block_ttl == -1 then
+  return {0, 1, 0, block, level}
+end
+if block_ttl > 0 then
+  return {0, 1, 0, block_ttl * 1000, level}
+end
+
+local allowed, remaining, reset
+
+if algorithm == 'sliding_window_log' then
+  redis.call('ZREMRANGEBYSCORE', KEYS[3], '-inf', now - window)
+  local count = redis.call('ZCARD', KEYS[3])
+  allowed = count + cost <= limit
+  if allowed then
+    for i = 1, cost do
+      redis.call('ZADD', KEYS[3], now, ARGV[7] .. '-' .. i)
+    end
+    count = count + cost
+  end
+  redis.call('PEXPIRE', KEYS[3], ms(window))
+  remaining = limit - count
+  reset = window
+  -- Members start with their timestamp, which avoids float formatting of scores
+  local oldest = redis.call('ZRANGE', KEYS[3], 0, 0)
+  if oldest[1] then
+    reset = tonumber(string.match(oldest[1], '^%d+')) + window - now
+  end
+elseif algorithm == 'sliding_window_counter' then
+  local count = redis.call('INCRBY', KEYS[3], cost)
+  if count == cost then
+    redis.call('PEXPIRE', KEYS[3], ms(2 * window))
+  end
+  local previous = tonumber(redis.call('GET', KEYS[4]) or '0')
+  local offset = now % window
+  local estimate = previous * (1 - offset / window) + count
+  allowed = estimate <= limit
+  remaining = limit - math.ceil(estimate)
+  reset = window - offset
+elseif algorithm == 'token_bucket' then
+  if limit <= 0 then
+    return {0, 0, 0, window, level}
+  end
+  if burst <= 0 then
+    burst = limit
+  end
+  local capacity = burst * 1000
+  local rate = limit * 1000 / window
+  local tokens = capacity
+  local last = tonumber(redis.call('GET', KEYS[4]) or '0')
+  if last > 0 then
+    local stored = tonumber(redis.call('GET', KEYS[3]) or '0')
+    tokens = math.min(capacity, stored + math.max(0, now - last) * rate)
+  end
+  allowed = tokens >= cost * 1000
+  if allowed then
+    tokens = tokens - cost * 1000
+    local ttl = ms((capacity - tokens) / rate + window)
+    redis.call('SET', KEYS[3], math.floor(tokens), 'PX', ttl)
+    redis.call('SET', KEYS[4], now, 'PX', ttl)
+    remaining = math.floor(tokens / 1000)
+    reset = (1000 - tokens % 1000) / rate
+  else
+    remaining = 0
+    reset = (cost * 1000 - tokens) / rate
+  end
+else
+  local count = redis.call('INCRBY', KEYS[3], cost)
+  if count == cost then
+    redis.call('PEXPIRE', KEYS[3], ms(window))
+  end
+  allowed = count <= limit
+  remaining = limit - count
+  reset = redis.call('PTTL', KEYS[3]) * 1000
+end
+
+if not allowed then
+  if block > 0 then
+    -- Every violation within the lookback after the last block multiplies it
+    if progressive then
+      level = redis.call('INCR', KEYS[2])
+      block = math.ceil(block * factor ^ (level - 1))
+      if max_block > 0 and block > max_block then
+        block = max_block
+      end
+      redis.call('PEXPIRE', KEYS[2], ms(block + lookback))
+    end
+    redis.call('SET', KEYS[1], '1', 'PX', ms(block))
+    redis.call('DEL', unpack(KEYS, 3))
+    reset = block
+  end
+  return {0, 0, 0, math.ceil(reset), level}
+end
+
+return {1, 0, math.max(0, remaining), math.ceil(reset), level}
+`
+
+// acquireScript takes a semaphore slot. Leases are members of a sorted set
+// scored by their expiry, so slots of crashed holders free themselves.
+// Expiries follow the Redis clock, so instances with skewed clocks never
+// evict each other's live leases. Times are in microseconds.
+//
+// KEYS[1] semaphore
+// ARGV[1] lease, ARGV[2] limit, ARGV[3] lease ttl
+//
+// Returns {acquired, slots in use}
+const acquireScript = `
+local limit = tonumber(ARGV[2])
+local ttl = tonumber(ARGV[3])
+
+-- Redis before 5 replicates scripts verbatim unless told otherwise, which
+-- would let replicas read another TIME
+redis.replicate_commands()
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+local held = redis.call('ZSCORE', KEYS[1], ARGV[1])
+local count = redis.call('ZCARD', KEYS[1])
+if not held and count >= limit then
+  return {0, count}
+end
+
+redis.call('ZADD', KEYS[1], now + ttl, ARGV[1])
+if not held then
+  count = count + 1
+end
+-- Keep the semaphore until its newest lease expires
+redis.call('PEXPIRE', KEYS[1], math.max(1, math.ceil(ttl / 1000)))
+return {1, count}
+`
+
+// reserveScript takes up to n units of the quota of the current window, none
+// when fewer than the cost are left. Times are passed in microseconds.
+//
+// KEYS[1] block key, KEYS[2] window counter as returned by WindowKey
+// ARGV[1] limit, ARGV[2] n, ARGV[3] time left in the window, ARGV[4] block time,
+// ARGV[5] cost
+//
+// Returns {granted, blocked, remaining, reset after in microseconds}
+const reserveScript = `
+local limit = tonumber(ARGV[1])
+local n = tonumber(ARGV[2])
+local reset = tonumber(ARGV[3])
+local block = tonumber(ARGV[4])
+local cost = math.min(n, tonumber(ARGV[5]))
+
+local function ms(us)
+  return math.max(1, math.ceil(us / 1000))
+end
+
+local block_ttl = redis.call('PTTL', KEYS[1])
+if block_ttl == -1 then
+  return {0, 1, 0, block}
+end
+if block_ttl > 0 then
+  return {0, 1, 0, block_ttl * 1000}
+end
+
+local used = tonumber(redis.call('GET', KEYS[2]) or '0')
+local left = math.max(0, limit - used)
+local granted = math.min(n, left)
+if granted < cost then
+  granted = 0
+end
+
+if granted > 0 then
+  redis.call('INCRBY', KEYS[2], granted)
+  redis.call('PEXPIRE', KEYS[2], ms(reset))
+  return {granted, 0, left - granted, reset}
+end
+
+if block > 0 then
+  redis.call('SET', KEYS[1], '1', 'PX', ms(block))
+  redis.call('DEL', KEYS[2])
+  reset = block
+end
+return {0, 0, 0, reset}
+`
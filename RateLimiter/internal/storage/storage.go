@@ -5,12 +5,24 @@ import (
 	"time"
 )
 
+// Entry describes a stored key
+type Entry struct {
+	Key string
+	// Value is the counter value, or the number of entries of a sliding log
+	Value int64
+	// TTL is the time left before the key expires, zero if it never expires
+	TTL time.Duration
+}
+
 // Storage defines the interface for rate limiter storage
 type Storage interface {
 	// Increment increments the counter for a given key
 	// Returns the new count and an error if any
 	Increment(ctx context.Context, key string) (int64, error)
 
+	// IncrementBy adds n to the counter for a given key and returns the new count
+	IncrementBy(ctx context.Context, key string, n int64) (int64, error)
+
 	// Get retrieves the current count for a given key
 	Get(ctx context.Context, key string) (int64, error)
 
@@ -23,6 +35,42 @@ type Storage interface {
 	// Block blocks a key for a given duration
 	Block(ctx context.Context, key string, duration time.Duration) error
 
+	// Set stores an integer value for a key with the given expiration
+	Set(ctx context.Context, key string, value int64, expiration time.Duration) error
+
+	// AppendTimestamp records ts in the sliding log stored at key, discards
+	// entries older than window and returns the number of entries left
+	AppendTimestamp(ctx context.Context, key string, ts time.Time, window time.Duration) (int64, error)
+
+	// Evaluate atomically checks whether key is blocked, counts the request
+	// against policy and blocks the key when the limit is exceeded
+	Evaluate(ctx context.Context, key string, policy Policy, now time.Time) (*Decision, error)
+
+	// Reserve atomically takes up to n units of the fixed window quota of key,
+	// none when fewer than the policy cost are left, and blocks the key when
+	// the quota is used up
+	Reserve(ctx context.Context, key string, policy Policy, n int, now time.Time) (*Reservation, error)
+
+	// Acquire atomically takes one of limit slots of the semaphore at key for
+	// lease, until it is released or ttl passes. Acquiring a lease already
+	// held renews it. Shared storages may measure ttl by their own clock
+	// instead of now.
+	Acquire(ctx context.Context, key string, lease string, limit int, ttl time.Duration, now time.Time) (*Acquisition, error)
+
+	// Release frees the slot held by lease, if any
+	Release(ctx context.Context, key string, lease string) error
+
+	// ListBlocked returns the currently blocked keys, with TTL set to the
+	// remaining block time
+	ListBlocked(ctx context.Context) ([]Entry, error)
+
+	// Scan returns the keys starting with prefix
+	Scan(ctx context.Context, prefix string) ([]Entry, error)
+
+	// Unblock lifts the block on a key and forgets its violations, so the
+	// next block starts again at the base penalty
+	Unblock(ctx context.Context, key string) error
+
 	// Reset resets the counter for a key
 	Reset(ctx context.Context, key string) error
 
@@ -0,0 +1,86 @@
+// Package storagetest provides Storage implementations for tests
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/goxprts/ratelimiter/internal/storage"
+)
+
+// ErrUnavailable is returned by every operation of Unavailable
+var ErrUnavailable = errors.New("connection refused")
+
+// Unavailable fails every operation like an unreachable Redis
+type Unavailable struct{}
+
+var _ storage.Storage = Unavailable{}
+
+func (Unavailable) Increment(ctx context.Context, key string) (int64, error) {
+	return 0, ErrUnavailable
+}
+
+func (Unavailable) IncrementBy(ctx context.Context, key string, n int64) (int64, error) {
+	return 0, ErrUnavailable
+}
+
+func (Unavailable) Get(ctx context.Context, key string) (int64, error) {
+	return 0, ErrUnavailable
+}
+
+func (Unavailable) SetExpiration(ctx context.Context, key string, expiration time.Duration) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) IsBlocked(ctx context.Context, key string) (bool, error) {
+	return false, ErrUnavailable
+}
+
+func (Unavailable) Block(ctx context.Context, key string, duration time.Duration) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) Set(ctx context.Context, key string, value int64, expiration time.Duration) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) AppendTimestamp(ctx context.Context, key string, ts time.Time, window time.Duration) (int64, error) {
+	return 0, ErrUnavailable
+}
+
+func (Unavailable) Evaluate(ctx context.Context, key string, policy storage.Policy, now time.Time) (*storage.Decision, error) {
+	return nil, ErrUnavailable
+}
+
+func (Unavailable) Reserve(ctx context.Context, key string, policy storage.Policy, n int, now time.Time) (*storage.Reservation, error) {
+	return nil, ErrUnavailable
+}
+
+func (Unavailable) Acquire(ctx context.Context, key string, lease string, limit int, ttl time.Duration, now time.Time) (*storage.Acquisition, error) {
+	return nil, ErrUnavailable
+}
+
+func (Unavailable) Release(ctx context.Context, key string, lease string) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) ListBlocked(ctx context.Context) ([]storage.Entry, error) {
+	return nil, ErrUnavailable
+}
+
+func (Unavailable) Scan(ctx context.Context, prefix string) ([]storage.Entry, error) {
+	return nil, ErrUnavailable
+}
+
+func (Unavailable) Unblock(ctx context.Context, key string) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) Reset(ctx context.Context, key string) error {
+	return ErrUnavailable
+}
+
+func (Unavailable) Close() error {
+	return nil
+}
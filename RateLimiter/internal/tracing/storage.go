@@ -0,0 +1,185 @@
+package tracing
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/goxprts/ratelimiter/internal/storage"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/goxprts/ratelimiter/internal/tracing"
+
+// TracedStorage records a span for every operation of the wrapped Storage.
+// Spans carry the kind of key, e.g. ip or token, never the key itself,
+// since keys may hold API tokens.
+type TracedStorage struct {
+	next   storage.Storage
+	system string
+	tracer trace.Tracer
+}
+
+// NewStorage wraps next, a storage of the given system (redis or memory),
+// recording spans with provider
+func NewStorage(next storage.Storage, system string, provider trace.TracerProvider) *TracedStorage {
+	return &TracedStorage{
+		next:   next,
+		system: system,
+		tracer: provider.Tracer(instrumentationName),
+	}
+}
+
+func (s *TracedStorage) start(ctx context.Context, operation string, key string) (context.Context, trace.Span) {
+	return s.tracer.Start(ctx, s.system+" "+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemKey.String(s.system),
+			semconv.DBOperation(operation),
+			KeyType.String(keyType(key)),
+		),
+	)
+}
+
+// end records err on span and ends it
+func end(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// keyType returns the prefix of key naming its kind, e.g. ip for
+// ip:1.2.3.4 or block for block:{ip:1.2.3.4}
+func keyType(key string) string {
+	kind, _, _ := strings.Cut(strings.TrimPrefix(key, "{"), ":")
+	return kind
+}
+
+func (s *TracedStorage) Increment(ctx context.Context, key string) (int64, error) {
+	ctx, span := s.start(ctx, "increment", key)
+	count, err := s.next.Increment(ctx, key)
+	end(span, err)
+	return count, err
+}
+
+func (s *TracedStorage) IncrementBy(ctx context.Context, key string, n int64) (int64, error) {
+	ctx, span := s.start(ctx, "increment", key)
+	count, err := s.next.IncrementBy(ctx, key, n)
+	end(span, err)
+	return count, err
+}
+
+func (s *TracedStorage) Get(ctx context.Context, key string) (int64, error) {
+	ctx, span := s.start(ctx, "get", key)
+	value, err := s.next.Get(ctx, key)
+	end(span, err)
+	return value, err
+}
+
+func (s *TracedStorage) SetExpiration(ctx context.Context, key string, expiration time.Duration) error {
+	ctx, span := s.start(ctx, "set_expiration", key)
+	err := s.next.SetExpiration(ctx, key, expiration)
+	end(span, err)
+	return err
+}
+
+func (s *TracedStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
+	ctx, span := s.start(ctx, "is_blocked", key)
+	blocked, err := s.next.IsBlocked(ctx, key)
+	end(span, err)
+	return blocked, err
+}
+
+func (s *TracedStorage) Block(ctx context.Context, key string, duration time.Duration) error {
+	ctx, span := s.start(ctx, "block", key)
+	err := s.next.Block(ctx, key, duration)
+	end(span, err)
+	return err
+}
+
+func (s *TracedStorage) Set(ctx context.Context, key string, value int64, expiration time.Duration) error {
+	ctx, span := s.start(ctx, "set", key)
+	err := s.next.Set(ctx, key, value, expiration)
+	end(span, err)
+	return err
+}
+
+func (s *TracedStorage) AppendTimestamp(ctx context.Context, key string, ts time.Time, window time.Duration) (int64, error) {
+	ctx, span := s.start(ctx, "append_timestamp", key)
+	count, err := s.next.AppendTimestamp(ctx, key, ts, window)
+	end(span, err)
+	return count, err
+}
+
+func (s *TracedStorage) Evaluate(ctx context.Context, key string, policy storage.Policy, now time.Time) (*storage.Decision, error) {
+	ctx, span := s.start(ctx, "evaluate", key)
+	d, err := s.next.Evaluate(ctx, key, policy, now)
+	if err == nil {
+		span.SetAttributes(Allowed.Bool(d.Allowed), Remaining.Int(d.Remaining))
+	}
+	end(span, err)
+	return d, err
+}
+
+func (s *TracedStorage) Reserve(ctx context.Context, key string, policy storage.Policy, n int, now time.Time) (*storage.Reservation, error) {
+	ctx, span := s.start(ctx, "reserve", key)
+	r, err := s.next.Reserve(ctx, key, policy, n, now)
+	if err == nil {
+		span.SetAttributes(Granted.Int(r.Granted), Remaining.Int(r.Remaining))
+	}
+	end(span, err)
+	return r, err
+}
+
+func (s *TracedStorage) Acquire(ctx context.Context, key string, lease string, limit int, ttl time.Duration, now time.Time) (*storage.Acquisition, error) {
+	ctx, span := s.start(ctx, "acquire", key)
+	a, err := s.next.Acquire(ctx, key, lease, limit, ttl, now)
+	if err == nil {
+		span.SetAttributes(Allowed.Bool(a.Acquired), Remaining.Int(max(0, limit-a.InUse)))
+	}
+	end(span, err)
+	return a, err
+}
+
+func (s *TracedStorage) Release(ctx context.Context, key string, lease string) error {
+	ctx, span := s.start(ctx, "release", key)
+	err := s.next.Release(ctx, key, lease)
+	end(span, err)
+	return err
+}
+
+func (s *TracedStorage) ListBlocked(ctx context.Context) ([]storage.Entry, error) {
+	ctx, span := s.start(ctx, "list_blocked", "block")
+	entries, err := s.next.ListBlocked(ctx)
+	end(span, err)
+	return entries, err
+}
+
+func (s *TracedStorage) Scan(ctx context.Context, prefix string) ([]storage.Entry, error) {
+	ctx, span := s.start(ctx, "scan", prefix)
+	entries, err := s.next.Scan(ctx, prefix)
+	end(span, err)
+	return entries, err
+}
+
+func (s *TracedStorage) Unblock(ctx context.Context, key string) error {
+	ctx, span := s.start(ctx, "unblock", key)
+	err := s.next.Unblock(ctx, key)
+	end(span, err)
+	return err
+}
+
+func (s *TracedStorage) Reset(ctx context.Context, key string) error {
+	ctx, span := s.start(ctx, "reset", key)
+	err := s.next.Reset(ctx, key)
+	end(span, err)
+	return err
+}
+
+func (s *TracedStorage) Close() error {
+	return s.next.Close()
+}
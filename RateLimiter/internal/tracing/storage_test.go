@@ -0,0 +1,75 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/goxprts/ratelimiter/internal/storage"
+	"github.com/goxprts/ratelimiter/internal/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func newTestStorage(t *testing.T) (*TracedStorage, *tracetest.SpanRecorder) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	store := storage.NewMemoryStorage(storage.MemoryOptions{})
+	t.Cleanup(func() { store.Close() })
+	return NewStorage(store, "memory", provider), recorder
+}
+
+func attributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func TestTracedStorage_Evaluate(t *testing.T) {
+	store, recorder := newTestStorage(t)
+	ctx := context.Background()
+	policy := storage.Policy{Limit: 1, Window: time.Second, BlockTime: time.Minute}
+
+	_, err := store.Evaluate(ctx, "token:secret", policy, time.Now())
+	require.NoError(t, err)
+	_, err = store.Evaluate(ctx, "token:secret", policy, time.Now())
+	require.NoError(t, err)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+	assert.Equal(t, "memory evaluate", spans[0].Name())
+
+	attrs := attributes(spans[0])
+	assert.Equal(t, "memory", attrs["db.system"].AsString())
+	assert.Equal(t, "evaluate", attrs["db.operation"].AsString())
+	assert.Equal(t, "token", attrs[KeyType].AsString())
+	assert.True(t, attrs[Allowed].AsBool())
+	assert.Equal(t, int64(0), attrs[Remaining].AsInt64())
+	assert.False(t, attributes(spans[1])[Allowed].AsBool())
+
+	// Keys may hold API tokens and are left out
+	for _, kv := range spans[0].Attributes() {
+		assert.NotContains(t, kv.Value.Emit(), "secret")
+	}
+}
+
+func TestTracedStorage_Error(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	store := NewStorage(storagetest.Unavailable{}, "redis", sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	_, err := store.Get(context.Background(), "{ip:1.2.3.4}:window")
+	require.Error(t, err)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 1)
+	assert.Equal(t, codes.Error, spans[0].Status().Code)
+	assert.Equal(t, "ip", attributes(spans[0])[KeyType].AsString())
+	require.Len(t, spans[0].Events(), 1)
+	assert.Equal(t, "exception", spans[0].Events()[0].Name)
+}
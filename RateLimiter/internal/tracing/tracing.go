@@ -0,0 +1,69 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+)
+
+// Attributes set on the spans of limiter decisions and storage operations
+const (
+	KeyType   = attribute.Key("ratelimit.key_type")
+	Allowed   = attribute.Key("ratelimit.allowed")
+	Remaining = attribute.Key("ratelimit.remaining")
+	Limit     = attribute.Key("ratelimit.limit")
+	Cost      = attribute.Key("ratelimit.cost")
+	// Granted is the number of units a reservation took
+	Granted = attribute.Key("ratelimit.granted")
+	// WouldBlock marks the denials of dry run limits, which let the request
+	// through
+	WouldBlock = attribute.Key("ratelimit.would_block")
+)
+
+// Options configures the export of spans
+type Options struct {
+	ServiceName string
+	// Endpoint is the URL of the OTLP/HTTP collector, e.g.
+	// http://otel-collector:4318. TLS is used for https URLs.
+	Endpoint string
+	// SampleRatio is the share of new traces recorded. Requests carrying a
+	// trace context keep the sampling decision of their caller.
+	SampleRatio float64
+}
+
+// Setup exports spans to the collector and reads and writes W3C trace
+// context headers. The returned function flushes the pending spans.
+func Setup(ctx context.Context, opts Options) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(opts.Endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	res, err := resource.New(ctx, resource.WithAttributes(semconv.ServiceName(opts.ServiceName)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tracing resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	shutdown := func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		return provider.Shutdown(ctx)
+	}
+	return shutdown, nil
+}
@@ -0,0 +1,362 @@
+// Package transport throttles the requests a service makes to external APIs
+// with the rate limiter, sharing the quota of each API between replicas.
+package transport
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goxprts/ratelimiter/internal/config"
+	"github.com/goxprts/ratelimiter/internal/limiter"
+	"github.com/goxprts/ratelimiter/internal/setup"
+	"github.com/goxprts/ratelimiter/internal/storage"
+)
+
+// DefaultRule is the limiter rule outbound requests are counted under
+const DefaultRule = "outbound"
+
+// DefaultMaxRetryAfter caps how long an upstream Retry-After holds requests
+const DefaultMaxRetryAfter = 10 * time.Minute
+
+// minRetry keeps waiting requests from retrying in a busy loop when the
+// limiter reports a reset time already past
+const minRetry = 10 * time.Millisecond
+
+// blockRecheck is how often a key held back by another instance's
+// Retry-After is checked again, as the shared block carries no end time
+const blockRecheck = time.Second
+
+// Algorithms accepted in Limit.Algorithm
+const (
+	FixedWindow          = string(limiter.FixedWindow)
+	SlidingWindowLog     = string(limiter.SlidingWindowLog)
+	SlidingWindowCounter = string(limiter.SlidingWindowCounter)
+	TokenBucket          = string(limiter.TokenBucket)
+)
+
+// Limit caps the requests sent per second under a key
+type Limit struct {
+	// RPS is the number of requests per second; zero leaves requests
+	// unlimited
+	RPS int
+	// Algorithm defaults to FixedWindow
+	Algorithm string
+	// Burst is the token bucket capacity, defaulting to RPS
+	Burst int
+	// BlockTime holds the key after a denied request. Keep it at zero unless
+	// denied requests should hold the key for longer than the window.
+	BlockTime time.Duration
+}
+
+func (l Limit) config() limiter.TokenConfig {
+	return limiter.TokenConfig{
+		RPS:       l.RPS,
+		Algorithm: limiter.Algorithm(l.Algorithm),
+		Burst:     l.Burst,
+		BlockTime: l.BlockTime,
+	}
+}
+
+// Mode chooses what a Transport does with requests over the limit
+type Mode string
+
+const (
+	// Wait holds requests until quota frees up
+	Wait Mode = "wait"
+	// FailFast returns a *LimitError without sending the request
+	FailFast Mode = "fail_fast"
+)
+
+// ErrRateLimited is matched by every *LimitError
+var ErrRateLimited = errors.New("outbound rate limit exceeded")
+
+// LimitError is returned for requests the Transport did not send
+type LimitError struct {
+	Key        string
+	RetryAfter time.Duration
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("outbound rate limit exceeded for %s, retry after %v", e.Key, e.RetryAfter)
+}
+
+func (e *LimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// KeyFunc returns the key an outbound request is counted under
+type KeyFunc func(*http.Request) string
+
+// ByHost counts requests per destination host and port
+func ByHost(r *http.Request) string {
+	return strings.ToLower(r.URL.Host)
+}
+
+// ByCredential counts requests per destination host and value of header,
+// e.g. Authorization. Values are hashed so credentials never reach the
+// storage. Requests without the header are counted by host.
+func ByCredential(header string) KeyFunc {
+	return func(r *http.Request) string {
+		value := r.Header.Get(header)
+		if value == "" {
+			return ByHost(r)
+		}
+		sum := sha256.Sum256([]byte(value))
+		return ByHost(r) + "|" + hex.EncodeToString(sum[:8])
+	}
+}
+
+// Options configures a Transport. Zero values use the defaults.
+type Options struct {
+	// Base sends the allowed requests (default http.DefaultTransport)
+	Base http.RoundTripper
+	// Rule names the limiter rule, so transports of different services
+	// sharing a storage keep separate quotas (default DefaultRule)
+	Rule string
+	// Key defaults to ByHost
+	Key KeyFunc
+	// Limit applies to every key
+	Limit Limit
+	// Hosts override Limit for requests to a host name, without port
+	Hosts map[string]Limit
+	// Mode defaults to Wait
+	Mode Mode
+	// MaxWait bounds the time a request waits in Wait mode; zero waits
+	// until the request context is done
+	MaxWait time.Duration
+	// MaxRetryAfter defaults to DefaultMaxRetryAfter
+	MaxRetryAfter time.Duration
+	// FailOpen sends requests when the limiter is unavailable instead of
+	// returning its error
+	FailOpen bool
+}
+
+// Transport is an http.RoundTripper that throttles outbound requests with a
+// RateLimiter before sending them. Upstream 429 and 503 responses with a
+// Retry-After hold the key back on every instance sharing the storage.
+type Transport struct {
+	limiter *limiter.RateLimiter
+	opts    Options
+	now     func() time.Time
+	// store is set when the Transport opened it
+	store storage.Storage
+
+	mu sync.Mutex
+	// retryAfter keeps the exact end of the upstream Retry-After seen by
+	// this instance. Others learn of it through the shared block.
+	retryAfter map[string]time.Time
+}
+
+// New throttles requests with rl
+func New(rl *limiter.RateLimiter, opts Options) *Transport {
+	if opts.Base == nil {
+		opts.Base = http.DefaultTransport
+	}
+	if opts.Rule == "" {
+		opts.Rule = DefaultRule
+	}
+	if opts.Key == nil {
+		opts.Key = ByHost
+	}
+	if opts.Mode == "" {
+		opts.Mode = Wait
+	}
+	if opts.MaxRetryAfter <= 0 {
+		opts.MaxRetryAfter = DefaultMaxRetryAfter
+	}
+	return &Transport{
+		limiter:    rl,
+		opts:       opts,
+		now:        time.Now,
+		retryAfter: make(map[string]time.Time),
+	}
+}
+
+// FromEnv connects to the storage configured in the environment, as the
+// server does, so services in other modules share quotas with each other.
+// Close releases the storage.
+func FromEnv(opts Options) (*Transport, error) {
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, err
+	}
+	store, err := setup.NewStorage(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Storage.Backend == "redis" {
+		store = setup.NewCircuitBreaker(cfg.Storage, store)
+	}
+	t := New(limiter.NewRateLimiter(store, 0, 0, nil), opts)
+	t.store = store
+	return t, nil
+}
+
+// Close closes the storage opened by FromEnv
+func (t *Transport) Close() error {
+	if t.store == nil {
+		return nil
+	}
+	return t.store.Close()
+}
+
+// Client returns an http.Client sending its requests through t
+func (t *Transport) Client() *http.Client {
+	return &http.Client{Transport: t}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := t.opts.Key(req)
+	if key == "" {
+		key = ByHost(req)
+	}
+
+	if err := t.wait(req, key); err != nil {
+		// RoundTrippers close the body even when the request is not sent
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	resp, err := t.opts.Base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	t.observe(req, key, resp)
+	return resp, nil
+}
+
+// wait returns once key has quota for req, or the error to return instead
+func (t *Transport) wait(req *http.Request, key string) error {
+	ctx := req.Context()
+	cfg, limited := t.limit(req)
+
+	var giveUp time.Time
+	if t.opts.MaxWait > 0 {
+		giveUp = t.now().Add(t.opts.MaxWait)
+	}
+
+	for {
+		delay := t.retryDelay(key)
+		if delay == 0 {
+			var err error
+			if delay, err = t.sharedDelay(ctx, key, cfg, limited); err != nil {
+				if t.opts.FailOpen {
+					if !errors.Is(err, storage.ErrCircuitOpen) {
+						log.Printf("outbound rate limiter unavailable (failing open): %v", err)
+					}
+					return nil
+				}
+				return err
+			}
+		}
+		if delay == 0 {
+			return nil
+		}
+
+		if t.opts.Mode == FailFast || (!giveUp.IsZero() && t.now().Add(delay).After(giveUp)) {
+			return &LimitError{Key: key, RetryAfter: delay}
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// sharedDelay returns how long key must wait according to the storage: the
+// limit when it has one, or else the Retry-After another instance shared
+func (t *Transport) sharedDelay(ctx context.Context, key string, cfg limiter.TokenConfig, limited bool) (time.Duration, error) {
+	if !limited {
+		blocked, err := t.limiter.RuleBlocked(ctx, t.opts.Rule, key)
+		if err != nil || !blocked {
+			return 0, err
+		}
+		return blockRecheck, nil
+	}
+	result, err := t.limiter.AllowRule(ctx, t.opts.Rule, key, cfg)
+	if err != nil || result.Allowed {
+		return 0, err
+	}
+	return max(result.ResetTime.Sub(t.now()), minRetry), nil
+}
+
+// limit returns the limit of req and whether it has one
+func (t *Transport) limit(req *http.Request) (limiter.TokenConfig, bool) {
+	l, ok := t.opts.Hosts[strings.ToLower(req.URL.Hostname())]
+	if !ok {
+		l = t.opts.Limit
+	}
+	return l.config(), l.RPS > 0
+}
+
+// retryDelay returns how long the last Retry-After seen for key still holds
+func (t *Transport) retryDelay(key string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	until, ok := t.retryAfter[key]
+	if !ok {
+		return 0
+	}
+	if delay := until.Sub(t.now()); delay > 0 {
+		return delay
+	}
+	delete(t.retryAfter, key)
+	return 0
+}
+
+// observe holds key back for the Retry-After of a throttled response
+func (t *Transport) observe(req *http.Request, key string, resp *http.Response) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return
+	}
+	delay, ok := parseRetryAfter(resp.Header.Get("Retry-After"), t.now())
+	if !ok {
+		return
+	}
+	delay = min(delay, t.opts.MaxRetryAfter)
+
+	t.mu.Lock()
+	t.retryAfter[key] = t.now().Add(delay)
+	t.mu.Unlock()
+
+	if err := t.limiter.BlockRule(req.Context(), t.opts.Rule, key, delay); err != nil {
+		log.Printf("failed to share upstream Retry-After for %s: %v", key, err)
+	}
+}
+
+// parseRetryAfter reads a Retry-After header in seconds or as an HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds <= 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if delay := date.Sub(now); delay > 0 {
+		return delay, true
+	}
+	return 0, false
+}
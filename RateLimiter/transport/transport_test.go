@@ -0,0 +1,230 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/goxprts/ratelimiter/internal/limiter"
+	"github.com/goxprts/ratelimiter/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLimiter(t *testing.T) *limiter.RateLimiter {
+	store := storage.NewMemoryStorage(storage.MemoryOptions{})
+	t.Cleanup(func() { store.Close() })
+	return limiter.NewRateLimiter(store, 10, 0, map[string]limiter.TokenConfig{})
+}
+
+// countingUpstream answers every request with status and counts them
+func countingUpstream(t *testing.T, status int, header http.Header) (*httptest.Server, *atomic.Int32) {
+	var count atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count.Add(1)
+		for name, values := range header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream, &count
+}
+
+func get(client *http.Client, url string, header http.Header) (*http.Response, error) {
+	req, _ := http.NewRequest("GET", url, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return resp, err
+}
+
+func TestTransport_FailFast(t *testing.T) {
+	upstream, count := countingUpstream(t, http.StatusOK, nil)
+	client := New(newTestLimiter(t), Options{
+		Limit: Limit{RPS: 2},
+		Mode:  FailFast,
+	}).Client()
+
+	for i := 0; i < 2; i++ {
+		resp, err := get(client, upstream.URL, nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// Requests over the limit never reach the upstream
+	_, err := get(client, upstream.URL, nil)
+	assert.ErrorIs(t, err, ErrRateLimited)
+	var limitErr *LimitError
+	require.True(t, errors.As(err, &limitErr))
+	assert.Positive(t, limitErr.RetryAfter)
+	assert.Equal(t, int32(2), count.Load())
+}
+
+func TestTransport_Wait(t *testing.T) {
+	upstream, count := countingUpstream(t, http.StatusOK, nil)
+	// One request every 100ms
+	client := New(newTestLimiter(t), Options{
+		Limit: Limit{RPS: 10, Burst: 1, Algorithm: TokenBucket},
+	}).Client()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		_, err := get(client, upstream.URL, nil)
+		require.NoError(t, err)
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+	assert.Equal(t, int32(3), count.Load())
+}
+
+func TestTransport_Wait_MaxWaitAndCancel(t *testing.T) {
+	upstream, _ := countingUpstream(t, http.StatusOK, nil)
+	rl := newTestLimiter(t)
+	opts := Options{Limit: Limit{RPS: 1, Algorithm: TokenBucket}, MaxWait: 50 * time.Millisecond}
+	client := New(rl, opts).Client()
+
+	_, err := get(client, upstream.URL, nil)
+	require.NoError(t, err)
+
+	// The next token is further away than the max wait
+	start := time.Now()
+	_, err = get(client, upstream.URL, nil)
+	assert.ErrorIs(t, err, ErrRateLimited)
+	assert.Less(t, time.Since(start), 50*time.Millisecond)
+
+	// Without a max wait the request context bounds the wait
+	opts.MaxWait = 0
+	client = New(rl, opts).Client()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", upstream.URL, nil)
+	_, err = client.Do(req)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestTransport_Keys(t *testing.T) {
+	a, countA := countingUpstream(t, http.StatusOK, nil)
+	b, countB := countingUpstream(t, http.StatusOK, nil)
+	rl := newTestLimiter(t)
+
+	// Hosts are counted separately
+	client := New(rl, Options{Limit: Limit{RPS: 1}, Mode: FailFast}).Client()
+	_, err := get(client, a.URL, nil)
+	require.NoError(t, err)
+	_, err = get(client, b.URL, nil)
+	require.NoError(t, err)
+	_, err = get(client, a.URL, nil)
+	assert.ErrorIs(t, err, ErrRateLimited)
+
+	// Credentials for the same host too
+	client = New(rl, Options{
+		Rule:  "per-key",
+		Key:   ByCredential("Authorization"),
+		Limit: Limit{RPS: 1},
+		Mode:  FailFast,
+	}).Client()
+	_, err = get(client, b.URL, http.Header{"Authorization": {"Bearer one"}})
+	require.NoError(t, err)
+	_, err = get(client, b.URL, http.Header{"Authorization": {"Bearer two"}})
+	require.NoError(t, err)
+	_, err = get(client, b.URL, http.Header{"Authorization": {"Bearer one"}})
+	assert.ErrorIs(t, err, ErrRateLimited)
+
+	assert.Equal(t, int32(1), countA.Load())
+	assert.Equal(t, int32(3), countB.Load())
+}
+
+func TestTransport_HostLimits(t *testing.T) {
+	upstream, _ := countingUpstream(t, http.StatusOK, nil)
+	client := New(newTestLimiter(t), Options{
+		Limit: Limit{RPS: 1},
+		Hosts: map[string]Limit{"127.0.0.1": {RPS: 3}},
+		Mode:  FailFast,
+	}).Client()
+
+	for i := 0; i < 3; i++ {
+		_, err := get(client, upstream.URL, nil)
+		require.NoError(t, err)
+	}
+	_, err := get(client, upstream.URL, nil)
+	assert.ErrorIs(t, err, ErrRateLimited)
+}
+
+func TestTransport_RetryAfter(t *testing.T) {
+	upstream, count := countingUpstream(t, http.StatusTooManyRequests, http.Header{"Retry-After": {"1"}})
+	rl := newTestLimiter(t)
+	opts := Options{Limit: Limit{RPS: 100}, Mode: FailFast}
+
+	resp, err := get(New(rl, opts).Client(), upstream.URL, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	// Another replica sharing the storage holds back as well
+	_, err = get(New(rl, opts).Client(), upstream.URL, nil)
+	assert.ErrorIs(t, err, ErrRateLimited)
+	assert.Equal(t, int32(1), count.Load())
+}
+
+func TestTransport_RetryAfter_Unlimited(t *testing.T) {
+	upstream, count := countingUpstream(t, http.StatusTooManyRequests, http.Header{"Retry-After": {"1"}})
+	rl := newTestLimiter(t)
+	opts := Options{Mode: FailFast}
+
+	resp, err := get(New(rl, opts).Client(), upstream.URL, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	// The shared block holds back hosts without a limit too
+	_, err = get(New(rl, opts).Client(), upstream.URL, nil)
+	assert.ErrorIs(t, err, ErrRateLimited)
+	assert.Equal(t, int32(1), count.Load())
+}
+
+func TestTransport_RetryAfter_Wait(t *testing.T) {
+	var count atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if count.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(upstream.Close)
+	client := New(newTestLimiter(t), Options{}).Client()
+
+	resp, err := get(client, upstream.URL, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	start := time.Now()
+	resp, err = get(client, upstream.URL, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.GreaterOrEqual(t, time.Since(start), 900*time.Millisecond)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	d, ok := parseRetryAfter("120", now)
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Minute, d)
+
+	d, ok = parseRetryAfter("Mon, 01 Jan 2024 12:00:30 GMT", now)
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, d)
+
+	for _, value := range []string{"", "0", "-5", "soon", "Mon, 01 Jan 2024 11:00:00 GMT"} {
+		_, ok = parseRetryAfter(value, now)
+		assert.False(t, ok, value)
+	}
+}